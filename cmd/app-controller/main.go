@@ -5,11 +5,12 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json" // JSONパース用に追加
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,9 +18,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
 	"github.com/tyottodekiru/k8s-playground/internal/controllers"
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
 	"github.com/tyottodekiru/k8s-playground/pkg/queue"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	googleoauth2 "google.golang.org/api/oauth2/v2"
 )
 
@@ -36,49 +36,46 @@ func main() {
 	dindWorkloadType := getEnv("DIND_WORKLOAD_TYPE", "statefulset")
 	loggingControllerAPIURL := getEnv("LOGGING_CONTROLLER_API_URL", "")
 	loggingAdminToken := getEnv("LOGGING_ADMIN_TOKEN", "")
-
-	if sessionKey == "" {
-		log.Println("Warning: SESSION_KEY is not set. Generating a random key for temporary use. Set a persistent key in production.")
-		key := make([]byte, 64)
-		_, err := rand.Read(key)
-		if err != nil {
-			log.Fatalf("Failed to generate random session key: %v", err)
-		}
-		sessionKey = base64.StdEncoding.EncodeToString(key)
+	if err := k8s.ValidateInstanceID(getEnv("INSTANCE_ID", "")); err != nil {
+		log.Fatalf("Invalid INSTANCE_ID: %v", err)
 	}
 
-	var oauth2Config *oauth2.Config
+	var oidcProvider *controllers.OIDCProvider
 	var legacyAuthPassword string
 	var googleAllowedDomainsList []string
 	var dindImageVersionsMap map[string]string // ★ DinDバージョン情報を格納するマップ
 
-	// DinDバージョン情報のJSONをパース
+	// DinDバージョン情報のJSONをパース (タグ文字列または {repository, tag, digest})
 	log.Printf("DIND_IMAGE_VERSIONS_JSON: %s", dindImageVersionsJSON)
-	if err := json.Unmarshal([]byte(dindImageVersionsJSON), &dindImageVersionsMap); err != nil {
+	if dindImages, err := k8s.ParseDinDImageVersions(dindImageVersionsJSON); err != nil {
 		log.Printf("Warning: Failed to parse DIND_IMAGE_VERSIONS_JSON: %v. Using fallback versions. JSON was: %s", err, dindImageVersionsJSON)
 		// パース失敗時は、Helm values.yamlのデフォルト値を使用
 		dindImageVersionsMap = map[string]string{
 			"1.33": "k8s-1.33.0",
 			"1.32": "k8s-1.32.1",
-			"1.31": "k8s-1.31.2", 
+			"1.31": "k8s-1.31.2",
 			"1.30": "k8s-1.30.2",
 		}
 		log.Printf("Using fallback DinD versions: %+v", dindImageVersionsMap)
+	} else {
+		dindImageVersionsMap = make(map[string]string, len(dindImages))
+		for version, img := range dindImages {
+			dindImageVersionsMap[version] = img.String()
+		}
 	}
-	
+
 	// 空のマップの場合もデフォルト値を使用
 	if len(dindImageVersionsMap) == 0 {
 		log.Printf("DinD versions map is empty. Using fallback versions.")
 		dindImageVersionsMap = map[string]string{
 			"1.33": "k8s-1.33.0",
-			"1.32": "k8s-1.32.1", 
+			"1.32": "k8s-1.32.1",
 			"1.31": "k8s-1.31.2",
 			"1.30": "k8s-1.30.2",
 		}
 	}
-	
-	log.Printf("Final DinD versions: %+v", dindImageVersionsMap)
 
+	log.Printf("Final DinD versions: %+v", dindImageVersionsMap)
 
 	if authMethod == "google" {
 		googleClientID := getEnv("GOOGLE_CLIENT_ID", "")
@@ -86,7 +83,9 @@ func main() {
 		if googleClientID == "" || googleClientSecret == "" {
 			log.Fatalf("AUTH_METHOD is 'google', but GOOGLE_CLIENT_ID or GOOGLE_CLIENT_SECRET is not set.")
 		}
-		oauth2Config = &oauth2.Config{
+		// Google is a preset of the generic OIDC provider
+		oidcProvider = controllers.NewOIDCProvider(controllers.OIDCConfig{
+			IssuerURL:    controllers.GoogleIssuerURL,
 			ClientID:     googleClientID,
 			ClientSecret: googleClientSecret,
 			RedirectURL:  baseURL + "/auth/google/callback",
@@ -95,8 +94,9 @@ func main() {
 				googleoauth2.UserinfoEmailScope,
 				googleoauth2.UserinfoProfileScope,
 			},
-			Endpoint: google.Endpoint,
-		}
+			OwnerClaim:  getEnv("OIDC_OWNER_CLAIM", controllers.DefaultOIDCOwnerClaim),
+			DisplayName: "Google",
+		})
 		log.Println("Authentication mode: Google OAuth2")
 		if googleAllowedDomainsRaw != "" {
 			googleAllowedDomainsList = strings.Split(googleAllowedDomainsRaw, ",")
@@ -107,11 +107,38 @@ func main() {
 		} else {
 			log.Println("No domain restriction for Google login (any Google account allowed).")
 		}
+	} else if authMethod == "oidc" {
+		issuerURL := getEnv("OIDC_ISSUER_URL", "")
+		clientID := getEnv("OIDC_CLIENT_ID", "")
+		clientSecret := getEnv("OIDC_CLIENT_SECRET", "")
+		if issuerURL == "" || clientID == "" || clientSecret == "" {
+			log.Fatalf("AUTH_METHOD is 'oidc', but OIDC_ISSUER_URL, OIDC_CLIENT_ID or OIDC_CLIENT_SECRET is not set.")
+		}
+		if u, err := url.Parse(issuerURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			log.Fatalf("OIDC_ISSUER_URL must be an https URL: %s", issuerURL)
+		}
+		var scopes []string
+		for _, scope := range strings.Split(getEnv("OIDC_SCOPES", "openid,email,profile"), ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+		oidcProvider = controllers.NewOIDCProvider(controllers.OIDCConfig{
+			IssuerURL:    issuerURL,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  baseURL + "/auth/oidc/callback",
+			Scopes:       scopes,
+			OwnerClaim:   getEnv("OIDC_OWNER_CLAIM", controllers.DefaultOIDCOwnerClaim),
+			GroupsClaim:  getEnv("OIDC_GROUPS_CLAIM", controllers.DefaultOIDCGroupsClaim),
+			DisplayName:  getEnv("OIDC_PROVIDER_NAME", ""),
+		})
+		log.Printf("Authentication mode: OpenID Connect (issuer %s, owner claim %s)", issuerURL, oidcProvider.OwnerClaim())
 	} else if authMethod == "password" {
 		legacyAuthPassword = getEnv("AUTH_PASSWORD", "admin123")
 		log.Printf("Authentication mode: Legacy Password (Password: %s)", legacyAuthPassword)
 	} else {
-		log.Fatalf("Invalid AUTH_METHOD: %s. Must be 'google' or 'password'.", authMethod)
+		log.Fatalf("Invalid AUTH_METHOD: %s. Must be 'google', 'oidc' or 'password'.", authMethod)
 	}
 
 	redisQueue, err := queue.NewRedisQueue(redisURL)
@@ -120,18 +147,72 @@ func main() {
 	}
 	defer redisQueue.Close()
 
-	store := sessions.NewCookieStore([]byte(sessionKey))
+	if sessionKey == "" {
+		key := make([]byte, 64)
+		_, err := rand.Read(key)
+		if err != nil {
+			log.Fatalf("Failed to generate random session key: %v", err)
+		}
+		sessionKey = base64.StdEncoding.EncodeToString(key)
+
+		// By default the generated key is shared through Redis so sessions survive restarts and
+		// work across replicas; SESSION_KEY_PERSIST=false keeps it in memory only
+		persist, err := strconv.ParseBool(getEnv("SESSION_KEY_PERSIST", "true"))
+		if err != nil {
+			log.Fatalf("Invalid SESSION_KEY_PERSIST: %v", err)
+		}
+		if persist {
+			storedKey, created, err := redisQueue.LoadOrStoreSessionKey(context.Background(), sessionKey)
+			if err != nil {
+				log.Fatalf("Failed to persist the generated session key: %v", err)
+			}
+			sessionKey = storedKey
+			if created {
+				log.Println("Warning: SESSION_KEY is not set. Generated a session key and stored it in Redis. Anyone with access to Redis can forge sessions; set SESSION_KEY in production.")
+			} else {
+				log.Println("Warning: SESSION_KEY is not set. Using the session key stored in Redis. Anyone with access to Redis can forge sessions; set SESSION_KEY in production.")
+			}
+		} else {
+			log.Println("Warning: SESSION_KEY is not set. Generating a random key for temporary use; sessions end when the app controller restarts. Set a persistent key in production.")
+		}
+	}
+
+	store := sessions.NewCookieStore(sessionKeyPairs(sessionKey)...)
 	store.Options = &sessions.Options{
 		Path:     "/",
+		Domain:   getEnv("COOKIE_DOMAIN", ""),
 		MaxAge:   86400 * 7, // 7 days
 		HttpOnly: true,
 		Secure:   ginMode == "release",
 		SameSite: http.SameSiteLaxMode,
 	}
+	// Behind a TLS-terminating proxy or across subdomains the defaults above may not fit
+	if raw := getEnv("COOKIE_SECURE", ""); raw != "" {
+		secure, err := strconv.ParseBool(raw)
+		if err != nil {
+			log.Fatalf("Invalid COOKIE_SECURE: %s", raw)
+		}
+		store.Options.Secure = secure
+	}
+	if raw := getEnv("COOKIE_SAMESITE", ""); raw != "" {
+		switch strings.ToLower(raw) {
+		case "lax":
+			store.Options.SameSite = http.SameSiteLaxMode
+		case "strict":
+			store.Options.SameSite = http.SameSiteStrictMode
+		case "none":
+			store.Options.SameSite = http.SameSiteNoneMode
+		default:
+			log.Fatalf("Invalid COOKIE_SAMESITE: %s. Must be 'lax', 'strict' or 'none'.", raw)
+		}
+	}
+	if store.Options.SameSite == http.SameSiteNoneMode && !store.Options.Secure {
+		log.Fatalf("COOKIE_SAMESITE=none requires a secure cookie; set COOKIE_SECURE=true")
+	}
 
 	appController := controllers.NewAppController(
 		redisQueue,
-		oauth2Config,
+		oidcProvider,
 		store,
 		authMethod,
 		legacyAuthPassword,
@@ -169,13 +250,43 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	// Terminal WebSockets are hijacked connections that Shutdown does not wait for
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		if err := appController.Drain(ctx); err != nil {
+			log.Printf("Terminal sessions not drained: %v", err)
+		}
+	}()
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
+	<-drained
 
 	log.Println("Server exited")
 }
 
+// sessionKeyPairs turns SESSION_KEY, a comma-separated list of keys with the newest first, into
+// key pairs for the cookie store. Cookies are signed with the first key but accepted if any key
+// verifies them. To rotate without logging everyone out:
+//  1. prepend the new key: SESSION_KEY=new,old
+//  2. once the old cookies have expired (their MaxAge, 7 days) or no longer matter, drop the old
+//     key: SESSION_KEY=new
+//
+// Cookies are signed only, so every pair has a nil encryption key.
+func sessionKeyPairs(raw string) [][]byte {
+	var pairs [][]byte
+	for _, key := range strings.Split(raw, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			pairs = append(pairs, []byte(key), nil)
+		}
+	}
+	if len(pairs) == 0 {
+		log.Fatalf("SESSION_KEY does not contain any key")
+	}
+	return pairs
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -1,18 +1,135 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
 	"github.com/tyottodekiru/k8s-playground/pkg/queue"
 )
 
+// generatingWatchdog handles items stuck in 'generating', e.g. after the generator crashed mid-provisioning
+type generatingWatchdog struct {
+	maxAge    time.Duration
+	retry     bool // send the item back to pending (up to queue.MaxRetries) instead of failing it
+	k8sClient *k8s.Client
+	namespace string
+}
+
 func main() {
 	redisURL := getEnv("REDIS_URL", "redis://localhost:6379")
+	idleTimeout, err := time.ParseDuration(getEnv("IDLE_RECLAIM_TIMEOUT", "0"))
+	if err != nil || idleTimeout < 0 {
+		log.Fatalf("Invalid IDLE_RECLAIM_TIMEOUT: %s", getEnv("IDLE_RECLAIM_TIMEOUT", "0"))
+	}
+	if idleTimeout > 0 {
+		log.Printf("Idle reclamation enabled: environments unused for %v will be shut down", idleTimeout)
+	}
+	quarantinePeriod, err := time.ParseDuration(getEnv("ERROR_QUARANTINE_PERIOD", "0"))
+	if err != nil || quarantinePeriod < 0 {
+		log.Fatalf("Invalid ERROR_QUARANTINE_PERIOD: %s", getEnv("ERROR_QUARANTINE_PERIOD", "0"))
+	}
+	if quarantinePeriod > 0 {
+		log.Printf("Error quarantine enabled: errored workloads are kept for %v before cleanup", quarantinePeriod)
+	}
+
+	// How long terminated items are kept in the queue before they are deleted
+	terminatedRetention, err := time.ParseDuration(getEnv("TERMINATED_RETENTION", "5m"))
+	if err != nil || terminatedRetention < 0 {
+		log.Fatalf("Invalid TERMINATED_RETENTION: %s", getEnv("TERMINATED_RETENTION", "5m"))
+	}
+	log.Printf("Terminated items are deleted %v after termination", terminatedRetention)
+
+	maxGeneratingAge, err := time.ParseDuration(getEnv("MAX_GENERATING_AGE", "0"))
+	if err != nil || maxGeneratingAge < 0 {
+		log.Fatalf("Invalid MAX_GENERATING_AGE: %s", getEnv("MAX_GENERATING_AGE", "0"))
+	}
+	orphanGracePeriod, err := time.ParseDuration(getEnv("ORPHAN_GRACE_PERIOD", "0"))
+	if err != nil || orphanGracePeriod < 0 {
+		log.Fatalf("Invalid ORPHAN_GRACE_PERIOD: %s", getEnv("ORPHAN_GRACE_PERIOD", "0"))
+	}
+
+	expiryWarningWindow, err := time.ParseDuration(getEnv("EXPIRY_WARNING_WINDOW", "30m"))
+	if err != nil || expiryWarningWindow < 0 {
+		log.Fatalf("Invalid EXPIRY_WARNING_WINDOW: %s", getEnv("EXPIRY_WARNING_WINDOW", "30m"))
+	}
+	expiryWebhookURL := getEnv("EXPIRY_WEBHOOK_URL", "")
+	if expiryWebhookURL != "" {
+		if u, err := url.Parse(expiryWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid EXPIRY_WEBHOOK_URL: %s", expiryWebhookURL)
+		}
+	}
+
+	interval, err := time.ParseDuration(getEnv("COLLECTOR_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid COLLECTOR_INTERVAL: %s", getEnv("COLLECTOR_INTERVAL", "30s"))
+	}
+	// Fraction of the interval by which each wait is randomly lengthened or shortened
+	jitter, err := strconv.ParseFloat(getEnv("INTERVAL_JITTER", "0.1"), 64)
+	if err != nil || jitter < 0 || jitter >= 1 {
+		log.Fatalf("Invalid INTERVAL_JITTER: %s (must be at least 0 and less than 1)", getEnv("INTERVAL_JITTER", "0.1"))
+	}
+
+	// With leader election several replicas can run; only the holder of the lease does any work
+	leaderElection, err := strconv.ParseBool(getEnv("LEADER_ELECTION", "false"))
+	if err != nil {
+		log.Fatalf("Invalid LEADER_ELECTION: %s", getEnv("LEADER_ELECTION", "false"))
+	}
+	leaderElectionConfig := k8s.LeaderElectionConfig{
+		LeaseName:      getEnv("LEADER_ELECTION_LEASE_NAME", "collector-controller"),
+		LeaseNamespace: getEnv("LEADER_ELECTION_NAMESPACE", ""),
+	}
+
+	if err := k8s.ValidateInstanceID(getEnv("INSTANCE_ID", "")); err != nil {
+		log.Fatalf("Invalid INSTANCE_ID: %v", err)
+	}
+
+	var k8sClient *k8s.Client
+	if maxGeneratingAge > 0 || orphanGracePeriod > 0 || leaderElection {
+		k8sClient, err = k8s.NewClient()
+		if err != nil {
+			log.Fatalf("Failed to initialize Kubernetes client: %v", err)
+		}
+		k8sClient.SetInstanceID(getEnv("INSTANCE_ID", ""))
+	}
+
+	var watchdog *generatingWatchdog
+	if maxGeneratingAge > 0 {
+		action := getEnv("STUCK_GENERATING_ACTION", "error")
+		if action != "error" && action != "retry" {
+			log.Fatalf("Invalid STUCK_GENERATING_ACTION: %s (must be 'error' or 'retry')", action)
+		}
+		watchdog = &generatingWatchdog{
+			maxAge:    maxGeneratingAge,
+			retry:     action == "retry",
+			k8sClient: k8sClient,
+			namespace: getEnv("NAMESPACE", "default"),
+		}
+		log.Printf("Generating watchdog enabled: items generating for more than %v are handled with action '%s'", maxGeneratingAge, action)
+	}
+	var reaper *orphanReaper
+	if orphanGracePeriod > 0 {
+		reaper = &orphanReaper{gracePeriod: orphanGracePeriod, k8sClient: k8sClient}
+		log.Printf("Orphan reaping enabled: DinD workloads without a queue item are deleted after %v", orphanGracePeriod)
+	}
+
+	var warner *expiryWarner
+	if expiryWarningWindow > 0 {
+		warner = &expiryWarner{window: expiryWarningWindow, webhookURL: expiryWebhookURL, httpClient: &http.Client{Timeout: 10 * time.Second}}
+		log.Printf("Expiry warnings enabled: owners are warned %v before their environment expires", expiryWarningWindow)
+	}
 
 	redisQueue, err := queue.NewRedisQueue(redisURL)
 	if err != nil {
@@ -34,52 +151,137 @@ func main() {
 		cancel()
 	}()
 
-	ticker := time.NewTicker(30 * time.Second) // Check every 30 seconds
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Collector controller shutting down...")
-			return
-		case <-ticker.C:
-			if err := cleanupItems(ctx, redisQueue); err != nil {
-				log.Printf("Error during cleanup: %v", err)
+	run := func(ctx context.Context) {
+		timer := time.NewTimer(nextInterval(interval, jitter))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Collector controller stopping...")
+				return
+			case <-timer.C:
+				if err := cleanupItems(ctx, redisQueue, idleTimeout, quarantinePeriod, terminatedRetention, watchdog, warner); err != nil {
+					log.Printf("Error during cleanup: %v", err)
+				}
+				if reaper != nil {
+					if err := reaper.reap(ctx, redisQueue); err != nil {
+						log.Printf("Error reaping orphaned workloads: %v", err)
+					}
+				}
+				timer.Reset(nextInterval(interval, jitter))
 			}
 		}
 	}
+
+	if !leaderElection {
+		run(ctx)
+		return
+	}
+	if err := k8sClient.RunLeaderElected(ctx, leaderElectionConfig, run); err != nil {
+		log.Fatalf("Collector controller stopped: %v", err)
+	}
 }
 
-func cleanupItems(ctx context.Context, redisQueue *queue.RedisQueue) error {
+func cleanupItems(ctx context.Context, redisQueue *queue.RedisQueue, idleTimeout, quarantinePeriod, terminatedRetention time.Duration, watchdog *generatingWatchdog, warner *expiryWarner) error {
+	// Terminated items past TERMINATED_ITEM_TTL are hidden from reads but stay stored until purged
+	if purged, err := redisQueue.PurgeExpiredTerminated(ctx); err != nil {
+		log.Printf("Failed to purge expired terminated items: %v", err)
+	} else if purged > 0 {
+		log.Printf("Purged %d expired terminated items", purged)
+	}
+
 	allItems, err := redisQueue.GetAllItems(ctx)
 	if err != nil {
 		return err
 	}
 
 	now := time.Now()
-	const terminatedGracePeriod = 5 * time.Minute
 
 	for _, item := range allItems {
 		// Collect expired items and mark them for shutdown
 		if item.ShouldBeCollected() {
 			log.Printf("Collecting expired item %s (expired at %v)", item.ID, item.ExpiresAt)
 
-			item.Status = queue.StatusShutdown
-			if err := redisQueue.UpdateItem(ctx, item); err != nil {
+			// Only if unchanged since it was read: an environment extended or destroyed meanwhile
+			// is left for the next pass to look at again
+			collected := *item
+			collected.Status = queue.StatusShutdown
+			err := redisQueue.UpdateItemIfUnchanged(ctx, &collected)
+			if errors.Is(err, queue.ErrConflict) || errors.Is(err, queue.ErrItemNotFound) {
+				log.Printf("Expired item %s was changed since it was read, skipping it: %v", item.ID, err)
+			} else if err != nil {
 				log.Printf("Failed to update item %s status to shutdown: %v", item.ID, err)
 
-				item.Status = queue.StatusError
-				item.ErrorMessage = "Failed to mark for shutdown during collection"
-				if updateErr := redisQueue.UpdateItem(ctx, item); updateErr != nil {
+				failed := *item
+				failed.Status = queue.StatusError
+				failed.ErrorMessage = "Failed to mark for shutdown during collection"
+				if updateErr := redisQueue.UpdateItemIfUnchanged(ctx, &failed); updateErr != nil {
 					log.Printf("Failed to update item %s status to error: %v", item.ID, updateErr)
 				}
 			}
 			continue // This item is processed for this cycle
 		}
 
-		// Delete items that have been in the 'terminated' state for a while
-		if item.Status == queue.StatusTerminated {
-			if now.Sub(item.StatusUpdatedAt) > terminatedGracePeriod {
+		// Warn owners of environments that will be collected soon, once
+		if warner != nil && item.WarnedAt == nil && (item.Status == queue.StatusAvailable || item.Status == queue.StatusRestarting) && item.ExpiresAt.Sub(now) <= warner.window {
+			if err := warner.warn(ctx, redisQueue, item); err != nil {
+				log.Printf("Failed to warn about expiry of item %s: %v", item.ID, err)
+			}
+		}
+
+		// Recover items wedged in 'generating'
+		if watchdog != nil && item.Status == queue.StatusGenerating && now.Sub(item.StatusUpdatedAt) > watchdog.maxAge {
+			if err := watchdog.recover(ctx, redisQueue, item); err != nil {
+				log.Printf("Failed to recover stuck item %s: %v", item.ID, err)
+			}
+			continue
+		}
+
+		// Reclaim available environments with no live session heartbeat and no recent input/output
+		if idleTimeout > 0 && item.Status == queue.StatusAvailable {
+			idle, err := isIdle(ctx, redisQueue, item, idleTimeout, now)
+			if err != nil {
+				log.Printf("Failed to check activity for item %s: %v", item.ID, err)
+			} else if idle {
+				log.Printf("Reclaiming idle item %s (no activity for %v)", item.ID, idleTimeout)
+				err := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+					i.Status = queue.StatusShutdown
+				})
+				if err != nil {
+					log.Printf("Failed to update idle item %s status to shutdown: %v", item.ID, err)
+				}
+				continue
+			}
+		}
+
+		// Keep errored workloads around for post-mortem, then hand them to the killer
+		if quarantinePeriod > 0 && item.Status == queue.StatusError && item.PodID != "" {
+			if item.QuarantineUntil == nil {
+				until := item.StatusUpdatedAt.Add(quarantinePeriod)
+				item.QuarantineUntil = &until
+				log.Printf("Quarantining errored item %s (workload %s) until %v", item.ID, item.PodID, until)
+				err := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+					i.QuarantineUntil = &until
+				})
+				if err != nil {
+					log.Printf("Failed to quarantine item %s: %v", item.ID, err)
+				}
+			} else if !item.IsQuarantined() {
+				log.Printf("Quarantine of item %s ended, marking for shutdown", item.ID)
+				err := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+					i.Status = queue.StatusShutdown
+				})
+				if err != nil {
+					log.Printf("Failed to update quarantined item %s status to shutdown: %v", item.ID, err)
+				}
+			}
+			continue
+		}
+
+		// Delete items that have been terminated, for real or in a dry run, for a while
+		if item.IsTerminated() {
+			if now.Sub(item.StatusUpdatedAt) > terminatedRetention {
 				log.Printf("Deleting old terminated item %s (terminated at %v)", item.ID, item.StatusUpdatedAt)
 				if err := redisQueue.DeleteItem(ctx, item.ID); err != nil {
 					log.Printf("Failed to delete terminated item %s: %v", item.ID, err)
@@ -91,6 +293,199 @@ func cleanupItems(ctx context.Context, redisQueue *queue.RedisQueue) error {
 	return nil
 }
 
+// recover removes any partially created workload of a stuck item and either queues it for
+// another attempt or marks it as errored. A retried item stays in generating until its workload
+// is gone, so the generator does not find the old one still terminating.
+func (w *generatingWatchdog) recover(ctx context.Context, redisQueue *queue.RedisQueue, item *queue.QueueItem) error {
+	log.Printf("Item %s has been generating since %v (more than %v)", item.ID, item.StatusUpdatedAt, w.maxAge)
+
+	// The generator may have crashed anywhere between creating the workload and recording PodID
+	workloadName := item.PodID
+	if workloadName == "" {
+		workloadName = item.WorkloadName()
+	}
+	namespace := item.NamespaceOr(w.namespace)
+	var err error
+	if item.WorkloadType == "deployment" {
+		err = w.k8sClient.DeleteDinDDeployment(ctx, workloadName, namespace)
+	} else {
+		err = w.k8sClient.DeleteDinDStatefulSet(ctx, workloadName, namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete partial workload %s: %w", workloadName, err)
+	}
+	item.PodID = ""
+
+	if w.retry && item.RetryCount < queue.MaxRetries {
+		exists, err := w.k8sClient.DinDWorkloadExists(ctx, workloadName, item.WorkloadType, namespace)
+		if err != nil {
+			return fmt.Errorf("failed to check partial workload %s: %w", workloadName, err)
+		}
+		if exists {
+			log.Printf("Partial workload %s of stuck item %s is still terminating, requeueing later", workloadName, item.ID)
+			return nil
+		}
+	}
+
+	if w.retry && item.RetryCount < queue.MaxRetries {
+		item.RetryCount++
+		item.Status = queue.StatusPending
+		item.ErrorMessage = ""
+		log.Printf("Requeueing stuck item %s (retry %d/%d)", item.ID, item.RetryCount, queue.MaxRetries)
+	} else {
+		item.Status = queue.StatusError
+		item.ErrorMessage = fmt.Sprintf("Provisioning did not finish within %v", w.maxAge)
+		log.Printf("Marking stuck item %s as error", item.ID)
+	}
+	// A generator that was only slow may have moved the item on meanwhile
+	err = redisQueue.UpdateItemIfUnchanged(ctx, item)
+	if errors.Is(err, queue.ErrConflict) || errors.Is(err, queue.ErrItemNotFound) {
+		log.Printf("Stuck item %s was changed since it was read, leaving it: %v", item.ID, err)
+		return nil
+	}
+	return err
+}
+
+// expiryWarner tells owners that their environment is about to be collected: connected terminal
+// sessions are warned by the app-controller, and an optional webhook is notified
+type expiryWarner struct {
+	window     time.Duration
+	webhookURL string
+	httpClient *http.Client
+}
+
+func (w *expiryWarner) warn(ctx context.Context, redisQueue *queue.RedisQueue, item *queue.QueueItem) error {
+	// Record the warning first so it is sent at most once even if announcing it fails. An item
+	// extended or destroyed since it was read is not warned about; the next pass looks at it again.
+	now := time.Now()
+	warned := *item
+	warned.WarnedAt = &now
+	err := redisQueue.UpdateItemIfUnchanged(ctx, &warned)
+	if errors.Is(err, queue.ErrConflict) || errors.Is(err, queue.ErrItemNotFound) {
+		log.Printf("Item %s was changed since it was read, not warning about its expiry: %v", item.ID, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record warning: %w", err)
+	}
+	*item = warned
+	log.Printf("Item %s of %s expires at %v, warning its owner", item.ID, item.Owner, item.ExpiresAt)
+
+	if err := redisQueue.PublishExpiryWarning(ctx, item); err != nil {
+		log.Printf("Failed to publish expiry warning for item %s: %v", item.ID, err)
+	}
+	if w.webhookURL != "" {
+		if err := w.notifyWebhook(ctx, item); err != nil {
+			log.Printf("Failed to notify expiry webhook for item %s: %v", item.ID, err)
+		}
+	}
+	return nil
+}
+
+// notifyWebhook POSTs the expiring environment as JSON to the configured webhook
+func (w *expiryWarner) notifyWebhook(ctx context.Context, item *queue.QueueItem) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"event":          "environment_expiring",
+		"environment_id": item.ID,
+		"owner":          item.Owner,
+		"display_name":   item.DisplayName,
+		"expires_at":     item.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// orphanReaper deletes DinD workloads that no queue item refers to, e.g. after the app-controller
+// crashed mid-request or Redis was wiped
+type orphanReaper struct {
+	gracePeriod time.Duration
+	k8sClient   *k8s.Client
+}
+
+func (r *orphanReaper) reap(ctx context.Context, redisQueue *queue.RedisQueue) error {
+	// List the workloads before the items: an item is always stored before its workload is
+	// created, so a workload listed here that belongs to an item will find it below
+	workloads, err := r.k8sClient.ListDinDWorkloads(ctx, "")
+	if err != nil {
+		return err
+	}
+	allItems, err := redisQueue.GetAllItems(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The generator only records PodID once the workload is ready, so match on both
+	known := make(map[string]bool, 2*len(allItems))
+	for _, item := range allItems {
+		if item.PodID != "" {
+			known[item.PodID] = true
+		}
+		known[item.WorkloadName()] = true
+	}
+
+	now := time.Now()
+	for _, workload := range workloads {
+		if known[workload.Name] {
+			continue
+		}
+		if now.Sub(workload.CreatedAt) < r.gracePeriod {
+			continue
+		}
+		log.Printf("Reaping orphaned %s %s/%s (created %v, no queue item)", workload.Type, workload.Namespace, workload.Name, workload.CreatedAt)
+		if workload.Type == "deployment" {
+			err = r.k8sClient.DeleteDinDDeployment(ctx, workload.Name, workload.Namespace)
+		} else {
+			err = r.k8sClient.DeleteDinDStatefulSet(ctx, workload.Name, workload.Namespace)
+		}
+		if err != nil {
+			log.Printf("Failed to reap orphaned %s %s/%s: %v", workload.Type, workload.Namespace, workload.Name, err)
+		}
+	}
+	return nil
+}
+
+// isIdle reports whether an environment has had neither a live heartbeat nor any
+// terminal activity within idleTimeout. Environments that were never used are
+// measured from when they became available.
+func isIdle(ctx context.Context, redisQueue *queue.RedisQueue, item *queue.QueueItem, idleTimeout time.Duration, now time.Time) (bool, error) {
+	lastActivity, hasHeartbeat, err := redisQueue.GetActivity(ctx, item.ID)
+	if err != nil {
+		return false, err
+	}
+	if hasHeartbeat {
+		return false, nil
+	}
+	if lastActivity.Before(item.StatusUpdatedAt) {
+		lastActivity = item.StatusUpdatedAt
+	}
+	return now.Sub(lastActivity) > idleTimeout, nil
+}
+
+// nextInterval returns interval lengthened or shortened by a random amount of up to jitter
+// (a fraction of interval), so controllers and replicas started together drift apart instead of
+// hitting Redis and the API server in lockstep
+func nextInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*jitter*float64(interval))
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
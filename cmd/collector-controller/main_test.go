@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+const testNamespace = "playground"
+
+func newTestQueue(t *testing.T) *queue.RedisQueue {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	redisQueue, err := queue.NewRedisQueue("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	return redisQueue
+}
+
+// addStuckItem stores an item that has been generating for an hour without a recorded PodID,
+// as left behind by a generator that crashed after creating the workload
+func addStuckItem(t *testing.T, redisQueue *queue.RedisQueue) *queue.QueueItem {
+	t.Helper()
+	item := &queue.QueueItem{
+		ID:              "0123abcd-0000-0000-0000-000000000000",
+		Owner:           "alice",
+		Status:          queue.StatusGenerating,
+		StatusUpdatedAt: time.Now().Add(-time.Hour),
+		ExpiresAt:       time.Now().Add(time.Hour),
+		Namespace:       testNamespace,
+	}
+	if err := redisQueue.AddItem(context.Background(), item); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	return item
+}
+
+// newPartialWorkload returns a fake clientset holding the StatefulSet, Service and PVC of item
+func newPartialWorkload(item *queue.QueueItem) *fake.Clientset {
+	meta := metav1.ObjectMeta{Name: item.WorkloadName(), Namespace: testNamespace}
+	return fake.NewSimpleClientset(
+		&appsv1.StatefulSet{ObjectMeta: meta},
+		&corev1.Service{ObjectMeta: meta},
+		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "docker-graph-storage-" + meta.Name + "-0", Namespace: testNamespace}},
+	)
+}
+
+func runWatchdog(t *testing.T, redisQueue *queue.RedisQueue, clientset *fake.Clientset, retry bool) *queue.QueueItem {
+	t.Helper()
+	watchdog := &generatingWatchdog{
+		maxAge:    10 * time.Minute,
+		retry:     retry,
+		k8sClient: k8s.NewClientForClientset(clientset),
+		namespace: "default",
+	}
+	ctx := context.Background()
+	if err := cleanupItems(ctx, redisQueue, 0, 0, time.Hour, watchdog, nil); err != nil {
+		t.Fatalf("cleanupItems: %v", err)
+	}
+	items, err := redisQueue.GetAllItems(ctx)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("GetAllItems = %v, %v; want the stuck item", items, err)
+	}
+	return items[0]
+}
+
+func TestWatchdogDeletesWorkloadOfStuckItemWithoutPodID(t *testing.T) {
+	redisQueue := newTestQueue(t)
+	item := addStuckItem(t, redisQueue)
+	clientset := newPartialWorkload(item)
+
+	recovered := runWatchdog(t, redisQueue, clientset, false)
+
+	ctx := context.Background()
+	if _, err := clientset.AppsV1().StatefulSets(testNamespace).Get(ctx, item.WorkloadName(), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("partial statefulset was not deleted (err = %v)", err)
+	}
+	if _, err := clientset.CoreV1().Services(testNamespace).Get(ctx, item.WorkloadName(), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("partial service was not deleted (err = %v)", err)
+	}
+	if recovered.Status != queue.StatusError || recovered.ErrorMessage == "" {
+		t.Errorf("stuck item = %s (%q), want error with a message", recovered.Status, recovered.ErrorMessage)
+	}
+}
+
+func TestWatchdogRequeuesStuckItemOnceWorkloadIsGone(t *testing.T) {
+	redisQueue := newTestQueue(t)
+	item := addStuckItem(t, redisQueue)
+
+	recovered := runWatchdog(t, redisQueue, newPartialWorkload(item), true)
+
+	if recovered.Status != queue.StatusPending || recovered.RetryCount != 1 {
+		t.Errorf("stuck item = %s after %d retries, want pending after 1", recovered.Status, recovered.RetryCount)
+	}
+}
+
+func TestWatchdogWaitsForTerminatingWorkloadBeforeRequeueing(t *testing.T) {
+	redisQueue := newTestQueue(t)
+	item := addStuckItem(t, redisQueue)
+	clientset := newPartialWorkload(item)
+	// Foreground deletion keeps the StatefulSet until its pods are gone
+	clientset.PrependReactor("delete", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+
+	recovered := runWatchdog(t, redisQueue, clientset, true)
+
+	if recovered.Status != queue.StatusGenerating || recovered.RetryCount != 0 {
+		t.Errorf("stuck item = %s after %d retries, want it left generating until the workload is gone", recovered.Status, recovered.RetryCount)
+	}
+}
+
+func TestWatchdogLeavesItemChangedDuringRecovery(t *testing.T) {
+	redisQueue := newTestQueue(t)
+	item := addStuckItem(t, redisQueue)
+	clientset := newPartialWorkload(item)
+	// A slow generator finishes while the watchdog deletes the workload
+	clientset.PrependReactor("delete", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		finished, err := redisQueue.GetItem(context.Background(), item.ID)
+		if err != nil {
+			t.Errorf("GetItem: %v", err)
+			return false, nil, nil
+		}
+		finished.Status = queue.StatusAvailable
+		if err := redisQueue.UpdateItem(context.Background(), finished); err != nil {
+			t.Errorf("UpdateItem: %v", err)
+		}
+		return false, nil, nil
+	})
+
+	recovered := runWatchdog(t, redisQueue, clientset, false)
+
+	if recovered.Status != queue.StatusAvailable {
+		t.Errorf("item = %s, want the generator's available left in place", recovered.Status)
+	}
+}
+
+func TestCleanupDeletesTerminatedItemsAfterRetention(t *testing.T) {
+	redisQueue := newTestQueue(t)
+	ctx := context.Background()
+	items := []*queue.QueueItem{
+		{ID: "terminated-old", Status: queue.StatusTerminated, StatusUpdatedAt: time.Now().Add(-10 * time.Minute)},
+		{ID: "dry-run-old", Status: queue.StatusDryRunTerminated, StatusUpdatedAt: time.Now().Add(-10 * time.Minute)},
+		{ID: "dry-run-recent", Status: queue.StatusDryRunTerminated, StatusUpdatedAt: time.Now().Add(-time.Minute)},
+	}
+	for _, item := range items {
+		if err := redisQueue.AddItem(ctx, item); err != nil {
+			t.Fatalf("AddItem: %v", err)
+		}
+	}
+
+	if err := cleanupItems(ctx, redisQueue, 0, 0, 5*time.Minute, nil, nil); err != nil {
+		t.Fatalf("cleanupItems: %v", err)
+	}
+
+	remaining, err := redisQueue.GetAllItems(ctx)
+	if err != nil {
+		t.Fatalf("GetAllItems: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != "dry-run-recent" {
+		t.Errorf("remaining items = %v, want only dry-run-recent", remaining)
+	}
+}
+
+func TestCleanupPurgesExpiredTerminatedItems(t *testing.T) {
+	t.Setenv("TERMINATED_ITEM_TTL", "1h")
+	redisQueue := newTestQueue(t)
+	ctx := context.Background()
+	// Terminated before tombstones existed, longer ago than the TTL
+	expired := &queue.QueueItem{ID: "expired", Status: queue.StatusTerminated, StatusUpdatedAt: time.Now().Add(-2 * time.Hour)}
+	if err := redisQueue.AddItem(ctx, expired); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+
+	// A long retention keeps the item from being deleted as an old terminated item
+	if err := cleanupItems(ctx, redisQueue, 0, 0, 24*time.Hour, nil, nil); err != nil {
+		t.Fatalf("cleanupItems: %v", err)
+	}
+	if stored, err := redisQueue.Client.HExists(ctx, queue.QueueKey, expired.ID).Result(); err != nil || stored {
+		t.Errorf("expired item stored = %v, %v; want purged", stored, err)
+	}
+}
+
+func TestExpiryWarningSkipsItemChangedSinceRead(t *testing.T) {
+	redisQueue := newTestQueue(t)
+	ctx := context.Background()
+	var webhookCalls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookCalls.Add(1)
+	}))
+	defer server.Close()
+	warner := &expiryWarner{window: time.Hour, webhookURL: server.URL, httpClient: server.Client()}
+
+	item := &queue.QueueItem{ID: "expiring", Owner: "alice", Status: queue.StatusAvailable, ExpiresAt: time.Now().Add(10 * time.Minute)}
+	if err := redisQueue.AddItem(ctx, item); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	stale := *item
+	// The owner extends the environment after the collector read it
+	extended := *item
+	extended.ExpiresAt = time.Now().Add(24 * time.Hour)
+	if err := redisQueue.UpdateItem(ctx, &extended); err != nil {
+		t.Fatalf("UpdateItem: %v", err)
+	}
+
+	if err := warner.warn(ctx, redisQueue, &stale); err != nil {
+		t.Fatalf("warn: %v", err)
+	}
+	if n := webhookCalls.Load(); n != 0 {
+		t.Errorf("webhook was called %d times for an extended environment", n)
+	}
+	stored, err := redisQueue.GetItem(ctx, item.ID)
+	if err != nil {
+		t.Fatalf("GetItem: %v", err)
+	}
+	if stored.WarnedAt != nil || !stored.ExpiresAt.Equal(extended.ExpiresAt) {
+		t.Errorf("stored item warned at %v, expires at %v; want the extension left in place", stored.WarnedAt, stored.ExpiresAt)
+	}
+
+	// Read again, the item is warned about once
+	fresh, err := redisQueue.GetItem(ctx, item.ID)
+	if err != nil {
+		t.Fatalf("GetItem: %v", err)
+	}
+	if err := warner.warn(ctx, redisQueue, fresh); err != nil {
+		t.Fatalf("warn: %v", err)
+	}
+	if n := webhookCalls.Load(); n != 1 {
+		t.Errorf("webhook was called %d times, want once", n)
+	}
+}
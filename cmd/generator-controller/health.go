@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// loopHeartbeat records when the main loop last finished an iteration, so a liveness probe can
+// tell a wedged loop (e.g. stuck on a Kubernetes or Redis call) from a healthy one
+type loopHeartbeat struct {
+	last atomic.Int64 // unix nanoseconds
+	// Whether the loop is running; a standby waiting for leadership has no heartbeat
+	running atomic.Bool
+}
+
+func (h *loopHeartbeat) start() {
+	h.beat()
+	h.running.Store(true)
+}
+
+func (h *loopHeartbeat) stop() {
+	h.running.Store(false)
+}
+
+func (h *loopHeartbeat) beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+func (h *loopHeartbeat) age() time.Duration {
+	return time.Since(time.Unix(0, h.last.Load()))
+}
+
+// startHealthServer serves /healthz on addr, reporting unhealthy once the last heartbeat of the
+// running loop is older than maxAge
+func startHealthServer(addr string, heartbeat *loopHeartbeat, maxAge time.Duration) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if age := heartbeat.age(); heartbeat.running.Load() && age > maxAge {
+			http.Error(w, fmt.Sprintf("generator loop has not run for %v", age.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		log.Printf("Starting health server on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Health server error: %v", err)
+		}
+	}()
+	return server
+}
@@ -2,21 +2,48 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
 	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+	corev1 "k8s.io/api/core/v1"
 )
 
 var (
 	dindImageBaseRepository string
-	dindImageVersions       map[string]string
+	dindImageVersions       map[string]k8s.DinDImage
+	maxEnvironmentsPerUser  int
+	// Cap on items generating at once across all generators, 0 = unlimited
+	maxConcurrentGenerating int
+	// Pod readiness polling: exponential backoff from the initial interval up to the max, bounded by the timeout
+	podReadyInitialInterval time.Duration
+	podReadyMaxInterval     time.Duration
+	podReadyTimeout         time.Duration
+	resourceSizing          k8s.ResourceSizing
+	entrypointPresets       map[string]k8s.EntrypointPreset
+	environmentTemplates    map[string]k8s.EnvironmentTemplate
+	// Nodes of the kind cluster in the DinD image (docker/baseimages/kind-config.yaml), which scale the DinD limits
+	dindNodeCount int
+	// How long provisioning failure diagnostics are kept, 0 disables capturing them
+	diagnosticsRetention time.Duration
+	// Whether /root/share is backed by the per-user directory on the NFS server
+	nfsEnabled bool
+)
+
+const (
+	diagnosticsCaptureTimeout = 30 * time.Second
+	diagnosticsLogTailLines   = 200
+	diagnosticsLogLimitBytes  = 64 * 1024
 )
 
 func main() {
@@ -25,12 +52,93 @@ func main() {
 	dindImageBaseRepository = getEnv("DIND_IMAGE_BASE_REPOSITORY", "tyottodekiru/dind")
 	dindImageVersionsJSON := getEnv("DIND_IMAGE_VERSIONS_JSON", "{}")
 
-	if err := json.Unmarshal([]byte(dindImageVersionsJSON), &dindImageVersions); err != nil {
+	var err error
+	dindImageVersions, err = k8s.ParseDinDImageVersions(dindImageVersionsJSON)
+	if err != nil {
 		log.Fatalf("Failed to parse DIND_IMAGE_VERSIONS_JSON: %v. JSON was: %s", err, dindImageVersionsJSON)
 	}
 	if len(dindImageVersions) == 0 {
 		log.Println("Warning: DIND_IMAGE_VERSIONS_JSON is empty or invalid. Generator will fail if K8s versions are not mapped.")
 	}
+	maxEnvironmentsPerUser, err = strconv.Atoi(getEnv("MAX_ENVIRONMENTS_PER_USER", "0"))
+	if err != nil || maxEnvironmentsPerUser < 0 {
+		log.Fatalf("Invalid MAX_ENVIRONMENTS_PER_USER: %s", getEnv("MAX_ENVIRONMENTS_PER_USER", "0"))
+	}
+	maxConcurrentGenerating, err = strconv.Atoi(getEnv("MAX_CONCURRENT_GENERATING", "0"))
+	if err != nil || maxConcurrentGenerating < 0 {
+		log.Fatalf("Invalid MAX_CONCURRENT_GENERATING: %s", getEnv("MAX_CONCURRENT_GENERATING", "0"))
+	}
+	podReadyInitialInterval = getDurationEnv("POD_READY_POLL_INITIAL_INTERVAL", 2*time.Second)
+	podReadyMaxInterval = getDurationEnv("POD_READY_POLL_MAX_INTERVAL", 30*time.Second)
+	podReadyTimeout = getDurationEnv("POD_READY_TIMEOUT", 5*time.Minute)
+	if podReadyMaxInterval < podReadyInitialInterval {
+		log.Fatalf("POD_READY_POLL_MAX_INTERVAL (%s) must not be less than POD_READY_POLL_INITIAL_INTERVAL (%s)", podReadyMaxInterval, podReadyInitialInterval)
+	}
+	defaultResources := k8s.DefaultDinDResources()
+	resourceSizing = k8s.ResourceSizing{
+		Base: k8s.DinDResources{
+			CPURequest:    getEnv("DIND_CPU_REQUEST", defaultResources.CPURequest),
+			MemoryRequest: getEnv("DIND_MEMORY_REQUEST", defaultResources.MemoryRequest),
+			CPULimit:      getEnv("DIND_CPU_LIMIT", defaultResources.CPULimit),
+			MemoryLimit:   getEnv("DIND_MEMORY_LIMIT", defaultResources.MemoryLimit),
+		},
+		PerNodeCPU:    getEnv("DIND_PER_NODE_CPU", "500m"),
+		PerNodeMemory: getEnv("DIND_PER_NODE_MEMORY", "1Gi"),
+		MaxCPU:        getEnv("DIND_MAX_CPU_LIMIT", ""),
+		MaxMemory:     getEnv("DIND_MAX_MEMORY_LIMIT", ""),
+	}
+	dindNodeCount, err = strconv.Atoi(getEnv("DIND_NODE_COUNT", "3"))
+	if err != nil || dindNodeCount < 1 {
+		log.Fatalf("Invalid DIND_NODE_COUNT: %s", getEnv("DIND_NODE_COUNT", "3"))
+	}
+	if _, err := resourceSizing.Compute(dindNodeCount); err != nil {
+		log.Fatalf("Invalid DinD resource configuration: %v", err)
+	}
+	entrypointPresets, err = k8s.ParseEntrypointPresets(getEnv("DIND_ENTRYPOINT_PRESETS_JSON", ""))
+	if err != nil {
+		log.Fatalf("Invalid DIND_ENTRYPOINT_PRESETS_JSON: %v", err)
+	}
+	environmentTemplates, err = k8s.ParseEnvironmentTemplates(getEnv("ENVIRONMENT_TEMPLATES_JSON", ""))
+	if err != nil {
+		log.Fatalf("Invalid ENVIRONMENT_TEMPLATES_JSON: %v", err)
+	}
+	diagnosticsRetention, err = time.ParseDuration(getEnv("DIAGNOSTICS_RETENTION", "72h"))
+	if err != nil || diagnosticsRetention < 0 {
+		log.Fatalf("Invalid DIAGNOSTICS_RETENTION: %s", getEnv("DIAGNOSTICS_RETENTION", "72h"))
+	}
+	nfsEnabled, err = strconv.ParseBool(getEnv("NFS_ENABLED", "true"))
+	if err != nil {
+		log.Fatalf("Invalid NFS_ENABLED: %s", getEnv("NFS_ENABLED", "true"))
+	}
+	if !nfsEnabled {
+		log.Println("NFS is disabled; /root/share of each environment is an emptyDir and does not outlive its pod")
+	}
+	if err := k8s.ValidateInstanceID(getEnv("INSTANCE_ID", "")); err != nil {
+		log.Fatalf("Invalid INSTANCE_ID: %v", err)
+	}
+
+	// How often pending and restarting items are processed
+	interval := getDurationEnv("GENERATOR_INTERVAL", 5*time.Second)
+	// Fraction of the interval by which each wait is randomly lengthened or shortened
+	jitter, err := strconv.ParseFloat(getEnv("INTERVAL_JITTER", "0.1"), 64)
+	if err != nil || jitter < 0 || jitter >= 1 {
+		log.Fatalf("Invalid INTERVAL_JITTER: %s (must be at least 0 and less than 1)", getEnv("INTERVAL_JITTER", "0.1"))
+	}
+
+	// With leader election several replicas can run; only the holder of the lease does any work
+	leaderElection, err := strconv.ParseBool(getEnv("LEADER_ELECTION", "false"))
+	if err != nil {
+		log.Fatalf("Invalid LEADER_ELECTION: %s", getEnv("LEADER_ELECTION", "false"))
+	}
+	leaderElectionConfig := k8s.LeaderElectionConfig{
+		LeaseName:      getEnv("LEADER_ELECTION_LEASE_NAME", "generator-controller"),
+		LeaseNamespace: getEnv("LEADER_ELECTION_NAMESPACE", ""),
+	}
+
+	concurrency, err := strconv.Atoi(getEnv("GENERATOR_CONCURRENCY", "4"))
+	if err != nil || concurrency < 1 {
+		log.Fatalf("Invalid GENERATOR_CONCURRENCY: %s", getEnv("GENERATOR_CONCURRENCY", "4"))
+	}
 	log.Printf("DinD Image Base Repository: %s", dindImageBaseRepository)
 	log.Printf("DinD Image Versions Map: %+v", dindImageVersions)
 
@@ -45,7 +153,36 @@ func main() {
 		log.Fatalf("Failed to initialize Kubernetes client: %v", err)
 	}
 
-	log.Println("Starting generator controller...")
+	// Security context template for the DinD container (JSON form of corev1.SecurityContext)
+	dindSecurityContext, err := k8s.ParseSecurityContext(getEnv("DIND_SECURITY_CONTEXT_JSON", ""))
+	if err != nil {
+		log.Fatalf("Invalid DIND_SECURITY_CONTEXT_JSON: %v", err)
+	}
+	k8sClient.SetDinDSecurityContext(dindSecurityContext)
+	k8sClient.SetInstanceID(getEnv("INSTANCE_ID", ""))
+
+	// Node selector and tolerations keeping the privileged DinD pods on dedicated nodes
+	nodeSelector, err := k8s.ParseNodeSelector(getEnv("DIND_NODE_SELECTOR", ""))
+	if err != nil {
+		log.Fatalf("Invalid DIND_NODE_SELECTOR: %v", err)
+	}
+	tolerations, err := k8s.ParseTolerations(getEnv("DIND_TOLERATIONS", ""))
+	if err != nil {
+		log.Fatalf("Invalid DIND_TOLERATIONS: %v", err)
+	}
+	k8sClient.SetDinDScheduling(k8s.DinDScheduling{NodeSelector: nodeSelector, Tolerations: tolerations})
+
+	// Lets the app-controller estimate how long pending items wait
+	parallelism := concurrency
+	if maxConcurrentGenerating > 0 {
+		parallelism = min(parallelism, maxConcurrentGenerating)
+	}
+	if err := redisQueue.SetGenerationParallelism(context.Background(), parallelism); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	log.Printf("Starting generator controller with %d workers...", concurrency)
+	pool := newWorkerPool(concurrency)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -59,63 +196,311 @@ func main() {
 		cancel()
 	}()
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Generator controller shutting down...")
-			return
-		case <-ticker.C:
-			if err := processPendingItems(ctx, redisQueue, k8sClient, namespace); err != nil {
-				log.Printf("Error processing pending items: %v", err)
+	heartbeat := &loopHeartbeat{}
+	// Unhealthy after three iterations were missed, allowing for the longest jittered wait
+	maxHeartbeatAge := 3 * time.Duration(float64(interval)*(1+jitter))
+	healthServer := startHealthServer(":"+getEnv("HEALTH_PORT", "8081"), heartbeat, maxHeartbeatAge)
+	defer healthServer.Close()
+
+	run := func(ctx context.Context) {
+		heartbeat.start()
+		defer heartbeat.stop()
+		timer := time.NewTimer(nextInterval(interval, jitter))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Generator controller stopping, waiting for in-flight items...")
+				pool.Wait()
+				return
+			case <-timer.C:
+				if err := processPendingItems(ctx, redisQueue, k8sClient, pool, namespace); err != nil {
+					log.Printf("Error processing pending items: %v", err)
+				}
+				if err := processRestartingItems(ctx, redisQueue, k8sClient, namespace); err != nil {
+					log.Printf("Error processing restarting items: %v", err)
+				}
+				heartbeat.beat()
+				timer.Reset(nextInterval(interval, jitter))
 			}
 		}
 	}
+
+	if !leaderElection {
+		run(ctx)
+		return
+	}
+	if err := k8sClient.RunLeaderElected(ctx, leaderElectionConfig, run); err != nil {
+		log.Fatalf("Generator controller stopped: %v", err)
+	}
 }
 
-func processPendingItems(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, namespace string) error {
+// workerPool runs processItem for up to size items at a time and remembers which items are in flight,
+// so an item is never picked up twice while its worker hasn't finished.
+type workerPool struct {
+	slots    chan struct{}
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	inFlight map[string]string // item ID -> owner
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{
+		slots:    make(chan struct{}, size),
+		inFlight: make(map[string]string),
+	}
+}
+
+// TryRun starts fn for item in a new worker. It returns false without running anything
+// when the item is already in flight or all workers are busy.
+func (p *workerPool) TryRun(item *queue.QueueItem, fn func()) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, busy := p.inFlight[item.ID]; busy {
+		return false
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return false
+	}
+	p.inFlight[item.ID] = item.Owner
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			p.mutex.Lock()
+			delete(p.inFlight, item.ID)
+			p.mutex.Unlock()
+			<-p.slots
+			p.wg.Done()
+		}()
+		fn()
+	}()
+	return true
+}
+
+// InFlight returns the owners of the items currently being processed, keyed by item ID
+func (p *workerPool) InFlight() map[string]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	snapshot := make(map[string]string, len(p.inFlight))
+	for id, owner := range p.inFlight {
+		snapshot[id] = owner
+	}
+	return snapshot
+}
+
+func (p *workerPool) Wait() {
+	p.wg.Wait()
+}
+
+func processPendingItems(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, pool *workerPool, namespace string) error {
 	pendingItems, err := redisQueue.GetItemsByStatus(ctx, queue.StatusPending)
 	if err != nil {
 		return fmt.Errorf("failed to get pending items: %w", err)
 	}
+	// Served in creation order, which the queue positions shown to users assume
+	queue.SortByCreation(pendingItems)
+
+	// Count each owner's active environments so over-quota items stay pending
+	activeCounts := make(map[string]int)
+	if maxEnvironmentsPerUser > 0 && len(pendingItems) > 0 {
+		allItems, err := redisQueue.GetAllItems(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get items for quota check: %w", err)
+		}
+		inFlight := pool.InFlight()
+		for _, item := range allItems {
+			if _, ok := inFlight[item.ID]; !ok && item.IsActive() {
+				activeCounts[item.Owner]++
+			}
+		}
+		for _, owner := range inFlight {
+			activeCounts[owner]++
+		}
+	}
 
-	for _, item := range pendingItems {
-		if err := processItem(ctx, redisQueue, k8sClient, item, namespace); err != nil {
-			log.Printf("Error processing item %s: %v", item.ID, err)
+	// Items generating anywhere, plus those in flight here that have not been claimed yet
+	generating := 0
+	if maxConcurrentGenerating > 0 && len(pendingItems) > 0 {
+		generatingItems, err := redisQueue.GetItemsByStatus(ctx, queue.StatusGenerating)
+		if err != nil {
+			return fmt.Errorf("failed to get generating items: %w", err)
+		}
+		generating = len(generatingItems)
+		claimed := make(map[string]bool, len(generatingItems))
+		for _, item := range generatingItems {
+			claimed[item.ID] = true
+		}
+		for id := range pool.InFlight() {
+			if !claimed[id] {
+				generating++
+			}
+		}
+	}
 
-			item.Status = queue.StatusError
-			item.ErrorMessage = err.Error()
-			if updateErr := redisQueue.UpdateItem(ctx, item); updateErr != nil {
-				log.Printf("Failed to update item %s status to error: %v", item.ID, updateErr)
+	for i, item := range pendingItems {
+		if maxConcurrentGenerating > 0 && generating >= maxConcurrentGenerating {
+			log.Printf("%d items are generating (MAX_CONCURRENT_GENERATING), leaving %d items pending", generating, len(pendingItems)-i)
+			break
+		}
+		if maxEnvironmentsPerUser > 0 {
+			if activeCounts[item.Owner] >= maxEnvironmentsPerUser {
+				log.Printf("Owner %s is at quota (%d), leaving item %s pending", item.Owner, maxEnvironmentsPerUser, item.ID)
+				continue
 			}
 		}
+		// The worker overwrites item with the claimed copy, so read nothing from it once started
+		owner := item.Owner
+		started := pool.TryRun(item, func() {
+			runItem(ctx, redisQueue, k8sClient, item, namespace)
+		})
+		if started {
+			activeCounts[owner]++
+			generating++
+		}
 	}
 
 	return nil
 }
 
-func processItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, item *queue.QueueItem, namespace string) error {
-	item.Status = queue.StatusGenerating
-	if err := redisQueue.UpdateItem(ctx, item); err != nil {
-		return fmt.Errorf("failed to update item status to generating: %w", err)
+// processRestartingItems sets restarted environments back to available once their new pod is running,
+// and marks them as errored when it does not come up within POD_READY_TIMEOUT
+func processRestartingItems(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, namespace string) error {
+	restartingItems, err := redisQueue.GetItemsByStatus(ctx, queue.StatusRestarting)
+	if err != nil {
+		return fmt.Errorf("failed to get restarting items: %w", err)
 	}
 
-	workloadName := fmt.Sprintf("k8s-playground-%s", item.ID[:8])
+	for _, item := range restartingItems {
+		requestedAt := item.StatusUpdatedAt
+		if item.RestartRequestedAt != nil {
+			requestedAt = *item.RestartRequestedAt
+		}
+		itemNamespace := item.NamespaceOr(namespace)
 
-	imageTag, ok := dindImageVersions[item.K8sVersion]
+		podName, err := k8sClient.RestartedPodReady(ctx, item.PodID, item.WorkloadType, itemNamespace, requestedAt)
+		if err != nil {
+			log.Printf("Failed to check restarted pod of item %s: %v", item.ID, err)
+			continue
+		}
+		if podName != "" {
+			ready, reason, err := k8sClient.IsEnvironmentReady(ctx, podName, itemNamespace)
+			if err != nil {
+				log.Printf("Failed to check readiness of restarted pod %s of item %s: %v", podName, item.ID, err)
+				podName = ""
+			} else if !ready {
+				log.Printf("Restarted pod %s of item %s is running but the environment is not ready yet: %s", podName, item.ID, reason)
+				podName = ""
+			}
+		}
+		if podName != "" {
+			err := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+				i.Status = queue.StatusAvailable
+				i.RestartRequestedAt = nil
+			})
+			if err != nil {
+				log.Printf("Failed to update restarted item %s to available: %v", item.ID, err)
+				continue
+			}
+			log.Printf("Environment in pod %s is ready, restarted item %s is available again", podName, item.ID)
+			continue
+		}
+
+		if time.Since(requestedAt) < podReadyTimeout {
+			continue
+		}
+		diagnosis := "no pod was created"
+		if item.WorkloadType != "deployment" {
+			diagCtx, diagCancel := context.WithTimeout(context.Background(), 15*time.Second)
+			diagnosis = k8sClient.DiagnosePodNotReady(diagCtx, item.PodID+"-0", itemNamespace)
+			diagCancel()
+		}
+		message := fmt.Sprintf("timeout waiting for restarted pod of workload %s: %s", item.PodID, diagnosis)
+		err = redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+			i.Status = queue.StatusError
+			i.ErrorMessage = message
+			i.RestartRequestedAt = nil
+		})
+		if err != nil {
+			log.Printf("Failed to update item %s status to error: %v", item.ID, err)
+			continue
+		}
+		log.Printf("Restart of item %s did not complete within %v", item.ID, podReadyTimeout)
+	}
+	return nil
+}
+
+// runItem claims a pending item and processes it in a worker, recording failures (including
+// panics) on the item. Items that another worker or replica claimed first are skipped.
+func runItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, item *queue.QueueItem, namespace string) {
+	claimed, ok, err := redisQueue.ClaimPendingItem(ctx, item.ID)
+	if err != nil {
+		log.Printf("Failed to claim item %s: %v", item.ID, err)
+		return
+	}
 	if !ok {
-		err := fmt.Errorf("unsupported k8s version for DinD image: %s. Check DIND_IMAGE_VERSIONS_JSON configuration. Available versions: %v", item.K8sVersion, getMapKeys(dindImageVersions))
-		log.Println(err.Error())
-		item.Status = queue.StatusError
-		item.ErrorMessage = err.Error()
-		if updateErr := redisQueue.UpdateItem(ctx, item); updateErr != nil {
-			log.Printf("Failed to update item status to error after unsupported K8s version: %v", updateErr)
+		log.Printf("Item %s is no longer pending, skipping it", item.ID)
+		return
+	}
+	*item = *claimed
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic while processing item %s: %v\n%s", item.ID, r, debug.Stack())
+			err = fmt.Errorf("internal error while generating environment: %v", r)
+		}
+		if errors.Is(err, queue.ErrConflict) || errors.Is(err, queue.ErrItemNotFound) {
+			log.Printf("Item %s was changed while it was being generated, giving it up: %v", item.ID, err)
+			abandonWorkload(k8sClient, item, namespace)
+			return
+		}
+		if err != nil {
+			log.Printf("Error processing item %s: %v", item.ID, err)
+
+			message := err.Error()
+			// Use a fresh context so the failure is still recorded during shutdown
+			updateCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			updateErr := redisQueue.TransitionItem(updateCtx, item, func(i *queue.QueueItem) {
+				i.Status = queue.StatusError
+				i.ErrorMessage = message
+				i.PodID = item.PodID
+				i.Resources = item.Resources
+			})
+			if updateErr != nil {
+				log.Printf("Failed to update item %s status to error: %v", item.ID, updateErr)
+				if errors.Is(updateErr, queue.ErrConflict) || errors.Is(updateErr, queue.ErrItemNotFound) {
+					abandonWorkload(k8sClient, item, namespace)
+					return
+				}
+			}
+
+			if diagnosticsRetention > 0 {
+				failed := *item
+				go captureDiagnostics(redisQueue, k8sClient, &failed, namespace, err.Error())
+			}
 		}
-		return err
+	}()
+	err = processItem(ctx, redisQueue, k8sClient, item, namespace)
+}
+
+func processItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, item *queue.QueueItem, namespace string) error {
+	// The NFS server lives in the controllers' namespace; the workload goes to the item's namespace
+	nfsNamespace := namespace
+	namespace = item.NamespaceOr(namespace)
+	// The item was claimed, i.e. moved to generating, just before
+	generationStartedAt := item.StatusUpdatedAt
+
+	workloadName := item.WorkloadName()
+
+	dindImage, ok := dindImageVersions[item.K8sVersion]
+	if !ok {
+		// Recorded on the item by runItem
+		return fmt.Errorf("unsupported k8s version for DinD image: %s. Check DIND_IMAGE_VERSIONS_JSON configuration. Available versions: %v", item.K8sVersion, getMapKeys(dindImageVersions))
 	}
-	dindImageName := fmt.Sprintf("%s:%s", dindImageBaseRepository, imageTag)
+	dindImageName := dindImage.Reference(dindImageBaseRepository)
 	log.Printf("Using DinD image: %s for K8s version %s (Item ID: %s)", dindImageName, item.K8sVersion, item.ID)
 
 	workloadType := item.WorkloadType
@@ -125,27 +510,49 @@ func processItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k
 	log.Printf("Creating workload '%s' of type '%s' for item %s", workloadName, workloadType, item.ID)
 
 	var podName string
-	var err error
 
-	// Get the NFS Service ClusterIP to bypass node DNS issues
-	nfsServerIP, err := k8sClient.GetServiceClusterIP(ctx, "k8s-playground-nfs-server", namespace)
+	// Size the DinD container for the inner cluster. Every environment runs the kind cluster baked into the image.
+	resources, err := resourceSizing.Compute(dindNodeCount)
 	if err != nil {
-		return fmt.Errorf("failed to get nfs server service IP: %w", err)
+		return fmt.Errorf("failed to compute resources: %w", err)
+	}
+	allocation := queue.ResourceAllocation(resources)
+	item.Resources = &allocation
+
+	var entrypoint k8s.EntrypointPreset
+	if item.EntrypointPreset != "" {
+		preset, ok := entrypointPresets[item.EntrypointPreset]
+		if !ok {
+			return fmt.Errorf("unknown entrypoint preset %q", item.EntrypointPreset)
+		}
+		entrypoint = preset
+		log.Printf("Using entrypoint preset '%s' for item %s", item.EntrypointPreset, item.ID)
 	}
-	log.Printf("Found NFS Server ClusterIP: %s", nfsServerIP)
 
-	// Create a per-user subdirectory on the NFS server
-	nfsSubPath, err := k8sClient.EnsureNFSDirectory(ctx, namespace, item.Owner)
-	if err != nil {
-		return fmt.Errorf("failed to ensure nfs directory for owner %s: %w", item.Owner, err)
+	// Without NFS the share is an emptyDir that only lives as long as the pod
+	var nfsServerIP, nfsSubPath string
+	if nfsEnabled {
+		// Get the NFS Service ClusterIP to bypass node DNS issues
+		nfsServerIP, err = k8sClient.GetServiceClusterIP(ctx, "k8s-playground-nfs-server", nfsNamespace)
+		if err != nil {
+			return fmt.Errorf("failed to get nfs server service IP: %w", err)
+		}
+		log.Printf("Found NFS Server ClusterIP: %s", nfsServerIP)
+
+		// Create a per-user subdirectory on the NFS server
+		nfsSubPath, err = k8sClient.EnsureNFSDirectory(ctx, nfsNamespace, item.Owner)
+		if err != nil {
+			return fmt.Errorf("failed to ensure nfs directory for owner %s: %w", item.Owner, err)
+		}
+		log.Printf("Using NFS subpath '%s' for item %s", nfsSubPath, item.ID)
 	}
-	log.Printf("Using NFS subpath '%s' for item %s", nfsSubPath, item.ID)
 
 	if workloadType == "deployment" {
-		_, err = k8sClient.CreateDinDDeployment(ctx, workloadName, namespace, dindImageName, nfsServerIP, nfsSubPath)
+		_, err = k8sClient.CreateDinDDeployment(ctx, workloadName, namespace, dindImageName, nfsServerIP, nfsSubPath, item.CostAllocation, resources, entrypoint)
 	} else {
 		pvcSize := getEnv("DIND_PVC_SIZE", "10Gi")
-		podName, err = k8sClient.CreateDinDStatefulSet(ctx, workloadName, namespace, dindImageName, pvcSize, nfsServerIP, nfsSubPath)
+		storageClass := getEnv("DIND_STORAGE_CLASS", "")
+		podName, err = k8sClient.CreateDinDStatefulSet(ctx, workloadName, namespace, dindImageName, pvcSize, storageClass, nfsServerIP, nfsSubPath, item.CostAllocation, resources, entrypoint)
 	}
 
 	if err != nil {
@@ -155,17 +562,36 @@ func processItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k
 
 	log.Printf("Created workload %s for item %s", workloadName, item.ID)
 
-	timeout := time.After(5 * time.Minute)
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	timeout := time.After(podReadyTimeout)
+	// Why a running pod is not usable yet, reported if it never becomes ready
+	notReadyReason := ""
+	pollInterval := podReadyInitialInterval
+	pollTimer := time.NewTimer(pollInterval)
+	defer pollTimer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-timeout:
-			return fmt.Errorf("timeout waiting for pod to be running for workload %s", workloadName)
-		case <-ticker.C:
+			if podName == "" {
+				return fmt.Errorf("timeout waiting for pod to be running for workload %s: no pod was created", workloadName)
+			}
+			// Include the pod's state and recent warning events so the user can see why it never became ready
+			diagCtx, diagCancel := context.WithTimeout(context.Background(), 15*time.Second)
+			diagnosis := k8sClient.DiagnosePodNotReady(diagCtx, podName, namespace)
+			diagCancel()
+			if notReadyReason != "" {
+				return fmt.Errorf("timeout waiting for environment to be ready for workload %s: %s", workloadName, notReadyReason)
+			}
+			return fmt.Errorf("timeout waiting for pod to be running for workload %s: %s", workloadName, diagnosis)
+		case <-pollTimer.C:
+			pollInterval *= 2
+			if pollInterval > podReadyMaxInterval {
+				pollInterval = podReadyMaxInterval
+			}
+			pollTimer.Reset(pollInterval)
+
 			// Resolve pod name if it's not yet known (for deployments)
 			if podName == "" && workloadType == "deployment" {
 				resolvedPodName, resolveErr := k8sClient.GetPodNameForWorkload(ctx, workloadName, namespace)
@@ -187,11 +613,40 @@ func processItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k
 			}
 
 			if running {
-				item.Status = queue.StatusAvailable
-				if err := redisQueue.UpdateItem(ctx, item); err != nil {
+				// The pod is up; only hand it out once docker and the inner cluster answer too
+				ready, reason, err := k8sClient.IsEnvironmentReady(ctx, podName, namespace)
+				if err != nil {
+					log.Printf("Failed to check readiness of environment in pod %s: %v. Waiting...", podName, err)
+					notReadyReason = "readiness check failed"
+					continue
+				}
+				if !ready {
+					log.Printf("Pod %s is running but the environment is not ready yet: %s. Waiting...", podName, reason)
+					notReadyReason = reason
+					continue
+				}
+				if item.FromSnapshot != "" {
+					if err := k8sClient.RestoreSnapshot(ctx, podName, namespace, item.FromSnapshot); err != nil {
+						return fmt.Errorf("failed to restore snapshot %s: %w", item.FromSnapshot, err)
+					}
+					log.Printf("Restored snapshot %s into pod %s for item %s", item.FromSnapshot, podName, item.ID)
+				}
+				if item.Template != "" {
+					applyTemplate(ctx, k8sClient, item, podName, namespace)
+				}
+				err = redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+					i.Status = queue.StatusAvailable
+					i.PodID = item.PodID
+					i.Resources = item.Resources
+					i.ErrorMessage = item.ErrorMessage
+				})
+				if err != nil {
 					return fmt.Errorf("failed to update item status to available: %w", err)
 				}
-				log.Printf("Pod %s is running, item %s is now available", podName, item.ID)
+				log.Printf("Environment in pod %s is ready, item %s is now available", podName, item.ID)
+				if err := redisQueue.RecordGenerationDuration(ctx, time.Since(generationStartedAt)); err != nil {
+					log.Printf("Warning: %v", err)
+				}
 				return nil
 			}
 			currentPod, getErr := k8sClient.GetPod(ctx, podName, namespace)
@@ -204,6 +659,57 @@ func processItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k
 	}
 }
 
+// abandonWorkload deletes the workload created for an item that was changed elsewhere while it
+// was being generated, e.g. destroyed by its owner. The stored item does not reference the
+// workload, so nothing else would delete it.
+func abandonWorkload(k8sClient *k8s.Client, item *queue.QueueItem, namespace string) {
+	if item.PodID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	namespace = item.NamespaceOr(namespace)
+
+	var err error
+	if item.WorkloadType == "deployment" {
+		err = k8sClient.DeleteDinDDeployment(ctx, item.PodID, namespace)
+	} else {
+		err = k8sClient.DeleteDinDStatefulSet(ctx, item.PodID, namespace)
+	}
+	if err != nil {
+		log.Printf("Failed to delete workload %s of abandoned item %s: %v", item.PodID, item.ID, err)
+		return
+	}
+	log.Printf("Deleted workload %s of abandoned item %s", item.PodID, item.ID)
+}
+
+// applyTemplate applies the item's template to its inner cluster. A failure is reported in the
+// item's ErrorMessage but does not fail the environment, which is usable without the manifests.
+func applyTemplate(ctx context.Context, k8sClient *k8s.Client, item *queue.QueueItem, podName, namespace string) {
+	template, ok := environmentTemplates[item.Template]
+	if !ok {
+		item.ErrorMessage = fmt.Sprintf("Template %q is not configured; the environment was created without it", item.Template)
+		log.Printf("Unknown template %q for item %s", item.Template, item.ID)
+		return
+	}
+	if err := k8sClient.ApplyTemplate(ctx, podName, namespace, template); err != nil {
+		item.ErrorMessage = fmt.Sprintf("Template %q was not fully applied: %v", item.Template, err)
+		log.Printf("Failed to apply template %s for item %s: %v", item.Template, item.ID, err)
+		return
+	}
+	log.Printf("Applied template %s into pod %s for item %s", item.Template, podName, item.ID)
+}
+
+// nextInterval returns interval lengthened or shortened by a random amount of up to jitter
+// (a fraction of interval), so controllers and replicas started together drift apart instead of
+// hitting Redis and the API server in lockstep
+func nextInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*jitter*float64(interval))
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -211,7 +717,107 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func getMapKeys(m map[string]string) []string {
+// captureDiagnostics stores a post-mortem bundle for an environment that failed to provision.
+// It is best-effort: whatever cannot be collected is noted in the bundle, and failures are only logged.
+func captureDiagnostics(redisQueue *queue.RedisQueue, k8sClient *k8s.Client, item *queue.QueueItem, namespace, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsCaptureTimeout)
+	defer cancel()
+
+	bundle := &queue.DiagnosticsBundle{
+		EnvironmentID: item.ID,
+		Owner:         item.Owner,
+		K8sVersion:    item.K8sVersion,
+		Namespace:     item.NamespaceOr(namespace),
+		WorkloadName:  item.PodID,
+		Reason:        reason,
+		CapturedAt:    time.Now(),
+	}
+	if img, ok := dindImageVersions[item.K8sVersion]; ok {
+		bundle.Image = img.Reference(dindImageBaseRepository)
+	}
+
+	if item.PodID != "" {
+		podName := item.PodID + "-0"
+		if item.WorkloadType == "deployment" {
+			resolved, err := k8sClient.GetPodNameForWorkload(ctx, item.PodID, bundle.Namespace)
+			if err != nil {
+				bundle.CaptureErrors = append(bundle.CaptureErrors, fmt.Sprintf("pod: %v", err))
+				podName = ""
+			} else {
+				podName = resolved
+			}
+		}
+		if podName != "" {
+			collectPodDiagnostics(ctx, k8sClient, bundle, podName)
+		}
+	}
+
+	if err := redisQueue.SaveDiagnostics(ctx, bundle, diagnosticsRetention); err != nil {
+		log.Printf("Failed to save diagnostics for item %s: %v", item.ID, err)
+		return
+	}
+	log.Printf("Captured provisioning diagnostics for item %s", item.ID)
+}
+
+// collectPodDiagnostics adds the pod's phase, events and container logs to the bundle
+func collectPodDiagnostics(ctx context.Context, k8sClient *k8s.Client, bundle *queue.DiagnosticsBundle, podName string) {
+	bundle.PodName = podName
+
+	pod, err := k8sClient.GetPod(ctx, podName, bundle.Namespace)
+	if err != nil {
+		bundle.CaptureErrors = append(bundle.CaptureErrors, fmt.Sprintf("pod: %v", err))
+	} else {
+		bundle.PodPhase = string(pod.Status.Phase)
+		for _, cs := range append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+			if cs.State.Waiting != nil && cs.LastTerminationState.Terminated == nil {
+				continue // Never started, so there are no logs
+			}
+			logs, err := k8sClient.GetContainerLogs(ctx, podName, bundle.Namespace, cs.Name, diagnosticsLogTailLines, diagnosticsLogLimitBytes)
+			if err != nil {
+				bundle.CaptureErrors = append(bundle.CaptureErrors, fmt.Sprintf("logs %s: %v", cs.Name, err))
+				continue
+			}
+			if bundle.ContainerLogs == nil {
+				bundle.ContainerLogs = make(map[string]string)
+			}
+			bundle.ContainerLogs[cs.Name] = logs
+		}
+	}
+
+	events, err := k8sClient.GetPodEvents(ctx, podName, bundle.Namespace)
+	if err != nil {
+		bundle.CaptureErrors = append(bundle.CaptureErrors, fmt.Sprintf("events: %v", err))
+		return
+	}
+	for _, ev := range events {
+		lastSeen := ev.LastTimestamp.Time
+		if lastSeen.IsZero() {
+			lastSeen = ev.EventTime.Time
+		}
+		bundle.Events = append(bundle.Events, queue.DiagnosticEvent{
+			Type:     ev.Type,
+			Reason:   ev.Reason,
+			Message:  ev.Message,
+			Count:    ev.Count,
+			LastSeen: lastSeen,
+		})
+	}
+}
+
+// getDurationEnv parses a Go duration (e.g. "30s") from the environment, exiting on invalid values
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s: %s", key, raw)
+	}
+	return d
+}
+
+func getMapKeys[V any](m map[string]V) []string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
 		keys = append(keys, k)
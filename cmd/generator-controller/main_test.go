@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+func TestWorkerPoolTryRun(t *testing.T) {
+	const size = 2
+	pool := newWorkerPool(size)
+	release := make(chan struct{})
+	var started, finished atomic.Int32
+	blockingWork := func() {
+		started.Add(1)
+		<-release
+		finished.Add(1)
+	}
+
+	items := make([]*queue.QueueItem, size+1)
+	for i := range items {
+		items[i] = &queue.QueueItem{ID: fmt.Sprintf("item-%d", i), Owner: fmt.Sprintf("owner-%d", i%2)}
+	}
+	for _, item := range items[:size] {
+		if !pool.TryRun(item, blockingWork) {
+			t.Fatalf("TryRun(%s) = false with a free worker", item.ID)
+		}
+	}
+
+	// Saturated: neither a new item nor one already in flight is started
+	if pool.TryRun(items[size], blockingWork) {
+		t.Errorf("TryRun(%s) = true with all %d workers busy", items[size].ID, size)
+	}
+	if pool.TryRun(items[0], blockingWork) {
+		t.Errorf("TryRun(%s) = true while it is in flight", items[0].ID)
+	}
+	want := map[string]string{"item-0": "owner-0", "item-1": "owner-1"}
+	if got := pool.InFlight(); !maps.Equal(got, want) {
+		t.Errorf("InFlight() = %v, want %v", got, want)
+	}
+
+	// InFlight returns a copy
+	pool.InFlight()["item-9"] = "owner-9"
+	if got := pool.InFlight(); !maps.Equal(got, want) {
+		t.Errorf("InFlight() = %v after modifying a snapshot, want %v", got, want)
+	}
+
+	close(release)
+	pool.Wait()
+	if n := finished.Load(); n != size {
+		t.Errorf("Wait returned after %d of %d workers finished", n, size)
+	}
+	if n := started.Load(); n != size {
+		t.Errorf("%d workers started, want %d", n, size)
+	}
+	if got := pool.InFlight(); len(got) != 0 {
+		t.Errorf("InFlight() = %v after Wait, want none", got)
+	}
+
+	// Finished items free their worker and can run again
+	for _, item := range []*queue.QueueItem{items[0], items[size]} {
+		if !pool.TryRun(item, func() {}) {
+			t.Errorf("TryRun(%s) = false after the workers finished", item.ID)
+		}
+	}
+	pool.Wait()
+}
+
+func TestWorkerPoolWaitBlocksUntilWorkersFinish(t *testing.T) {
+	pool := newWorkerPool(1)
+	release := make(chan struct{})
+	pool.TryRun(&queue.QueueItem{ID: "item"}, func() { <-release })
+
+	waited := make(chan struct{})
+	go func() {
+		pool.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while a worker was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after the worker finished")
+	}
+}
+
+func TestProcessPendingItemsServesOldestFirst(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisQueue, err := queue.NewRedisQueue("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	defer redisQueue.Close()
+	previous := maxConcurrentGenerating
+	maxConcurrentGenerating = 2
+	t.Cleanup(func() { maxConcurrentGenerating = previous })
+
+	ctx := context.Background()
+	created := time.Now().Add(-time.Hour)
+	// Stored out of order; "b" and "c" were created at the same time
+	for _, item := range []*queue.QueueItem{
+		{ID: "d", CreatedAt: created.Add(3 * time.Minute)},
+		{ID: "c", CreatedAt: created.Add(time.Minute)},
+		{ID: "e", CreatedAt: created.Add(4 * time.Minute)},
+		{ID: "a", CreatedAt: created},
+		{ID: "b", CreatedAt: created.Add(time.Minute)},
+	} {
+		item.Status = queue.StatusPending
+		item.Owner = "owner-" + item.ID
+		if err := redisQueue.AddItem(ctx, item); err != nil {
+			t.Fatalf("AddItem: %v", err)
+		}
+	}
+
+	// Only two items may generate at once, so each pass starts the next two in line
+	pool := newWorkerPool(5)
+	k8sClient := k8s.NewClientForClientset(fake.NewSimpleClientset())
+	for _, want := range [][]string{{"a", "b"}, {"c", "d"}, {"e"}} {
+		before := pendingIDs(t, redisQueue)
+		if err := processPendingItems(ctx, redisQueue, k8sClient, pool, "default"); err != nil {
+			t.Fatalf("processPendingItems: %v", err)
+		}
+		pool.Wait()
+		var started []string
+		after := pendingIDs(t, redisQueue)
+		for _, id := range before {
+			if !slices.Contains(after, id) {
+				started = append(started, id)
+			}
+		}
+		if !slices.Equal(started, want) {
+			t.Errorf("started %v, want %v", started, want)
+		}
+	}
+}
+
+func pendingIDs(t *testing.T, redisQueue *queue.RedisQueue) []string {
+	t.Helper()
+	items, err := redisQueue.GetItemsByStatus(context.Background(), queue.StatusPending)
+	if err != nil {
+		t.Fatalf("GetItemsByStatus: %v", err)
+	}
+	var ids []string
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
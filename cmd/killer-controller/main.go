@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,12 +27,51 @@ func main() {
 	}
 	defer redisQueue.Close()
 
+	// Number of workloads deleted in parallel; foreground deletions can wait on finalizers for a while
+	concurrency, err := strconv.Atoi(getEnv("KILLER_CONCURRENCY", "4"))
+	if err != nil || concurrency < 1 {
+		log.Fatalf("Invalid KILLER_CONCURRENCY: %s", getEnv("KILLER_CONCURRENCY", "4"))
+	}
+
+	// In dry-run mode shutdown items are only logged and marked, no workload is deleted
+	dryRun, err := strconv.ParseBool(getEnv("DRY_RUN", "false"))
+	if err != nil {
+		log.Fatalf("Invalid DRY_RUN: %s", getEnv("DRY_RUN", "false"))
+	}
+
+	// With leader election several replicas can run; only the holder of the lease does any work
+	leaderElection, err := strconv.ParseBool(getEnv("LEADER_ELECTION", "false"))
+	if err != nil {
+		log.Fatalf("Invalid LEADER_ELECTION: %s", getEnv("LEADER_ELECTION", "false"))
+	}
+	leaderElectionConfig := k8s.LeaderElectionConfig{
+		LeaseName:      getEnv("LEADER_ELECTION_LEASE_NAME", "killer-controller"),
+		LeaseNamespace: getEnv("LEADER_ELECTION_NAMESPACE", ""),
+	}
+
+	if err := k8s.ValidateInstanceID(getEnv("INSTANCE_ID", "")); err != nil {
+		log.Fatalf("Invalid INSTANCE_ID: %v", err)
+	}
 	k8sClient, err := k8s.NewClient()
 	if err != nil {
 		log.Fatalf("Failed to initialize Kubernetes client: %v", err)
 	}
+	k8sClient.SetInstanceID(getEnv("INSTANCE_ID", ""))
+
+	interval, err := time.ParseDuration(getEnv("KILLER_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid KILLER_INTERVAL: %s", getEnv("KILLER_INTERVAL", "10s"))
+	}
+	// Fraction of the interval by which each wait is randomly lengthened or shortened
+	jitter, err := strconv.ParseFloat(getEnv("INTERVAL_JITTER", "0.1"), 64)
+	if err != nil || jitter < 0 || jitter >= 1 {
+		log.Fatalf("Invalid INTERVAL_JITTER: %s (must be at least 0 and less than 1)", getEnv("INTERVAL_JITTER", "0.1"))
+	}
 
-	log.Println("Starting killer controller...")
+	if dryRun {
+		log.Printf("DRY_RUN is enabled: shutdown items are marked %s and their workloads are left running", queue.StatusDryRunTerminated)
+	}
+	log.Printf("Starting killer controller with %d workers...", concurrency)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -42,54 +85,108 @@ func main() {
 		cancel()
 	}()
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Killer controller shutting down...")
-			return
-		case <-ticker.C:
-			if err := processShutdownItems(ctx, redisQueue, k8sClient, namespace); err != nil {
-				log.Printf("Error processing shutdown items: %v", err)
+	run := func(ctx context.Context) {
+		timer := time.NewTimer(nextInterval(interval, jitter))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Killer controller stopping...")
+				return
+			case <-timer.C:
+				if err := processShutdownItems(ctx, redisQueue, k8sClient, namespace, concurrency, dryRun); err != nil {
+					log.Printf("Error processing shutdown items: %v", err)
+				}
+				timer.Reset(nextInterval(interval, jitter))
 			}
 		}
 	}
+
+	if !leaderElection {
+		run(ctx)
+		return
+	}
+	if err := k8sClient.RunLeaderElected(ctx, leaderElectionConfig, run); err != nil {
+		log.Fatalf("Killer controller stopped: %v", err)
+	}
 }
 
-func processShutdownItems(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, namespace string) error {
+// Quarantined shutdown items skipped on the previous pass, so each is logged once rather than on
+// every tick. Only the run loop calls processShutdownItems, one pass at a time.
+var skippedQuarantined = map[string]bool{}
+
+// processShutdownItems reclaims the shutdown items with up to concurrency deletions in flight.
+// It returns once all of them have been handled, so the next tick never sees an item that is
+// still being processed.
+func processShutdownItems(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, namespace string, concurrency int, dryRun bool) error {
 	shutdownItems, err := redisQueue.GetItemsByStatus(ctx, queue.StatusShutdown)
 	if err != nil {
 		return fmt.Errorf("failed to get shutdown items: %w", err)
 	}
 
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	quarantined := make(map[string]bool)
 	for _, item := range shutdownItems {
-		if err := processShutdownItem(ctx, redisQueue, k8sClient, item, namespace); err != nil {
-			log.Printf("Error processing shutdown item %s: %v", item.ID, err)
-
-			item.Status = queue.StatusError
-			item.ErrorMessage = err.Error()
-			if updateErr := redisQueue.UpdateItem(ctx, item); updateErr != nil {
-				log.Printf("Failed to update item status to error: %v", updateErr)
+		if item.IsQuarantined() {
+			// Workload is being kept for post-mortem; it will be deleted once the quarantine ends
+			quarantined[item.ID] = true
+			if !skippedQuarantined[item.ID] {
+				log.Printf("Skipping shutdown item %s: workload %s is quarantined until %v", item.ID, item.PodID, item.QuarantineUntil)
 			}
+			continue
 		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			process := processShutdownItem
+			if dryRun {
+				process = dryRunShutdownItem
+			}
+			err := process(ctx, redisQueue, k8sClient, item, namespace)
+			if errors.Is(err, queue.ErrConflict) || errors.Is(err, queue.ErrItemNotFound) {
+				log.Printf("Shutdown item %s was changed since it was read, skipping it: %v", item.ID, err)
+				return
+			}
+			if err != nil {
+				log.Printf("Error processing shutdown item %s: %v", item.ID, err)
+
+				message := err.Error()
+				updateErr := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+					i.Status = queue.StatusError
+					i.ErrorMessage = message
+				})
+				if updateErr != nil {
+					log.Printf("Failed to update item %s status to error: %v", item.ID, updateErr)
+				}
+			}
+		}()
 	}
+	wg.Wait()
+	skippedQuarantined = quarantined
 
 	return nil
 }
 
 func processShutdownItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, item *queue.QueueItem, namespace string) error {
-	// Mark as Terminated first, so we don't re-process it if deletion fails
-	item.Status = queue.StatusTerminated
-	if err := redisQueue.UpdateItem(ctx, item); err != nil {
+	// Mark as Terminated first, so we don't re-process it if deletion fails. Only an item still in
+	// shutdown is terminated, so a concurrent change is never overwritten.
+	err := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+		i.Status = queue.StatusTerminated
+	})
+	if err != nil {
 		return fmt.Errorf("failed to update item status to terminating: %w", err)
 	}
 
+	namespace = item.NamespaceOr(namespace)
 	if item.PodID != "" { // PodID now holds the StatefulSet or Deployment name
 		log.Printf("Deleting workload %s (type: %s) for item %s", item.PodID, item.WorkloadType, item.ID)
 
-		var err error
 		if item.WorkloadType == "deployment" {
 			err = k8sClient.DeleteDinDDeployment(ctx, item.PodID, namespace)
 		} else {
@@ -107,6 +204,39 @@ func processShutdownItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sC
 	return nil
 }
 
+// dryRunShutdownItem logs what processShutdownItem would delete and marks the item
+// StatusDryRunTerminated instead, leaving the workload in place
+func dryRunShutdownItem(ctx context.Context, redisQueue *queue.RedisQueue, k8sClient *k8s.Client, item *queue.QueueItem, namespace string) error {
+	namespace = item.NamespaceOr(namespace)
+	if item.PodID != "" {
+		workloadType := item.WorkloadType
+		if workloadType == "" {
+			workloadType = "statefulset"
+		}
+		log.Printf("[DRY RUN] Would delete %s %s/%s for item %s", workloadType, namespace, item.PodID, item.ID)
+	} else {
+		log.Printf("[DRY RUN] Item %s has no workload to delete", item.ID)
+	}
+
+	err := redisQueue.TransitionItem(ctx, item, func(i *queue.QueueItem) {
+		i.Status = queue.StatusDryRunTerminated
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update item status to %s: %w", queue.StatusDryRunTerminated, err)
+	}
+	return nil
+}
+
+// nextInterval returns interval lengthened or shortened by a random amount of up to jitter
+// (a fraction of interval), so controllers and replicas started together drift apart instead of
+// hitting Redis and the API server in lockstep
+func nextInterval(interval time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*jitter*float64(interval))
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+// deleteTracker records the StatefulSet deletes in flight. The fake clientset runs reactors under
+// a lock, so deletes are observed by wrapping the typed client instead.
+type deleteTracker struct {
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+	deletes     map[string]int
+}
+
+type trackedClientset struct {
+	*fake.Clientset
+	tracker *deleteTracker
+}
+
+func (c *trackedClientset) AppsV1() appsv1client.AppsV1Interface {
+	return &trackedAppsV1{AppsV1Interface: c.Clientset.AppsV1(), tracker: c.tracker}
+}
+
+type trackedAppsV1 struct {
+	appsv1client.AppsV1Interface
+	tracker *deleteTracker
+}
+
+func (a *trackedAppsV1) StatefulSets(namespace string) appsv1client.StatefulSetInterface {
+	return &trackedStatefulSets{StatefulSetInterface: a.AppsV1Interface.StatefulSets(namespace), tracker: a.tracker}
+}
+
+type trackedStatefulSets struct {
+	appsv1client.StatefulSetInterface
+	tracker *deleteTracker
+}
+
+func (s *trackedStatefulSets) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	t := s.tracker
+	t.mutex.Lock()
+	t.inFlight++
+	t.maxInFlight = max(t.maxInFlight, t.inFlight)
+	t.deletes[name]++
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		t.inFlight--
+		t.mutex.Unlock()
+	}()
+
+	// Long enough for the other workers to start theirs
+	time.Sleep(50 * time.Millisecond)
+	return s.StatefulSetInterface.Delete(ctx, name, opts)
+}
+
+func TestProcessShutdownItemsBoundsConcurrency(t *testing.T) {
+	const itemCount, concurrency, namespace = 12, 3, "playground"
+	mr := miniredis.RunT(t)
+	redisQueue, err := queue.NewRedisQueue("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	defer redisQueue.Close()
+
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	for i := range itemCount {
+		item := &queue.QueueItem{
+			ID:        fmt.Sprintf("item-%02d", i),
+			Status:    queue.StatusShutdown,
+			PodID:     fmt.Sprintf("k8s-playground-%02d", i),
+			Namespace: namespace,
+		}
+		if err := redisQueue.AddItem(ctx, item); err != nil {
+			t.Fatalf("AddItem: %v", err)
+		}
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: item.PodID, Namespace: namespace}}
+		if _, err := clientset.AppsV1().StatefulSets(namespace).Create(ctx, sts, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("create statefulset: %v", err)
+		}
+	}
+	quarantineUntil := time.Now().Add(time.Hour)
+	quarantined := &queue.QueueItem{ID: "quarantined", Status: queue.StatusShutdown, PodID: "k8s-playground-qq", QuarantineUntil: &quarantineUntil}
+	if err := redisQueue.AddItem(ctx, quarantined); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+
+	tracker := &deleteTracker{deletes: make(map[string]int)}
+	k8sClient := k8s.NewClientForClientset(&trackedClientset{Clientset: clientset, tracker: tracker})
+	if err := processShutdownItems(ctx, redisQueue, k8sClient, "default", concurrency, false); err != nil {
+		t.Fatalf("processShutdownItems: %v", err)
+	}
+
+	if tracker.maxInFlight != concurrency {
+		t.Errorf("at most %d deletes were in flight, want %d", tracker.maxInFlight, concurrency)
+	}
+	if len(tracker.deletes) != itemCount {
+		t.Errorf("%d workloads were deleted, want %d", len(tracker.deletes), itemCount)
+	}
+	for name, count := range tracker.deletes {
+		if count != 1 {
+			t.Errorf("%s was deleted %d times, want once", name, count)
+		}
+	}
+
+	items, err := redisQueue.GetAllItems(ctx)
+	if err != nil {
+		t.Fatalf("GetAllItems: %v", err)
+	}
+	for _, item := range items {
+		want := queue.StatusTerminated
+		if item.ID == quarantined.ID {
+			want = queue.StatusShutdown
+		}
+		if item.Status != want {
+			t.Errorf("item %s is %s, want %s", item.ID, item.Status, want)
+		}
+	}
+	if remaining, _ := clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{}); len(remaining.Items) != 0 {
+		t.Errorf("%d statefulsets are left", len(remaining.Items))
+	}
+}
+
+func TestProcessShutdownItemsLogsQuarantinedItemOnce(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisQueue, err := queue.NewRedisQueue("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	defer redisQueue.Close()
+	ctx := context.Background()
+	quarantineUntil := time.Now().Add(time.Hour)
+	item := &queue.QueueItem{ID: "quarantined", Status: queue.StatusShutdown, PodID: "k8s-playground-qq", QuarantineUntil: &quarantineUntil}
+	if err := redisQueue.AddItem(ctx, item); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+
+	// Forget items skipped by earlier tests
+	skippedQuarantined = map[string]bool{}
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	k8sClient := k8s.NewClientForClientset(fake.NewSimpleClientset())
+	skipped := func() int {
+		if err := processShutdownItems(ctx, redisQueue, k8sClient, "default", 1, false); err != nil {
+			t.Fatalf("processShutdownItems: %v", err)
+		}
+		return strings.Count(output.String(), "Skipping shutdown item quarantined")
+	}
+	if n := skipped(); n != 1 {
+		t.Errorf("first pass logged the quarantined item %d times, want once", n)
+	}
+	if n := skipped(); n != 1 {
+		t.Errorf("second pass logged the quarantined item again (%d lines in total)", n)
+	}
+
+	// Once the item leaves the queue it is forgotten, and logged again if it comes back
+	if err := redisQueue.DeleteItem(ctx, item.ID); err != nil {
+		t.Fatalf("DeleteItem: %v", err)
+	}
+	skipped()
+	if err := redisQueue.AddItem(ctx, item); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if n := skipped(); n != 2 {
+		t.Errorf("logged %d times after the item came back, want 2", n)
+	}
+}
+
+func TestProcessShutdownItemSkipsChangedItem(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisQueue, err := queue.NewRedisQueue("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	defer redisQueue.Close()
+
+	ctx := context.Background()
+	item := &queue.QueueItem{ID: "item", Status: queue.StatusShutdown, PodID: "k8s-playground-item", Namespace: "playground"}
+	if err := redisQueue.AddItem(ctx, item); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	stale := *item
+	// Moved on after the killer read it, e.g. marked errored by another controller
+	changed := *item
+	changed.Status = queue.StatusError
+	if err := redisQueue.UpdateItem(ctx, &changed); err != nil {
+		t.Fatalf("UpdateItem: %v", err)
+	}
+	clientset := fake.NewSimpleClientset(&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: item.PodID, Namespace: "playground"}})
+
+	err = processShutdownItem(ctx, redisQueue, k8s.NewClientForClientset(clientset), &stale, "default")
+	if !errors.Is(err, queue.ErrConflict) {
+		t.Errorf("processShutdownItem = %v, want a conflict", err)
+	}
+	stored, err := redisQueue.GetItem(ctx, item.ID)
+	if err != nil || stored.Status != queue.StatusError {
+		t.Errorf("stored item = %v, %v; want it left errored", stored, err)
+	}
+	if _, err := clientset.AppsV1().StatefulSets("playground").Get(ctx, item.PodID, metav1.GetOptions{}); err != nil {
+		t.Errorf("workload of the changed item was deleted: %v", err)
+	}
+}
@@ -42,8 +42,9 @@ func main() {
 
 	// Setup HTTP API for admin access
 	mux := http.NewServeMux()
-	mux.HandleFunc("/admin/auth", loggingController.HandleAdminAuth)
-	mux.HandleFunc("/admin/logs", loggingController.HandleAdminLogs)
+	mux.HandleFunc("/admin/auth", loggingController.WrapAdminHandler(loggingController.HandleAdminAuth, true))
+	mux.HandleFunc("/admin/logs", loggingController.WrapAdminHandler(loggingController.HandleAdminLogs, false))
+	mux.HandleFunc("/admin/buffer", loggingController.WrapAdminHandler(loggingController.HandleAdminBuffer, false))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -88,4 +89,4 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
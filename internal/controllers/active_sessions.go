@@ -0,0 +1,181 @@
+// internal/controllers/active_sessions.go
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// ActiveSession describes a connected terminal session
+type ActiveSession struct {
+	ID            string    `json:"id"`
+	Owner         string    `json:"owner"`
+	EnvironmentID string    `json:"environment_id"`
+	PodName       string    `json:"pod_name"`
+	Namespace     string    `json:"namespace"`
+	ConnectedAt   time.Time `json:"connected_at"`
+}
+
+// serverRestartReason is the close reason of sessions ended by a shutdown of the app-controller
+const serverRestartReason = "Server is restarting, please reconnect"
+
+// How often Drain checks whether all sessions have closed
+const drainPollInterval = 100 * time.Millisecond
+
+// registeredSession is an active session together with what is needed to end it
+type registeredSession struct {
+	ActiveSession
+	cancelExec context.CancelFunc
+	endOnce    sync.Once
+	// Close code and reason of a session ended from outside; valid once ended is set
+	endCode   int
+	endReason string
+	ended     atomic.Bool
+}
+
+// end cancels the session's exec, which makes handleTerminalSession close its WebSocket with
+// the given code and reason
+func (s *registeredSession) end(code int, reason string) {
+	s.endOnce.Do(func() {
+		s.endCode, s.endReason = code, reason
+		s.ended.Store(true)
+		s.cancelExec()
+	})
+}
+
+// sessionRegistry keeps track of the terminal sessions connected to this app-controller
+// instance; sessions handled by other replicas are not included
+type sessionRegistry struct {
+	mutex    sync.Mutex
+	sessions map[string]*registeredSession
+	// Set once the app-controller shuts down; sessions registered afterwards are ended at once
+	draining bool
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*registeredSession)}
+}
+
+func (r *sessionRegistry) add(session ActiveSession, cancelExec context.CancelFunc) *registeredSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	registered := &registeredSession{ActiveSession: session, cancelExec: cancelExec}
+	r.sessions[session.ID] = registered
+	if r.draining {
+		registered.end(websocket.CloseServiceRestart, serverRestartReason)
+	}
+	return registered
+}
+
+func (r *sessionRegistry) remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sessions, id)
+}
+
+// moved records that a session was reconnected to a new pod after its environment was recreated
+func (r *sessionRegistry) moved(id, podName, namespace string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if s, ok := r.sessions[id]; ok {
+		s.PodName = podName
+		s.Namespace = namespace
+	}
+}
+
+// list returns the active sessions, oldest first
+func (r *sessionRegistry) list() []ActiveSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sessions := make([]ActiveSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s.ActiveSession)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt) })
+	return sessions
+}
+
+// terminate ends a session on behalf of an admin. Returns false if no such session is connected.
+func (r *sessionRegistry) terminate(id string) bool {
+	r.mutex.Lock()
+	s, ok := r.sessions[id]
+	r.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	s.end(closeCodeTerminatedByAdmin, "Session terminated by an administrator")
+	return true
+}
+
+// drain ends every session with a server restart close code, including sessions registered
+// from now on, and returns how many are still connected
+func (r *sessionRegistry) drain() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.draining = true
+	for _, s := range r.sessions {
+		s.end(websocket.CloseServiceRestart, serverRestartReason)
+	}
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) isDraining() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.draining
+}
+
+func (r *sessionRegistry) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sessions)
+}
+
+// Drain gracefully closes the terminal sessions and read-only viewers of this instance for a
+// shutdown. Hijacked WebSocket connections are not tracked by http.Server.Shutdown, so this is
+// called alongside it. Every session is told the server is restarting and closed with code 1012
+// (service restart); new terminal connections are refused. Returns ctx.Err() if sessions are
+// still open when ctx is done.
+func (a *AppController) Drain(ctx context.Context) error {
+	remaining := a.terminalSessions.drain()
+	a.viewers.closeAll()
+	log.Printf("Draining %d terminal sessions", remaining)
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for a.terminalSessions.count() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("%d terminal sessions still open after draining: %v", a.terminalSessions.count(), ctx.Err())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	log.Println("All terminal sessions closed")
+	return nil
+}
+
+// getActiveSessions lists the terminal sessions connected to this instance for admins
+func (a *AppController) getActiveSessions(c *gin.Context) {
+	sessions := a.terminalSessions.list()
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "count": len(sessions)})
+}
+
+// terminateActiveSession ends a terminal session on behalf of an admin
+func (a *AppController) terminateActiveSession(c *gin.Context) {
+	id := c.Param("id")
+	if !a.terminalSessions.terminate(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	log.Printf("Admin %v terminated terminal session %s", c.MustGet("owner_id"), id)
+	c.JSON(http.StatusOK, gin.H{"message": "Session terminated"})
+}
@@ -4,40 +4,67 @@ package controllers
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 	"github.com/gorilla/websocket"
 	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
 	"github.com/tyottodekiru/k8s-playground/pkg/queue"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/idtoken"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/tools/remotecommand"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
-	writeWait          = 10 * time.Second
-	pongWait           = 60 * time.Second
-	pingPeriod         = (pongWait * 9) / 10
-	maxMessageSize     = 8192
-	sessionName        = "k8s-playground-session"
-	legacyOwnerID      = "legacy_admin_user"
+	sessionName      = "k8s-playground-session"
+	activityThrottle = 10 * time.Second
+	// How long a readiness probe result is reused before the pod and inner cluster are checked again
+	readinessCacheTTL = 5 * time.Second
+	legacyOwnerID     = "legacy_admin_user"
 )
 
+const requestIDHeader = "X-Request-ID"
+
+// Terminal sizes outside these bounds are clamped; DEFAULT_TERM_COLS/ROWS must lie within them
+const (
+	minTerminalCols = 20
+	maxTerminalCols = 500
+	minTerminalRows = 5
+	maxTerminalRows = 200
+)
+
+// requestIDPattern limits incoming request IDs to characters that are safe to embed in logs and shell scripts
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// cappedTerminalSessions counts terminal sessions closed by a configured limit, keyed by "duration", "input_bytes" or "idle"
+var cappedTerminalSessions = expvar.NewMap("terminal_sessions_capped")
+
 type TerminalMessage struct {
 	Operation string `json:"operation"`
 	Data      string `json:"data"`
@@ -50,6 +77,8 @@ type TerminalSession struct {
 	bound    chan error
 	sizeChan chan *k8s.TerminalSize
 	doneChan chan struct{}
+	// Last requested size, replayed to the new shell when the session is moved to a recreated pod
+	lastSize atomic.Pointer[k8s.TerminalSize]
 }
 
 func NewTerminalSession(sessionId string) *TerminalSession {
@@ -71,6 +100,7 @@ func (t *TerminalSession) Next() *k8s.TerminalSize {
 	}
 }
 func (t *TerminalSession) Resize(cols, rows uint16) {
+	t.lastSize.Store(&k8s.TerminalSize{Width: cols, Height: rows})
 	select {
 	case t.sizeChan <- &k8s.TerminalSize{Width: cols, Height: rows}:
 	case <-time.After(100 * time.Millisecond):
@@ -89,6 +119,8 @@ type WSClient struct {
 	conn    *websocket.Conn
 	session *TerminalSession
 	mutex   sync.Mutex
+	// Timeouts and read limit of the connection
+	settings webSocketSettings
 	// Logging fields
 	environmentID string
 	userID        string
@@ -96,52 +128,107 @@ type WSClient struct {
 	podName       string
 	sessionID     string
 	logger        *LoggingController
+	// Whether commands are logged from the instrumented shell rather than parsed from keystrokes.
+	// Only set once the instrumented bash has started; until then keystrokes are parsed.
+	commandsFromShell atomic.Bool
+	// Activity tracking for idle detection
+	redisQueue       *queue.RedisQueue
+	activityMutex    sync.Mutex
+	lastActivitySent time.Time
+	// Input cap (0 = unlimited); Read fails once more than maxInputBytes have been received
+	maxInputBytes int64
+	inputBytes    atomic.Int64
+	inputCapped   atomic.Bool
+	// Output rate limit (nil = unlimited) and when the user was last told about it (unix nanoseconds)
+	outputLimiter      *rate.Limiter
+	lastThrottleNotice atomic.Int64
+	// Idle tracking: time of the last user input (unix nanoseconds) and whether the session was ended for being idle
+	lastInput        atomic.Int64
+	idleDisconnected atomic.Bool
+	// Read-only viewers that receive a copy of everything written to the terminal
+	viewers *viewerHub
+	// Input pump: a single goroutine reads the WebSocket so that successive execs can share it
+	input   chan []byte
+	closed  chan struct{}
+	readErr error
 }
 
-func NewWSClient(conn *websocket.Conn, session *TerminalSession) *WSClient {
-	client := &WSClient{conn: conn, session: session}
-	conn.SetReadLimit(maxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(pongWait))
-	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+// errInputCapExceeded is returned by Read once the session's input byte cap has been reached
+var errInputCapExceeded = errors.New("terminal input limit exceeded")
+
+func NewWSClient(conn *websocket.Conn, session *TerminalSession, settings webSocketSettings) *WSClient {
+	client := &WSClient{conn: conn, session: session, settings: settings, input: make(chan []byte), closed: make(chan struct{})}
+	client.setupConn()
 	go client.startPingTimer()
 	return client
 }
 
-func NewWSClientWithLogging(conn *websocket.Conn, session *TerminalSession, environmentID, userID, userName, podName, sessionID string, logger *LoggingController) *WSClient {
+func NewWSClientWithLogging(conn *websocket.Conn, session *TerminalSession, settings webSocketSettings, environmentID, userID, userName, podName, sessionID string, logger *LoggingController) *WSClient {
 	client := &WSClient{
 		conn:          conn,
 		session:       session,
+		settings:      settings,
 		environmentID: environmentID,
 		userID:        userID,
 		userName:      userName,
 		podName:       podName,
 		sessionID:     sessionID,
 		logger:        logger,
+		input:         make(chan []byte),
+		closed:        make(chan struct{}),
 	}
-	conn.SetReadLimit(maxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(pongWait))
-	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	client.setupConn()
 	go client.startPingTimer()
 	return client
 }
-func (c *WSClient) Read(p []byte) (n int, err error) {
+
+// setupConn applies the read limit and keeps extending the read deadline while pongs arrive
+func (c *WSClient) setupConn() {
+	c.conn.SetReadLimit(c.settings.maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.settings.pongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(c.settings.pongWait)); return nil })
+}
+
+// logCommand records a command executed in the session's pod
+func (c *WSClient) logCommand(podName, command string) {
+	if c.logger == nil || c.environmentID == "" || c.userID == "" {
+		return
+	}
+	go func() {
+		if err := c.logger.LogCommandToBuffer(c.environmentID, c.userID, c.userName, podName, command, c.sessionID); err != nil {
+			log.Printf("Failed to buffer command: %v", err)
+			// Fallback to direct logging
+			if err := c.logger.LogCommand(c.environmentID, c.userID, c.userName, podName, command, c.sessionID); err != nil {
+				log.Printf("Failed to log command directly: %v", err)
+			}
+		}
+	}()
+}
+
+// nextInput reads from the WebSocket until a message with terminal input arrives, handling
+// heartbeat and resize control messages along the way
+func (c *WSClient) nextInput() ([]byte, error) {
 	for {
-		if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.settings.pongWait)); err != nil {
 		}
 		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				return 0, fmt.Errorf("websocket closed: %w", err)
+				return nil, fmt.Errorf("websocket closed: %w", err)
 			}
-			return 0, err
+			return nil, err
 		}
 		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+			c.recordActivity()
 			var controlMsg map[string]interface{}
 			if errJSON := json.Unmarshal(message, &controlMsg); errJSON == nil {
+				if heartbeat, ok := controlMsg["heartbeat"].(bool); ok && heartbeat {
+					continue
+				}
 				if resize, ok := controlMsg["resize"].(bool); ok && resize {
 					if cols, okCols := controlMsg["cols"].(float64); okCols {
 						if rows, okRows := controlMsg["rows"].(float64); okRows {
-							c.session.Resize(uint16(cols), uint16(rows))
+							c.session.Resize(clampTerminalSize(int(cols), minTerminalCols, maxTerminalCols), clampTerminalSize(int(rows), minTerminalRows, maxTerminalRows))
 							continue
 						}
 					}
@@ -149,57 +236,108 @@ func (c *WSClient) Read(p []byte) (n int, err error) {
 			}
 
 			// Log command if logger is available
-			if c.logger != nil && c.environmentID != "" && c.userID != "" {
+			if c.logger != nil && !c.commandsFromShell.Load() {
 				if command := c.logger.ParseCommandFromWebSocketDataWithSession(message, c.sessionID); command != "" {
-					go func() {
-						if err := c.logger.LogCommandToBuffer(c.environmentID, c.userID, c.userName, c.podName, command, c.sessionID); err != nil {
-							log.Printf("Failed to buffer command: %v", err)
-							// Fallback to direct logging
-							if err := c.logger.LogCommand(c.environmentID, c.userID, c.userName, c.podName, command, c.sessionID); err != nil {
-								log.Printf("Failed to log command directly: %v", err)
-							}
-						}
-					}()
+					c.logCommand(c.podName, command)
 				}
 			}
 
-			n = copy(p, message)
-			return n, nil
+			c.markInput()
+			if c.maxInputBytes > 0 && c.inputBytes.Add(int64(len(message))) > c.maxInputBytes {
+				c.inputCapped.Store(true)
+				return nil, errInputCapExceeded
+			}
+
+			return message, nil
 		}
 	}
 }
 func (c *WSClient) Write(p []byte) (n int, err error) {
+	c.recordActivity()
+	if !c.throttleOutput(len(p)) {
+		return 0, io.ErrClosedPipe
+	}
+	if c.viewers != nil {
+		c.viewers.broadcast(c.environmentID, p)
+	}
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-	}
-	const maxChunkSize = 4096
 	totalWritten := 0
 	for len(p) > 0 {
-		chunkSize := len(p)
-		if chunkSize > maxChunkSize {
-			chunkSize = maxChunkSize
-		}
+		chunkSize := min(len(p), c.settings.writeChunkSize)
 		chunk := p[:chunkSize]
+		// Per chunk, so large output sent with writeChunkDelay does not run out of time
+		c.conn.SetWriteDeadline(time.Now().Add(c.settings.writeWait))
 		if err := c.conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
 			return totalWritten, err
 		}
 		totalWritten += chunkSize
 		p = p[chunkSize:]
-		if len(p) > 0 {
-			time.Sleep(1 * time.Millisecond)
+		if len(p) > 0 && c.settings.writeChunkDelay > 0 {
+			time.Sleep(c.settings.writeChunkDelay)
 		}
 	}
 	return totalWritten, nil
 }
+
+// writeText sends a text message, serialized with the exec output and pings on the same connection
+func (c *WSClient) writeText(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.settings.writeWait)); err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// sendError writes an "error" TerminalMessage to the session
+func (c *WSClient) sendError(message string) {
+	jsonData, err := json.Marshal(TerminalMessage{Operation: "error", Data: "\x1b[31m" + message + "\x1b[0m\r\n"})
+	if err != nil {
+		log.Printf("Error marshalling error message to JSON: %v", err)
+		jsonData = []byte(message + "\r\n")
+	}
+	if err := c.writeText(jsonData); err != nil {
+		log.Printf("Error sending error message to session %s: %v", c.sessionID, err)
+	}
+}
+
+// sendRaw writes message to the session as is
+func (c *WSClient) sendRaw(message string) {
+	if err := c.writeText([]byte(message)); err != nil {
+		log.Printf("Error sending raw message to session %s: %v", c.sessionID, err)
+	}
+}
+
+// recordActivity marks the environment as in use. Writes to Redis are throttled
+// since this is called for every input and output message.
+func (c *WSClient) recordActivity() {
+	if c.redisQueue == nil || c.environmentID == "" {
+		return
+	}
+	c.activityMutex.Lock()
+	if time.Since(c.lastActivitySent) < activityThrottle {
+		c.activityMutex.Unlock()
+		return
+	}
+	c.lastActivitySent = time.Now()
+	c.activityMutex.Unlock()
+
+	go func() {
+		if err := c.redisQueue.RecordActivity(context.Background(), c.environmentID); err != nil {
+			log.Printf("Failed to record activity for env %s: %v", c.environmentID, err)
+		}
+	}()
+}
+
 func (c *WSClient) startPingTimer() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.settings.pingPeriod)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			c.mutex.Lock()
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if err := c.conn.SetWriteDeadline(time.Now().Add(c.settings.writeWait)); err != nil {
 				c.mutex.Unlock()
 				return
 			}
@@ -216,24 +354,65 @@ func (c *WSClient) startPingTimer() {
 func (c *WSClient) Close() error { c.session.Close(); return c.conn.Close() }
 
 type AppController struct {
-	redisQueue              *queue.RedisQueue
-	k8sClient               *k8s.Client
-	upgrader                websocket.Upgrader
-	oauth2Config            *oauth2.Config
-	sessionStore            sessions.Store
-	authMethod              string
-	legacyAuthPassword      string
-	googleAllowedDomains    []string
-	dindImageVersions       map[string]string
+	redisQueue           *queue.RedisQueue
+	k8sClient            *k8s.Client
+	upgrader             websocket.Upgrader
+	wsSettings           webSocketSettings
+	oidcProvider         *OIDCProvider // set for the oidc and google authentication methods
+	sessionStore         sessions.Store
+	authMethod           string
+	legacyAuthPassword   string
+	googleAllowedDomains []string
+	dindImageVersions    map[string]string
+	// Version preselected in the UI, "" = none; see getK8sVersionDetails
+	defaultK8sVersion       string
+	deprecatedK8sVersions   map[string]bool
 	dindWorkloadType        string // ★ フィールドを追加
 	loggingController       *LoggingController
 	loggingControllerAPIURL string
 	loggingAdminToken       string
+	costAllocationKeys      []string
+	maxEnvironmentsPerUser  int
+	quotaExceededBehavior   string
+	readinessCache          sync.Map // map[string]readinessResult, keyed by environment ID + workload name
+	maxSessionDuration      time.Duration
+	maxSessionInputBytes    int64
+	maxSessionOutputRate    int                    // terminal output bytes per second, 0 = unlimited
+	commandLogMode          string                 // commandLogModeKeystroke or commandLogModeShell
+	createRateLimits        *createRateLimitPolicy // environment creations allowed per owner per minute
+	terminalIdleTimeout     time.Duration
+	disconnectWarningLead   time.Duration // how long before an idle/duration disconnect the countdown starts
+	idleWarningMessage      string
+	durationWarningMessage  string
+	entrypointPresets       map[string]k8s.EntrypointPreset
+	environmentTemplates    map[string]k8s.EnvironmentTemplate
+	lifetimes               *lifetimePolicy
+	defaultTermCols         uint16 // used when the client does not report a valid initial size
+	defaultTermRows         uint16
+	maxSessionsPerUser      int             // concurrent terminal sessions per owner, 0 = unlimited
+	proxyProbeTimeout       time.Duration   // pre-flight connect check before proxying, 0 = disabled
+	allowedRedirectHosts    map[string]bool // hosts absolute post-login redirects may point to
+	activeSessions          map[string]int
+	activeSessionsMutex     sync.Mutex
+	terminalSessions        *sessionRegistry  // connected terminal sessions, for admins
+	ownerNamespaces         map[string]string // owner or "@domain" -> namespace for new environments
+	maxUploadBytes          int64             // size limit of files uploaded to the share
+	viewers                 *viewerHub        // read-only viewers of terminal output, see terminal_share.go
+	statusHub               *statusHub        // status changes for open terminal sessions, started on first use
+	statusHubOnce           sync.Once
+	expiryHub               *expiryHub // expiry warnings for open terminal sessions, started on first use
+	expiryHubOnce           sync.Once
+}
+
+type readinessResult struct {
+	ready     bool
+	reason    string
+	checkedAt time.Time
 }
 
 func NewAppController(
 	redisQueue *queue.RedisQueue,
-	oauth2Config *oauth2.Config,
+	oidcProvider *OIDCProvider,
 	store sessions.Store,
 	authMethod string,
 	legacyAuthPassword string,
@@ -246,6 +425,8 @@ func NewAppController(
 	k8sClient, err := k8s.NewClient()
 	if err != nil {
 		log.Printf("Warning: Failed to initialize k8s client: %v. Some functionalities might be affected.", err)
+	} else {
+		k8sClient.SetInstanceID(getEnv("INSTANCE_ID", ""))
 	}
 
 	// Initialize logging controller with Redis buffering
@@ -254,36 +435,217 @@ func NewAppController(
 		logDir = "/var/log/k8s-playground"
 	}
 
+	maxEnvironmentsPerUser, err := strconv.Atoi(getEnv("MAX_ENVIRONMENTS_PER_USER", "0"))
+	if err != nil || maxEnvironmentsPerUser < 0 {
+		log.Printf("Warning: Invalid MAX_ENVIRONMENTS_PER_USER, quota disabled: %v", err)
+		maxEnvironmentsPerUser = 0
+	}
+	quotaExceededBehavior := getEnv("QUOTA_EXCEEDED_BEHAVIOR", "reject")
+	if quotaExceededBehavior != "reject" && quotaExceededBehavior != "queue" {
+		log.Printf("Warning: Invalid QUOTA_EXCEEDED_BEHAVIOR '%s', falling back to 'reject'", quotaExceededBehavior)
+		quotaExceededBehavior = "reject"
+	}
+
+	// Optional caps on a single terminal session; 0 disables them
+	maxSessionDuration, err := time.ParseDuration(getEnv("TERMINAL_MAX_SESSION_DURATION", "0"))
+	if err != nil || maxSessionDuration < 0 {
+		log.Printf("Warning: Invalid TERMINAL_MAX_SESSION_DURATION, duration cap disabled: %v", err)
+		maxSessionDuration = 0
+	}
+	maxSessionInputBytes, err := strconv.ParseInt(getEnv("TERMINAL_MAX_INPUT_BYTES", "0"), 10, 64)
+	if err != nil || maxSessionInputBytes < 0 {
+		log.Printf("Warning: Invalid TERMINAL_MAX_INPUT_BYTES, input cap disabled: %v", err)
+		maxSessionInputBytes = 0
+	}
+	maxSessionOutputRate, err := strconv.Atoi(getEnv("TERMINAL_OUTPUT_RATE_LIMIT", "0"))
+	if err != nil || maxSessionOutputRate < 0 {
+		log.Printf("Warning: Invalid TERMINAL_OUTPUT_RATE_LIMIT, output rate limit disabled: %v", err)
+		maxSessionOutputRate = 0
+	}
+	commandLogMode := getEnv("COMMAND_LOG_MODE", commandLogModeKeystroke)
+	if commandLogMode != commandLogModeKeystroke && commandLogMode != commandLogModeShell {
+		log.Printf("Warning: Invalid COMMAND_LOG_MODE %q, using %s", commandLogMode, commandLogModeKeystroke)
+		commandLogMode = commandLogModeKeystroke
+	}
+	// Disconnects sessions without user input for this long; heartbeats and pings don't count as input
+	terminalIdleTimeout, err := time.ParseDuration(getEnv("TERMINAL_IDLE_TIMEOUT", "0"))
+	if err != nil || terminalIdleTimeout < 0 {
+		log.Printf("Warning: Invalid TERMINAL_IDLE_TIMEOUT, idle disconnect disabled: %v", err)
+		terminalIdleTimeout = 0
+	}
+
+	disconnectWarningLead, err := time.ParseDuration(getEnv("TERMINAL_DISCONNECT_WARNING", "60s"))
+	if err != nil || disconnectWarningLead < 0 {
+		log.Printf("Warning: Invalid TERMINAL_DISCONNECT_WARNING, using 60s: %v", err)
+		disconnectWarningLead = 60 * time.Second
+	}
+
+	maxSessionsPerUser, err := strconv.Atoi(getEnv("MAX_SESSIONS_PER_USER", "0"))
+	if err != nil || maxSessionsPerUser < 0 {
+		log.Printf("Warning: Invalid MAX_SESSIONS_PER_USER, session limit disabled: %v", err)
+		maxSessionsPerUser = 0
+	}
+
+	proxyProbeTimeout, err := time.ParseDuration(getEnv("PROXY_HEALTH_PROBE_TIMEOUT", "0"))
+	if err != nil || proxyProbeTimeout < 0 {
+		log.Printf("Warning: Invalid PROXY_HEALTH_PROBE_TIMEOUT, proxy health probe disabled: %v", err)
+		proxyProbeTimeout = 0
+	}
+
+	serviceCacheTTL, err := time.ParseDuration(getEnv("SERVICE_CACHE_TTL", k8s.DefaultServiceCacheTTL.String()))
+	if err != nil || serviceCacheTTL < 0 {
+		log.Printf("Warning: Invalid SERVICE_CACHE_TTL, using %v: %v", k8s.DefaultServiceCacheTTL, err)
+		serviceCacheTTL = k8s.DefaultServiceCacheTTL
+	}
+	if k8sClient != nil {
+		k8sClient.SetServiceCacheTTL(serviceCacheTTL)
+	}
+	if raw := getEnv("SERVICE_SCAN_PORTS", ""); raw != "" && k8sClient != nil {
+		if ports, err := k8s.ParsePortList(raw); err != nil {
+			log.Printf("Warning: Invalid SERVICE_SCAN_PORTS, using the default ports: %v", err)
+		} else {
+			k8sClient.SetServiceScanPorts(ports)
+		}
+	}
+	if raw := getEnv("SERVICE_WEB_PORTS", ""); raw != "" && k8sClient != nil {
+		if ports, err := k8s.ParsePortList(raw); err != nil {
+			log.Printf("Warning: Invalid SERVICE_WEB_PORTS, using the default ports: %v", err)
+		} else {
+			k8sClient.SetWebPorts(ports)
+		}
+	}
+
+	maxUploadBytes, err := strconv.ParseInt(getEnv("MAX_UPLOAD_BYTES", strconv.Itoa(defaultMaxUploadBytes)), 10, 64)
+	if err != nil || maxUploadBytes <= 0 {
+		log.Printf("Warning: Invalid MAX_UPLOAD_BYTES, using %d: %v", defaultMaxUploadBytes, err)
+		maxUploadBytes = defaultMaxUploadBytes
+	}
+
+	defaultTermCols, err := strconv.Atoi(getEnv("DEFAULT_TERM_COLS", "80"))
+	if err != nil || defaultTermCols < minTerminalCols || defaultTermCols > maxTerminalCols {
+		log.Printf("Warning: DEFAULT_TERM_COLS must be between %d and %d, using 80: %v", minTerminalCols, maxTerminalCols, err)
+		defaultTermCols = 80
+	}
+	defaultTermRows, err := strconv.Atoi(getEnv("DEFAULT_TERM_ROWS", "24"))
+	if err != nil || defaultTermRows < minTerminalRows || defaultTermRows > maxTerminalRows {
+		log.Printf("Warning: DEFAULT_TERM_ROWS must be between %d and %d, using 24: %v", minTerminalRows, maxTerminalRows, err)
+		defaultTermRows = 24
+	}
+
+	entrypointPresets, err := k8s.ParseEntrypointPresets(getEnv("DIND_ENTRYPOINT_PRESETS_JSON", ""))
+	if err != nil {
+		log.Printf("Warning: Invalid DIND_ENTRYPOINT_PRESETS_JSON, no entrypoint presets available: %v", err)
+		entrypointPresets = map[string]k8s.EntrypointPreset{}
+	}
+
+	environmentTemplates, err := k8s.ParseEnvironmentTemplates(getEnv("ENVIRONMENT_TEMPLATES_JSON", ""))
+	if err != nil {
+		log.Printf("Warning: Invalid ENVIRONMENT_TEMPLATES_JSON, no environment templates available: %v", err)
+		environmentTemplates = map[string]k8s.EnvironmentTemplate{}
+	}
+
+	maxEnvironmentLifetime, err := time.ParseDuration(getEnv("MAX_ENVIRONMENT_LIFETIME", defaultMaxEnvironmentLifetime.String()))
+	if err != nil || maxEnvironmentLifetime <= 0 {
+		log.Printf("Warning: Invalid MAX_ENVIRONMENT_LIFETIME, using %v: %v", defaultMaxEnvironmentLifetime, err)
+		maxEnvironmentLifetime = defaultMaxEnvironmentLifetime
+	}
+	lifetimes, err := parseLifetimePolicy(getEnv("DEFAULT_LIFETIMES_JSON", ""), maxEnvironmentLifetime)
+	if err != nil {
+		log.Printf("Warning: Invalid DEFAULT_LIFETIMES_JSON, all environments live %v: %v", min(defaultEnvironmentLifetime, maxEnvironmentLifetime), err)
+		lifetimes, _ = parseLifetimePolicy("", maxEnvironmentLifetime)
+	}
+
+	ownerNamespaces, err := parseOwnerNamespaces(getEnv("OWNER_NAMESPACES_JSON", ""))
+	if err != nil {
+		log.Printf("Warning: Invalid OWNER_NAMESPACES_JSON, all environments use the default namespace: %v", err)
+		ownerNamespaces = map[string]string{}
+	}
+
+	wsSettings, err := parseWebSocketSettings(getEnv)
+	if err != nil {
+		log.Printf("Warning: Invalid WebSocket settings, using defaults: %v", err)
+		wsSettings = defaultWebSocketSettings()
+	}
+
+	defaultK8sVersion, deprecatedK8sVersions, err := parseK8sVersionFlags(getEnv("DIND_DEFAULT_VERSION", ""), getEnv("DIND_DEPRECATED_VERSIONS", ""), dindImageVersions)
+	if err != nil {
+		log.Printf("Warning: Invalid DIND_DEFAULT_VERSION or DIND_DEPRECATED_VERSIONS, no version is flagged: %v", err)
+		defaultK8sVersion, deprecatedK8sVersions = "", map[string]bool{}
+	}
+
+	createRateLimit, err := strconv.Atoi(getEnv("CREATE_RATE_LIMIT", "0"))
+	if err != nil || createRateLimit < 0 {
+		log.Printf("Warning: Invalid CREATE_RATE_LIMIT, creation rate limit disabled: %v", err)
+		createRateLimit = 0
+	}
+	createRateLimits, err := parseCreateRateLimitPolicy(createRateLimit, getEnv("CREATE_RATE_LIMIT_GROUPS_JSON", ""))
+	if err != nil {
+		log.Printf("Warning: Invalid CREATE_RATE_LIMIT_GROUPS_JSON, all owners are limited to %d per minute: %v", createRateLimit, err)
+		createRateLimits, _ = parseCreateRateLimitPolicy(createRateLimit, "")
+	}
+
 	return &AppController{
 		redisQueue:              redisQueue,
 		k8sClient:               k8sClient,
-		oauth2Config:            oauth2Config,
+		oidcProvider:            oidcProvider,
 		sessionStore:            store,
 		authMethod:              authMethod,
 		legacyAuthPassword:      legacyAuthPassword,
 		googleAllowedDomains:    googleAllowedDomains,
 		dindImageVersions:       dindImageVersions,
+		defaultK8sVersion:       defaultK8sVersion,
+		deprecatedK8sVersions:   deprecatedK8sVersions,
 		dindWorkloadType:        dindWorkloadType, // ★ 初期化
 		loggingController:       NewLoggingControllerWithRedis(logDir, redisQueue.Client),
 		loggingControllerAPIURL: loggingControllerAPIURL,
 		loggingAdminToken:       loggingAdminToken,
+		costAllocationKeys:      splitAndTrim(getEnv("COST_ALLOCATION_KEYS", "team,project,cost-center")),
+		maxEnvironmentsPerUser:  maxEnvironmentsPerUser,
+		quotaExceededBehavior:   quotaExceededBehavior,
+		maxSessionDuration:      maxSessionDuration,
+		maxSessionInputBytes:    maxSessionInputBytes,
+		maxSessionOutputRate:    maxSessionOutputRate,
+		commandLogMode:          commandLogMode,
+		terminalIdleTimeout:     terminalIdleTimeout,
+		createRateLimits:        createRateLimits,
+		disconnectWarningLead:   disconnectWarningLead,
+		idleWarningMessage:      getEnv("TERMINAL_IDLE_WARNING_MESSAGE", defaultIdleWarningMessage),
+		durationWarningMessage:  getEnv("TERMINAL_DURATION_WARNING_MESSAGE", defaultDurationWarningMessage),
+		entrypointPresets:       entrypointPresets,
+		environmentTemplates:    environmentTemplates,
+		lifetimes:               lifetimes,
+		defaultTermCols:         uint16(defaultTermCols),
+		defaultTermRows:         uint16(defaultTermRows),
+		maxSessionsPerUser:      maxSessionsPerUser,
+		proxyProbeTimeout:       proxyProbeTimeout,
+		maxUploadBytes:          maxUploadBytes,
+		viewers:                 newViewerHub(),
+		allowedRedirectHosts:    parseRedirectHosts(getEnv("BASE_URL", ""), getEnv("ALLOWED_REDIRECT_HOSTS", "")),
+		activeSessions:          make(map[string]int),
+		terminalSessions:        newSessionRegistry(),
+		ownerNamespaces:         ownerNamespaces,
+		wsSettings:              wsSettings,
 		upgrader: websocket.Upgrader{
-			CheckOrigin:  func(r *http.Request) bool { return true },
+			CheckOrigin:  checkOrigin(parseAllowedOrigins(getEnv("BASE_URL", ""), getEnv("ALLOWED_ORIGINS", ""))),
 			Subprotocols: []string{"base64.channel.k8s.io"},
 		},
 	}
 }
 
 func (a *AppController) SetupRoutes(router *gin.Engine) {
+	router.Use(requestIDMiddleware())
 	router.Static("/static", "/app/web/static")
 	router.LoadHTMLGlob("/app/web/templates/*")
 
 	router.GET("/", a.loginPage)
 	router.GET("/logout", a.handleLogout)
+	// Read-only terminal viewers authenticate with the share token instead of a session
+	router.GET("/share/:token", a.sharePage)
+	router.GET("/api/share/:token/connect", a.connectViewer)
 
-	if a.authMethod == "google" {
-		router.GET("/login/google", a.handleGoogleLogin)
-		router.GET("/auth/google/callback", a.handleGoogleCallback)
+	if a.usesOIDC() {
+		router.GET("/login/"+a.authMethod, a.handleOIDCLogin)
+		router.GET("/auth/"+a.authMethod+"/callback", a.handleOIDCCallback)
 	} else if a.authMethod == "password" {
 		router.POST("/login", a.handleLegacyLogin)
 	}
@@ -294,13 +656,31 @@ func (a *AppController) SetupRoutes(router *gin.Engine) {
 		authGroup.GET("/dashboard", a.dashboard)
 		authGroup.GET("/api/environments", a.getEnvironments)
 		authGroup.POST("/api/environments", a.createEnvironment)
+		authGroup.DELETE("/api/environments", a.destroyAllEnvironments)
+		authGroup.GET("/api/environments/:id", a.getEnvironment)
 		authGroup.DELETE("/api/environments/:id", a.destroyEnvironment)
+		authGroup.GET("/api/environments/:id/history", a.getEnvironmentHistory)
 		authGroup.PUT("/api/environments/:id/displayname", a.updateEnvironmentDisplayName)
+		authGroup.POST("/api/environments/:id/retry", a.retryEnvironment)
+		authGroup.POST("/api/environments/:id/restart", a.restartEnvironment)
 		authGroup.GET("/api/environments/:id/connect", a.connectEnvironment)
 		authGroup.GET("/api/environments/:id/services", a.getEnvironmentServices)
+		authGroup.POST("/api/environments/:id/snapshot", a.snapshotEnvironment)
+		authGroup.GET("/api/environments/:id/ready", a.getEnvironmentReady)
+		authGroup.GET("/api/environments/:id/kubeconfig", a.getEnvironmentKubeconfig)
+		authGroup.GET("/api/environments/:id/events", a.getEnvironmentEvents)
+		authGroup.GET("/api/environments/:id/logs", a.getEnvironmentLogs)
+		authGroup.POST("/api/environments/:id/share", a.createShareToken)
+		authGroup.GET("/api/environments/:id/share", a.listShareTokens)
+		authGroup.DELETE("/api/environments/:id/share/:token", a.revokeShareToken)
 		authGroup.Any("/api/environments/:id/browser/*path", a.proxyToPod)
+		authGroup.GET("/api/environments/:id/files/*path", a.downloadSharedFile)
+		authGroup.POST("/api/environments/:id/files/*path", a.uploadSharedFile)
 		authGroup.GET("/api/user", a.getUserInfo)
 		authGroup.GET("/api/k8s-versions", a.getAvailableK8sVersions)
+		authGroup.GET("/api/k8s-versions/detailed", a.getK8sVersionDetails)
+		authGroup.GET("/api/entrypoint-presets", a.getEntrypointPresets)
+		authGroup.GET("/api/templates", a.getEnvironmentTemplates)
 	}
 
 	// Admin routes for logging
@@ -310,19 +690,33 @@ func (a *AppController) SetupRoutes(router *gin.Engine) {
 	{
 		adminGroup.GET("/", a.adminDashboard)
 		adminGroup.GET("/api/command-logs", a.getCommandLogs)
+		adminGroup.GET("/api/log-buffer", a.getLogBuffer)
+		adminGroup.POST("/api/log-buffer/flush", a.flushLogBuffer)
 		adminGroup.GET("/api/all-environments", a.getAllEnvironments)
+		adminGroup.GET("/api/active-sessions", a.getActiveSessions)
+		adminGroup.DELETE("/api/active-sessions/:id", a.terminateActiveSession)
+		adminGroup.GET("/api/environments/:id/history", a.getEnvironmentHistoryAdmin)
+		adminGroup.GET("/api/metrics", gin.WrapH(expvar.Handler()))
+		adminGroup.GET("/api/diagnostics", a.listDiagnostics)
+		adminGroup.GET("/api/diagnostics/:id", a.getDiagnostics)
 	}
 }
 
 func (a *AppController) getAvailableK8sVersions(c *gin.Context) {
 	log.Printf("getAvailableK8sVersions called. dindImageVersions: %+v", a.dindImageVersions)
+	versions := a.k8sVersionNames()
+	log.Printf("Returning versions: %+v", versions)
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
+
+// k8sVersionNames returns the Kubernetes versions environments can be created with, sorted
+func (a *AppController) k8sVersionNames() []string {
 	versions := make([]string, 0, len(a.dindImageVersions))
 	for k := range a.dindImageVersions {
 		versions = append(versions, k)
 	}
 	sort.Strings(versions)
-	log.Printf("Returning versions: %+v", versions)
-	c.JSON(http.StatusOK, gin.H{"versions": versions})
+	return versions
 }
 
 func (a *AppController) getUserInfo(c *gin.Context) {
@@ -346,6 +740,20 @@ func (a *AppController) getUserInfo(c *gin.Context) {
 	})
 }
 
+// requestIDMiddleware assigns every request an ID (reusing a well-formed incoming X-Request-ID)
+// and echoes it in the response so browser requests can be matched with server logs.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		c.Set("request_id", requestID)
+		c.Header(requestIDHeader, requestID)
+		c.Next()
+	}
+}
+
 func (a *AppController) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		session, err := a.sessionStore.Get(c.Request, sessionName)
@@ -360,6 +768,9 @@ func (a *AppController) authMiddleware() gin.HandlerFunc {
 			if c.Request.Header.Get("Upgrade") == "websocket" {
 				log.Printf("WebSocket authentication failed for request to %s", c.Request.URL.Path)
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized WebSocket connection"})
+			} else if c.Request.Method == http.MethodGet && !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+				// Come back to the requested page after signing in
+				c.Redirect(http.StatusFound, "/?next="+url.QueryEscape(c.Request.URL.RequestURI()))
 			} else {
 				c.Redirect(http.StatusFound, "/")
 			}
@@ -367,31 +778,47 @@ func (a *AppController) authMiddleware() gin.HandlerFunc {
 			return
 		}
 		var ownerID string
-		if a.authMethod == "google" {
-			userEmail, okEmail := session.Values["user_email"].(string)
-			if !okEmail || userEmail == "" {
-				log.Printf("User email not found in session for authenticated Google user.")
+		if a.usesOIDC() {
+			// Sessions created before owner_id was stored are keyed by the email; with another
+			// owner claim they must sign in again
+			sessionOwner, okOwner := session.Values["owner_id"].(string)
+			if (!okOwner || sessionOwner == "") && a.oidcProvider.OwnerClaim() == "email" {
+				sessionOwner, okOwner = session.Values["user_email"].(string)
+			}
+			if !okOwner || sessionOwner == "" {
+				log.Printf("Owner ID not found in session for authenticated %s user.", a.authMethod)
 				session.Values["authenticated"] = false
 				session.Options.MaxAge = -1
 				if err := session.Save(c.Request, c.Writer); err != nil {
 					log.Printf("Error saving session during auth failure: %v", err)
 				}
 				if c.Request.Header.Get("Upgrade") == "websocket" {
-					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User email missing in session"})
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User identity missing in session"})
 				} else {
 					c.Redirect(http.StatusFound, "/")
 				}
 				c.Abort()
 				return
 			}
-			ownerID = userEmail
-			c.Set("user_email", userEmail)
+			ownerID = sessionOwner
+			// Sessions from before emails were verified at login may hold an unverified one
+			if verified, _ := session.Values["user_email_verified"].(bool); verified {
+				if email, ok := session.Values["user_email"].(string); ok && email != "" {
+					c.Set("user_email", email)
+				}
+			}
 			if name, ok := session.Values["user_name"].(string); ok {
 				c.Set("user_name", name)
 			}
 			if picture, ok := session.Values["user_picture"].(string); ok {
 				c.Set("user_picture", picture)
 			}
+			if groups, ok := session.Values["user_groups"].([]string); ok {
+				c.Set("user_groups", groups)
+			}
+			if sub, ok := session.Values["user_sub"].(string); ok && sub != "" {
+				c.Set("user_sub", sub)
+			}
 		} else if a.authMethod == "password" {
 			userID, okUserID := session.Values["user_id"].(string)
 			if !okUserID || userID != legacyOwnerID {
@@ -428,10 +855,18 @@ func (a *AppController) authMiddleware() gin.HandlerFunc {
 func (a *AppController) loginPage(c *gin.Context) {
 	session, _ := a.sessionStore.Get(c.Request, sessionName)
 	if auth, ok := session.Values["authenticated"].(bool); ok && auth {
-		c.Redirect(http.StatusFound, "/dashboard")
+		c.Redirect(http.StatusFound, a.safeRedirectTarget(c.Query("next")))
 		return
 	}
-	c.HTML(http.StatusOK, "login.html", gin.H{"title": "k8s Playground - Login", "AuthMethod": a.authMethod, "error": c.Query("error")})
+	var next string
+	if c.Query("next") != "" {
+		next = a.safeRedirectTarget(c.Query("next"))
+	}
+	providerName := ""
+	if a.oidcProvider != nil {
+		providerName = a.oidcProvider.DisplayName()
+	}
+	c.HTML(http.StatusOK, "login.html", gin.H{"title": "k8s Playground - Login", "AuthMethod": a.authMethod, "ProviderName": providerName, "error": loginErrorMessage(c.Query("error")), "next": next})
 }
 
 func (a *AppController) handleLegacyLogin(c *gin.Context) {
@@ -441,7 +876,7 @@ func (a *AppController) handleLegacyLogin(c *gin.Context) {
 	}
 	password := c.PostForm("password")
 	if password != a.legacyAuthPassword {
-		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"title": "k8s Playground - Login", "error": "Invalid password", "AuthMethod": a.authMethod})
+		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"title": "k8s Playground - Login", "error": "Invalid password", "AuthMethod": a.authMethod, "next": a.safeRedirectTarget(c.PostForm("next"))})
 		return
 	}
 	session, _ := a.sessionStore.Get(c.Request, sessionName)
@@ -452,50 +887,72 @@ func (a *AppController) handleLegacyLogin(c *gin.Context) {
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Failed to save session.", "AuthMethod": a.authMethod})
 		return
 	}
-	c.Redirect(http.StatusFound, "/dashboard")
+	c.Redirect(http.StatusFound, a.safeRedirectTarget(c.PostForm("next")))
+}
+
+// usesOIDC reports whether users sign in with an OpenID Connect provider; google is a preset of oidc
+func (a *AppController) usesOIDC() bool {
+	return (a.authMethod == "oidc" || a.authMethod == "google") && a.oidcProvider != nil
 }
 
-func (a *AppController) handleGoogleLogin(c *gin.Context) {
-	if a.authMethod != "google" || a.oauth2Config == nil {
-		c.HTML(http.StatusForbidden, "login.html", gin.H{"title": "Login Error", "error": "Google login is not enabled or configured.", "AuthMethod": a.authMethod})
+func (a *AppController) handleOIDCLogin(c *gin.Context) {
+	if !a.usesOIDC() {
+		c.HTML(http.StatusForbidden, "login.html", gin.H{"title": "Login Error", "error": "Single sign-on is not enabled or configured.", "AuthMethod": a.authMethod})
+		return
+	}
+	oauth2Config, err := a.oidcProvider.OAuth2Config(c.Request.Context())
+	if err != nil {
+		log.Printf("Identity provider not available in handleOIDCLogin: %v", err)
+		c.HTML(http.StatusServiceUnavailable, "login.html", gin.H{"title": "Login Error", "error": "The identity provider is not reachable, please try again later.", "AuthMethod": a.authMethod})
 		return
 	}
 	session, err := a.sessionStore.Get(c.Request, sessionName)
 	if err != nil {
-		log.Printf("Session store error in handleGoogleLogin: %v", err)
+		log.Printf("Session store error in handleOIDCLogin: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Session error, please try again.", "AuthMethod": a.authMethod})
 		return
 	}
-	oauthState := make([]byte, 16)
+	// The state protects the callback against CSRF, the nonce binds the ID token to this login
+	oauthState := make([]byte, 32)
 	if _, err := rand.Read(oauthState); err != nil {
 		log.Printf("Error generating oauth state: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Could not initiate login, please try again.", "AuthMethod": a.authMethod})
 		return
 	}
-	stateString := base64.URLEncoding.EncodeToString(oauthState)
+	stateString := base64.URLEncoding.EncodeToString(oauthState[:16])
+	nonceString := base64.URLEncoding.EncodeToString(oauthState[16:])
 	session.Values["oauth_state"] = stateString
+	session.Values["oidc_nonce"] = nonceString
+	session.Values["post_login_redirect"] = a.safeRedirectTarget(c.Query("next"))
 	if err := session.Save(c.Request, c.Writer); err != nil {
-		log.Printf("Error saving session in handleGoogleLogin: %v", err)
+		log.Printf("Error saving session in handleOIDCLogin: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Could not save session, please try again.", "AuthMethod": a.authMethod})
 		return
 	}
 	var url string
-	authCodeURLOptions := []oauth2.AuthCodeOption{oauth2.AccessTypeOnline}
+	authCodeURLOptions := []oauth2.AuthCodeOption{oauth2.AccessTypeOnline, oauth2.SetAuthURLParam("nonce", nonceString)}
 	if len(a.googleAllowedDomains) == 1 && a.googleAllowedDomains[0] != "" {
 		authCodeURLOptions = append(authCodeURLOptions, oauth2.SetAuthURLParam("hd", a.googleAllowedDomains[0]))
 	}
-	url = a.oauth2Config.AuthCodeURL(stateString, authCodeURLOptions...)
+	url = oauth2Config.AuthCodeURL(stateString, authCodeURLOptions...)
 	c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
-func (a *AppController) handleGoogleCallback(c *gin.Context) {
-	if a.authMethod != "google" || a.oauth2Config == nil {
-		c.HTML(http.StatusForbidden, "login.html", gin.H{"title": "Login Error", "error": "Google login is not enabled or configured.", "AuthMethod": a.authMethod})
+func (a *AppController) handleOIDCCallback(c *gin.Context) {
+	if !a.usesOIDC() {
+		c.HTML(http.StatusForbidden, "login.html", gin.H{"title": "Login Error", "error": "Single sign-on is not enabled or configured.", "AuthMethod": a.authMethod})
+		return
+	}
+	oauth2Config, err := a.oidcProvider.OAuth2Config(c.Request.Context())
+	if err != nil {
+		log.Printf("Identity provider not available in handleOIDCCallback: %v", err)
+		c.HTML(http.StatusServiceUnavailable, "login.html", gin.H{"title": "Login Error", "error": "The identity provider is not reachable, please try again later.", "AuthMethod": a.authMethod})
 		return
 	}
+	providerName := a.oidcProvider.DisplayName()
 	session, err := a.sessionStore.Get(c.Request, sessionName)
 	if err != nil {
-		log.Printf("Session store error in handleGoogleCallback: %v", err)
+		log.Printf("Session store error in handleOIDCCallback: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Session error during callback, please try again.", "AuthMethod": a.authMethod})
 		return
 	}
@@ -505,8 +962,9 @@ func (a *AppController) handleGoogleCallback(c *gin.Context) {
 		c.HTML(http.StatusBadRequest, "login.html", gin.H{"title": "Login Error", "error": "Invalid session state. Please try logging in again.", "AuthMethod": a.authMethod})
 		return
 	}
+	nonce, _ := session.Values["oidc_nonce"].(string)
 	code := c.Query("code")
-	token, err := a.oauth2Config.Exchange(context.Background(), code)
+	token, err := oauth2Config.Exchange(a.oidcProvider.HTTPContext(c.Request.Context()), code)
 	if err != nil {
 		log.Printf("Failed to exchange token: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Failed to exchange token: " + err.Error(), "AuthMethod": a.authMethod})
@@ -515,17 +973,17 @@ func (a *AppController) handleGoogleCallback(c *gin.Context) {
 	idTokenString, ok := token.Extra("id_token").(string)
 	if !ok {
 		log.Printf("ID token not found in token response")
-		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Could not get ID token from Google.", "AuthMethod": a.authMethod})
+		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Could not get ID token from " + providerName + ".", "AuthMethod": a.authMethod})
 		return
 	}
-	payload, err := idtoken.Validate(context.Background(), idTokenString, a.oauth2Config.ClientID)
+	claims, err := a.oidcProvider.VerifyIDToken(c.Request.Context(), idTokenString, nonce)
 	if err != nil {
 		log.Printf("Failed to validate ID token: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Failed to validate ID token: " + err.Error(), "AuthMethod": a.authMethod})
 		return
 	}
 	if len(a.googleAllowedDomains) > 0 && !(len(a.googleAllowedDomains) == 1 && a.googleAllowedDomains[0] == "") {
-		hdClaim, claimOk := payload.Claims["hd"].(string)
+		hdClaim, claimOk := claims["hd"].(string)
 		isAllowed := false
 		if claimOk {
 			for _, allowedDomain := range a.googleAllowedDomains {
@@ -545,25 +1003,77 @@ func (a *AppController) handleGoogleCallback(c *gin.Context) {
 			return
 		}
 	}
-	userEmail := payload.Claims["email"].(string)
-	userName, _ := payload.Claims["name"].(string)
-	userPicture, _ := payload.Claims["picture"].(string)
-	if userEmail == "" {
-		log.Printf("User email not provided by Google (from ID token).")
-		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "User email not provided by Google.", "AuthMethod": a.authMethod})
+	ownerClaim := a.oidcProvider.OwnerClaim()
+	ownerID, _ := claims[ownerClaim].(string)
+	if ownerID == "" {
+		log.Printf("Claim %q not provided by %s (from ID token).", ownerClaim, providerName)
+		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": fmt.Sprintf("User identity (%s) not provided by %s.", ownerClaim, providerName), "AuthMethod": a.authMethod})
+		return
+	}
+	userEmail, _ := claims["email"].(string)
+	// An unverified email must not become the owner ID of someone else's environments; providers
+	// that do not say whether it was verified are not trusted either
+	if verified, _ := claims["email_verified"].(bool); !verified && ownerClaim == "email" {
+		log.Printf("Login with unverified email %s rejected.", userEmail)
+		c.HTML(http.StatusForbidden, "login.html", gin.H{"title": "Login Error", "error": "Your email address has not been verified by " + providerName + ".", "AuthMethod": a.authMethod})
 		return
 	}
-	session.Values["user_email"] = userEmail
-	session.Values["user_name"] = userName
-	session.Values["user_picture"] = userPicture
+	if verified, _ := claims["email_verified"].(bool); verified && ownerClaim != "email" && userEmail != "" && userEmail != ownerID {
+		a.migrateEmailOwnedItems(c.Request.Context(), userEmail, ownerID)
+	}
+	a.storeOIDCIdentity(session, claims, ownerID)
 	session.Values["authenticated"] = true
 	delete(session.Values, "oauth_state")
+	delete(session.Values, "oidc_nonce")
+	redirectTarget, _ := session.Values["post_login_redirect"].(string)
+	delete(session.Values, "post_login_redirect")
 	if err := session.Save(c.Request, c.Writer); err != nil {
-		log.Printf("Error saving session in handleGoogleCallback: %v", err)
+		log.Printf("Error saving session in handleOIDCCallback: %v", err)
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"title": "Login Error", "error": "Failed to save session after login.", "AuthMethod": a.authMethod})
 		return
 	}
-	c.Redirect(http.StatusFound, "/dashboard")
+	c.Redirect(http.StatusFound, a.safeRedirectTarget(redirectTarget))
+}
+
+// storeOIDCIdentity records the signed-in user from the ID token claims in the session. The email
+// is only kept once the provider has verified it, since ADMIN_USERS is matched against it.
+func (a *AppController) storeOIDCIdentity(session *sessions.Session, claims map[string]interface{}, ownerID string) {
+	session.Values["owner_id"] = ownerID
+	session.Values["user_sub"], _ = claims["sub"].(string)
+	session.Values["user_name"], _ = claims["name"].(string)
+	session.Values["user_picture"], _ = claims["picture"].(string)
+	if verified, _ := claims["email_verified"].(bool); verified {
+		session.Values["user_email"], _ = claims["email"].(string)
+		session.Values["user_email_verified"] = true
+	} else {
+		delete(session.Values, "user_email")
+		delete(session.Values, "user_email_verified")
+	}
+	// Only stored if the token has a groups claim, so admin checks can tell "no groups" from "no group info"
+	if groups, ok := a.oidcProvider.Groups(claims); ok {
+		session.Values["user_groups"] = groups
+	} else {
+		delete(session.Values, "user_groups")
+	}
+}
+
+// migrateEmailOwnedItems hands the environments created while owners were identified by email
+// over to the user's new owner ID (e.g. sub), so switching OIDC_OWNER_CLAIM does not orphan
+// them. Only called for verified emails. Failures are logged and retried on the next login.
+func (a *AppController) migrateEmailOwnedItems(ctx context.Context, email, ownerID string) {
+	items, err := a.redisQueue.GetItemsByOwner(ctx, email)
+	if err != nil {
+		log.Printf("Failed to look up environments owned by %s for migration: %v", email, err)
+		return
+	}
+	for _, item := range items {
+		item.Owner = ownerID
+		if err := a.redisQueue.UpdateItem(ctx, item); err != nil {
+			log.Printf("Failed to migrate owner of environment %s from %s to %s: %v", item.ID, email, ownerID, err)
+			continue
+		}
+		log.Printf("Migrated owner of environment %s from %s to %s", item.ID, email, ownerID)
+	}
 }
 
 func (a *AppController) handleLogout(c *gin.Context) {
@@ -571,9 +1081,15 @@ func (a *AppController) handleLogout(c *gin.Context) {
 	if err == nil {
 		session.Values["authenticated"] = false
 		delete(session.Values, "user_email")
+		delete(session.Values, "user_email_verified")
 		delete(session.Values, "user_name")
 		delete(session.Values, "user_picture")
 		delete(session.Values, "oauth_state")
+		delete(session.Values, "oidc_nonce")
+		delete(session.Values, "owner_id")
+		delete(session.Values, "user_sub")
+		delete(session.Values, "user_groups")
+		delete(session.Values, "post_login_redirect")
 		delete(session.Values, "user_id")
 		session.Options.MaxAge = -1
 		if err := session.Save(c.Request, c.Writer); err != nil {
@@ -589,7 +1105,7 @@ func (a *AppController) dashboard(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
 	displayName := ownerID
 	userPicture := ""
-	if a.authMethod == "google" {
+	if a.usesOIDC() {
 		name, okName := c.Get("user_name")
 		pic, okPic := c.Get("user_picture")
 		if okName {
@@ -615,13 +1131,31 @@ func (a *AppController) getEnvironments(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get environments"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"environments": environments})
+	c.JSON(http.StatusOK, gin.H{"environments": environments, "queue": a.ownerQueuePositions(ctx, environments)})
+}
+
+// getEnvironment returns a single environment of the owner
+func (a *AppController) getEnvironment(c *gin.Context) {
+	item := a.ownedEnvironment(c)
+	if item == nil {
+		return
+	}
+	response := gin.H{"environment": item}
+	if position, ok := a.ownerQueuePositions(c.Request.Context(), []*queue.QueueItem{item})[item.ID]; ok {
+		response["queue"] = position
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func (a *AppController) createEnvironment(c *gin.Context) {
 	var req struct {
-		K8sVersion  string `json:"k8s_version"`
-		DisplayName string `json:"display_name"`
+		K8sVersion       string            `json:"k8s_version"`
+		DisplayName      string            `json:"display_name"`
+		CostAllocation   map[string]string `json:"cost_allocation"`
+		FromSnapshot     string            `json:"from_snapshot"`
+		WorkloadType     string            `json:"workload_type"`
+		EntrypointPreset string            `json:"entrypoint_preset"`
+		Template         string            `json:"template"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
@@ -631,37 +1165,145 @@ func (a *AppController) createEnvironment(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "k8s_version is required"})
 		return
 	}
+	if _, ok := a.dindImageVersions[req.K8sVersion]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unsupported k8s_version '%s'", req.K8sVersion), "available_versions": a.k8sVersionNames()})
+		return
+	}
 	if len(req.DisplayName) > 50 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "DisplayName cannot exceed 50 characters"})
 		return
 	}
+	if err := validateDisplayName(req.DisplayName); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.validateCostAllocation(req.CostAllocation); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "allowed_keys": a.costAllocationKeys})
+		return
+	}
+	if req.WorkloadType != "" && req.WorkloadType != "statefulset" && req.WorkloadType != "deployment" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workload_type must be 'statefulset' or 'deployment'"})
+		return
+	}
+	if req.EntrypointPreset != "" {
+		if _, ok := a.entrypointPresets[req.EntrypointPreset]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown entrypoint_preset '%s'", req.EntrypointPreset), "available_presets": a.entrypointPresetNames()})
+			return
+		}
+	}
+	if req.Template != "" {
+		if _, ok := a.environmentTemplates[req.Template]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown template '%s'", req.Template), "available_templates": a.environmentTemplateNames()})
+			return
+		}
+	}
+	if req.FromSnapshot != "" {
+		if err := k8s.ValidateSnapshotID(req.FromSnapshot); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	ownerID := c.MustGet("owner_id").(string)
+	ctx := context.Background()
+
+	// Rate limit creations per owner (token bucket refilled over one minute)
+	var groups []string
+	if value, ok := c.Get("user_groups"); ok {
+		groups = value.([]string)
+	}
+	if createRateLimit := a.createRateLimits.limitFor(groups); createRateLimit > 0 {
+		allowed, retryAfter, err := a.redisQueue.TakeToken(ctx, "create:"+ownerID, createRateLimit, time.Minute)
+		if err != nil {
+			// Don't block creation on a Redis hiccup in the limiter
+			log.Printf("Warning: create rate limit check failed for owner %s: %v", ownerID, err)
+		} else if !allowed {
+			retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retrySeconds))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Too many environments created recently (max %d per minute). Try again in %d seconds", createRateLimit, retrySeconds)})
+			return
+		}
+	}
+
+	// Quota check: in "queue" mode over-quota requests stay pending until the generator finds a free slot
+	queued := false
+	if a.maxEnvironmentsPerUser > 0 {
+		ownerItems, err := a.redisQueue.GetItemsByStatusesAndOwner(ctx, []queue.QueueStatus{queue.StatusPending, queue.StatusGenerating, queue.StatusAvailable, queue.StatusRestarting}, ownerID)
+		if err != nil {
+			log.Printf("Error checking quota for owner %s: %v", ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create environment"})
+			return
+		}
+		if len(ownerItems) >= a.maxEnvironmentsPerUser {
+			if a.quotaExceededBehavior != "queue" {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Environment quota exceeded (max %d)", a.maxEnvironmentsPerUser)})
+				return
+			}
+			queued = true
+		}
+	}
 
-	// ★ WorkloadType を設定
-	workloadType := a.dindWorkloadType
-	if workloadType != "statefulset" && workloadType != "deployment" {
-		workloadType = "statefulset" // 安全のためのフォールバック
+	// ★ WorkloadType を設定 (リクエストで指定がなければサーバーのデフォルト)
+	workloadType := req.WorkloadType
+	if workloadType == "" {
+		workloadType = a.dindWorkloadType
+		if workloadType != "statefulset" && workloadType != "deployment" {
+			workloadType = "statefulset" // 安全のためのフォールバック
+		}
 	}
 
+	now := time.Now()
 	item := &queue.QueueItem{
-		Owner:           ownerID,
-		K8sVersion:      req.K8sVersion,
-		DisplayName:     req.DisplayName,
-		Status:          queue.StatusPending,
-		StatusUpdatedAt: time.Now(),
-		ExpiresAt:       time.Now().Add(24 * time.Hour),
-		WorkloadType:    workloadType, // ★ WorkloadTypeをセット
+		Owner:            ownerID,
+		K8sVersion:       req.K8sVersion,
+		DisplayName:      req.DisplayName,
+		Status:           queue.StatusPending,
+		StatusUpdatedAt:  now,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(a.lifetimes.lifetimeFor(req.K8sVersion, workloadType)),
+		WorkloadType:     workloadType, // ★ WorkloadTypeをセット
+		CostAllocation:   req.CostAllocation,
+		FromSnapshot:     req.FromSnapshot,
+		EntrypointPreset: req.EntrypointPreset,
+		Template:         req.Template,
+		Namespace:        a.namespaceForOwner(ownerID),
 	}
-	ctx := context.Background()
 	if err := a.redisQueue.AddItem(ctx, item); err != nil {
 		log.Printf("Error creating environment for owner %s (version %s, name %s): %v", ownerID, req.K8sVersion, req.DisplayName, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create environment"})
 		return
 	}
 	log.Printf("Environment created: ID %s, Owner %s, Version %s, Name %s, Type %s", item.ID, item.Owner, item.K8sVersion, item.DisplayName, item.WorkloadType)
+	if queued {
+		c.JSON(http.StatusAccepted, gin.H{"environment": item, "queued": true, "message": "Environment quota reached; the environment will be provisioned when a slot frees up"})
+		return
+	}
 	c.JSON(http.StatusCreated, gin.H{"environment": item})
 }
 
+// validateCostAllocation checks that every key is in the configured allowlist and
+// that keys and values are usable as Kubernetes labels.
+func (a *AppController) validateCostAllocation(costAllocation map[string]string) error {
+	for key, value := range costAllocation {
+		allowed := false
+		for _, allowedKey := range a.costAllocationKeys {
+			if key == allowedKey {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("cost_allocation key '%s' is not allowed", key)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("cost_allocation key '%s' is invalid: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("cost_allocation value for '%s' is invalid: %s", key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
 func (a *AppController) updateEnvironmentDisplayName(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
 	envID := c.Param("id")
@@ -672,10 +1314,14 @@ func (a *AppController) updateEnvironmentDisplayName(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
 		return
 	}
+	if err := validateDisplayName(req.DisplayName); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	ctx := context.Background()
 	item, err := a.redisQueue.GetItem(ctx, envID)
 	if err != nil {
-		if err.Error() == "item not found" {
+		if errors.Is(err, queue.ErrItemNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
 		} else {
 			log.Printf("Error getting environment %s for name update by owner %s: %v", envID, ownerID, err)
@@ -699,76 +1345,230 @@ func (a *AppController) updateEnvironmentDisplayName(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"environment": item})
 }
 
-func (a *AppController) destroyEnvironment(c *gin.Context) {
+// retryEnvironment sends an errored environment back to the generator, keeping its name and version
+func (a *AppController) retryEnvironment(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
-	id := c.Param("id")
+	envID := c.Param("id")
 	ctx := context.Background()
-	item, err := a.redisQueue.GetItem(ctx, id)
+	item, err := a.redisQueue.GetItem(ctx, envID)
 	if err != nil {
-		if err.Error() == "item not found" {
+		if errors.Is(err, queue.ErrItemNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
 		} else {
-			log.Printf("Error getting environment %s for owner %s: %v", id, ownerID, err)
+			log.Printf("Error getting environment %s for retry by owner %s: %v", envID, ownerID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
 		}
 		return
 	}
 	if item.Owner != ownerID {
-		log.Printf("Forbidden: Owner %s attempted to destroy environment %s owned by %s", ownerID, id, item.Owner)
+		log.Printf("Forbidden: Owner %s attempted to retry environment %s owned by %s", ownerID, envID, item.Owner)
 		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
 		return
 	}
-	item.Status = queue.StatusShutdown
-	item.StatusUpdatedAt = time.Now()
+	if item.Status != queue.StatusError {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Only environments in error state can be retried (current status: %s)", item.Status)})
+		return
+	}
+	if item.RetryCount >= queue.MaxRetries {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Retry limit reached (%d). Please delete and recreate the environment", queue.MaxRetries)})
+		return
+	}
+
+	// Remove whatever the failed attempt left behind so the generator starts from a clean workload
+	if item.PodID != "" && a.k8sClient != nil {
+		namespace := item.NamespaceOr(getNamespace())
+		var delErr error
+		if item.WorkloadType == "deployment" {
+			delErr = a.k8sClient.DeleteDinDDeployment(ctx, item.PodID, namespace)
+		} else {
+			delErr = a.k8sClient.DeleteDinDStatefulSet(ctx, item.PodID, namespace)
+		}
+		if delErr != nil {
+			log.Printf("Warning: Failed to clean up workload %s before retrying environment %s: %v", item.PodID, envID, delErr)
+		}
+	}
+
+	item.Status = queue.StatusPending
+	item.ErrorMessage = ""
+	item.PodID = ""
+	item.QuarantineUntil = nil
+	item.RetryCount++
 	if err := a.redisQueue.UpdateItem(ctx, item); err != nil {
-		log.Printf("Error marking environment %s for destruction by owner %s: %v", id, ownerID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to destroy environment"})
+		log.Printf("Error resetting environment %s for retry by owner %s: %v", envID, ownerID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry environment"})
 		return
 	}
-	log.Printf("Environment %s marked for destruction by owner %s", id, ownerID)
-	c.JSON(http.StatusOK, gin.H{"message": "Environment marked for destruction"})
+	log.Printf("Environment %s queued for retry %d/%d by owner %s", item.ID, item.RetryCount, queue.MaxRetries, ownerID)
+	c.JSON(http.StatusOK, gin.H{"environment": item})
 }
 
-func (a *AppController) connectEnvironment(c *gin.Context) {
+// restartEnvironment replaces the pod of an available environment, keeping the environment record,
+// its display name and the data on its volumes. The generator sets it back to available once the
+// new pod is running.
+func (a *AppController) restartEnvironment(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
-	envId := c.Param("id")
+	envID := c.Param("id")
 	ctx := context.Background()
-	item, err := a.redisQueue.GetItem(ctx, envId)
+	item, err := a.redisQueue.GetItem(ctx, envID)
 	if err != nil {
-		log.Printf("Connect: Environment %s not found for owner %s. Error: %v", envId, ownerID, err)
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for restart by owner %s: %v", envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
 		return
 	}
 	if item.Owner != ownerID {
-		log.Printf("Connect: Owner %s attempted to access environment %s owned by %s.", ownerID, envId, item.Owner)
-		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		log.Printf("Forbidden: Owner %s attempted to restart environment %s owned by %s", ownerID, envID, item.Owner)
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
 		return
 	}
-	if item.Status != queue.StatusAvailable {
-		log.Printf("Connect: Environment %s not available for owner %s. Status: %s", envId, ownerID, item.Status)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Environment not available"})
+	if item.Status != queue.StatusAvailable || item.PodID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Only available environments can be restarted (current status: %s)", item.Status)})
 		return
 	}
 	if a.k8sClient == nil {
-		log.Printf("Connect: Kubernetes client not available for environment %s, owner %s.", envId, ownerID)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Kubernetes client not available"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Kubernetes client not available"})
 		return
 	}
-	if item.PodID == "" {
-		log.Printf("Connect: Pod ID (StatefulSet name) not available for environment %s, owner %s.", envId, ownerID)
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Pod ID not available"})
+
+	// Announce the restart before touching the pod so open terminals wait for the new one
+	requestedAt := time.Now()
+	item.Status = queue.StatusRestarting
+	item.RestartRequestedAt = &requestedAt
+	if err := a.redisQueue.UpdateItem(ctx, item); err != nil {
+		log.Printf("Error marking environment %s as restarting: %v", envID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restart environment"})
 		return
 	}
 
-	namespace := os.Getenv("NAMESPACE")
-	if namespace == "" {
-		namespace = "default"
+	namespace := item.NamespaceOr(getNamespace())
+	if err := a.k8sClient.RestartDinDPod(ctx, item.PodID, item.WorkloadType, namespace, requestedAt); err != nil {
+		log.Printf("Error restarting pod of environment %s: %v", envID, err)
+		item.Status = queue.StatusAvailable
+		item.RestartRequestedAt = nil
+		if updateErr := a.redisQueue.UpdateItem(ctx, item); updateErr != nil {
+			log.Printf("Failed to set environment %s back to available: %v", envID, updateErr)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restart environment"})
+		return
 	}
 
-	var podName string
-	var errGetPod error
+	log.Printf("Environment %s restart requested by owner %s", envID, ownerID)
+	c.JSON(http.StatusAccepted, gin.H{"environment": item})
+}
 
-	// ★ ワークロードタイプに応じてPod名を取得する方法を分岐
+func (a *AppController) destroyEnvironment(c *gin.Context) {
+	ownerID := c.MustGet("owner_id").(string)
+	id := c.Param("id")
+	ctx := context.Background()
+	item, err := a.redisQueue.GetItem(ctx, id)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for owner %s: %v", id, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
+		return
+	}
+	if item.Owner != ownerID {
+		log.Printf("Forbidden: Owner %s attempted to destroy environment %s owned by %s", ownerID, id, item.Owner)
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return
+	}
+	item.Status = queue.StatusShutdown
+	item.StatusUpdatedAt = time.Now()
+	if err := a.redisQueue.UpdateItem(ctx, item); err != nil {
+		log.Printf("Error marking environment %s for destruction by owner %s: %v", id, ownerID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to destroy environment"})
+		return
+	}
+	log.Printf("Environment %s marked for destruction by owner %s", id, ownerID)
+	c.JSON(http.StatusOK, gin.H{"message": "Environment marked for destruction"})
+}
+
+// destroyAllEnvironments marks every environment of the caller that is not already shutting down
+// for destruction. Calling it again only affects environments created in the meantime.
+func (a *AppController) destroyAllEnvironments(c *gin.Context) {
+	ownerID := c.MustGet("owner_id").(string)
+	ctx := context.Background()
+	// Environments already shut down or terminated are left alone
+	items, err := a.redisQueue.GetItemsByStatusesAndOwner(ctx, []queue.QueueStatus{queue.StatusPending, queue.StatusGenerating, queue.StatusError, queue.StatusAvailable, queue.StatusRestarting}, ownerID)
+	if err != nil {
+		log.Printf("Error getting environments of owner %s for bulk destruction: %v", ownerID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environments"})
+		return
+	}
+
+	destroyed := []string{}
+	failed := []string{}
+	for _, item := range items {
+		item.Status = queue.StatusShutdown
+		if err := a.redisQueue.UpdateItem(ctx, item); err != nil {
+			log.Printf("Error marking environment %s for destruction by owner %s: %v", item.ID, ownerID, err)
+			failed = append(failed, item.ID)
+			continue
+		}
+		destroyed = append(destroyed, item.ID)
+	}
+
+	log.Printf("%d environments of owner %s marked for destruction", len(destroyed), ownerID)
+	if len(failed) > 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to destroy some environments", "count": len(destroyed), "ids": destroyed, "failed_ids": failed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": len(destroyed), "ids": destroyed})
+}
+
+func (a *AppController) connectEnvironment(c *gin.Context) {
+	ownerID := c.MustGet("owner_id").(string)
+	envId := c.Param("id")
+	ctx := context.Background()
+	item, err := a.redisQueue.GetItem(ctx, envId)
+	if err != nil {
+		log.Printf("Connect: Environment %s not found for owner %s. Error: %v", envId, ownerID, err)
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		return
+	}
+	if item.Owner != ownerID {
+		log.Printf("Connect: Owner %s attempted to access environment %s owned by %s.", ownerID, envId, item.Owner)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return
+	}
+	if item.Status != queue.StatusAvailable {
+		log.Printf("Connect: Environment %s not available for owner %s. Status: %s", envId, ownerID, item.Status)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Environment not available"})
+		return
+	}
+	if a.terminalSessions.isDraining() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": serverRestartReason})
+		return
+	}
+	if a.k8sClient == nil {
+		log.Printf("Connect: Kubernetes client not available for environment %s, owner %s.", envId, ownerID)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Kubernetes client not available"})
+		return
+	}
+	if item.PodID == "" {
+		log.Printf("Connect: Pod ID (StatefulSet name) not available for environment %s, owner %s.", envId, ownerID)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Pod ID not available"})
+		return
+	}
+
+	shell, cwd, err := parseShellOptions(c.Query("shell"), c.Query("cwd"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	namespace := item.NamespaceOr(getNamespace())
+
+	var podName string
+	var errGetPod error
+
+	// ★ ワークロードタイプに応じてPod名を取得する方法を分岐
 	if item.WorkloadType == "deployment" {
 		podName, errGetPod = a.k8sClient.GetPodNameForWorkload(c.Request.Context(), item.PodID, namespace)
 	} else {
@@ -783,32 +1583,49 @@ func (a *AppController) connectEnvironment(c *gin.Context) {
 
 	log.Printf("Attempting to connect to pod %s for workload %s (env %s)", podName, item.PodID, envId)
 
+	if !a.acquireSession(ownerID) {
+		log.Printf("Connect: Owner %s already has %d terminal sessions open, rejecting env %s", ownerID, a.maxSessionsPerUser, envId)
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Too many open terminal sessions (limit %d). Close another terminal and try again", a.maxSessionsPerUser)})
+		return
+	}
+
 	conn, err := a.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade WebSocket connection for env %s, owner %s: %v", envId, ownerID, err)
+		a.releaseSession(ownerID)
 		return
 	}
 	log.Printf("WebSocket connection upgraded for env %s, owner %s", envId, ownerID)
 	// ★ handleTerminalSessionにpodNameとnamespaceを渡すように変更
-	a.handleTerminalSession(conn, item, podName, namespace)
+	a.handleTerminalSession(conn, item, podName, namespace, shell, cwd)
 }
 
 // ★ handleTerminalSessionのシグネチャを変更
-func (a *AppController) handleTerminalSession(conn *websocket.Conn, item *queue.QueueItem, podName string, namespace string) {
+func (a *AppController) handleTerminalSession(conn *websocket.Conn, item *queue.QueueItem, podName string, namespace string, shell string, cwd string) {
+	// Why the session ended, sent to the browser in the close frame
+	closeCode, closeReason := websocket.CloseNormalClosure, "Shell exited"
+	// Removes the session from the registry only once its connection is closed, so Drain
+	// does not return before the close frame was sent
+	unregister := func() {}
 	defer func() {
-		log.Printf("Closing WebSocket for session to pod %s (env %s)", podName, item.ID)
+		log.Printf("Closing WebSocket for session to pod %s (env %s): %d %s", podName, item.ID, closeCode, closeReason)
+		a.sendCloseFrame(conn, closeCode, closeReason)
 		conn.Close()
+		a.releaseSession(item.Owner)
+		unregister()
 	}()
 
 	running, err := a.k8sClient.IsPodRunning(context.Background(), podName, namespace)
 	if err != nil {
 		log.Printf("Error re-checking pod status for %s: %v", podName, err)
 		a.sendErrorMessage(conn, fmt.Sprintf("Error checking pod status: %v", err))
+		closeCode, closeReason = websocket.CloseInternalServerErr, "Error checking pod status"
 		return
 	}
 	if !running {
 		log.Printf("Pod %s is no longer running before exec", podName)
 		a.sendErrorMessage(conn, "Pod is not running")
+		closeCode, closeReason = closeCodePodGone, "Pod is not running"
 		return
 	}
 
@@ -819,9 +1636,23 @@ func (a *AppController) handleTerminalSession(conn *websocket.Conn, item *queue.
 	// Get user information for logging
 	ownerID := item.Owner
 	userName := ownerID // Default to owner ID
-	
+
 	// Create WSClient with logging capability
-	wsClient := NewWSClientWithLogging(conn, session, item.ID, ownerID, userName, podName, sessionId, a.loggingController)
+	wsClient := NewWSClientWithLogging(conn, session, a.wsSettings, item.ID, ownerID, userName, podName, sessionId, a.loggingController)
+	wsClient.redisQueue = a.redisQueue
+	wsClient.maxInputBytes = a.maxSessionInputBytes
+	wsClient.outputLimiter = newOutputLimiter(a.maxSessionOutputRate)
+	// Only bash can be instrumented; other shells keep keystroke parsing
+	commandLogPath := ""
+	if a.commandLogMode == commandLogModeShell && shell == defaultShell {
+		commandLogPath = shellCommandLogPath(sessionId)
+	}
+	wsClient.viewers = a.viewers
+	wsClient.markInput()
+	wsClient.recordActivity()
+	if err := a.redisQueue.RecordHistory(context.Background(), item.ID, queue.HistoryEvent{Type: queue.HistoryEventConnected}); err != nil {
+		log.Printf("Failed to record connection of session %s in history: %v", sessionId, err)
+	}
 
 	_, initialMessage, err := conn.ReadMessage()
 	if err != nil {
@@ -834,48 +1665,161 @@ func (a *AppController) handleTerminalSession(conn *websocket.Conn, item *queue.
 	}
 	if err := json.Unmarshal(initialMessage, &initMsg); err != nil {
 		log.Printf("Could not parse initial JSON from client for session %s: %v. Using defaults.", sessionId, err)
-		initMsg.Cols = 80
-		initMsg.Rows = 24
+		initMsg.Cols = int(a.defaultTermCols)
+		initMsg.Rows = int(a.defaultTermRows)
 	}
 	if initMsg.Cols > 0 && initMsg.Rows > 0 {
-		session.Resize(uint16(initMsg.Cols), uint16(initMsg.Rows))
+		session.Resize(clampTerminalSize(initMsg.Cols, minTerminalCols, maxTerminalCols), clampTerminalSize(initMsg.Rows, minTerminalRows, maxTerminalRows))
 	} else {
-		session.Resize(80, 24)
+		session.Resize(a.defaultTermCols, a.defaultTermRows)
 	}
 	displayName := item.DisplayName
 	if displayName == "" {
 		displayName = item.ID[:8]
 	}
-	a.sendRawMessage(conn, fmt.Sprintf("\x1b[32mWelcome! Connecting to your Kubernetes environment '%s' (Pod: %s)...\x1b[0m\r\n", displayName, podName))
+	wsClient.sendRaw(fmt.Sprintf("\x1b[32mWelcome! Connecting to your Kubernetes environment '%s' (Pod: %s)...\x1b[0m\r\n", displayName, podName))
 
-	containerName := "dind"
-	command := []string{"/bin/bash", "-c", "cd /root && exec /bin/bash"}
-	execCtx, cancelExec := context.WithCancel(context.Background())
+	command := shellCommand("/bin/bash", shell, cwd, commandLogPath)
+	var execCtx context.Context
+	var cancelExec context.CancelFunc
+	if a.maxSessionDuration > 0 {
+		execCtx, cancelExec = context.WithTimeout(context.Background(), a.maxSessionDuration)
+	} else {
+		execCtx, cancelExec = context.WithCancel(context.Background())
+	}
 	defer cancelExec()
 
-	go func() {
-		defer cancelExec()
-		log.Printf("Starting exec for session %s in pod %s", sessionId, podName)
-		err := a.k8sClient.ExecInPod(execCtx, namespace, podName, containerName, command, wsClient, wsClient, wsClient, session)
-		if err != nil {
-			errMsg := fmt.Sprintf("Terminal session error: %v", err)
-			log.Printf("Exec error for session %s: %v", sessionId, err)
-			if conn.UnderlyingConn() != nil {
-				a.sendErrorMessage(conn, errMsg)
+	registered := a.terminalSessions.add(ActiveSession{
+		ID:            sessionId,
+		Owner:         ownerID,
+		EnvironmentID: item.ID,
+		PodName:       podName,
+		Namespace:     namespace,
+		ConnectedAt:   time.Now(),
+	}, cancelExec)
+	unregister = func() { a.terminalSessions.remove(sessionId) }
+
+	go a.watchSessionDeadlines(execCtx, wsClient, time.Now(), cancelExec)
+
+	statusChanges, stopWatching := a.watchStatus(item.ID)
+	defer stopWatching()
+	stopExpiryWarnings := a.watchExpiry(item.ID, wsClient)
+	defer stopExpiryWarnings()
+	warnIfExpiring(wsClient, item)
+	wsClient.startReadPump()
+
+	for {
+		stopCommandLog := func() {}
+		if commandLogPath != "" {
+			stopCommandLog = a.tailShellCommands(execCtx, wsClient, namespace, podName, commandLogPath)
+		}
+		recreating, err := a.runExec(execCtx, wsClient, session, namespace, podName, command, statusChanges)
+		stopCommandLog()
+
+		if registered.ended.Load() {
+			log.Printf("Terminal session %s ended: %s", sessionId, registered.endReason)
+			closeCode, closeReason = registered.endCode, registered.endReason
+			wsClient.sendError(closeReason)
+			break
+		}
+		if reason := sessionCapReason(execCtx, wsClient); reason != "" {
+			log.Printf("Terminal session %s closed by %s limit", sessionId, reason)
+			cappedTerminalSessions.Add(reason, 1)
+			closeCode, closeReason = closeCodeSessionLimit, fmt.Sprintf("Session closed: %s limit reached", strings.ReplaceAll(reason, "_", " "))
+			wsClient.sendError(closeReason)
+			break
+		}
+		if wsClient.disconnected() {
+			log.Printf("Client of terminal session %s disconnected: %v", sessionId, wsClient.readErr)
+			closeCode, closeReason = websocket.CloseGoingAway, "Client disconnected"
+			break
+		}
+		if execCtx.Err() != nil {
+			break
+		}
+
+		if k8s.IsExecutableNotFound(err) && command[0] != fallbackInterpreter {
+			log.Printf("%s not found in pod %s for session %s, falling back to %s", command[0], podName, sessionId, fallbackInterpreter)
+			command = shellCommand(fallbackInterpreter, shell, cwd, commandLogPath)
+			continue
+		}
+		if !recreating {
+			recreating = a.awaitRecreate(execCtx, item.ID, statusChanges)
+		}
+		if !recreating {
+			if err != nil {
+				log.Printf("Exec error for session %s: %v", sessionId, err)
+				wsClient.sendError(fmt.Sprintf("Terminal session error: %v", err))
+				closeCode, closeReason = websocket.CloseInternalServerErr, "Terminal session error"
+				if running, checkErr := a.k8sClient.IsPodRunning(context.Background(), podName, namespace); checkErr == nil && !running {
+					closeCode, closeReason = closeCodePodGone, "The environment's pod is no longer running"
+				}
 			}
+			break
 		}
-		log.Printf("Exec finished for session %s", sessionId)
-	}()
 
-	select {
-	case <-session.Done():
-		log.Printf("Terminal session %s marked as done.", sessionId)
-	case <-execCtx.Done():
-		log.Printf("Exec context for session %s done: %v", sessionId, execCtx.Err())
+		// The environment is being recreated: keep the WebSocket open and move the session to the new pod
+		wsClient.sendWarning("Environment is restarting, reconnecting...")
+		refreshed, err := a.waitForEnvironmentAvailable(execCtx, wsClient, item.ID, statusChanges)
+		if err == nil {
+			namespace = refreshed.NamespaceOr(getNamespace())
+			podName, err = a.resolvePodName(execCtx, refreshed, namespace)
+		}
+		if err != nil && registered.ended.Load() {
+			closeCode, closeReason = registered.endCode, registered.endReason
+			wsClient.sendError(closeReason)
+			break
+		}
+		if err != nil {
+			log.Printf("Could not reconnect terminal session %s: %v", sessionId, err)
+			if !wsClient.disconnected() {
+				wsClient.sendError(fmt.Sprintf("Could not reconnect: %v", err))
+			}
+			closeCode, closeReason = closeCodePodGone, "The environment did not come back after restarting"
+			break
+		}
+		log.Printf("Reconnecting terminal session %s to pod %s", sessionId, podName)
+		a.terminalSessions.moved(sessionId, podName, namespace)
+		wsClient.sendWarning(fmt.Sprintf("Reconnected to the restarted environment (Pod: %s). A new shell has been started.", podName))
 	}
 	log.Printf("Exiting handleTerminalSession for session %s", sessionId)
 }
 
+// sessionCapReason reports which configured session limit, if any, ended the exec stream
+func sessionCapReason(execCtx context.Context, wsClient *WSClient) string {
+	if wsClient.inputCapped.Load() {
+		return "input_bytes"
+	}
+	if wsClient.idleDisconnected.Load() {
+		return "idle"
+	}
+	if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+		return "duration"
+	}
+	return ""
+}
+
+// Application close codes (4000-4999) sent when a terminal session ends for a reason other
+// than the shell exiting (1000) or a server error (1011)
+const (
+	closeCodePodGone           = 4001 // the environment's pod is not running any more
+	closeCodeSessionLimit      = 4002 // a session limit (duration, idle time, input bytes) was reached
+	closeCodeShareRevoked      = 4003 // the share link of a read-only viewer expired or was revoked
+	closeCodeTerminatedByAdmin = 4004 // an administrator ended the session
+)
+
+// maxCloseReasonLen is the longest reason that fits in a close frame's 125-byte payload
+const maxCloseReasonLen = 123
+
+// sendCloseFrame tells the client why the connection is about to be closed. Errors are ignored
+// since the client may already be gone.
+func (a *AppController) sendCloseFrame(conn *websocket.Conn, code int, reason string) {
+	if len(reason) > maxCloseReasonLen {
+		reason = reason[:maxCloseReasonLen]
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(a.wsSettings.writeWait))
+}
+
 func (a *AppController) sendErrorMessage(conn *websocket.Conn, message string) {
 	msg := TerminalMessage{Operation: "error", Data: "\x1b[31m" + message + "\x1b[0m\r\n"}
 	jsonData, err := json.Marshal(msg)
@@ -926,8 +1870,20 @@ func (a *AppController) adminMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// For Google auth, check if user is in admin list (environment variable)
-		if a.authMethod == "google" {
+		// For single sign-on, admins are the members of ADMIN_GROUP. Users whose ID token had no
+		// groups claim are checked against the ADMIN_USERS email list instead.
+		if a.usesOIDC() {
+			adminGroup := getEnv("ADMIN_GROUP", "")
+			if groups, ok := c.Get("user_groups"); ok && adminGroup != "" {
+				if !slices.Contains(groups.([]string), adminGroup) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "Access denied: admin privileges required"})
+					c.Abort()
+					return
+				}
+				c.Next()
+				return
+			}
+
 			adminUsers := getEnv("ADMIN_USERS", "")
 			if adminUsers == "" {
 				c.JSON(http.StatusForbidden, gin.H{"error": "No admin users configured"})
@@ -935,11 +1891,18 @@ func (a *AppController) adminMiddleware() gin.HandlerFunc {
 				return
 			}
 
-			userEmail := ownerID.(string)
+			// ADMIN_USERS lists emails. The owner ID is one when OIDC_OWNER_CLAIM is email, which
+			// requires it to be verified; otherwise only a verified email is set.
+			userEmail := ""
+			if a.oidcProvider.OwnerClaim() == "email" {
+				userEmail = ownerID.(string)
+			} else if email, ok := c.Get("user_email"); ok {
+				userEmail = email.(string)
+			}
 			adminList := strings.Split(adminUsers, ",")
 			isAdmin := false
 			for _, admin := range adminList {
-				if strings.TrimSpace(admin) == userEmail {
+				if userEmail != "" && strings.TrimSpace(admin) == userEmail {
 					isAdmin = true
 					break
 				}
@@ -961,8 +1924,8 @@ func (a *AppController) adminDashboard(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
 	displayName := ownerID
 	userPicture := ""
-	
-	if a.authMethod == "google" {
+
+	if a.usesOIDC() {
 		name, okName := c.Get("user_name")
 		pic, okPic := c.Get("user_picture")
 		if okName {
@@ -974,13 +1937,13 @@ func (a *AppController) adminDashboard(c *gin.Context) {
 	} else if a.authMethod == "password" {
 		displayName = "Admin (Password Auth)"
 	}
-	
+
 	c.HTML(http.StatusOK, "admin-dashboard.html", gin.H{
-		"title": "k8s Playground - Admin Dashboard", 
-		"OwnerID": ownerID, 
-		"DisplayName": displayName, 
-		"UserPicture": userPicture, 
-		"AuthMethod": a.authMethod,
+		"title":       "k8s Playground - Admin Dashboard",
+		"OwnerID":     ownerID,
+		"DisplayName": displayName,
+		"UserPicture": userPicture,
+		"AuthMethod":  a.authMethod,
 	})
 }
 
@@ -994,34 +1957,156 @@ func (a *AppController) getCommandLogs(c *gin.Context) {
 
 	limit := 100
 	offset := 0
-	
+
 	if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
 		limit = l
 	}
-	
+
 	if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
 		offset = o
 	}
 
-	// Use internal API if available, otherwise fallback to direct access
+	logs, err := a.fetchCommandLogs(userID, environmentID, limit, offset)
+	if err != nil {
+		log.Printf("Error getting command logs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve command logs"})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		a.writeCommandLogsCSV(c, logs)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"logs": logs, "count": len(logs)})
+}
+
+// fetchCommandLogs uses the logging controller's internal API if available, otherwise falls back to direct access
+func (a *AppController) fetchCommandLogs(userID, environmentID string, limit, offset int) ([]CommandLog, error) {
 	if a.loggingControllerAPIURL != "" && a.loggingAdminToken != "" {
 		logs, err := a.fetchLogsFromAPI(userID, environmentID, limit, offset)
 		if err == nil {
-			c.JSON(http.StatusOK, gin.H{"logs": logs, "count": len(logs)})
-			return
+			return logs, nil
 		}
 		log.Printf("Failed to fetch logs from API, falling back to direct access: %v", err)
 	}
+	return a.loggingController.GetCommandLogs(userID, environmentID, limit, offset)
+}
+
+// writeCommandLogsCSV streams command logs as a CSV attachment
+func (a *AppController) writeCommandLogsCSV(c *gin.Context, logs []CommandLog) {
+	filename := "command-logs.csv"
+	if len(logs) > 0 {
+		// Logs are sorted newest first
+		from := logs[len(logs)-1].Timestamp.Format("20060102")
+		to := logs[0].Timestamp.Format("20060102")
+		filename = fmt.Sprintf("command-logs-%s-%s.csv", from, to)
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	if err := writer.Write([]string{"timestamp", "user_id", "user_name", "environment_id", "pod_name", "session_id", "command"}); err != nil {
+		log.Printf("Error writing CSV header: %v", err)
+		return
+	}
+	for _, entry := range logs {
+		record := []string{
+			entry.Timestamp.Format(time.RFC3339),
+			csvCell(entry.UserID),
+			csvCell(entry.UserName),
+			csvCell(entry.EnvironmentID),
+			csvCell(entry.PodName),
+			csvCell(entry.SessionID),
+			csvCell(entry.Command),
+		}
+		if err := writer.Write(record); err != nil {
+			log.Printf("Error writing CSV record: %v", err)
+			return
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Error flushing CSV output: %v", err)
+	}
+}
+
+// csvCell keeps spreadsheets from evaluating a cell as a formula. Commands are typed by users,
+// so a value starting with =, +, -, @, a tab or a carriage return is prefixed with a quote.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
 
-	// Fallback to direct access
-	logs, err := a.loggingController.GetCommandLogs(userID, environmentID, limit, offset)
+// getLogBuffer reports how many command logs are waiting in Redis to be persisted
+func (a *AppController) getLogBuffer(c *gin.Context) {
+	length, err := a.loggingController.BufferLength(c.Request.Context())
 	if err != nil {
-		log.Printf("Error getting command logs: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve command logs"})
+		log.Printf("Error reading command log buffer length: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the log buffer"})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"length": length})
+}
 
-	c.JSON(http.StatusOK, gin.H{"logs": logs, "count": len(logs)})
+// flushLogBuffer persists the buffered command logs synchronously. The logging controller does
+// the writing when its API is configured, so the logs land on its volume; otherwise they are
+// written directly, as with reading logs.
+func (a *AppController) flushLogBuffer(c *gin.Context) {
+	if a.loggingControllerAPIURL != "" && a.loggingAdminToken != "" {
+		flushed, length, err := a.flushLogBufferViaAPI()
+		if err == nil {
+			c.JSON(http.StatusOK, gin.H{"flushed": flushed, "length": length})
+			return
+		}
+		log.Printf("Failed to flush log buffer via API, falling back to direct access: %v", err)
+	}
+
+	flushed, err := a.loggingController.FlushBuffer(c.Request.Context())
+	if err != nil {
+		log.Printf("Error flushing command log buffer after %d entries: %v", flushed, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to flush the log buffer", "flushed": flushed})
+		return
+	}
+	length, err := a.loggingController.BufferLength(c.Request.Context())
+	if err != nil {
+		log.Printf("Error reading command log buffer length: %v", err)
+	}
+	log.Printf("Flushed %d buffered command logs", flushed)
+	c.JSON(http.StatusOK, gin.H{"flushed": flushed, "length": length})
+}
+
+// flushLogBufferViaAPI asks the logging controller to flush its buffer
+func (a *AppController) flushLogBufferViaAPI() (int, int64, error) {
+	req, err := http.NewRequest("POST", a.loggingControllerAPIURL+"/admin/buffer", nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-Admin-Token", a.loggingAdminToken)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("API returned status %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Flushed int   `json:"flushed"`
+		Length  int64 `json:"length"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return 0, 0, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return response.Flushed, response.Length, nil
 }
 
 // fetchLogsFromAPI calls the logging controller's internal API
@@ -1064,28 +2149,123 @@ func (a *AppController) fetchLogsFromAPI(userID, environmentID string, limit, of
 	return response.Logs, nil
 }
 
-// getAllEnvironments returns all environments for admin users
+// getEnvironmentHistory returns the lifecycle timeline of one of the caller's environments
+func (a *AppController) getEnvironmentHistory(c *gin.Context) {
+	item := a.ownedEnvironment(c)
+	if item == nil {
+		return
+	}
+	a.respondHistory(c, item.ID)
+}
+
+// getEnvironmentHistoryAdmin returns the lifecycle timeline of any environment for admin users
+func (a *AppController) getEnvironmentHistoryAdmin(c *gin.Context) {
+	a.respondHistory(c, c.Param("id"))
+}
+
+func (a *AppController) respondHistory(c *gin.Context, environmentID string) {
+	events, err := a.redisQueue.GetHistory(c.Request.Context(), environmentID)
+	if err != nil {
+		log.Printf("Error getting history of environment %s: %v", environmentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment history"})
+		return
+	}
+	connections := 0
+	for _, event := range events {
+		if event.Type == queue.HistoryEventConnected {
+			connections++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "connections": connections})
+}
+
+// getAllEnvironments returns environments for admin users, most recently updated first.
+// Supports the status and owner filters and limit/offset paging; total counts all matches.
 func (a *AppController) getAllEnvironments(c *gin.Context) {
+	status := c.Query("status")
+	owner := c.Query("owner")
+	limitStr := c.DefaultQuery("limit", "100")
+	offsetStr := c.DefaultQuery("offset", "0")
+
+	limit := 100
+	offset := 0
+
+	if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+		offset = o
+	}
+
 	ctx := context.Background()
-	environments, err := a.redisQueue.GetAllItems(ctx)
+	var statuses []queue.QueueStatus
+	if status != "" {
+		statuses = []queue.QueueStatus{queue.QueueStatus(status)}
+	}
+	environments, err := a.redisQueue.GetItemsByStatusesAndOwner(ctx, statuses, owner)
 	if err != nil {
 		log.Printf("Error getting all environments for admin: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get environments"})
 		return
 	}
-	
-	c.JSON(http.StatusOK, gin.H{"environments": environments})
+	if environments == nil {
+		environments = []*queue.QueueItem{}
+	}
+	sort.Slice(environments, func(i, j int) bool {
+		if !environments[i].CreatedAt.Equal(environments[j].CreatedAt) {
+			return environments[i].CreatedAt.After(environments[j].CreatedAt)
+		}
+		return environments[i].ID < environments[j].ID
+	})
+
+	total := len(environments)
+	start := min(offset, total)
+	end := min(start+limit, total)
+	c.JSON(http.StatusOK, gin.H{"environments": environments[start:end], "total": total, "limit": limit, "offset": offset})
+}
+
+// listDiagnostics lists the retained provisioning failure bundles for admin users
+func (a *AppController) listDiagnostics(c *gin.Context) {
+	summaries, err := a.redisQueue.ListDiagnostics(c.Request.Context())
+	if err != nil {
+		log.Printf("Error listing diagnostics for admin: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list diagnostics"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"diagnostics": summaries})
+}
+
+// getDiagnostics returns the provisioning failure bundle of an environment; ?download=true serves it as a file
+func (a *AppController) getDiagnostics(c *gin.Context) {
+	envID := c.Param("id")
+	bundle, err := a.redisQueue.GetDiagnostics(c.Request.Context(), envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrDiagnosticsNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No diagnostics retained for this environment"})
+		} else {
+			log.Printf("Error getting diagnostics for environment %s: %v", envID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get diagnostics"})
+		}
+		return
+	}
+	if c.Query("download") == "true" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"diagnostics-%s.json\"", bundle.EnvironmentID))
+		c.IndentedJSON(http.StatusOK, bundle)
+		return
+	}
+	c.JSON(http.StatusOK, bundle)
 }
 
 // getEnvironmentServices returns the list of services running in the DinD Pod
 func (a *AppController) getEnvironmentServices(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
 	envID := c.Param("id")
-	
+
 	ctx := context.Background()
 	item, err := a.redisQueue.GetItem(ctx, envID)
 	if err != nil {
-		if err.Error() == "item not found" {
+		if errors.Is(err, queue.ErrItemNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
 		} else {
 			log.Printf("Error getting environment %s for services by owner %s: %v", envID, ownerID, err)
@@ -1093,28 +2273,25 @@ func (a *AppController) getEnvironmentServices(c *gin.Context) {
 		}
 		return
 	}
-	
+
 	if item.Owner != ownerID {
 		log.Printf("Forbidden: Owner %s attempted to access services for environment %s owned by %s", ownerID, envID, item.Owner)
 		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
 		return
 	}
-	
+
 	if item.Status != queue.StatusAvailable {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Environment is not available"})
 		return
 	}
-	
+
 	if item.PodID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Pod ID not available"})
 		return
 	}
-	
-	namespace := os.Getenv("NAMESPACE")
-	if namespace == "" {
-		namespace = "default"
-	}
-	
+
+	namespace := item.NamespaceOr(getNamespace())
+
 	var podName string
 	if item.WorkloadType == "deployment" {
 		podName, err = a.k8sClient.GetPodNameForWorkload(c.Request.Context(), item.PodID, namespace)
@@ -1126,322 +2303,549 @@ func (a *AppController) getEnvironmentServices(c *gin.Context) {
 	} else {
 		podName = fmt.Sprintf("%s-0", item.PodID)
 	}
-	
+
+	if c.Query("refresh") == "true" {
+		a.k8sClient.InvalidateServiceCache(podName, namespace)
+	}
 	services, err := a.k8sClient.GetServicesInPod(c.Request.Context(), podName, namespace)
 	if err != nil {
 		log.Printf("Error getting services for pod %s in environment %s: %v", podName, envID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve services"})
 		return
 	}
-	
+
 	c.JSON(http.StatusOK, gin.H{"services": services})
 }
 
-// proxyToPod proxies HTTP requests to services running inside the DinD Pod
-func (a *AppController) proxyToPod(c *gin.Context) {
+// snapshotEnvironment saves the environment's Docker images and home directory to the owner's NFS share
+func (a *AppController) snapshotEnvironment(c *gin.Context) {
 	ownerID := c.MustGet("owner_id").(string)
 	envID := c.Param("id")
-	path := c.Param("path")
-	
+
 	ctx := context.Background()
 	item, err := a.redisQueue.GetItem(ctx, envID)
 	if err != nil {
-		if err.Error() == "item not found" {
+		if errors.Is(err, queue.ErrItemNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
 		} else {
-			log.Printf("Error getting environment %s for proxy by owner %s: %v", envID, ownerID, err)
+			log.Printf("Error getting environment %s for snapshot by owner %s: %v", envID, ownerID, err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
 		}
 		return
 	}
-	
+
 	if item.Owner != ownerID {
-		log.Printf("Forbidden: Owner %s attempted to proxy to environment %s owned by %s", ownerID, envID, item.Owner)
+		log.Printf("Forbidden: Owner %s attempted to snapshot environment %s owned by %s", ownerID, envID, item.Owner)
 		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
 		return
 	}
-	
-	if item.Status != queue.StatusAvailable {
+
+	if item.Status != queue.StatusAvailable || item.PodID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Environment is not available"})
 		return
 	}
-	
+
+	namespace := item.NamespaceOr(getNamespace())
+	podName, err := a.resolvePodName(c.Request.Context(), item, namespace)
+	if err != nil {
+		log.Printf("Failed to get pod name for workload %s (env %s): %v", item.PodID, envID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find the running pod for the environment"})
+		return
+	}
+
+	snapshotID := strings.ToLower(fmt.Sprintf("%s-%s", item.ID[:8], time.Now().UTC().Format("20060102-150405")))
+	if err := a.k8sClient.CreateSnapshot(c.Request.Context(), podName, namespace, snapshotID, item.ID); err != nil {
+		log.Printf("Error creating snapshot for environment %s: %v", envID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create snapshot"})
+		return
+	}
+
+	log.Printf("Snapshot %s created for environment %s by owner %s", snapshotID, envID, ownerID)
+	c.JSON(http.StatusCreated, gin.H{"snapshot_id": snapshotID})
+}
+
+// getEnvironmentKubeconfig returns a kubeconfig for the environment's inner cluster as a file.
+// Its server is https://127.0.0.1:<port> (the optional port query parameter, default the inner
+// API server's port), so it only connects once that local port is forwarded to the DinD pod.
+// That needs access to the cluster running the playground, so the dashboard does not offer it.
+func (a *AppController) getEnvironmentKubeconfig(c *gin.Context) {
+	item := a.ownedEnvironment(c)
+	if item == nil {
+		return
+	}
+	if item.Status != queue.StatusAvailable || item.PodID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Environment is not available"})
+		return
+	}
+
+	localPort := 0
+	if raw := c.Query("port"); raw != "" {
+		port, err := strconv.Atoi(raw)
+		if err != nil || port < 1 || port > 65535 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "port must be between 1 and 65535"})
+			return
+		}
+		localPort = port
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	namespace := item.NamespaceOr(getNamespace())
+	podName, err := a.resolvePodName(ctx, item, namespace)
+	if err != nil {
+		log.Printf("Error resolving pod of environment %s for kubeconfig: %v", item.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Environment pod not found"})
+		return
+	}
+
+	name := "playground-" + item.ID[:8]
+	kubeconfig, _, err := a.k8sClient.InnerClusterKubeconfig(ctx, podName, namespace, name, localPort)
+	if err != nil {
+		log.Printf("Error reading kubeconfig of environment %s: %v", item.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to read the environment's kubeconfig"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"kubeconfig-%s.yaml\"", item.ID[:8]))
+	c.Data(http.StatusOK, "application/yaml", kubeconfig)
+}
+
+// getEnvironmentReady reports whether the environment can be connected to right now.
+// Pod and inner cluster checks are cached briefly so clients can poll this endpoint in a wait loop.
+func (a *AppController) getEnvironmentReady(c *gin.Context) {
+	ownerID := c.MustGet("owner_id").(string)
+	envID := c.Param("id")
+
+	item, err := a.redisQueue.GetItem(c.Request.Context(), envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for readiness by owner %s: %v", envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
+		return
+	}
+	if item.Owner != ownerID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return
+	}
+
+	if item.Status != queue.StatusAvailable || item.PodID == "" {
+		c.JSON(http.StatusOK, gin.H{"ready": false, "reason": fmt.Sprintf("environment status is %s", item.Status)})
+		return
+	}
+
+	cacheKey := item.ID + "/" + item.PodID
+	if cached, ok := a.readinessCache.Load(cacheKey); ok {
+		result := cached.(readinessResult)
+		if time.Since(result.checkedAt) < readinessCacheTTL {
+			c.JSON(http.StatusOK, gin.H{"ready": result.ready, "reason": result.reason})
+			return
+		}
+	}
+
+	result := a.checkEnvironmentReady(c.Request.Context(), item)
+	// Drop entries for environments nobody is polling any more
+	a.readinessCache.Range(func(key, value interface{}) bool {
+		if time.Since(value.(readinessResult).checkedAt) > time.Minute {
+			a.readinessCache.Delete(key)
+		}
+		return true
+	})
+	a.readinessCache.Store(cacheKey, result)
+	c.JSON(http.StatusOK, gin.H{"ready": result.ready, "reason": result.reason})
+}
+
+func (a *AppController) checkEnvironmentReady(ctx context.Context, item *queue.QueueItem) readinessResult {
+	result := readinessResult{checkedAt: time.Now()}
+	namespace := item.NamespaceOr(getNamespace())
+
+	podName, err := a.resolvePodName(ctx, item, namespace)
+	if err != nil {
+		result.reason = "pod not found"
+		return result
+	}
+
+	ready, reason, err := a.k8sClient.IsEnvironmentReady(ctx, podName, namespace)
+	if err != nil {
+		log.Printf("Readiness: check failed for env %s: %v", item.ID, err)
+		result.reason = "readiness check failed"
+		return result
+	}
+	if !ready {
+		result.reason = reason
+		return result
+	}
+
+	result.ready = true
+	return result
+}
+
+// getEnvironmentEvents returns the most recent Kubernetes events for the environment's pod, newest first
+func (a *AppController) getEnvironmentEvents(c *gin.Context) {
+	ownerID := c.MustGet("owner_id").(string)
+	envID := c.Param("id")
+
+	item, err := a.redisQueue.GetItem(c.Request.Context(), envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for events by owner %s: %v", envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
+		return
+	}
+	if item.Owner != ownerID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return
+	}
+	if item.PodID == "" {
+		c.JSON(http.StatusOK, gin.H{"events": []gin.H{}, "count": 0})
+		return
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 200 {
+		limit = l
+	}
+
+	namespace := item.NamespaceOr(getNamespace())
+	podName, err := a.resolvePodName(c.Request.Context(), item, namespace)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Could not find the pod for the environment"})
+		return
+	}
+
+	events, err := a.k8sClient.GetPodEvents(c.Request.Context(), podName, namespace)
+	if err != nil {
+		log.Printf("Error getting events for pod %s (env %s): %v", podName, envID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve events"})
+		return
+	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	result := make([]gin.H, 0, len(events))
+	for _, ev := range events {
+		result = append(result, gin.H{
+			"type":       ev.Type,
+			"reason":     ev.Reason,
+			"message":    ev.Message,
+			"count":      ev.Count,
+			"first_seen": ev.FirstTimestamp.Time,
+			"last_seen":  ev.LastTimestamp.Time,
+			"source":     ev.Source.Component,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"pod_name": podName, "events": result, "count": len(result)})
+}
+
+// environmentLogLimitBytes caps the DinD container logs returned without ?follow; 5000 lines of
+// up to ~200 bytes each fit
+const environmentLogLimitBytes = 1 << 20
+
+// getEnvironmentLogs returns the DinD container's stdout/stderr. With ?follow=true the logs
+// are streamed as a chunked plain-text response until the client disconnects.
+func (a *AppController) getEnvironmentLogs(c *gin.Context) {
+	ownerID := c.MustGet("owner_id").(string)
+	envID := c.Param("id")
+
+	item, err := a.redisQueue.GetItem(c.Request.Context(), envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for logs by owner %s: %v", envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
+		return
+	}
+	if item.Owner != ownerID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return
+	}
 	if item.PodID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Pod ID not available"})
 		return
 	}
-	
-	namespace := os.Getenv("NAMESPACE")
-	if namespace == "" {
-		namespace = "default"
+
+	tail := int64(100)
+	if t, err := strconv.ParseInt(c.Query("tail"), 10, 64); err == nil && t > 0 && t <= 5000 {
+		tail = t
+	}
+
+	namespace := item.NamespaceOr(getNamespace())
+	podName, err := a.resolvePodName(c.Request.Context(), item, namespace)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Could not find the pod for the environment"})
+		return
+	}
+
+	if c.Query("follow") != "true" {
+		logs, err := a.k8sClient.GetContainerLogs(c.Request.Context(), podName, namespace, "dind", tail, environmentLogLimitBytes)
+		if err != nil {
+			log.Printf("Error getting logs for pod %s (env %s): %v", podName, envID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve logs"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"pod_name": podName, "logs": logs})
+		return
+	}
+
+	stream, err := a.k8sClient.StreamPodLogs(c.Request.Context(), podName, namespace, "dind", tail)
+	if err != nil {
+		log.Printf("Error streaming logs for pod %s (env %s): %v", podName, envID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve logs"})
+		return
+	}
+	defer stream.Close()
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	if _, err := io.Copy(&flushingWriter{w: c.Writer}, stream); err != nil && c.Request.Context().Err() == nil {
+		log.Printf("Log stream for pod %s (env %s) ended: %v", podName, envID, err)
+	}
+}
+
+// resolvePodName returns the pod backing an environment's workload
+func (a *AppController) resolvePodName(ctx context.Context, item *queue.QueueItem, namespace string) (string, error) {
+	if item.WorkloadType == "deployment" {
+		return a.k8sClient.GetPodNameForWorkload(ctx, item.PodID, namespace)
+	}
+	return fmt.Sprintf("%s-0", item.PodID), nil
+}
+
+// proxyToPod proxies HTTP requests to services running inside the DinD Pod
+func (a *AppController) proxyToPod(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	ownerID := c.MustGet("owner_id").(string)
+	envID := c.Param("id")
+	path, err := validateProxyPath(c.Param("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"request_id": requestID, "error": "Invalid path", "details": err.Error()})
+		return
+	}
+
+	ctx := context.Background()
+	item, err := a.redisQueue.GetItem(ctx, envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"request_id": requestID, "error": "Environment not found"})
+		} else {
+			log.Printf("[req %s] Error getting environment %s for proxy by owner %s: %v", requestID, envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"request_id": requestID, "error": "Failed to retrieve environment details"})
+		}
+		return
+	}
+
+	if item.Owner != ownerID {
+		log.Printf("[req %s] Forbidden: Owner %s attempted to proxy to environment %s owned by %s", requestID, ownerID, envID, item.Owner)
+		c.JSON(http.StatusForbidden, gin.H{"request_id": requestID, "error": "You are not the owner of this environment"})
+		return
 	}
-	
+
+	if item.Status != queue.StatusAvailable {
+		c.JSON(http.StatusBadRequest, gin.H{"request_id": requestID, "error": "Environment is not available"})
+		return
+	}
+
+	if item.PodID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"request_id": requestID, "error": "Pod ID not available"})
+		return
+	}
+
+	namespace := item.NamespaceOr(getNamespace())
+
 	var podName string
 	if item.WorkloadType == "deployment" {
 		podName, err = a.k8sClient.GetPodNameForWorkload(c.Request.Context(), item.PodID, namespace)
 		if err != nil {
-			log.Printf("Failed to get pod name for workload %s (env %s): %v", item.PodID, envID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find the running pod for the environment"})
+			log.Printf("[req %s] Failed to get pod name for workload %s (env %s): %v", requestID, item.PodID, envID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"request_id": requestID, "error": "Could not find the running pod for the environment"})
 			return
 		}
 	} else {
 		podName = fmt.Sprintf("%s-0", item.PodID)
 	}
-	
+
 	// Get the port from query parameters or use default
 	port := c.DefaultQuery("port", "80")
-	
-	// For Kind cluster services, we need to proxy through the DinD container
-	// since services are only accessible from within the cluster network
-	a.proxyThroughDinDContainer(c, podName, namespace, port, path, c.Request)
+	portInt, err := strconv.Atoi(port)
+	if err != nil || portInt < 1 || portInt > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"request_id": requestID, "error": "Invalid port", "details": fmt.Sprintf("%q is not a port number", port)})
+		return
+	}
+	scheme, err := proxyScheme(c.Query("scheme"), portInt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"request_id": requestID, "error": "Invalid scheme", "details": err.Error()})
+		return
+	}
+
+	if c.Query("refresh") == "true" {
+		a.k8sClient.InvalidateServiceCache(podName, namespace)
+	}
+
+	// Kind cluster services are only reachable from within the DinD container,
+	// so the request goes through a port-forward into the inner cluster
+	a.proxyThroughPortForward(c, podName, namespace, port, scheme, path, c.Request)
 }
 
-// proxyThroughDinDContainer proxies HTTP requests by executing curl inside the DinD container
-// This allows access to services running inside the Kind cluster
-func (a *AppController) proxyThroughDinDContainer(c *gin.Context, podName, namespace, port, path string, req *http.Request) {
-	// Create context with timeout for the entire operation
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+// serviceForPort returns the first service listening on port. NodePort services can be addressed
+// by their NodePort too; the tunnel uses the service port.
+func serviceForPort(services []k8s.ServiceInfo, port int) *k8s.ServiceInfo {
+	for i := range services {
+		if services[i].Port == port || (services[i].NodePort != 0 && services[i].NodePort == port) {
+			return &services[i]
+		}
+	}
+	return nil
+}
+
+// proxyThroughPortForward proxies HTTP requests to a service of the Kind cluster inside the DinD
+// container over a native port-forward tunnel, streaming the response back to the client.
+// scheme is "http" or "https"; see proxyScheme.
+func (a *AppController) proxyThroughPortForward(c *gin.Context, podName, namespace, port, scheme, path string, req *http.Request) {
+	requestID := c.GetString("request_id")
+	// Bound service discovery and tunnel setup; the proxied request itself may stream for longer
+	setupCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	
+
 	// First, try to find the service and get the correct target
 	// Look for services running on the specified port
-	services, err := a.k8sClient.GetKindClusterServices(ctx, podName, namespace)
+	services, err := a.k8sClient.GetKindClusterServices(setupCtx, podName, namespace)
 	if err != nil {
-		log.Printf("Failed to get services for pod %s: %v", podName, err)
+		log.Printf("[req %s] Failed to get services for pod %s: %v", requestID, podName, err)
 		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error": "Failed to discover services",
-			"details": fmt.Sprintf("Could not list services in pod %s", podName),
+			"request_id": requestID,
+			"error":      "Failed to discover services",
+			"details":    fmt.Sprintf("Could not list services in pod %s", podName),
 		})
 		return
 	}
-	
-	var targetService *k8s.ServiceInfo
+
 	portInt, _ := strconv.Atoi(port)
-	for _, svc := range services {
-		if svc.Port == portInt {
-			targetService = &svc
-			break
-		}
-	}
-	
+	targetService := serviceForPort(services, portInt)
+
 	if targetService == nil {
 		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Service not found",
-			"details": fmt.Sprintf("No service found on port %s", port),
+			"request_id": requestID,
+			"error":      "Service not found",
+			"details":    fmt.Sprintf("No service found on port %s", port),
 		})
 		return
 	}
-	
-	// Build target URL using service name and port within the Kind cluster
-	//targetURL := fmt.Sprintf("http://%s:%d%s", targetService.Name, targetService.Port, path)
-	// targetService.Name は、DinD Pod 上で名前解決できない。127.0.0.1 固定でいい
-	// targetService.Port は、port-forward ではPodのリッスンポートを直撃しないとダメ
-	// 以下の実装では、サービスポートにアクセスすることになる
-	targetURL := fmt.Sprintf("http://localhost:%d%s", targetService.Port, path)
-	if req.URL.RawQuery != "" {
-		// Remove the port parameter from query since we're using it for targeting
-		params := req.URL.Query()
-		params.Del("port")
-		if encodedQuery := params.Encode(); encodedQuery != "" {
-			targetURL += "?" + encodedQuery
-		}
-	}
-	
-	// Build headers for curl command
-	var headerArgs []string
-	for name, values := range req.Header {
-		// Skip headers that shouldn't be forwarded
-		if name == "Host" || name == "Content-Length" || strings.HasPrefix(name, "X-Forwarded-") {
-			continue
-		}
-		for _, value := range values {
-			headerArgs = append(headerArgs, "-H", fmt.Sprintf("'%s: %s'", name, value))
-		}
-	}
-	
-	// Build data arguments for POST/PUT requests
-	var dataArg string
-	var hasBody bool
-	if req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH" {
-		bodyBytes, err := io.ReadAll(req.Body)
-		if err == nil && len(bodyBytes) > 0 {
-			hasBody = true
-			// Escape the body for shell
-			dataArg = fmt.Sprintf("--data-binary '%s'", strings.ReplaceAll(string(bodyBytes), "'", "'\"'\"'"))
-		}
-	}
-	
-	// Create a comprehensive bash command that:
-	// 1. Starts kubectl port-forward in background
-	// 2. Waits for port to be ready
-	// 3. Executes curl request
-	// 4. Cleans up port-forward
-	var curlCmd string
-	if hasBody {
-		curlCmd = fmt.Sprintf("curl -s -i -X %s %s %s http://localhost:%s%s", 
-			req.Method, strings.Join(headerArgs, " "), dataArg, port, path)
-	} else {
-		// Explicitly specify GET method to prevent HEAD requests
-		method := req.Method
-		if method == "" || method == "HEAD" {
-			method = "GET"
-		}
-		curlCmd = fmt.Sprintf("curl -s -i -X %s %s http://localhost:%s%s", 
-			method, strings.Join(headerArgs, " "), port, path)
-	}
-	
-	bashScript := fmt.Sprintf(`
-		# Start port-forward in background
-		kubectl port-forward service/%s %s:%d > /dev/null 2>&1 &
-		PF_PID=$!
-		
-		# Wait a fixed time for port-forward to be ready
-		sleep 2
-		
-		# Execute curl request
-		%s
-		
-		# Cleanup port-forward
-		kill $PF_PID 2>/dev/null || true
-		wait $PF_PID 2>/dev/null || true
-	`, targetService.Name, port, targetService.Port, curlCmd)
-	
-	bashCmd := []string{"bash", "-c", bashScript}
-	
-	// Execute bash script inside the DinD container  
-	var stdout, stderr strings.Builder
-	
-	// Debug: Log the bash script being executed
-	log.Printf("Executing bash script in pod %s: %s", podName, bashScript)
-	
-	// Use the existing ExecInPod method but modify it for our needs
-	err = a.executeHTTPProxy(ctx, podName, namespace, bashCmd, nil, &stdout, &stderr)
-
-	if err != nil {
-		stderrOutput := stderr.String()
-		stdoutOutput := stdout.String()
-		
-		log.Printf("Failed to execute curl in pod %s: %v, stderr: %s, stdout: %s", podName, err, stderrOutput, stdoutOutput)
-		
-		// Check for specific error conditions
-		if strings.Contains(err.Error(), "operation was canceled") || strings.Contains(err.Error(), "context deadline exceeded") {
-			c.JSON(http.StatusRequestTimeout, gin.H{
-				"error": "Request timeout",
-				"details": "The request to the service timed out",
-				"target": targetURL,
-				"suggestion": "The service may be slow to respond or not running",
-			})
-		} else if strings.Contains(err.Error(), "exit code 56") || strings.Contains(stderrOutput, "Failed to connect") {
-			c.JSON(http.StatusServiceUnavailable, gin.H{
-				"error": "Service connection failed",
-				"details": "Could not connect to the service",
-				"target": targetURL,
-				"suggestion": "Verify the service is running and accessible on the specified port",
-			})
-		} else {
+
+	tunnel, err := a.k8sClient.OpenServiceTunnel(setupCtx, podName, namespace, targetService.Name, targetService.Port)
+	if err != nil {
+		log.Printf("[req %s] Failed to open tunnel to service %s:%d in pod %s: %v", requestID, targetService.Name, targetService.Port, podName, err)
+		if errors.Is(err, k8s.ErrNoReadyEndpoints) {
 			c.JSON(http.StatusServiceUnavailable, gin.H{
-				"error": "Failed to connect to service",
-				"details": fmt.Sprintf("Could not reach service on port %s", port),
-				"target": targetURL,
-				"debug_stderr": stderrOutput,
-				"debug_stdout": stdoutOutput,
+				"request_id": requestID,
+				"error":      fmt.Sprintf("Service not listening on port %d", portInt),
+				"details":    err.Error(),
+				"suggestion": "Check that the service's pods are running and ready",
 			})
+			return
 		}
-		return
-	}
-
-	// Parse curl output (headers + body)
-	output := stdout.String()
-	stderrOutput := stderr.String()
-	
-	// Debug: Log the raw output
-	log.Printf("Raw stdout from pod %s (length: %d): %q", podName, len(output), output)
-	log.Printf("Raw stderr from pod %s (length: %d): %q", podName, len(stderrOutput), stderrOutput)
-	
-	if output == "" {
-		log.Printf("Empty response from curl for %s", targetURL)
 		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error": "Empty response from service",
-			"target": targetURL,
+			"request_id": requestID,
+			"error":      "Failed to connect to service",
+			"details":    fmt.Sprintf("Could not reach service on port %s", port),
 		})
 		return
 	}
+	defer tunnel.Close()
 
-	// Split headers and body
-	parts := strings.SplitN(output, "\r\n\r\n", 2)
-	if len(parts) < 2 {
-		parts = strings.SplitN(output, "\n\n", 2)
-	}
-	
-	// Debug: Log the split results
-	log.Printf("Split output into %d parts for %s", len(parts), targetURL)
-	if len(parts) >= 1 {
-		log.Printf("Headers section (length: %d): %q", len(parts[0]), parts[0])
-	}
-	if len(parts) >= 2 {
-		log.Printf("Body section (length: %d): %q", len(parts[1]), parts[1][:min(200, len(parts[1]))])
-	}
-	
-	if len(parts) < 2 {
-		// No header separator found, treat entire output as body
-		log.Printf("No header separator found for %s, treating as plain text", targetURL)
-		c.Header("Content-Type", "text/plain")
-		c.String(http.StatusOK, output)
-		return
+	if a.proxyProbeTimeout > 0 {
+		if err := tunnel.Probe(a.proxyProbeTimeout); err != nil {
+			log.Printf("[req %s] Health probe of service %s:%d failed: %v", requestID, targetService.Name, targetService.Port, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"request_id": requestID,
+				"error":      fmt.Sprintf("Service not listening on port %d", portInt),
+				"details":    fmt.Sprintf("Nothing accepted a connection to service %s within %v", targetService.Name, a.proxyProbeTimeout),
+				"suggestion": "Check that the service's pods are running and ready",
+			})
+			return
+		}
 	}
 
-	headerSection := parts[0]
-	bodySection := parts[1]
+	// Remove the port, scheme and refresh parameters from query since they are meant for the proxy
+	params := req.URL.Query()
+	params.Del("port")
+	params.Del("scheme")
+	params.Del("refresh")
+	upstreamQuery := params.Encode()
 
-	// Parse status line
-	headerLines := strings.Split(headerSection, "\n")
-	if len(headerLines) == 0 {
-		log.Printf("No header lines found for %s", targetURL)
-		c.String(http.StatusOK, bodySection)
+	if isWebSocketUpgrade(req) {
+		log.Printf("[req %s] Proxying WebSocket %s to service %s:%d in pod %s", requestID, path, targetService.Name, targetService.Port, podName)
+		a.proxyWebSocket(c, tunnel, scheme, path, upstreamQuery, portInt)
 		return
 	}
 
-	statusLine := strings.TrimSpace(headerLines[0])
-	statusCode := http.StatusOK
+	// Built from parts so the path is escaped rather than parsed: a decoded "?" or "#" stays part of it
+	upstreamURL := &url.URL{
+		Scheme:   scheme,
+		Host:     fmt.Sprintf("127.0.0.1:%d", tunnel.LocalPort),
+		Path:     path,
+		RawQuery: upstreamQuery,
+	}
 
-	// Debug: Log status line parsing
-	log.Printf("Status line for %s: %q", targetURL, statusLine)
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), req.Method, upstreamURL.String(), req.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"request_id": requestID, "error": "Invalid proxy request"})
+		return
+	}
+	upstreamReq.ContentLength = req.ContentLength
+	// Present the address the service was addressed by, as the curl-based proxy did
+	upstreamReq.Host = fmt.Sprintf("localhost:%d", portInt)
+	for name, values := range req.Header {
+		// Skip headers that shouldn't be forwarded (the request ID is set explicitly below)
+		if isHopByHopHeader(name) || name == "Host" || name == requestIDHeader || strings.HasPrefix(name, "X-Forwarded-") {
+			continue
+		}
+		upstreamReq.Header[name] = values
+	}
+	upstreamReq.Header.Set(requestIDHeader, requestID)
 
-	// Extract status code from HTTP status line
-	if strings.HasPrefix(statusLine, "HTTP/") {
-		statusParts := strings.Fields(statusLine)
-		if len(statusParts) >= 2 {
-			if code, err := strconv.Atoi(statusParts[1]); err == nil {
-				statusCode = code
-				log.Printf("Extracted status code %d for %s", statusCode, targetURL)
-			} else {
-				log.Printf("Failed to parse status code from %q for %s", statusParts[1], targetURL)
-			}
+	log.Printf("[req %s] Proxying %s %s to service %s:%d over %s in pod %s", requestID, req.Method, path, targetService.Name, targetService.Port, scheme, podName)
+	client := proxyHTTPClient
+	if scheme == "https" {
+		client = proxyHTTPSClient
+	}
+	resp, err := client.Do(upstreamReq)
+	if err != nil {
+		log.Printf("[req %s] Proxy request to service %s:%d failed: %v", requestID, targetService.Name, targetService.Port, err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			c.JSON(http.StatusRequestTimeout, gin.H{
+				"request_id": requestID,
+				"error":      "Request timeout",
+				"details":    "The request to the service timed out",
+				"suggestion": "The service may be slow to respond or not running",
+			})
 		} else {
-			log.Printf("Invalid status line format for %s: %q", targetURL, statusLine)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"request_id": requestID,
+				"error":      "Service connection failed",
+				"details":    "Could not connect to the service",
+				"suggestion": "Verify the service is running and accessible on the specified port",
+			})
 		}
-	} else {
-		log.Printf("Status line doesn't start with HTTP/ for %s: %q", targetURL, statusLine)
+		return
 	}
+	defer resp.Body.Close()
 
-	// Set response headers (skip status line)
-	for i := 1; i < len(headerLines); i++ {
-		line := strings.TrimSpace(headerLines[i])
-		if line == "" {
+	for name, values := range resp.Header {
+		if isHopByHopHeader(name) {
 			continue
 		}
-		
-		colonIndex := strings.Index(line, ":")
-		if colonIndex > 0 {
-			name := strings.TrimSpace(line[:colonIndex])
-			value := strings.TrimSpace(line[colonIndex+1:])
-			
-			// Skip headers that shouldn't be set
-			if name == "Transfer-Encoding" || name == "Connection" || name == "Content-Length" {
-				continue
-			}
-			
-			c.Header(name, value)
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
 		}
 	}
 
@@ -1450,42 +2854,162 @@ func (a *AppController) proxyThroughDinDContainer(c *gin.Context, podName, names
 	c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 	c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
 
-	// Send response
-	log.Printf("Sending response for %s: status=%d, body_length=%d", targetURL, statusCode, len(bodySection))
-	c.String(statusCode, bodySection)
+	c.Status(resp.StatusCode)
+	// Flush as data arrives so server-sent events, long polls and chunked downloads reach the browser promptly
+	flushInterval := proxyFlushInterval
+	if resp.ContentLength < 0 || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		flushInterval = 0
+	}
+	written, err := io.Copy(&flushingWriter{w: c.Writer, interval: flushInterval}, resp.Body)
+	if err != nil {
+		log.Printf("[req %s] Error streaming response from service %s:%d after %d bytes: %v", requestID, targetService.Name, targetService.Port, written, err)
+		return
+	}
+	log.Printf("[req %s] Proxied response from service %s:%d: status=%d, body_length=%d", requestID, targetService.Name, targetService.Port, resp.StatusCode, written)
 }
 
-// executeHTTPProxy executes curl command inside the DinD container for HTTP proxying
-func (a *AppController) executeHTTPProxy(ctx context.Context, podName, namespace string, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
-	if a.k8sClient == nil {
-		return fmt.Errorf("k8s client is nil")
+// proxyWebSocket relays a WebSocket upgrade to the service behind the tunnel. Once the upstream
+// answers 101 Switching Protocols, the reverse proxy hijacks the browser connection and copies
+// frames in both directions until either side closes.
+func (a *AppController) proxyWebSocket(c *gin.Context, tunnel *k8s.ServiceTunnel, scheme, path, query string, port int) {
+	requestID := c.GetString("request_id")
+	proxy := &httputil.ReverseProxy{
+		Transport: proxyHTTPClient.Transport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = scheme
+			r.Out.URL.Host = fmt.Sprintf("127.0.0.1:%d", tunnel.LocalPort)
+			r.Out.URL.Path = path
+			r.Out.URL.RawPath = ""
+			r.Out.URL.RawQuery = query
+			r.Out.Host = fmt.Sprintf("localhost:%d", port)
+			r.Out.Header.Set(requestIDHeader, requestID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[req %s] WebSocket proxy error: %v", requestID, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if scheme == "https" {
+		proxy.Transport = proxyHTTPSClient.Transport
 	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// isWebSocketUpgrade reports whether the request asks to switch to the WebSocket protocol
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
 
-	// Create the exec request directly since we need custom handling
-	req := a.k8sClient.GetClientset().CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(podName).
-		Namespace(namespace).
-		SubResource("exec").
-		VersionedParams(&corev1.PodExecOptions{
-			Container: "dind",
-			Command:   command,
-			Stdin:     stdin != nil,
-			Stdout:    stdout != nil,
-			Stderr:    stderr != nil,
-			TTY:       false,
-		}, scheme.ParameterCodec)
+// maxProxyPathLength bounds the path proxied to a service, far above what browsers send in practice
+const maxProxyPathLength = 2048
 
-	executor, err := remotecommand.NewSPDYExecutor(a.k8sClient.GetRestConfig(), "POST", req.URL())
+// validateProxyPath checks the decoded path of a proxy request before it is sent to a service.
+// Control characters, backslashes and "." or ".." segments are rejected rather than cleaned
+// up, since browsers never send them and servers disagree on how to interpret them. The path
+// is escaped again when the upstream URL is built.
+func validateProxyPath(path string) (string, error) {
+	if path == "" {
+		return "/", nil
+	}
+	if len(path) > maxProxyPathLength {
+		return "", fmt.Errorf("path is longer than %d bytes", maxProxyPathLength)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", errors.New("path must start with /")
+	}
+	if !utf8.ValidString(path) {
+		return "", errors.New("path is not valid UTF-8")
+	}
+	for _, r := range path {
+		if unicode.IsControl(r) {
+			return "", errors.New("path contains control characters")
+		}
+		if r == '\\' {
+			return "", errors.New("path contains a backslash")
+		}
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return "", errors.New("path contains a relative segment")
+		}
+	}
+	return path, nil
+}
+
+// proxyHTTPClient sends proxied requests through port-forward tunnels. Each tunnel serves a
+// single request, so connections are not kept alive, and redirects are passed to the browser.
+var proxyHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: 20 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// proxyHTTPSClient is proxyHTTPClient for services serving TLS. Services of the inner cluster
+// typically use self-signed certificates, and the tunnel to them is already authenticated by
+// the Kubernetes API, so certificates are not verified.
+var proxyHTTPSClient = &http.Client{
+	Transport: &http.Transport{
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: 20 * time.Second,
+		// Matches the Host header the service is addressed with
+		TLSClientConfig: &tls.Config{ServerName: "localhost", InsecureSkipVerify: true},
+	},
+	CheckRedirect: proxyHTTPClient.CheckRedirect,
+}
+
+// Ports proxied over HTTPS unless the scheme query parameter says otherwise
+var tlsProxyPorts = map[int]bool{443: true, 8443: true}
+
+// proxyScheme returns the scheme used to reach a service: the scheme query parameter if given,
+// otherwise https for the usual TLS ports and http for the rest
+func proxyScheme(param string, port int) (string, error) {
+	switch param {
+	case "http", "https":
+		return param, nil
+	case "":
+		if tlsProxyPorts[port] {
+			return "https", nil
+		}
+		return "http", nil
+	}
+	return "", fmt.Errorf("scheme must be http or https, got %q", param)
+}
+
+// proxyFlushInterval bounds how long proxied response data of known length may sit in the write buffer
+const proxyFlushInterval = 100 * time.Millisecond
+
+// flushingWriter flushes the response after a write once interval has passed since the last flush;
+// an interval of 0 flushes after every write
+type flushingWriter struct {
+	w         gin.ResponseWriter
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
 	if err != nil {
-		return fmt.Errorf("failed to create SPDY executor: %w", err)
+		return n, err
 	}
+	if now := time.Now(); now.Sub(f.lastFlush) >= f.interval {
+		f.w.Flush()
+		f.lastFlush = now
+	}
+	return n, nil
+}
 
-	return executor.StreamWithContext(ctx, remotecommand.StreamOptions{
-		Stdin:  stdin,
-		Stdout: stdout,
-		Stderr: stderr,
-	})
+// isHopByHopHeader reports whether a header applies to a single connection and must not be proxied
+func isHopByHopHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade":
+		return true
+	}
+	return false
 }
 
 func getEnv(key, defaultValue string) string {
@@ -1494,3 +3018,124 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEntrypointPresets lists the DinD entrypoint presets users can choose from
+func (a *AppController) getEntrypointPresets(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"presets": a.entrypointPresetNames()})
+}
+
+func (a *AppController) entrypointPresetNames() []string {
+	names := make([]string, 0, len(a.entrypointPresets))
+	for name := range a.entrypointPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getEnvironmentTemplates lists the environment templates users can choose from
+func (a *AppController) getEnvironmentTemplates(c *gin.Context) {
+	templates := make([]gin.H, 0, len(a.environmentTemplates))
+	for _, name := range a.environmentTemplateNames() {
+		templates = append(templates, gin.H{"name": name, "description": a.environmentTemplates[name].Description})
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+func (a *AppController) environmentTemplateNames() []string {
+	names := make([]string, 0, len(a.environmentTemplates))
+	for name := range a.environmentTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// acquireSession counts a new terminal session for owner, refusing it when the owner is at MAX_SESSIONS_PER_USER
+func (a *AppController) acquireSession(owner string) bool {
+	a.activeSessionsMutex.Lock()
+	defer a.activeSessionsMutex.Unlock()
+	if a.maxSessionsPerUser > 0 && a.activeSessions[owner] >= a.maxSessionsPerUser {
+		return false
+	}
+	a.activeSessions[owner]++
+	return true
+}
+
+func (a *AppController) releaseSession(owner string) {
+	a.activeSessionsMutex.Lock()
+	defer a.activeSessionsMutex.Unlock()
+	if a.activeSessions[owner] <= 1 {
+		delete(a.activeSessions, owner)
+		return
+	}
+	a.activeSessions[owner]--
+}
+
+// clampTerminalSize keeps a client-reported dimension within [lo, hi]
+func clampTerminalSize(value, lo, hi int) uint16 {
+	return uint16(max(lo, min(value, hi)))
+}
+
+// getNamespace returns the namespace the DinD workloads run in
+func getNamespace() string {
+	return getEnv("NAMESPACE", "default")
+}
+
+// parseOwnerNamespaces parses OWNER_NAMESPACES_JSON, e.g.
+// {"alice@example.com": "team-a", "@partner.example": "partners"}
+func parseOwnerNamespaces(raw string) (map[string]string, error) {
+	namespaces := make(map[string]string)
+	if raw == "" {
+		return namespaces, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &namespaces); err != nil {
+		return nil, err
+	}
+	for owner, namespace := range namespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q for %s: %s", namespace, owner, strings.Join(errs, "; "))
+		}
+	}
+	return namespaces, nil
+}
+
+// namespaceForOwner picks the namespace for a new environment: an exact owner match first,
+// then the owner's email domain ("@example.com"), then the default namespace
+func (a *AppController) namespaceForOwner(owner string) string {
+	if namespace, ok := a.ownerNamespaces[owner]; ok {
+		return namespace
+	}
+	if at := strings.LastIndex(owner, "@"); at >= 0 {
+		if namespace, ok := a.ownerNamespaces[owner[at:]]; ok {
+			return namespace
+		}
+	}
+	return getNamespace()
+}
+
+// validateDisplayName rejects names that could inject escape sequences or line breaks
+// into the terminal banner and logs: invalid UTF-8, control characters (ESC, CR, LF, ...)
+// and invisible format characters such as bidi overrides.
+func validateDisplayName(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("DisplayName must be valid UTF-8")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return fmt.Errorf("DisplayName cannot contain control characters or escape sequences")
+		}
+	}
+	return nil
+}
+
+// splitAndTrim splits a comma-separated list, dropping empty entries
+func splitAndTrim(raw string) []string {
+	var values []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
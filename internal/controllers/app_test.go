@@ -0,0 +1,450 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
+)
+
+func TestValidateProxyPath(t *testing.T) {
+	// Paths reach validateProxyPath decoded, as in c.Param("path")
+	decode := func(raw string) string {
+		path, err := url.PathUnescape(raw)
+		if err != nil {
+			t.Fatalf("PathUnescape(%q): %v", raw, err)
+		}
+		return path
+	}
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantURL string // upstream path as escaped by url.URL, if accepted
+		wantErr bool
+	}{
+		{name: "empty", path: "", want: "/", wantURL: "/"},
+		{name: "plain", path: "/api/v1/items", want: "/api/v1/items", wantURL: "/api/v1/items"},
+		{name: "dots inside names", path: "/static/app.min.js/..hidden", want: "/static/app.min.js/..hidden", wantURL: "/static/app.min.js/..hidden"},
+		{name: "unicode", path: "/ドキュメント", want: "/ドキュメント", wantURL: "/%E3%83%89%E3%82%AD%E3%83%A5%E3%83%A1%E3%83%B3%E3%83%88"},
+		{name: "parent segment", path: "/a/../etc/passwd", wantErr: true},
+		{name: "trailing parent segment", path: "/a/..", wantErr: true},
+		{name: "current segment", path: "/a/./b", wantErr: true},
+		{name: "encoded parent segment", path: decode("/a/%2e%2e/etc/passwd"), wantErr: true},
+		{name: "mixed case encoded parent segment", path: decode("/a/%2E%2e/b"), wantErr: true},
+		// A double-encoded segment is an ordinary name once decoded, and is escaped again upstream
+		{name: "double encoded parent segment", path: decode("/a/%252e%252e/b"), want: "/a/%2e%2e/b", wantURL: "/a/%252e%252e/b"},
+		{name: "CRLF", path: "/a\r\nHost: evil", wantErr: true},
+		{name: "encoded CRLF", path: decode("/a%0d%0aSet-Cookie:%20x=1"), wantErr: true},
+		{name: "NUL", path: "/a\x00b", wantErr: true},
+		{name: "DEL", path: "/a\x7fb", wantErr: true},
+		{name: "backslash", path: `/a\..\b`, wantErr: true},
+		{name: "encoded backslash", path: decode("/a%5cb"), wantErr: true},
+		{name: "relative", path: "a/b", wantErr: true},
+		{name: "protocol relative", path: "//evil.example.com/x", want: "//evil.example.com/x", wantURL: "//evil.example.com/x"},
+		{name: "invalid UTF-8", path: "/a\xff\xfe", wantErr: true},
+		{name: "overlong UTF-8 slash", path: "/a\xc0\xafb", wantErr: true},
+		{name: "maximum length", path: "/" + strings.Repeat("a", maxProxyPathLength-1), want: "/" + strings.Repeat("a", maxProxyPathLength-1)},
+		{name: "over length", path: "/" + strings.Repeat("a", maxProxyPathLength), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateProxyPath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("validateProxyPath(%q) = %q, want an error", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateProxyPath(%q): %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("validateProxyPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+			if tt.wantURL != "" {
+				upstream := &url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: got}
+				if escaped := upstream.EscapedPath(); escaped != tt.wantURL {
+					t.Errorf("upstream path = %q, want %q", escaped, tt.wantURL)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyScheme(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		port    int
+		want    string
+		wantErr bool
+	}{
+		{name: "https port", port: 443, want: "https"},
+		{name: "alternate https port", port: 8443, want: "https"},
+		{name: "http port", port: 80, want: "http"},
+		{name: "other port", port: 3000, want: "http"},
+		{name: "http on a TLS port", param: "http", port: 443, want: "http"},
+		{name: "http on 8443", param: "http", port: 8443, want: "http"},
+		{name: "https on another port", param: "https", port: 3000, want: "https"},
+		{name: "upper case", param: "HTTPS", port: 443, wantErr: true},
+		{name: "unsupported scheme", param: "ftp", port: 21, wantErr: true},
+		{name: "scheme with separator", param: "https://", port: 443, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := proxyScheme(tt.param, tt.port)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("proxyScheme(%q, %d) = %q, want an error", tt.param, tt.port, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("proxyScheme(%q, %d): %v", tt.param, tt.port, err)
+			}
+			if got != tt.want {
+				t.Errorf("proxyScheme(%q, %d) = %q, want %q", tt.param, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyHTTPSClientAcceptsSelfSignedCertificates(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	resp, err := proxyHTTPSClient.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET over TLS with a self-signed certificate: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Redirects are passed to the browser
+	resp, err = proxyHTTPSClient.Get(server.URL + "/redirect")
+	if err != nil {
+		t.Fatalf("GET /redirect: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+}
+
+func TestWSClientWriteChunksLargeOutput(t *testing.T) {
+	tests := []struct {
+		chunkSize  int
+		chunkDelay time.Duration
+	}{
+		{chunkSize: defaultWSWriteChunkSize},
+		{chunkSize: 1000},
+		// 81 chunks, 5ms apart: the whole write takes longer than writeWait
+		{chunkSize: 64 * 1024, chunkDelay: 5 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		chunkSize := tt.chunkSize
+		settings := defaultWebSocketSettings()
+		settings.writeChunkSize = chunkSize
+		if tt.chunkDelay > 0 {
+			settings.writeChunkDelay = tt.chunkDelay
+			settings.writeWait = 200 * time.Millisecond
+		}
+		serverConn, clientConn := newTestWSPair(t)
+		wsClient := &WSClient{conn: serverConn, settings: settings}
+
+		output := make([]byte, 5*1024*1024+123)
+		rng := rand.New(rand.NewPCG(1, uint64(chunkSize)))
+		for i := range output {
+			output[i] = byte(rng.UintN(256))
+		}
+
+		type message struct {
+			messageType int
+			data        []byte
+		}
+		received := make(chan []message, 1)
+		go func() {
+			var messages []message
+			for total := 0; total < len(output); {
+				clientConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+				messageType, data, err := clientConn.ReadMessage()
+				if err != nil {
+					t.Errorf("read after %d bytes: %v", total, err)
+					break
+				}
+				messages = append(messages, message{messageType, data})
+				total += len(data)
+			}
+			received <- messages
+		}()
+
+		n, err := wsClient.Write(output)
+		if err != nil || n != len(output) {
+			t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(output))
+		}
+		messages := <-received
+
+		var reassembled bytes.Buffer
+		for i, msg := range messages {
+			if msg.messageType != websocket.BinaryMessage {
+				t.Errorf("chunk size %d: message %d has type %d, want binary", chunkSize, i, msg.messageType)
+			}
+			if last := i == len(messages)-1; len(msg.data) > chunkSize || (!last && len(msg.data) != chunkSize) {
+				t.Errorf("chunk size %d: message %d has %d bytes", chunkSize, i, len(msg.data))
+			}
+			reassembled.Write(msg.data)
+		}
+		if want := (len(output) + chunkSize - 1) / chunkSize; len(messages) != want {
+			t.Errorf("chunk size %d: %d messages, want %d", chunkSize, len(messages), want)
+		}
+		if !bytes.Equal(reassembled.Bytes(), output) {
+			t.Errorf("chunk size %d: received output differs from what was written", chunkSize)
+		}
+	}
+}
+
+func TestValidateDisplayName(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "empty", input: ""},
+		{name: "plain", input: "my cluster"},
+		{name: "unicode", input: "開発環境 ☸"},
+		{name: "punctuation", input: "team-a/staging (v1.30)"},
+		{name: "ANSI color", input: "\x1b[31mred\x1b[0m", wantErr: true},
+		{name: "CSI without ESC", input: "\u009b31mred", wantErr: true},
+		{name: "OSC title", input: "\x1b]0;owned\x07", wantErr: true},
+		{name: "newline", input: "line1\nline2", wantErr: true},
+		{name: "carriage return", input: "visible\rhidden", wantErr: true},
+		{name: "tab", input: "a\tb", wantErr: true},
+		{name: "NUL", input: "a\x00b", wantErr: true},
+		{name: "DEL", input: "a\x7fb", wantErr: true},
+		{name: "bidi override", input: "abc\u202edcba", wantErr: true},
+		{name: "zero-width space", input: "ad\u200bmin", wantErr: true},
+		{name: "invalid UTF-8", input: "a\xffb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDisplayName(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateDisplayName(%q) = %v, want error: %v", tt.input, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWSClientSerializesMessagesWithOutput(t *testing.T) {
+	const writers, messagesPerWriter = 4, 50
+	serverConn, clientConn := newTestWSPair(t)
+	wsClient := &WSClient{conn: serverConn, settings: defaultWebSocketSettings()}
+
+	// Exec output, errors, warnings and raw messages are written from different goroutines
+	var wg sync.WaitGroup
+	send := []func(i int){
+		func(i int) { wsClient.Write([]byte(fmt.Sprintf("output %d\r\n", i))) },
+		func(i int) { wsClient.sendError(fmt.Sprintf("error %d", i)) },
+		func(i int) { wsClient.sendWarning(fmt.Sprintf("warning %d", i)) },
+		func(i int) { wsClient.sendRaw(fmt.Sprintf("raw %d\r\n", i)) },
+	}
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range messagesPerWriter {
+				send[w](i)
+			}
+		}()
+	}
+
+	counts := map[string]int{}
+	for range writers * messagesPerWriter {
+		clientConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		messageType, data, err := clientConn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %v: %v", counts, err)
+		}
+		if messageType == websocket.BinaryMessage {
+			counts["output"]++
+			continue
+		}
+		var msg TerminalMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			counts["raw"]++
+			continue
+		}
+		counts[msg.Operation]++
+	}
+	wg.Wait()
+	for _, kind := range []string{"output", "error", "warning", "raw"} {
+		if counts[kind] != messagesPerWriter {
+			t.Errorf("received %d %s messages, want %d", counts[kind], kind, messagesPerWriter)
+		}
+	}
+}
+
+func TestAdminMiddlewareRequiresVerifiedEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_GROUP", "")
+	t.Setenv("ADMIN_USERS", "admin@example.com")
+	tests := []struct {
+		name       string
+		ownerClaim string
+		claims     map[string]interface{}
+		// stale sessions were written before only verified emails were stored
+		staleEmail string
+		wantStatus int
+	}{
+		{name: "verified admin email", ownerClaim: "sub", claims: map[string]interface{}{"sub": "user-1", "email": "admin@example.com", "email_verified": true}, wantStatus: http.StatusOK},
+		{name: "unverified admin email", ownerClaim: "sub", claims: map[string]interface{}{"sub": "user-1", "email": "admin@example.com", "email_verified": false}, wantStatus: http.StatusForbidden},
+		{name: "admin email without verification claim", ownerClaim: "sub", claims: map[string]interface{}{"sub": "user-1", "email": "admin@example.com"}, wantStatus: http.StatusForbidden},
+		{name: "unverified email in stale session", ownerClaim: "sub", claims: map[string]interface{}{"sub": "user-1"}, staleEmail: "admin@example.com", wantStatus: http.StatusForbidden},
+		{name: "sub equal to an admin email", ownerClaim: "sub", claims: map[string]interface{}{"sub": "admin@example.com"}, wantStatus: http.StatusForbidden},
+		{name: "verified other email", ownerClaim: "sub", claims: map[string]interface{}{"sub": "user-1", "email": "user@example.com", "email_verified": true}, wantStatus: http.StatusForbidden},
+		{name: "email owner", ownerClaim: "email", claims: map[string]interface{}{"sub": "user-1", "email": "admin@example.com", "email_verified": true}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &AppController{
+				authMethod:   "oidc",
+				oidcProvider: NewOIDCProvider(OIDCConfig{OwnerClaim: tt.ownerClaim}),
+				sessionStore: sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+			}
+			router := gin.New()
+			router.GET("/login", func(c *gin.Context) {
+				session, _ := a.sessionStore.Get(c.Request, sessionName)
+				ownerID, _ := tt.claims[tt.ownerClaim].(string)
+				a.storeOIDCIdentity(session, tt.claims, ownerID)
+				if tt.staleEmail != "" {
+					session.Values["user_email"] = tt.staleEmail
+				}
+				session.Values["authenticated"] = true
+				if err := session.Save(c.Request, c.Writer); err != nil {
+					t.Errorf("save session: %v", err)
+				}
+			})
+			router.GET("/admin", a.authMiddleware(), a.adminMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			login := httptest.NewRecorder()
+			router.ServeHTTP(login, httptest.NewRequest(http.MethodGet, "/login", nil))
+			request := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			for _, cookie := range login.Result().Cookies() {
+				request.AddCookie(cookie)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != tt.wantStatus {
+				t.Errorf("GET /admin = %d, want %d", response.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWriteCommandLogsCSVEscapesFormulas(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	logs := []CommandLog{{
+		Timestamp:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		UserID:        "@alice",
+		UserName:      "+Alice",
+		EnvironmentID: "env-1",
+		PodName:       "\tpod",
+		SessionID:     "\rsession",
+		Command:       `=HYPERLINK("http://evil.example","x")`,
+	}}
+	(&AppController{}).writeCommandLogsCSV(c, logs)
+
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want a header and one row", len(records))
+	}
+	want := []string{"2024-05-01T12:00:00Z", "'@alice", "'+Alice", "env-1", "'\tpod", "'\rsession", `'=HYPERLINK("http://evil.example","x")`}
+	if !slices.Equal(records[1], want) {
+		t.Errorf("row = %q, want %q", records[1], want)
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: ""},
+		{value: "ls -la", want: "ls -la"},
+		{value: "=1+1", want: "'=1+1"},
+		{value: "+1", want: "'+1"},
+		{value: "-1", want: "'-1"},
+		{value: "@SUM(A1)", want: "'@SUM(A1)"},
+		{value: "\tcmd", want: "'\tcmd"},
+		{value: "\rcmd", want: "'\rcmd"},
+		{value: "echo =1", want: "echo =1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := csvCell(tt.value); got != tt.want {
+				t.Errorf("csvCell(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceForPort(t *testing.T) {
+	services := []k8s.ServiceInfo{
+		{Name: "web", Port: 80},
+		{Name: "dashboard", Port: 8080, NodePort: 30080},
+		{Name: "api", Port: 30080},
+	}
+	tests := []struct {
+		name string
+		port int
+		want string
+	}{
+		{name: "service port", port: 80, want: "web"},
+		{name: "NodePort", port: 30080, want: "dashboard"},
+		{name: "service port of a NodePort service", port: 8080, want: "dashboard"},
+		{name: "no service", port: 9090},
+		{name: "unset NodePort does not match", port: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := serviceForPort(services, tt.port)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("serviceForPort(%d) = %s, want none", tt.port, got.Name)
+				}
+				return
+			}
+			if got == nil || got.Name != tt.want {
+				t.Errorf("serviceForPort(%d) = %v, want %s", tt.port, got, tt.want)
+			}
+		})
+	}
+}
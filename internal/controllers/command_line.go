@@ -0,0 +1,231 @@
+// internal/controllers/command_line.go
+package controllers
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// recalledCommandMarker is appended to commands that were recalled from the shell's history,
+// whose text is not visible in the terminal input
+const recalledCommandMarker = "[from history]"
+
+// maxEscapeSequenceLength bounds how long an unterminated escape sequence is waited for
+const maxEscapeSequenceLength = 32
+
+// commandLine reconstructs the line a user is editing from raw terminal input, so the logged
+// command is what the shell runs on Enter rather than every key typed. It understands:
+//   - printable text, including UTF-8 characters split across WebSocket frames
+//   - bracketed paste (ESC[200~ ... ESC[201~), whose newlines do not submit the line
+//   - cursor movement: left/right arrows, Home/End, Ctrl-A/Ctrl-E, Ctrl-B/Ctrl-F
+//   - deletion: Backspace, Delete, Ctrl-D, Ctrl-U, Ctrl-K, Ctrl-W
+//   - Ctrl-C, which abandons the line
+//
+// Known limitations: only the terminal input is seen, not the shell's state. History recall
+// (up/down, Ctrl-P/Ctrl-N, Ctrl-R) is logged with recalledCommandMarker in place of the text
+// the shell inserted. Tab completion, word-wise movement (Alt-b/Alt-f), vi mode, aliases and
+// full-screen programs such as editors are not modelled; their keys are either recorded
+// literally or skipped.
+type commandLine struct {
+	line      []rune
+	cursor    int
+	truncated bool
+	recalled  bool
+	inPaste   bool
+	// pending holds a UTF-8 character or escape sequence whose remaining bytes are in the next frame
+	pending []byte
+}
+
+// feed applies a frame of terminal input to the line and returns the commands submitted by it.
+// Input beyond maxLength characters is dropped and the command marked as truncated; editing
+// is then ignored, since the cursor may be past the part of the line that was kept.
+func (cl *commandLine) feed(data []byte, maxLength int) []string {
+	var commands []string
+
+	buf := append(cl.pending, data...)
+	cl.pending = nil
+	for i := 0; i < len(buf); {
+		b := buf[i]
+		switch {
+		case b == '\x1b':
+			n, complete := escapeSequenceLength(buf[i:])
+			if !complete {
+				cl.pending = append([]byte(nil), buf[i:]...)
+				return commands
+			}
+			cl.handleEscape(string(buf[i : i+n]))
+			i += n
+
+		case b == '\r' || b == '\n':
+			if cl.inPaste {
+				cl.insert('\n', maxLength)
+			} else if command := cl.submit(); command != "" {
+				commands = append(commands, command)
+			}
+			i++
+			if b == '\r' && i < len(buf) && buf[i] == '\n' {
+				i++ // CRLF is a single Enter
+			}
+
+		case b < 0x20 || b == 0x7f:
+			cl.handleControl(b, maxLength)
+			i++
+
+		default:
+			if !utf8.FullRune(buf[i:]) {
+				cl.pending = append([]byte(nil), buf[i:]...)
+				return commands
+			}
+			r, size := utf8.DecodeRune(buf[i:])
+			if r != utf8.RuneError && unicode.IsPrint(r) {
+				cl.insert(r, maxLength)
+			}
+			i += size
+		}
+	}
+	return commands
+}
+
+// escapeSequenceLength returns the length of the escape sequence at the start of b, or false if
+// the sequence continues in the next frame. An ESC at the very end of a frame is the Escape key.
+func escapeSequenceLength(b []byte) (int, bool) {
+	if len(b) < 2 {
+		return 1, true
+	}
+	switch b[1] {
+	case '[': // CSI: parameter and intermediate bytes, then a final byte
+		for j := 2; j < len(b); j++ {
+			if b[j] >= 0x40 && b[j] <= 0x7e {
+				return j + 1, true
+			}
+			if b[j] < 0x20 || b[j] > 0x3f || j >= maxEscapeSequenceLength {
+				return j, true // Malformed; skip what was read
+			}
+		}
+		return 0, false
+	case 'O': // SS3: a single final byte
+		if len(b) < 3 {
+			return 0, false
+		}
+		return 3, true
+	default: // Alt+key
+		return 2, true
+	}
+}
+
+func (cl *commandLine) handleEscape(seq string) {
+	switch seq {
+	case "\x1b[200~":
+		cl.inPaste = true
+	case "\x1b[201~":
+		cl.inPaste = false
+	case "\x1b[D", "\x1bOD":
+		cl.moveCursor(cl.cursor - 1)
+	case "\x1b[C", "\x1bOC":
+		cl.moveCursor(cl.cursor + 1)
+	case "\x1b[H", "\x1bOH", "\x1b[1~", "\x1b[7~":
+		cl.moveCursor(0)
+	case "\x1b[F", "\x1bOF", "\x1b[4~", "\x1b[8~":
+		cl.moveCursor(len(cl.line))
+	case "\x1b[3~":
+		cl.deleteRange(cl.cursor, cl.cursor+1)
+	case "\x1b[A", "\x1bOA", "\x1b[B", "\x1bOB":
+		cl.recalled = true
+	}
+}
+
+func (cl *commandLine) handleControl(b byte, maxLength int) {
+	switch b {
+	case '\t':
+		cl.insert('\t', maxLength)
+	case 0x01: // Ctrl-A
+		cl.moveCursor(0)
+	case 0x05: // Ctrl-E
+		cl.moveCursor(len(cl.line))
+	case 0x02: // Ctrl-B
+		cl.moveCursor(cl.cursor - 1)
+	case 0x06: // Ctrl-F
+		cl.moveCursor(cl.cursor + 1)
+	case 0x08, 0x7f: // Backspace
+		cl.deleteRange(cl.cursor-1, cl.cursor)
+	case 0x04: // Ctrl-D
+		cl.deleteRange(cl.cursor, cl.cursor+1)
+	case 0x15: // Ctrl-U
+		cl.deleteRange(0, cl.cursor)
+	case 0x0b: // Ctrl-K
+		cl.deleteRange(cl.cursor, len(cl.line))
+	case 0x17: // Ctrl-W
+		start := cl.cursor
+		for start > 0 && unicode.IsSpace(cl.line[start-1]) {
+			start--
+		}
+		for start > 0 && !unicode.IsSpace(cl.line[start-1]) {
+			start--
+		}
+		cl.deleteRange(start, cl.cursor)
+	case 0x10, 0x0e, 0x12: // Ctrl-P, Ctrl-N, Ctrl-R
+		cl.recalled = true
+	case 0x03: // Ctrl-C
+		cl.reset()
+	}
+}
+
+func (cl *commandLine) insert(r rune, maxLength int) {
+	if cl.truncated {
+		return
+	}
+	if len(cl.line) >= maxLength {
+		cl.truncated = true
+		return
+	}
+	cl.line = append(cl.line, 0)
+	copy(cl.line[cl.cursor+1:], cl.line[cl.cursor:])
+	cl.line[cl.cursor] = r
+	cl.cursor++
+}
+
+func (cl *commandLine) moveCursor(pos int) {
+	if cl.truncated {
+		return
+	}
+	cl.cursor = min(max(pos, 0), len(cl.line))
+}
+
+func (cl *commandLine) deleteRange(start, end int) {
+	if cl.truncated {
+		return
+	}
+	start = max(start, 0)
+	end = min(end, len(cl.line))
+	if start >= end {
+		return
+	}
+	cl.line = append(cl.line[:start], cl.line[end:]...)
+	if cl.cursor > end {
+		cl.cursor -= end - start
+	} else if cl.cursor > start {
+		cl.cursor = start
+	}
+}
+
+// submit returns the command for the current line, with markers for what could not be
+// captured, and starts a new line
+func (cl *commandLine) submit() string {
+	command := strings.TrimSpace(string(cl.line))
+	if command != "" && cl.truncated {
+		command += truncatedCommandMarker
+	}
+	if cl.recalled {
+		command = strings.TrimSpace(command + " " + recalledCommandMarker)
+	}
+	cl.reset()
+	return command
+}
+
+func (cl *commandLine) reset() {
+	cl.line = nil
+	cl.cursor = 0
+	cl.truncated = false
+	cl.recalled = false
+}
@@ -0,0 +1,65 @@
+// internal/controllers/create_rate_limits.go
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// createRateLimitPolicy decides how many environments an owner may create per minute. Members of
+// a group listed in CREATE_RATE_LIMIT_GROUPS_JSON get that group's limit instead of the default;
+// 0 means unlimited.
+type createRateLimitPolicy struct {
+	defaultLimit int
+	byGroup      map[string]int
+}
+
+// parseCreateRateLimitPolicy parses CREATE_RATE_LIMIT_GROUPS_JSON, e.g.
+//
+//	{"power-users": 30, "ci": 0}
+//
+// on top of the CREATE_RATE_LIMIT default. Groups come from the OIDC groups claim, so the
+// per-group limits only apply with single sign-on.
+func parseCreateRateLimitPolicy(defaultLimit int, raw string) (*createRateLimitPolicy, error) {
+	policy := &createRateLimitPolicy{defaultLimit: defaultLimit, byGroup: map[string]int{}}
+	if raw == "" {
+		return policy, nil
+	}
+
+	var groups map[string]int
+	if err := json.Unmarshal([]byte(raw), &groups); err != nil {
+		return nil, err
+	}
+	for group, limit := range groups {
+		if group == "" {
+			return nil, fmt.Errorf("empty group name")
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("limit %d for group %s must not be negative", limit, group)
+		}
+		policy.byGroup[group] = limit
+	}
+	return policy, nil
+}
+
+// limitFor returns the creation limit for a member of groups: the most generous limit among
+// the listed groups the owner belongs to, or the default if none is listed.
+func (p *createRateLimitPolicy) limitFor(groups []string) int {
+	limit, matched := 0, false
+	for _, group := range groups {
+		groupLimit, ok := p.byGroup[group]
+		if !ok {
+			continue
+		}
+		if groupLimit == 0 {
+			return 0
+		}
+		if !matched || groupLimit > limit {
+			limit, matched = groupLimit, true
+		}
+	}
+	if !matched {
+		return p.defaultLimit
+	}
+	return limit
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import "testing"
+
+func TestCreateRateLimitPolicyLimitFor(t *testing.T) {
+	policy, err := parseCreateRateLimitPolicy(5, `{"power-users": 30, "trainers": 60, "ci": 0}`)
+	if err != nil {
+		t.Fatalf("parseCreateRateLimitPolicy: %v", err)
+	}
+	tests := []struct {
+		name   string
+		groups []string
+		want   int
+	}{
+		{name: "no groups", groups: nil, want: 5},
+		{name: "unlisted groups", groups: []string{"developers"}, want: 5},
+		{name: "listed group", groups: []string{"developers", "power-users"}, want: 30},
+		{name: "most generous group", groups: []string{"trainers", "power-users"}, want: 60},
+		{name: "unlimited group", groups: []string{"power-users", "ci"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.limitFor(tt.groups); got != tt.want {
+				t.Errorf("limitFor(%v) = %d, want %d", tt.groups, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCreateRateLimitPolicyRejectsInvalid(t *testing.T) {
+	for _, raw := range []string{`{"ci": -1}`, `{"": 10}`, `{"ci": "10"}`, `["ci"]`} {
+		if _, err := parseCreateRateLimitPolicy(5, raw); err == nil {
+			t.Errorf("parseCreateRateLimitPolicy(%s) succeeded, want an error", raw)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// internal/controllers/expiry_warnings.go
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+// expiryHub relays the collector's expiry warnings to the terminal sessions of each environment
+type expiryHub struct {
+	mutex    sync.Mutex
+	sessions map[string]map[*WSClient]struct{}
+}
+
+func (h *expiryHub) dispatch(warning queue.ExpiryWarning) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for client := range h.sessions[warning.ID] {
+		go client.sendWarning(expiryWarningMessage(warning.ExpiresAt))
+	}
+}
+
+// watchExpiry delivers expiry warnings for the environment to the session's terminal. The
+// returned function must be called to stop.
+func (a *AppController) watchExpiry(environmentID string, wsClient *WSClient) func() {
+	a.expiryHubOnce.Do(func() {
+		a.expiryHub = &expiryHub{sessions: make(map[string]map[*WSClient]struct{})}
+		go func() {
+			for warning := range a.redisQueue.SubscribeExpiryWarnings(context.Background()) {
+				a.expiryHub.dispatch(warning)
+			}
+		}()
+	})
+
+	h := a.expiryHub
+	h.mutex.Lock()
+	if h.sessions[environmentID] == nil {
+		h.sessions[environmentID] = make(map[*WSClient]struct{})
+	}
+	h.sessions[environmentID][wsClient] = struct{}{}
+	h.mutex.Unlock()
+
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		delete(h.sessions[environmentID], wsClient)
+		if len(h.sessions[environmentID]) == 0 {
+			delete(h.sessions, environmentID)
+		}
+	}
+}
+
+func expiryWarningMessage(expiresAt time.Time) string {
+	remaining := time.Until(expiresAt).Round(time.Minute)
+	return fmt.Sprintf("This environment expires at %s (in %v) and will then be deleted. Save your work before it is collected.",
+		expiresAt.UTC().Format("15:04 MST"), max(remaining, 0))
+}
+
+// warnIfExpiring repeats a warning the collector already sent for the environment, so sessions
+// opened after it still learn that the environment is about to expire
+func warnIfExpiring(wsClient *WSClient, item *queue.QueueItem) {
+	if item.WarnedAt == nil || item.IsExpired() {
+		return
+	}
+	log.Printf("Session %s opened on environment %s that expires at %v", wsClient.sessionID, item.ID, item.ExpiresAt)
+	wsClient.sendWarning(expiryWarningMessage(item.ExpiresAt))
+}
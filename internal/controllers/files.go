@@ -0,0 +1,154 @@
+// internal/controllers/files.go
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+// Default for MAX_UPLOAD_BYTES
+const defaultMaxUploadBytes = 100 << 20
+
+// sharePath maps the path of a files API request onto the share. Cleaning it as an absolute
+// path drops any ".." that would climb above the share; symlinks are checked in the pod.
+func sharePath(raw string) (string, error) {
+	if strings.IndexFunc(raw, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("invalid path")
+	}
+	return path.Join(k8s.ShareMountPath, path.Clean("/"+raw)), nil
+}
+
+// sharedFilesPod checks that the caller owns the available environment named in the URL and
+// returns its pod. It writes the error response itself and returns ok=false on failure.
+func (a *AppController) sharedFilesPod(c *gin.Context) (podName, namespace string, ok bool) {
+	ownerID := c.MustGet("owner_id").(string)
+	envID := c.Param("id")
+
+	item, err := a.redisQueue.GetItem(c.Request.Context(), envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for files by owner %s: %v", envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
+		return "", "", false
+	}
+	if item.Owner != ownerID {
+		log.Printf("Forbidden: Owner %s attempted to access files of environment %s owned by %s", ownerID, envID, item.Owner)
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return "", "", false
+	}
+	if item.Status != queue.StatusAvailable || item.PodID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Environment is not available"})
+		return "", "", false
+	}
+
+	namespace = item.NamespaceOr(getNamespace())
+	podName, err = a.resolvePodName(c.Request.Context(), item, namespace)
+	if err != nil {
+		log.Printf("Failed to get pod name for workload %s (env %s): %v", item.PodID, envID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find the running pod for the environment"})
+		return "", "", false
+	}
+	return podName, namespace, true
+}
+
+// respondFileError writes the response for a failed file operation
+func respondFileError(c *gin.Context, target string, err error) {
+	switch {
+	case errors.Is(err, k8s.ErrFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, k8s.ErrOutsideShare):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Path is outside the shared directory"})
+	default:
+		log.Printf("File operation on %s failed: %v", target, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "File operation failed"})
+	}
+}
+
+// downloadSharedFile streams a file from the environment's share, or lists a directory with ?list=true
+func (a *AppController) downloadSharedFile(c *gin.Context) {
+	target, err := sharePath(c.Param("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	podName, namespace, ok := a.sharedFilesPod(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if c.Query("list") == "true" {
+		files, err := a.k8sClient.ListSharedFiles(ctx, podName, namespace, target)
+		if err != nil {
+			respondFileError(c, target, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"path": target, "files": files})
+		return
+	}
+
+	info, err := a.k8sClient.StatSharedFile(ctx, podName, namespace, target)
+	if err != nil {
+		respondFileError(c, target, err)
+		return
+	}
+	if info.IsDir {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Path is a directory; add ?list=true to list it"})
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name))
+	c.Header("Content-Length", fmt.Sprintf("%d", info.Size))
+	c.Status(http.StatusOK)
+	if err := a.k8sClient.ReadSharedFile(ctx, podName, namespace, target, c.Writer); err != nil {
+		// Headers are already sent; the client sees a short body
+		log.Printf("Download of %s from pod %s failed: %v", target, podName, err)
+	}
+}
+
+// uploadSharedFile stores the raw request body as a file in the environment's share
+func (a *AppController) uploadSharedFile(c *gin.Context) {
+	target, err := sharePath(c.Param("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if target == k8s.ShareMountPath || strings.HasSuffix(c.Param("path"), "/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload path must name a file"})
+		return
+	}
+	if c.Request.ContentLength < 0 {
+		c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length is required"})
+		return
+	}
+	if c.Request.ContentLength > a.maxUploadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File exceeds the upload limit of %d bytes", a.maxUploadBytes)})
+		return
+	}
+	podName, namespace, ok := a.sharedFilesPod(c)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, a.maxUploadBytes)
+	if err := a.k8sClient.WriteSharedFile(c.Request.Context(), podName, namespace, target, c.Request.ContentLength, body); err != nil {
+		respondFileError(c, target, err)
+		return
+	}
+
+	log.Printf("Uploaded %d bytes to %s in pod %s", c.Request.ContentLength, target, podName)
+	c.JSON(http.StatusCreated, gin.H{"path": target, "size": c.Request.ContentLength})
+}
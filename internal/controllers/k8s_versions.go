@@ -0,0 +1,57 @@
+// internal/controllers/k8s_versions.go
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// K8sVersionInfo describes a Kubernetes version environments can be created with
+type K8sVersionInfo struct {
+	Version string `json:"version"`
+	// DinD image tag and/or digest the version maps to
+	Image string `json:"image"`
+	// Preselected when creating an environment (DIND_DEFAULT_VERSION)
+	Default bool `json:"default"`
+	// Still available but about to be removed (DIND_DEPRECATED_VERSIONS)
+	Deprecated bool `json:"deprecated"`
+}
+
+// parseK8sVersionFlags validates DIND_DEFAULT_VERSION and the comma-separated
+// DIND_DEPRECATED_VERSIONS against the configured versions
+func parseK8sVersionFlags(defaultVersion, deprecatedVersions string, versions map[string]string) (string, map[string]bool, error) {
+	if _, ok := versions[defaultVersion]; defaultVersion != "" && !ok {
+		return "", nil, fmt.Errorf("default version %q is not configured", defaultVersion)
+	}
+	deprecated := make(map[string]bool)
+	for _, version := range strings.Split(deprecatedVersions, ",") {
+		version = strings.TrimSpace(version)
+		if version == "" {
+			continue
+		}
+		if _, ok := versions[version]; !ok {
+			return "", nil, fmt.Errorf("deprecated version %q is not configured", version)
+		}
+		deprecated[version] = true
+	}
+	return defaultVersion, deprecated, nil
+}
+
+// getK8sVersionDetails lists the available Kubernetes versions with their image and flags;
+// /api/k8s-versions keeps returning just the version keys
+func (a *AppController) getK8sVersionDetails(c *gin.Context) {
+	names := a.k8sVersionNames()
+	versions := make([]K8sVersionInfo, 0, len(names))
+	for _, version := range names {
+		versions = append(versions, K8sVersionInfo{
+			Version:    version,
+			Image:      a.dindImageVersions[version],
+			Default:    version == a.defaultK8sVersion,
+			Deprecated: a.deprecatedK8sVersions[version],
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": versions, "default": a.defaultK8sVersion})
+}
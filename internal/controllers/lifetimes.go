@@ -0,0 +1,107 @@
+// internal/controllers/lifetimes.go
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Lifetime of new environments when DEFAULT_LIFETIMES_JSON does not say otherwise
+	defaultEnvironmentLifetime = 24 * time.Hour
+	// Upper bound on any configured lifetime unless MAX_ENVIRONMENT_LIFETIME is set
+	defaultMaxEnvironmentLifetime = 30 * 24 * time.Hour
+)
+
+// lifetimePolicy decides how long a new environment lives before the collector removes it.
+// A lifetime configured for the K8s version wins over one for the workload type, which wins
+// over the default.
+type lifetimePolicy struct {
+	defaultLifetime time.Duration
+	byVersion       map[string]time.Duration
+	byWorkloadType  map[string]time.Duration
+	max             time.Duration
+}
+
+// parseLifetimePolicy parses DEFAULT_LIFETIMES_JSON, e.g.
+//
+//	{"default": "24h", "versions": {"1.30": "2h"}, "workload_types": {"statefulset": "168h", "deployment": "2h"}}
+//
+// Every lifetime must be positive and at most max, so a typo cannot create environments that
+// effectively never expire.
+func parseLifetimePolicy(raw string, max time.Duration) (*lifetimePolicy, error) {
+	policy := &lifetimePolicy{
+		defaultLifetime: defaultEnvironmentLifetime,
+		byVersion:       map[string]time.Duration{},
+		byWorkloadType:  map[string]time.Duration{},
+		max:             max,
+	}
+	if defaultEnvironmentLifetime > max {
+		policy.defaultLifetime = max
+	}
+	if raw == "" {
+		return policy, nil
+	}
+
+	var config struct {
+		Default       string            `json:"default"`
+		Versions      map[string]string `json:"versions"`
+		WorkloadTypes map[string]string `json:"workload_types"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	parse := func(what, value string) (time.Duration, error) {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid lifetime %q for %s: %w", value, what, err)
+		}
+		if lifetime <= 0 || lifetime > max {
+			return 0, fmt.Errorf("lifetime %v for %s must be positive and at most %v", lifetime, what, max)
+		}
+		return lifetime, nil
+	}
+
+	if config.Default != "" {
+		lifetime, err := parse("default", config.Default)
+		if err != nil {
+			return nil, err
+		}
+		policy.defaultLifetime = lifetime
+	}
+	for version, value := range config.Versions {
+		lifetime, err := parse("version "+version, value)
+		if err != nil {
+			return nil, err
+		}
+		policy.byVersion[version] = lifetime
+	}
+	for workloadType, value := range config.WorkloadTypes {
+		if workloadType != "statefulset" && workloadType != "deployment" {
+			return nil, fmt.Errorf("unknown workload type %q, expected 'statefulset' or 'deployment'", workloadType)
+		}
+		lifetime, err := parse("workload type "+workloadType, value)
+		if err != nil {
+			return nil, err
+		}
+		policy.byWorkloadType[workloadType] = lifetime
+	}
+	return policy, nil
+}
+
+// lifetimeFor returns the lifetime of a new environment, never more than the policy's maximum
+func (p *lifetimePolicy) lifetimeFor(k8sVersion, workloadType string) time.Duration {
+	lifetime, ok := p.byVersion[k8sVersion]
+	if !ok {
+		lifetime, ok = p.byWorkloadType[workloadType]
+	}
+	if !ok {
+		lifetime = p.defaultLifetime
+	}
+	return min(lifetime, p.max)
+}
@@ -15,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,19 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
+// commandLogBufferKey is the Redis list the app-controller pushes command logs to and the
+// logging controller persists them from
+const commandLogBufferKey = "command_log_buffer"
+
+// logBufferBatchSize caps how many buffered logs are written per flush
+const logBufferBatchSize = 100
+
+// defaultMaxCommandLength bounds how many characters of a single command are kept per session
+const defaultMaxCommandLength = 4096
+
+// truncatedCommandMarker is appended to commands cut at the maximum length
+const truncatedCommandMarker = " [truncated]"
+
 type CommandLog struct {
 	ID            string    `json:"id"`
 	EnvironmentID string    `json:"environment_id"`
@@ -34,26 +48,30 @@ type CommandLog struct {
 }
 
 type LoggingController struct {
-	logDir    string
-	logFile   *os.File
-	logWriter *bufio.Writer
-	mutex     sync.Mutex
+	logDir      string
+	logFile     *os.File
+	logWriter   *bufio.Writer
+	mutex       sync.Mutex
 	redisClient *redis.Client
-	adminToken string
+	adminTokens []string
+	tokenMutex  sync.RWMutex
+	guard       *adminAPIGuard
+	// maxCommandLength caps the buffered command per session; longer input is truncated
+	maxCommandLength int
 }
 
 func NewLoggingController(logDir string) *LoggingController {
 	if logDir == "" {
 		logDir = "/var/log/k8s-playground"
 	}
-	
+
 	// Create log directory if it doesn't exist
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		log.Printf("Warning: failed to create log directory %s: %v", logDir, err)
 		logDir = "/tmp/k8s-playground-logs" // fallback
 		os.MkdirAll(logDir, 0755)
 	}
-	
+
 	// Get admin token from environment variable or generate one
 	adminToken := os.Getenv("ADMIN_TOKEN")
 	if adminToken == "" {
@@ -62,11 +80,22 @@ func NewLoggingController(logDir string) *LoggingController {
 	} else {
 		log.Printf("Using admin token from environment: %s", adminToken[:8]+"...")
 	}
-	
-	return &LoggingController{
-		logDir: logDir,
-		adminToken: adminToken,
+
+	maxCommandLength, err := strconv.Atoi(getEnv("COMMAND_LOG_MAX_LENGTH", strconv.Itoa(defaultMaxCommandLength)))
+	if err != nil || maxCommandLength <= 0 {
+		log.Printf("Warning: invalid COMMAND_LOG_MAX_LENGTH, using %d", defaultMaxCommandLength)
+		maxCommandLength = defaultMaxCommandLength
 	}
+
+	lc := &LoggingController{
+		logDir:           logDir,
+		adminTokens:      []string{adminToken},
+		guard:            newAdminAPIGuard(),
+		maxCommandLength: maxCommandLength,
+	}
+	// ADMIN_TOKEN_FILE, when set, takes precedence and is re-read periodically so the token can be rotated without a restart
+	lc.reloadAdminTokenFile()
+	return lc
 }
 
 func NewLoggingControllerWithRedis(logDir string, redisClient *redis.Client) *LoggingController {
@@ -77,13 +106,13 @@ func NewLoggingControllerWithRedis(logDir string, redisClient *redis.Client) *Lo
 
 func (lc *LoggingController) Start(ctx context.Context) error {
 	log.Println("Logging controller started")
-	
+
 	// Initialize current day log file
 	if err := lc.rotateLogFileIfNeeded(); err != nil {
 		log.Printf("Failed to initialize log file: %v", err)
 		return err
 	}
-	
+
 	// Start log processor if Redis client is available
 	if lc.redisClient != nil {
 		go lc.processLogBuffer(ctx)
@@ -92,12 +121,17 @@ func (lc *LoggingController) Start(ctx context.Context) error {
 	// Start daily rotation and compression ticker
 	ticker := time.NewTicker(1 * time.Hour) // Check every hour for rotation
 	defer ticker.Stop()
-	
+
+	tokenTicker := time.NewTicker(adminTokenReloadInterval)
+	defer tokenTicker.Stop()
+
 	for {
 		select {
 		case <-ticker.C:
 			lc.rotateLogFileIfNeeded()
 			lc.compressOldLogFiles()
+		case <-tokenTicker.C:
+			lc.reloadAdminTokenFile()
 		case <-ctx.Done():
 			log.Println("Logging controller stopping...")
 			lc.closeLogFile()
@@ -127,14 +161,14 @@ func (lc *LoggingController) LogCommandToBuffer(environmentID, userID, userName,
 	// Push to Redis list buffer
 	if lc.redisClient != nil {
 		ctx := context.Background()
-		if err := lc.redisClient.LPush(ctx, "command_log_buffer", string(logData)).Err(); err != nil {
+		if err := lc.redisClient.LPush(ctx, commandLogBufferKey, string(logData)).Err(); err != nil {
 			return fmt.Errorf("failed to buffer command log to Redis: %v", err)
 		}
 	}
 
-	log.Printf("Command buffered: User %s (%s) executed '%s' in env %s (pod %s)", 
+	log.Printf("Command buffered: User %s (%s) executed '%s' in env %s (pod %s)",
 		userName, userID, command, environmentID, podName)
-	
+
 	return nil
 }
 
@@ -174,9 +208,9 @@ func (lc *LoggingController) LogCommand(environmentID, userID, userName, podName
 		}
 	}
 
-	log.Printf("Command logged: User %s (%s) executed '%s' in env %s (pod %s)", 
+	log.Printf("Command logged: User %s (%s) executed '%s' in env %s (pod %s)",
 		userName, userID, command, environmentID, podName)
-	
+
 	return nil
 }
 
@@ -204,7 +238,7 @@ func (lc *LoggingController) rotateLogFileIfNeeded() error {
 
 	lc.logFile = file
 	lc.logWriter = bufio.NewWriter(file)
-	
+
 	log.Printf("Rotated to new log file: %s", logFilePath)
 	return nil
 }
@@ -290,7 +324,7 @@ func (lc *LoggingController) getLogFiles() ([]string, error) {
 
 	// Sort files by date (newest first)
 	sort.Sort(sort.Reverse(sort.StringSlice(allFiles)))
-	
+
 	return allFiles, nil
 }
 
@@ -309,7 +343,7 @@ func (lc *LoggingController) readLogsFromFile(filePath string) ([]CommandLog, er
 
 	var logs []CommandLog
 	scanner := bufio.NewScanner(file)
-	
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.TrimSpace(line) == "" {
@@ -321,7 +355,7 @@ func (lc *LoggingController) readLogsFromFile(filePath string) ([]CommandLog, er
 			log.Printf("Warning: failed to unmarshal log line in %s: %v", filePath, err)
 			continue
 		}
-		
+
 		logs = append(logs, commandLog)
 	}
 
@@ -365,7 +399,7 @@ func (lc *LoggingController) compressOldLogFiles() {
 func (lc *LoggingController) compressLogFile(filePath string) error {
 	// Create compressed file
 	compressedPath := filePath + ".gz"
-	
+
 	inputFile, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open input file: %v", err)
@@ -438,7 +472,7 @@ func (lc *LoggingController) readCompressedLogFile(filePath string) ([]CommandLo
 
 	var logs []CommandLog
 	scanner := bufio.NewScanner(gzipReader)
-	
+
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.TrimSpace(line) == "" {
@@ -450,7 +484,7 @@ func (lc *LoggingController) readCompressedLogFile(filePath string) ([]CommandLo
 			log.Printf("Warning: failed to unmarshal log line in %s: %v", filePath, err)
 			continue
 		}
-		
+
 		logs = append(logs, commandLog)
 	}
 
@@ -461,10 +495,12 @@ func (lc *LoggingController) readCompressedLogFile(filePath string) ([]CommandLo
 	return logs, nil
 }
 
-// processLogBuffer continuously processes logs from Redis buffer
+// processLogBuffer continuously processes logs from Redis buffer. Each blocking pop is followed
+// by draining up to logBufferBatchSize entries so a busy buffer is persisted with one flush per
+// batch rather than one per command.
 func (lc *LoggingController) processLogBuffer(ctx context.Context) {
 	log.Println("Starting log buffer processor...")
-	
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -472,37 +508,113 @@ func (lc *LoggingController) processLogBuffer(ctx context.Context) {
 			return
 		default:
 			// Try to get logs from Redis buffer (blocking pop with timeout)
-			result, err := lc.redisClient.BRPop(ctx, 5*time.Second, "command_log_buffer").Result()
-			if err != nil {
+			result, err := lc.redisClient.BRPop(ctx, 5*time.Second, commandLogBufferKey).Result()
+			if err != nil || len(result) < 2 {
 				// Timeout or error - continue
 				continue
 			}
-			
-			if len(result) >= 2 {
-				logData := result[1] // BRPop returns [key, value]
-				
-				// Parse the log entry
-				var commandLog CommandLog
-				if err := json.Unmarshal([]byte(logData), &commandLog); err != nil {
-					log.Printf("Warning: failed to unmarshal buffered log: %v", err)
-					continue
-				}
-				
-				// Write to file
-				if err := lc.writeLogToFile(commandLog); err != nil {
-					log.Printf("Error writing log to file: %v", err)
-					// Re-queue the log to prevent data loss
-					if err := lc.redisClient.LPush(ctx, "command_log_buffer", logData).Err(); err != nil {
-						log.Printf("Critical: failed to re-queue log entry: %v", err)
-					}
-				}
+
+			entries := append([]string{result[1]}, lc.popLogBatch(ctx, logBufferBatchSize-1)...) // BRPop returns [key, value]
+			if err := lc.persistLogBatch(entries); err != nil {
+				log.Printf("Error writing %d logs to file: %v", len(entries), err)
+				// Re-queue the logs to prevent data loss
+				lc.requeueLogBatch(ctx, entries)
 			}
 		}
 	}
 }
 
-// writeLogToFile writes a single log entry to file
-func (lc *LoggingController) writeLogToFile(commandLog CommandLog) error {
+// popLogBatch atomically takes up to max of the oldest entries from the log buffer, oldest first
+func (lc *LoggingController) popLogBatch(ctx context.Context, max int) []string {
+	if max <= 0 {
+		return nil
+	}
+
+	// New logs are pushed on the left, so the oldest max entries are the rightmost ones
+	var rangeCmd *redis.StringSliceCmd
+	_, err := lc.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rangeCmd = pipe.LRange(ctx, commandLogBufferKey, int64(-max), -1)
+		pipe.LTrim(ctx, commandLogBufferKey, 0, int64(-max-1))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: failed to drain log buffer: %v", err)
+		return nil
+	}
+
+	newestFirst := rangeCmd.Val()
+	entries := make([]string, len(newestFirst))
+	for i, logData := range newestFirst {
+		entries[len(newestFirst)-1-i] = logData
+	}
+	return entries
+}
+
+// persistLogBatch writes buffered entries, oldest first, to the log file with a single flush.
+// Entries that cannot be parsed are dropped.
+func (lc *LoggingController) persistLogBatch(entries []string) error {
+	commandLogs := make([]CommandLog, 0, len(entries))
+	for _, logData := range entries {
+		var commandLog CommandLog
+		if err := json.Unmarshal([]byte(logData), &commandLog); err != nil {
+			log.Printf("Warning: failed to unmarshal buffered log: %v", err)
+			continue
+		}
+		commandLogs = append(commandLogs, commandLog)
+	}
+	return lc.writeLogsToFile(commandLogs)
+}
+
+// requeueLogBatch puts popped entries back at the oldest end of the buffer in their original order
+func (lc *LoggingController) requeueLogBatch(ctx context.Context, entries []string) {
+	values := make([]interface{}, len(entries))
+	for i, logData := range entries {
+		values[len(entries)-1-i] = logData
+	}
+	if err := lc.redisClient.RPush(ctx, commandLogBufferKey, values...).Err(); err != nil {
+		log.Printf("Critical: failed to re-queue %d log entries: %v", len(entries), err)
+	}
+}
+
+// BufferLength returns the number of command logs waiting in the Redis buffer
+func (lc *LoggingController) BufferLength(ctx context.Context) (int64, error) {
+	if lc.redisClient == nil {
+		return 0, fmt.Errorf("no Redis buffer configured")
+	}
+	return lc.redisClient.LLen(ctx, commandLogBufferKey).Result()
+}
+
+// FlushBuffer persists the command logs currently in the Redis buffer and returns how many were
+// written. Logs buffered while it runs are left to the buffer processor. On a write failure the
+// failed batch is put back where it was taken from and the error is returned.
+func (lc *LoggingController) FlushBuffer(ctx context.Context) (int, error) {
+	pending, err := lc.BufferLength(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	flushed := 0
+	for remaining := int(pending); remaining > 0; {
+		entries := lc.popLogBatch(ctx, min(remaining, logBufferBatchSize))
+		if len(entries) == 0 {
+			break // Drained concurrently by the buffer processor
+		}
+		if err := lc.persistLogBatch(entries); err != nil {
+			lc.requeueLogBatch(ctx, entries)
+			return flushed, fmt.Errorf("failed to persist buffered logs: %v", err)
+		}
+		flushed += len(entries)
+		remaining -= len(entries)
+	}
+	return flushed, nil
+}
+
+// writeLogsToFile writes log entries to file in order and flushes once
+func (lc *LoggingController) writeLogsToFile(commandLogs []CommandLog) error {
+	if len(commandLogs) == 0 {
+		return nil
+	}
+
 	lc.mutex.Lock()
 	defer lc.mutex.Unlock()
 
@@ -511,31 +623,35 @@ func (lc *LoggingController) writeLogToFile(commandLog CommandLog) error {
 		log.Printf("Warning: failed to rotate log file: %v", err)
 	}
 
-	// Marshal log entry
-	logData, err := json.Marshal(commandLog)
-	if err != nil {
-		return fmt.Errorf("failed to marshal command log: %v", err)
+	if lc.logWriter == nil {
+		return nil
 	}
 
-	// Write to file
-	if lc.logWriter != nil {
+	for _, commandLog := range commandLogs {
+		// Marshal log entry
+		logData, err := json.Marshal(commandLog)
+		if err != nil {
+			return fmt.Errorf("failed to marshal command log: %v", err)
+		}
+
 		if _, err := lc.logWriter.WriteString(string(logData) + "\n"); err != nil {
 			return fmt.Errorf("failed to write command log: %v", err)
 		}
-		if err := lc.logWriter.Flush(); err != nil {
-			return fmt.Errorf("failed to flush command log: %v", err)
-		}
+	}
+	if err := lc.logWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush command log: %v", err)
+	}
+
+	for _, commandLog := range commandLogs {
+		log.Printf("Log persisted: User %s (%s) executed '%s' in env %s (pod %s)",
+			commandLog.UserName, commandLog.UserID, commandLog.Command,
+			commandLog.EnvironmentID, commandLog.PodName)
 	}
 
-	log.Printf("Log persisted: User %s (%s) executed '%s' in env %s (pod %s)", 
-		commandLog.UserName, commandLog.UserID, commandLog.Command, 
-		commandLog.EnvironmentID, commandLog.PodName)
-	
 	return nil
 }
 
-
-// commandBuffer stores partial commands being typed by users per session
+// commandBuffer stores the line being edited by users per session
 var commandBuffer = sync.Map{}
 
 // ParseCommandFromWebSocketData extracts executable commands from WebSocket data
@@ -543,7 +659,9 @@ func (lc *LoggingController) ParseCommandFromWebSocketData(data []byte) string {
 	return lc.ParseCommandFromWebSocketDataWithSession(data, "default")
 }
 
-// ParseCommandFromWebSocketDataWithSession extracts executable commands with session tracking
+// ParseCommandFromWebSocketDataWithSession extracts executable commands with session tracking.
+// Line editing is applied as described on commandLine; commands submitted together in one frame
+// are returned joined by newlines.
 func (lc *LoggingController) ParseCommandFromWebSocketDataWithSession(data []byte, sessionID string) string {
 	// Handle JSON messages (resize commands, etc.)
 	var controlMsg map[string]interface{}
@@ -554,57 +672,23 @@ func (lc *LoggingController) ParseCommandFromWebSocketDataWithSession(data []byt
 		}
 	}
 
-	// Convert bytes to string
-	str := string(data)
-	
-	// Skip ANSI escape sequences and control characters except CR/LF
-	if len(str) > 0 && str[0] == '\x1b' {
-		return ""
-	}
-	
-	// Get current buffer for this session
-	bufferInterface, _ := commandBuffer.LoadOrStore(sessionID, "")
-	currentBuffer := bufferInterface.(string)
-	
-	// Check for Enter key (CR, LF, or CRLF) - command execution
-	if strings.Contains(str, "\r") || strings.Contains(str, "\n") {
-		// Command was executed, return the accumulated buffer
-		command := strings.TrimSpace(currentBuffer)
-		
-		// Clear the buffer for this session
-		commandBuffer.Store(sessionID, "")
-		
-		// Return all input, regardless of content
-		if len(command) > 0 {
-			log.Printf("DEBUG: Input recorded: %q", command)
-			return command
-		}
-		return ""
-	}
-	
-	// Check for backspace (delete character from buffer)
-	if str == "\x08" || str == "\x7f" {
-		if len(currentBuffer) > 0 {
-			currentBuffer = currentBuffer[:len(currentBuffer)-1]
-			commandBuffer.Store(sessionID, currentBuffer)
-		}
-		return ""
+	// Feed the input to the line being edited in this session
+	lineInterface, _ := commandBuffer.LoadOrStore(sessionID, &commandLine{})
+	line := lineInterface.(*commandLine)
+
+	maxLength := lc.maxCommandLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxCommandLength
 	}
-	
-	// Add printable characters to buffer
-	for _, r := range str {
-		if r >= 32 && r <= 126 || r == ' ' || r == '\t' {
-			currentBuffer += string(r)
-		}
+	commands := line.feed(data, maxLength)
+
+	// Return all input, regardless of content
+	for _, command := range commands {
+		log.Printf("DEBUG: Input recorded: %q", command)
 	}
-	
-	// Store updated buffer
-	commandBuffer.Store(sessionID, currentBuffer)
-	
-	return ""
+	return strings.Join(commands, "\n")
 }
 
-
 // Admin authentication and log viewing functions
 
 func generateAdminToken() string {
@@ -613,10 +697,9 @@ func generateAdminToken() string {
 }
 
 func (lc *LoggingController) VerifyAdminToken(token string) bool {
-	return token == lc.adminToken
+	return lc.verifyAdminTokenConstantTime(token)
 }
 
-
 func (lc *LoggingController) HandleAdminAuth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -640,6 +723,42 @@ func (lc *LoggingController) HandleAdminAuth(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// HandleAdminBuffer reports the length of the Redis log buffer (GET) or flushes it to disk (POST)
+func (lc *LoggingController) HandleAdminBuffer(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("X-Admin-Token")
+	if !lc.VerifyAdminToken(token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	response := map[string]interface{}{}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		flushed, err := lc.FlushBuffer(r.Context())
+		if err != nil {
+			log.Printf("Admin API: log buffer flush failed after %d entries: %v", flushed, err)
+			http.Error(w, fmt.Sprintf("Failed to flush log buffer: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin API: flushed %d buffered command logs", flushed)
+		response["flushed"] = flushed
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	length, err := lc.BufferLength(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read log buffer: %v", err), http.StatusInternalServerError)
+		return
+	}
+	response["length"] = length
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func (lc *LoggingController) HandleAdminLogs(w http.ResponseWriter, r *http.Request) {
 	token := r.Header.Get("X-Admin-Token")
 	if !lc.VerifyAdminToken(token) {
@@ -662,7 +781,7 @@ func (lc *LoggingController) HandleAdminLogs(w http.ResponseWriter, r *http.Requ
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"logs": logs,
+		"logs":  logs,
 		"count": len(logs),
 	})
-}
\ No newline at end of file
+}
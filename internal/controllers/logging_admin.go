@@ -0,0 +1,231 @@
+// internal/controllers/logging_admin.go
+package controllers
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminTokenReloadInterval = 30 * time.Second
+	adminAuthRateWindow      = time.Minute
+)
+
+// adminAPIGuard holds the access controls for the logging controller's admin API.
+// Every setting is optional; with nothing configured the API behaves as before
+// (token check only).
+type adminAPIGuard struct {
+	allowedOrigins []string
+	allowedNets    []*net.IPNet
+
+	tokenFile    string
+	tokenModTime time.Time
+
+	rateLimit    int
+	rateMutex    sync.Mutex
+	rateCounters map[string]*adminRateCounter
+}
+
+type adminRateCounter struct {
+	windowStart time.Time
+	count       int
+}
+
+// newAdminAPIGuard reads ADMIN_ALLOWED_ORIGINS, ADMIN_ALLOWED_IPS,
+// ADMIN_AUTH_RATE_LIMIT and ADMIN_TOKEN_FILE from the environment.
+func newAdminAPIGuard() *adminAPIGuard {
+	g := &adminAPIGuard{
+		allowedOrigins: splitAndTrim(os.Getenv("ADMIN_ALLOWED_ORIGINS")),
+		tokenFile:      os.Getenv("ADMIN_TOKEN_FILE"),
+		rateLimit:      10,
+		rateCounters:   make(map[string]*adminRateCounter),
+	}
+
+	for _, entry := range splitAndTrim(os.Getenv("ADMIN_ALLOWED_IPS")) {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid ADMIN_ALLOWED_IPS entry %q: %v", entry, err)
+			continue
+		}
+		g.allowedNets = append(g.allowedNets, ipNet)
+	}
+
+	if raw := os.Getenv("ADMIN_AUTH_RATE_LIMIT"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+			g.rateLimit = n
+		} else {
+			log.Printf("Warning: invalid ADMIN_AUTH_RATE_LIMIT %q, using %d per minute", raw, g.rateLimit)
+		}
+	}
+
+	if len(g.allowedOrigins) > 0 {
+		log.Printf("Admin API allowed origins: %v", g.allowedOrigins)
+	}
+	if len(g.allowedNets) > 0 {
+		log.Printf("Admin API restricted to source networks: %v", g.allowedNets)
+	}
+	return g
+}
+
+func (g *adminAPIGuard) originAllowed(origin string) bool {
+	for _, allowed := range g.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *adminAPIGuard) ipAllowed(ip net.IP) bool {
+	if len(g.allowedNets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range g.allowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowAttempt records an attempt from the given client and reports whether it is within the limit.
+func (g *adminAPIGuard) allowAttempt(client string) bool {
+	if g.rateLimit == 0 {
+		return true
+	}
+	g.rateMutex.Lock()
+	defer g.rateMutex.Unlock()
+
+	now := time.Now()
+	counter, ok := g.rateCounters[client]
+	if !ok || now.Sub(counter.windowStart) >= adminAuthRateWindow {
+		// Drop stale counters so the map doesn't grow without bound
+		for key, c := range g.rateCounters {
+			if now.Sub(c.windowStart) >= adminAuthRateWindow {
+				delete(g.rateCounters, key)
+			}
+		}
+		counter = &adminRateCounter{windowStart: now}
+		g.rateCounters[client] = counter
+	}
+	counter.count++
+	return counter.count <= g.rateLimit
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// WrapAdminHandler applies source IP, origin/CORS and (optionally) rate limit checks
+// before handing the request to an admin API handler.
+func (lc *LoggingController) WrapAdminHandler(next http.HandlerFunc, rateLimited bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if !lc.guard.ipAllowed(ip) {
+			log.Printf("Admin API: rejected request from %s (not in ADMIN_ALLOWED_IPS)", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" && len(lc.guard.allowedOrigins) > 0 {
+			if !lc.guard.originAllowed(origin) {
+				log.Printf("Admin API: rejected request from origin %s", origin)
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Token")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		if rateLimited && !lc.guard.allowAttempt(ip.String()) {
+			log.Printf("Admin API: rate limit exceeded for %s on %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(adminAuthRateWindow.Seconds())))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// setAdminTokens replaces the accepted admin tokens. Empty entries are ignored.
+func (lc *LoggingController) setAdminTokens(tokens []string) {
+	var valid []string
+	for _, t := range tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			valid = append(valid, t)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	lc.tokenMutex.Lock()
+	lc.adminTokens = valid
+	lc.tokenMutex.Unlock()
+}
+
+// reloadAdminTokenFile re-reads ADMIN_TOKEN_FILE when it has changed. The file may hold
+// several tokens (one per line) so the old and new token can overlap during a rotation.
+func (lc *LoggingController) reloadAdminTokenFile() {
+	if lc.guard.tokenFile == "" {
+		return
+	}
+	info, err := os.Stat(lc.guard.tokenFile)
+	if err != nil {
+		log.Printf("Warning: failed to stat admin token file %s: %v", lc.guard.tokenFile, err)
+		return
+	}
+	if info.ModTime().Equal(lc.guard.tokenModTime) {
+		return
+	}
+	data, err := os.ReadFile(lc.guard.tokenFile)
+	if err != nil {
+		log.Printf("Warning: failed to read admin token file %s: %v", lc.guard.tokenFile, err)
+		return
+	}
+	tokens := strings.Split(string(data), "\n")
+	lc.setAdminTokens(tokens)
+	lc.guard.tokenModTime = info.ModTime()
+	log.Printf("Loaded admin token(s) from %s", lc.guard.tokenFile)
+}
+
+func (lc *LoggingController) verifyAdminTokenConstantTime(token string) bool {
+	if token == "" {
+		return false
+	}
+	lc.tokenMutex.RLock()
+	defer lc.tokenMutex.RUnlock()
+	for _, t := range lc.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseCommandTruncatesPasteBomb(t *testing.T) {
+	const maxLength, frameSize = 4096, 64 * 1024
+	lc := &LoggingController{maxCommandLength: maxLength}
+	sessionID := t.Name()
+	t.Cleanup(func() { commandBuffer.Delete(sessionID) })
+
+	// 8 MiB pasted in one go, in frames as the terminal sends them. Multi-byte characters are
+	// split across frames, and the newlines inside the paste must not submit anything.
+	chunk := strings.Repeat("echo ünïcödé; ", 1023) + "\n"
+	paste := "\x1b[200~" + strings.Repeat(chunk, 8*1024*1024/len(chunk)) + "\x1b[201~\r"
+	var commands []string
+	for start := 0; start < len(paste); start += frameSize {
+		frame := paste[start:min(start+frameSize, len(paste))]
+		if command := lc.ParseCommandFromWebSocketDataWithSession([]byte(frame), sessionID); command != "" {
+			commands = append(commands, command)
+		}
+
+		value, _ := commandBuffer.Load(sessionID)
+		line := value.(*commandLine)
+		if len(line.line) > maxLength || cap(line.line) > 2*maxLength {
+			t.Fatalf("session buffer grew to %d runes (capacity %d), want at most %d", len(line.line), cap(line.line), maxLength)
+		}
+		if len(line.pending) > maxEscapeSequenceLength {
+			t.Fatalf("%d bytes pending between frames", len(line.pending))
+		}
+	}
+
+	if len(commands) != 1 {
+		t.Fatalf("paste submitted %d commands, want 1", len(commands))
+	}
+	command := commands[0]
+	if !strings.HasSuffix(command, truncatedCommandMarker) {
+		t.Errorf("command does not end with %q", truncatedCommandMarker)
+	}
+	if n := utf8.RuneCountInString(strings.TrimSuffix(command, truncatedCommandMarker)); n > maxLength {
+		t.Errorf("command has %d characters, want at most %d", n, maxLength)
+	}
+	if !strings.HasPrefix(command, "echo ünïcödé;") || !utf8.ValidString(command) {
+		t.Errorf("command starts with %q, want the start of the paste", command[:min(len(command), 40)])
+	}
+
+	// The session is usable again after the truncated command
+	if got := lc.ParseCommandFromWebSocketDataWithSession([]byte("ls -la\r"), sessionID); got != "ls -la" {
+		t.Errorf("next command = %q, want %q", got, "ls -la")
+	}
+}
@@ -0,0 +1,156 @@
+// internal/controllers/oidc.go
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// GoogleIssuerURL is the issuer of the google authentication method, a preset of the generic OIDC provider
+	GoogleIssuerURL = "https://accounts.google.com"
+	// DefaultOIDCOwnerClaim is the ID token claim used as owner_id unless OIDC_OWNER_CLAIM is set
+	DefaultOIDCOwnerClaim = "email"
+	// DefaultOIDCGroupsClaim is the ID token claim listing the user's groups unless OIDC_GROUPS_CLAIM is set
+	DefaultOIDCGroupsClaim = "groups"
+
+	// Timeout of discovery, JWKS and token requests to the identity provider
+	oidcRequestTimeout = 10 * time.Second
+)
+
+// OIDCConfig configures an OpenID Connect identity provider
+type OIDCConfig struct {
+	// IssuerURL is used for discovery and must match the iss claim of ID tokens
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// OwnerClaim is the ID token claim that identifies a user, stored as owner_id
+	OwnerClaim string
+	// GroupsClaim is the ID token claim listing the user's groups, used for ADMIN_GROUP
+	GroupsClaim string
+	// DisplayName is shown on the login button, e.g. "Google" or "Keycloak"
+	DisplayName string
+}
+
+// OIDCProvider signs users in with the authorization code flow of an OpenID Connect provider.
+// Endpoints are discovered from the issuer on first use; ID tokens are verified by go-oidc against
+// the issuer's JWKS.
+type OIDCProvider struct {
+	config     OIDCConfig
+	httpClient *http.Client
+
+	mutex        sync.Mutex
+	oauth2Config *oauth2.Config // nil until discovery succeeded
+	verifier     *oidc.IDTokenVerifier
+}
+
+// NewOIDCProvider returns a provider for config; nothing is fetched from the issuer yet
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if config.OwnerClaim == "" {
+		config.OwnerClaim = DefaultOIDCOwnerClaim
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = DefaultOIDCGroupsClaim
+	}
+	if !slices.Contains(config.Scopes, oidc.ScopeOpenID) {
+		config.Scopes = append([]string{oidc.ScopeOpenID}, config.Scopes...)
+	}
+	return &OIDCProvider{config: config, httpClient: &http.Client{Timeout: oidcRequestTimeout}}
+}
+
+// DisplayName returns the name of the provider shown to users
+func (p *OIDCProvider) DisplayName() string {
+	if p.config.DisplayName != "" {
+		return p.config.DisplayName
+	}
+	return "Single Sign-On"
+}
+
+// OwnerClaim returns the claim used as owner_id
+func (p *OIDCProvider) OwnerClaim() string {
+	return p.config.OwnerClaim
+}
+
+// Groups returns the groups listed in the ID token claims, and false if the token has no groups
+// claim. Providers send either a list or, for a single group, a string.
+func (p *OIDCProvider) Groups(claims map[string]interface{}) ([]string, bool) {
+	switch value := claims[p.config.GroupsClaim].(type) {
+	case []interface{}:
+		groups := make([]string, 0, len(value))
+		for _, v := range value {
+			if group, ok := v.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+		return groups, true
+	case string:
+		return []string{value}, true
+	}
+	return nil, false
+}
+
+// OAuth2Config returns the OAuth2 configuration of the provider, discovering its endpoints on
+// first use. A failed discovery is retried on the next call.
+func (p *OIDCProvider) OAuth2Config(ctx context.Context) (*oauth2.Config, error) {
+	oauth2Config, _, err := p.discover(ctx)
+	return oauth2Config, err
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.oauth2Config != nil {
+		return p.oauth2Config, p.verifier, nil
+	}
+
+	// The provider keeps the HTTP client of this context, not its deadline, for JWKS refreshes
+	provider, err := oidc.NewProvider(p.HTTPContext(ctx), p.config.IssuerURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	p.oauth2Config = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Scopes:       p.config.Scopes,
+		Endpoint:     provider.Endpoint(),
+	}
+	return p.oauth2Config, p.verifier, nil
+}
+
+// HTTPContext returns ctx with the provider's HTTP client, for token exchanges
+func (p *OIDCProvider) HTTPContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, p.httpClient)
+}
+
+// VerifyIDToken validates the signature and standard claims of an ID token issued to this
+// client, including the nonce sent with the authorization request, and returns its claims
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawToken, nonce string) (map[string]interface{}, error) {
+	_, verifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idToken, err := verifier.Verify(p.HTTPContext(ctx), rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != "" && idToken.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match the login request")
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	return claims, nil
+}
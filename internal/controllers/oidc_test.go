@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/coreos/go-oidc/v3/oidc/oidctest"
+)
+
+func TestOIDCProviderVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &oidctest.Server{PublicKeys: []oidctest.PublicKey{{PublicKey: key.Public(), KeyID: "test-key", Algorithm: oidc.RS256}}}
+	server := httptest.NewServer(issuer)
+	defer server.Close()
+	issuer.SetIssuer(server.URL)
+
+	provider := NewOIDCProvider(OIDCConfig{IssuerURL: server.URL, ClientID: "playground"})
+	sign := func(overrides map[string]interface{}) string {
+		claims := map[string]interface{}{
+			"iss":   server.URL,
+			"aud":   "playground",
+			"sub":   "user-1",
+			"email": "user@example.com",
+			"nonce": "expected-nonce",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range overrides {
+			claims[name] = value
+		}
+		data, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return oidctest.SignIDToken(key, "test-key", oidc.RS256, string(data))
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: sign(nil)},
+		{name: "nonce mismatch", token: sign(map[string]interface{}{"nonce": "other-nonce"}), wantErr: true},
+		{name: "other audience", token: sign(map[string]interface{}{"aud": "other-client"}), wantErr: true},
+		{name: "other issuer", token: sign(map[string]interface{}{"iss": "https://evil.example.com"}), wantErr: true},
+		{name: "expired", token: sign(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), wantErr: true},
+		{name: "unknown key", token: oidctest.SignIDToken(otherKey, "test-key", oidc.RS256, `{"iss":"`+server.URL+`","aud":"playground"}`), wantErr: true},
+		{name: "malformed", token: "not.a.token", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := provider.VerifyIDToken(context.Background(), tt.token, "expected-nonce")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("VerifyIDToken accepted the token, claims %v", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyIDToken: %v", err)
+			}
+			if claims["email"] != "user@example.com" || claims["sub"] != "user-1" {
+				t.Errorf("claims = %v, want the signed claims", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderGroups(t *testing.T) {
+	provider := NewOIDCProvider(OIDCConfig{GroupsClaim: "roles"})
+	tests := []struct {
+		name       string
+		claims     map[string]interface{}
+		wantGroups []string
+		wantOK     bool
+	}{
+		{name: "list", claims: map[string]interface{}{"roles": []interface{}{"admins", 42, "dev"}}, wantGroups: []string{"admins", "dev"}, wantOK: true},
+		{name: "single group", claims: map[string]interface{}{"roles": "admins"}, wantGroups: []string{"admins"}, wantOK: true},
+		{name: "empty list", claims: map[string]interface{}{"roles": []interface{}{}}, wantGroups: []string{}, wantOK: true},
+		{name: "other claim", claims: map[string]interface{}{"groups": []interface{}{"admins"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups, ok := provider.Groups(tt.claims)
+			if ok != tt.wantOK || !reflect.DeepEqual(groups, tt.wantGroups) {
+				t.Errorf("Groups = %v, %v; want %v, %v", groups, ok, tt.wantGroups, tt.wantOK)
+			}
+		})
+	}
+}
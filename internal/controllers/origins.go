@@ -0,0 +1,63 @@
+// internal/controllers/origins.go
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseAllowedOrigins builds the set of origins ("scheme://host[:port]") WebSocket upgrades may
+// come from: BASE_URL's origin plus the comma-separated ALLOWED_ORIGINS. An ALLOWED_ORIGINS
+// entry of "*" accepts any origin, for local development.
+func parseAllowedOrigins(baseURL, raw string) map[string]bool {
+	origins := make(map[string]bool)
+	if origin, ok := normalizeOrigin(baseURL); ok {
+		origins[origin] = true
+	}
+	for _, entry := range splitAndTrim(raw) {
+		if entry == "*" {
+			log.Println("Warning: ALLOWED_ORIGINS contains '*'; WebSocket connections are accepted from any origin")
+			origins["*"] = true
+			continue
+		}
+		origin, ok := normalizeOrigin(entry)
+		if !ok {
+			log.Printf("Warning: Ignoring invalid entry %q in ALLOWED_ORIGINS", entry)
+			continue
+		}
+		origins[origin] = true
+	}
+	return origins
+}
+
+// normalizeOrigin reduces an http(s) URL to its lower-cased origin
+func normalizeOrigin(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return "", false
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
+
+// checkOrigin returns the upgrader's CheckOrigin. Requests without an Origin header come from
+// non-browser clients and are accepted, as are same-host requests; any other origin must be
+// allowlisted, so pages on other sites cannot open terminals with the user's cookie.
+func checkOrigin(allowed map[string]bool) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		raw := r.Header.Get("Origin")
+		if raw == "" || allowed["*"] {
+			return true
+		}
+		u, err := url.Parse(raw)
+		if err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		if origin, ok := normalizeOrigin(raw); ok && allowed[origin] {
+			return true
+		}
+		log.Printf("Rejected WebSocket upgrade from origin %q to %s", raw, r.URL.Path)
+		return false
+	}
+}
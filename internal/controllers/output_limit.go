@@ -0,0 +1,61 @@
+// internal/controllers/output_limit.go
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// How often a throttled session is reminded that its output is being slowed down
+const outputThrottleNoticeInterval = time.Minute
+
+// newOutputLimiter returns a limiter allowing bytesPerSecond of terminal output with bursts of up
+// to one second's worth, or nil if bytesPerSecond is 0 (unlimited)
+func newOutputLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// throttleOutput blocks until n bytes of output fit the session's rate limit. Output is delayed
+// rather than dropped; since the exec stream is not read meanwhile, the command producing it is
+// slowed down by the pod's pipe filling up. Returns false if the session ended while waiting.
+func (c *WSClient) throttleOutput(n int) bool {
+	if c.outputLimiter == nil {
+		return true
+	}
+	burst := c.outputLimiter.Burst()
+	for n > 0 {
+		size := min(n, burst)
+		n -= size
+		delay := c.outputLimiter.ReserveN(time.Now(), size).Delay()
+		if delay <= 0 {
+			continue
+		}
+		c.noticeOutputThrottled()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.session.Done():
+			timer.Stop()
+			return false
+		}
+	}
+	return true
+}
+
+// noticeOutputThrottled tells the user their output is being slowed down, at most once per
+// outputThrottleNoticeInterval
+func (c *WSClient) noticeOutputThrottled() {
+	now := time.Now()
+	last := c.lastThrottleNotice.Load()
+	if now.Sub(time.Unix(0, last)) < outputThrottleNoticeInterval || !c.lastThrottleNotice.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	log.Printf("Throttling output of session %s to %d bytes/s", c.sessionID, c.outputLimiter.Burst())
+	c.sendWarning(fmt.Sprintf("Output is limited to %d bytes per second; the running command is being slowed down.", c.outputLimiter.Burst()))
+}
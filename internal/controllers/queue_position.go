@@ -0,0 +1,74 @@
+// internal/controllers/queue_position.go
+package controllers
+
+import (
+	"context"
+	"log"
+
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+// QueuePosition tells the owner of a pending environment where it stands in line
+type QueuePosition struct {
+	// 1 for the environment generated next
+	Position int `json:"position"`
+	// Estimated seconds until the environment is available, based on the recent generation
+	// durations; omitted until one was recorded
+	ETASeconds int64 `json:"eta_seconds,omitempty"`
+}
+
+// queuePositions returns the position in line of every pending item, keyed by item ID. Items
+// are served in the order they were created. The estimate assumes the generator works through
+// the line in batches of its parallelism, and ignores per-owner quotas.
+func (a *AppController) queuePositions(ctx context.Context) (map[string]QueuePosition, error) {
+	pending, err := a.redisQueue.GetItemsByStatus(ctx, queue.StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	queue.SortByCreation(pending)
+
+	stats, err := a.redisQueue.GetGenerationStats(ctx)
+	if err != nil {
+		log.Printf("Error getting generation stats for queue estimates: %v", err)
+	}
+	parallelism := max(stats.Parallelism, 1)
+
+	positions := make(map[string]QueuePosition, len(pending))
+	for i, item := range pending {
+		position := QueuePosition{Position: i + 1}
+		if stats.Samples > 0 {
+			batches := int64(i/parallelism + 1)
+			position.ETASeconds = batches * int64(stats.AverageDuration.Seconds())
+		}
+		positions[item.ID] = position
+	}
+	return positions, nil
+}
+
+// ownerQueuePositions returns the queue positions of the given items that are pending, or nil
+// if none is
+func (a *AppController) ownerQueuePositions(ctx context.Context, items []*queue.QueueItem) map[string]QueuePosition {
+	hasPending := false
+	for _, item := range items {
+		if item.Status == queue.StatusPending {
+			hasPending = true
+			break
+		}
+	}
+	if !hasPending {
+		return nil
+	}
+
+	all, err := a.queuePositions(ctx)
+	if err != nil {
+		log.Printf("Error computing queue positions: %v", err)
+		return nil
+	}
+	positions := make(map[string]QueuePosition)
+	for _, item := range items {
+		if position, ok := all[item.ID]; ok {
+			positions[item.ID] = position
+		}
+	}
+	return positions
+}
@@ -0,0 +1,69 @@
+// internal/controllers/redirects.go
+package controllers
+
+import (
+	"log"
+	"net/url"
+	"strings"
+)
+
+const defaultPostLoginRedirect = "/dashboard"
+
+// loginErrorMessages maps the error codes that may appear in the login page's ?error= parameter
+// to the text shown to the user. Free-form text from the query string is never displayed.
+var loginErrorMessages = map[string]string{
+	"config_error":    "Authentication is not configured correctly. Please contact the administrator.",
+	"session_expired": "Your session has expired. Please sign in again.",
+}
+
+// loginErrorMessage returns the message for an error code, or a generic one for unknown codes
+func loginErrorMessage(code string) string {
+	if code == "" {
+		return ""
+	}
+	if message, ok := loginErrorMessages[code]; ok {
+		return message
+	}
+	return "Login failed. Please try again."
+}
+
+// parseRedirectHosts builds the set of hosts absolute redirect targets may point to:
+// the host of BASE_URL plus the comma-separated ALLOWED_REDIRECT_HOSTS (host or host:port)
+func parseRedirectHosts(baseURL, raw string) map[string]bool {
+	hosts := make(map[string]bool)
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		hosts[strings.ToLower(u.Host)] = true
+	}
+	for _, host := range splitAndTrim(raw) {
+		if strings.ContainsAny(host, "/@?#") {
+			log.Printf("Warning: Ignoring invalid entry %q in ALLOWED_REDIRECT_HOSTS", host)
+			continue
+		}
+		hosts[strings.ToLower(host)] = true
+	}
+	return hosts
+}
+
+// safeRedirectTarget validates a user-influenced redirect destination. Relative paths on this
+// site and absolute http(s) URLs on an allowlisted host are returned unchanged; anything else
+// (other hosts, scheme-relative "//host" or "/\host" paths, javascript: URLs, ...) yields the dashboard.
+func (a *AppController) safeRedirectTarget(raw string) string {
+	if raw == "" || strings.ContainsAny(raw, "\\\r\n\t") {
+		return defaultPostLoginRedirect
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return defaultPostLoginRedirect
+	}
+	if u.Scheme == "" && u.Host == "" && u.User == nil {
+		if strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//") {
+			return raw
+		}
+		return defaultPostLoginRedirect
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.User == nil && a.allowedRedirectHosts[strings.ToLower(u.Host)] {
+		return raw
+	}
+	log.Printf("Rejected redirect target %q", raw)
+	return defaultPostLoginRedirect
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import "testing"
+
+func TestSafeRedirectTarget(t *testing.T) {
+	a := &AppController{allowedRedirectHosts: parseRedirectHosts("https://playground.example.com", "docs.example.com, grafana.example.com:3000")}
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "empty", target: "", want: defaultPostLoginRedirect},
+		{name: "relative path", target: "/terminal/abc?tab=2#top", want: "/terminal/abc?tab=2#top"},
+		{name: "base URL host", target: "https://playground.example.com/admin", want: "https://playground.example.com/admin"},
+		{name: "allowlisted host", target: "https://docs.example.com/guide", want: "https://docs.example.com/guide"},
+		{name: "allowlisted host is case-insensitive", target: "https://DOCS.example.com/", want: "https://DOCS.example.com/"},
+		{name: "allowlisted host with port", target: "http://grafana.example.com:3000/d/1", want: "http://grafana.example.com:3000/d/1"},
+		{name: "allowlisted host on another port", target: "https://grafana.example.com/d/1", want: defaultPostLoginRedirect},
+		{name: "host not allowlisted", target: "https://evil.example.org/", want: defaultPostLoginRedirect},
+		{name: "allowlisted host as a suffix", target: "https://docs.example.com.evil.org/", want: defaultPostLoginRedirect},
+		{name: "scheme-relative", target: "//evil.example.org/", want: defaultPostLoginRedirect},
+		{name: "backslash scheme-relative", target: `/\evil.example.org`, want: defaultPostLoginRedirect},
+		{name: "tab in scheme-relative", target: "/\t/evil.example.org", want: defaultPostLoginRedirect},
+		{name: "CRLF", target: "/dashboard\r\nSet-Cookie: x=1", want: defaultPostLoginRedirect},
+		{name: "javascript URL", target: "javascript:alert(document.cookie)", want: defaultPostLoginRedirect},
+		{name: "data URL", target: "data:text/html,<script>alert(1)</script>", want: defaultPostLoginRedirect},
+		{name: "userinfo", target: "https://user@playground.example.com/", want: defaultPostLoginRedirect},
+		{name: "userinfo with allowlisted user", target: "https://playground.example.com@evil.example.org/", want: defaultPostLoginRedirect},
+		{name: "other scheme on allowlisted host", target: "ftp://docs.example.com/", want: defaultPostLoginRedirect},
+		{name: "relative without slash", target: "dashboard", want: defaultPostLoginRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.safeRedirectTarget(tt.target); got != tt.want {
+				t.Errorf("safeRedirectTarget(%q) = %q, want %q", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRedirectHostsSkipsInvalidEntries(t *testing.T) {
+	hosts := parseRedirectHosts("https://playground.example.com/", "ok.example.com,evil.example.org/path,user@evil.example.org")
+	for _, host := range []string{"playground.example.com", "ok.example.com"} {
+		if !hosts[host] {
+			t.Errorf("%s is not allowed", host)
+		}
+	}
+	if len(hosts) != 2 {
+		t.Errorf("hosts = %v, want only the valid entries", hosts)
+	}
+}
+
+func TestLoginErrorMessage(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{code: "", want: ""},
+		{code: "session_expired", want: loginErrorMessages["session_expired"]},
+		{code: "config_error", want: loginErrorMessages["config_error"]},
+		{code: "unknown_code", want: "Login failed. Please try again."},
+		{code: "<script>alert(1)</script>", want: "Login failed. Please try again."},
+	}
+	for _, tt := range tests {
+		if got := loginErrorMessage(tt.code); got != tt.want {
+			t.Errorf("loginErrorMessage(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
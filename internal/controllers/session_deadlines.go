@@ -0,0 +1,94 @@
+// internal/controllers/session_deadlines.go
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// How often the countdown is repeated while a disconnect warning is active
+	disconnectCountdownInterval = 10 * time.Second
+
+	defaultIdleWarningMessage     = "Disconnecting in {remaining} due to inactivity. Press any key to stay connected."
+	defaultDurationWarningMessage = "This session will end in {remaining} (maximum session duration reached)."
+)
+
+// formatDisconnectWarning fills the {remaining} placeholder of a configured warning message
+func formatDisconnectWarning(message string, remaining time.Duration) string {
+	return strings.ReplaceAll(message, "{remaining}", remaining.Round(time.Second).String())
+}
+
+// markInput records that the user typed something, postponing an idle disconnect
+func (c *WSClient) markInput() {
+	c.lastInput.Store(time.Now().UnixNano())
+}
+
+func (c *WSClient) lastInputTime() time.Time {
+	return time.Unix(0, c.lastInput.Load())
+}
+
+// sendWarning writes a "warning" TerminalMessage, serialized with the exec output on the same connection
+func (c *WSClient) sendWarning(message string) {
+	jsonData, err := json.Marshal(TerminalMessage{Operation: "warning", Data: "\r\n\x1b[33m" + message + "\x1b[0m\r\n"})
+	if err != nil {
+		log.Printf("Error marshalling warning message to JSON: %v", err)
+		return
+	}
+	if err := c.writeText(jsonData); err != nil {
+		log.Printf("Error sending warning to session %s: %v", c.sessionID, err)
+	}
+}
+
+// watchSessionDeadlines counts down to the end of the session when it approaches the maximum
+// duration or the idle timeout. Input during the idle warning window cancels the idle disconnect.
+// The duration limit itself is enforced by the exec context; an idle session is ended here by
+// cancelling the exec. Returns once ctx is done.
+func (a *AppController) watchSessionDeadlines(ctx context.Context, wsClient *WSClient, started time.Time, cancelExec context.CancelFunc) {
+	if a.maxSessionDuration <= 0 && a.terminalIdleTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastDurationWarning, lastIdleWarning time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if a.maxSessionDuration > 0 {
+				remaining := started.Add(a.maxSessionDuration).Sub(now)
+				if remaining > 0 && remaining <= a.disconnectWarningLead && now.Sub(lastDurationWarning) >= disconnectCountdownInterval {
+					lastDurationWarning = now
+					wsClient.sendWarning(formatDisconnectWarning(a.durationWarningMessage, remaining))
+				}
+			}
+
+			if a.terminalIdleTimeout > 0 {
+				remaining := wsClient.lastInputTime().Add(a.terminalIdleTimeout).Sub(now)
+				switch {
+				case remaining <= 0:
+					log.Printf("Terminal session %s idle for %v, disconnecting", wsClient.sessionID, a.terminalIdleTimeout)
+					wsClient.idleDisconnected.Store(true)
+					cancelExec()
+					return
+				case remaining <= a.disconnectWarningLead:
+					if now.Sub(lastIdleWarning) >= disconnectCountdownInterval {
+						lastIdleWarning = now
+						wsClient.sendWarning(formatDisconnectWarning(a.idleWarningMessage, remaining))
+					}
+				default:
+					if !lastIdleWarning.IsZero() {
+						lastIdleWarning = time.Time{}
+						wsClient.sendWarning("Activity detected, idle disconnect cancelled.")
+					}
+				}
+			}
+		}
+	}
+}
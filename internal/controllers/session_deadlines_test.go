@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWSPair returns the server and client ends of a WebSocket connection
+func newTestWSPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade failed: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	serverConn := <-serverConns
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+	return serverConn, client
+}
+
+// readTerminalMessage reads the next TerminalMessage sent to the client
+func readTerminalMessage(t *testing.T, conn *websocket.Conn, timeout time.Duration) TerminalMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("no message within %v: %v", timeout, err)
+	}
+	var msg TerminalMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("invalid terminal message %q: %v", data, err)
+	}
+	return msg
+}
+
+func TestWatchSessionDeadlinesDisconnectsIdleSession(t *testing.T) {
+	serverConn, _ := newTestWSPair(t)
+	wsClient := &WSClient{conn: serverConn, sessionID: "idle", settings: defaultWebSocketSettings()}
+	wsClient.lastInput.Store(time.Now().Add(-time.Minute).UnixNano())
+	a := &AppController{terminalIdleTimeout: 10 * time.Second, disconnectWarningLead: 5 * time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		a.watchSessionDeadlines(ctx, wsClient, time.Now(), cancel)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle session was not disconnected")
+	}
+	if ctx.Err() == nil {
+		t.Error("exec of the idle session was not cancelled")
+	}
+	if !wsClient.idleDisconnected.Load() {
+		t.Error("session is not marked as disconnected for being idle")
+	}
+}
+
+func TestWatchSessionDeadlinesInputCancelsIdleWarning(t *testing.T) {
+	serverConn, clientConn := newTestWSPair(t)
+	wsClient := &WSClient{conn: serverConn, sessionID: "active", settings: defaultWebSocketSettings()}
+	wsClient.markInput()
+	a := &AppController{
+		terminalIdleTimeout:   4 * time.Second,
+		disconnectWarningLead: 2500 * time.Millisecond,
+		idleWarningMessage:    "idle, disconnecting in {remaining}",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var execCancelled atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		a.watchSessionDeadlines(ctx, wsClient, time.Now(), func() { execCancelled.Store(true) })
+		close(done)
+	}()
+
+	warning := readTerminalMessage(t, clientConn, 4*time.Second)
+	if warning.Operation != "warning" || !strings.Contains(warning.Data, "idle, disconnecting in") {
+		t.Fatalf("first message = %+v, want the idle warning", warning)
+	}
+
+	wsClient.markInput()
+	cancelled := readTerminalMessage(t, clientConn, 3*time.Second)
+	if !strings.Contains(cancelled.Data, "idle disconnect cancelled") {
+		t.Fatalf("message after input = %+v, want the cancellation notice", cancelled)
+	}
+
+	cancel()
+	<-done
+	if execCancelled.Load() || wsClient.idleDisconnected.Load() {
+		t.Error("session was disconnected although input arrived during the warning")
+	}
+}
+
+func TestFormatDisconnectWarning(t *testing.T) {
+	got := formatDisconnectWarning("ending in {remaining}, really {remaining}", 29600*time.Millisecond)
+	if want := "ending in 30s, really 30s"; got != want {
+		t.Errorf("formatDisconnectWarning = %q, want %q", got, want)
+	}
+}
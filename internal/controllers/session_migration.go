@@ -0,0 +1,256 @@
+// internal/controllers/session_migration.go
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tyottodekiru/k8s-playground/pkg/k8s"
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+const (
+	// How long an exec that ended on its own waits for a status change announcing a recreate
+	recreateDetectGrace = 5 * time.Second
+	// How long a session waits for a recreated environment to become available again
+	environmentRestartTimeout = 10 * time.Minute
+	// How long a cancelled exec is given to tear down its stream
+	execStopTimeout = 5 * time.Second
+)
+
+// statusHub fans the queue's status events out to the terminal sessions of each environment
+type statusHub struct {
+	mutex    sync.Mutex
+	watchers map[string]map[chan queue.QueueStatus]struct{}
+}
+
+func (h *statusHub) dispatch(event queue.StatusEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for ch := range h.watchers[event.ID] {
+		select {
+		case ch <- event.Status:
+		default:
+			// A session that is not keeping up only misses intermediate states; it re-reads the item
+		}
+	}
+}
+
+// watchStatus subscribes to the status changes of one environment. The returned function
+// must be called to unsubscribe.
+func (a *AppController) watchStatus(environmentID string) (<-chan queue.QueueStatus, func()) {
+	a.statusHubOnce.Do(func() {
+		a.statusHub = &statusHub{watchers: make(map[string]map[chan queue.QueueStatus]struct{})}
+		go func() {
+			for event := range a.redisQueue.SubscribeStatus(context.Background()) {
+				a.statusHub.dispatch(event)
+			}
+		}()
+	})
+
+	ch := make(chan queue.QueueStatus, 8)
+	h := a.statusHub
+	h.mutex.Lock()
+	if h.watchers[environmentID] == nil {
+		h.watchers[environmentID] = make(map[chan queue.QueueStatus]struct{})
+	}
+	h.watchers[environmentID][ch] = struct{}{}
+	h.mutex.Unlock()
+
+	return ch, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		delete(h.watchers[environmentID], ch)
+		if len(h.watchers[environmentID]) == 0 {
+			delete(h.watchers, environmentID)
+		}
+	}
+}
+
+// isRecreateStatus reports whether an environment in this status is being set up again
+// (after a retry or restart) rather than going away
+func isRecreateStatus(status queue.QueueStatus) bool {
+	return status == queue.StatusPending || status == queue.StatusGenerating || status == queue.StatusRestarting
+}
+
+// startReadPump starts the goroutine that reads the WebSocket. Input messages are handed to
+// whichever exec is currently reading; the first read error closes the client's input.
+func (c *WSClient) startReadPump() {
+	go func() {
+		for {
+			message, err := c.nextInput()
+			if err != nil {
+				c.readErr = err
+				close(c.closed)
+				return
+			}
+			select {
+			case c.input <- message:
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+}
+
+func (c *WSClient) Read(p []byte) (int, error) {
+	return c.readInput(p, nil)
+}
+
+// readInput returns the next input message, or io.EOF once done is closed so that an exec
+// which has been abandoned stops consuming input meant for its successor
+func (c *WSClient) readInput(p []byte, done <-chan struct{}) (int, error) {
+	select {
+	case message := <-c.input:
+		return copy(p, message), nil
+	case <-c.closed:
+		return 0, c.readErr
+	case <-done:
+		return 0, io.EOF
+	}
+}
+
+type execInput struct {
+	client *WSClient
+	done   <-chan struct{}
+}
+
+func (r execInput) Read(p []byte) (int, error) { return r.client.readInput(p, r.done) }
+
+// execSizeQueue hands terminal resizes to one exec until done is closed
+type execSizeQueue struct {
+	session *TerminalSession
+	done    <-chan struct{}
+}
+
+func (q execSizeQueue) Next() *k8s.TerminalSize {
+	select {
+	case size := <-q.session.sizeChan:
+		return size
+	case <-q.session.doneChan:
+		return nil
+	case <-q.done:
+		return nil
+	}
+}
+
+// runExec runs one shell in the pod and returns when it exits, the client goes away, or the
+// environment starts being recreated (reported by the first return value)
+func (a *AppController) runExec(ctx context.Context, wsClient *WSClient, session *TerminalSession, namespace, podName string, command []string, statusChanges <-chan queue.QueueStatus) (bool, error) {
+	execCtx, cancelExec := context.WithCancel(ctx)
+	defer cancelExec()
+
+	if size := session.lastSize.Load(); size != nil {
+		session.Resize(size.Width, size.Height)
+	}
+
+	execDone := make(chan error, 1)
+	go func() {
+		log.Printf("Starting exec for session %s in pod %s", session.id, podName)
+		execDone <- a.k8sClient.ExecInPod(execCtx, namespace, podName, "dind", command,
+			execInput{client: wsClient, done: execCtx.Done()}, wsClient, wsClient,
+			execSizeQueue{session: session, done: execCtx.Done()})
+		log.Printf("Exec finished for session %s", session.id)
+	}()
+
+	stop := func() {
+		// Make sure the exec stream and its SPDY connection are torn down before going on
+		cancelExec()
+		select {
+		case <-execDone:
+		case <-time.After(execStopTimeout):
+			log.Printf("Exec for session %s did not stop within %v after cancellation", session.id, execStopTimeout)
+		}
+	}
+
+	for {
+		select {
+		case err := <-execDone:
+			return false, err
+		case status := <-statusChanges:
+			if isRecreateStatus(status) {
+				log.Printf("Environment of session %s is being recreated (status %s)", session.id, status)
+				stop()
+				return true, nil
+			}
+		case <-wsClient.closed:
+			stop()
+			return false, nil
+		case <-ctx.Done():
+			stop()
+			return false, nil
+		}
+	}
+}
+
+// awaitRecreate decides whether an exec that ended on its own did so because the environment
+// is being recreated. The pod may be deleted before the status change is published, so a
+// short grace period is allowed for the announcement to arrive.
+func (a *AppController) awaitRecreate(ctx context.Context, environmentID string, statusChanges <-chan queue.QueueStatus) bool {
+	if item, err := a.redisQueue.GetItem(ctx, environmentID); err == nil && isRecreateStatus(item.Status) {
+		return true
+	}
+	timer := time.NewTimer(recreateDetectGrace)
+	defer timer.Stop()
+	for {
+		select {
+		case status := <-statusChanges:
+			if isRecreateStatus(status) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// waitForEnvironmentAvailable blocks until a recreated environment is available again and
+// returns its refreshed queue item. The generator only marks an item available once its pod
+// is running, so the pod can be exec'd into straight away.
+func (a *AppController) waitForEnvironmentAvailable(ctx context.Context, wsClient *WSClient, environmentID string, statusChanges <-chan queue.QueueStatus) (*queue.QueueItem, error) {
+	timer := time.NewTimer(environmentRestartTimeout)
+	defer timer.Stop()
+	for {
+		item, err := a.redisQueue.GetItem(ctx, environmentID)
+		if err != nil {
+			return nil, fmt.Errorf("environment is no longer available: %w", err)
+		}
+		switch item.Status {
+		case queue.StatusAvailable:
+			// Events of the states passed through on the way are stale now
+			for len(statusChanges) > 0 {
+				<-statusChanges
+			}
+			return item, nil
+		case queue.StatusPending, queue.StatusGenerating, queue.StatusRestarting:
+		default:
+			return nil, fmt.Errorf("environment did not come back (status %s)", item.Status)
+		}
+
+		select {
+		case <-statusChanges:
+		case <-timer.C:
+			return nil, fmt.Errorf("environment was not ready again within %v", environmentRestartTimeout)
+		case <-wsClient.closed:
+			return nil, wsClient.readErr
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// disconnected reports whether the client's input has been closed
+func (c *WSClient) disconnected() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
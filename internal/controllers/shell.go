@@ -0,0 +1,73 @@
+// internal/controllers/shell.go
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Interpreter used to run the launcher when the image has no /bin/bash
+	fallbackInterpreter = "/bin/sh"
+
+	defaultShell      = "/bin/bash"
+	defaultWorkingDir = "/root"
+	maxWorkingDirLen  = 1024
+)
+
+// allowedShells are the shells a terminal session may be started with
+var allowedShells = map[string]bool{
+	"/bin/bash": true,
+	"/bin/sh":   true,
+	"/bin/zsh":  true,
+}
+
+// shellLauncherScript changes into the requested directory (falling back to /root) and execs
+// the first shell of the requested one, /bin/bash and /bin/sh that exists in the container.
+// When a command log path is given and the shell is bash, it is started with the rc file passed
+// after the path, which records each executed command to that path (see shellCommandLogRC). An
+// empty record is written to the path first, telling the app that the instrumented bash started.
+// The directory, shell, path and rc file are passed as positional parameters, never spliced into the script.
+const shellLauncherScript = `cd -- "$1" 2>/dev/null || { echo "cannot cd to $1, starting in ` + defaultWorkingDir + `" >&2; cd ` + defaultWorkingDir + `; }
+for s in "$2" /bin/bash /bin/sh; do
+	if [ -x "$s" ]; then
+		[ "$s" = "$2" ] || echo "$2 not found, using $s" >&2
+		if [ -n "$3" ] && [ "${s##*/}" = bash ] && mkdir -p "${3%/*}" && printf '%s\n' "$4" > "$3.rc"; then
+			export PLAYGROUND_COMMAND_LOG="$3"
+			printf '\0' > "$3"
+			exec "$s" --rcfile "$3.rc" -i
+		fi
+		exec "$s"
+	fi
+done
+echo "no usable shell found in the container" >&2
+exit 127`
+
+// parseShellOptions validates the optional shell and cwd query parameters of a terminal connection
+func parseShellOptions(shell, cwd string) (string, string, error) {
+	if shell == "" {
+		shell = defaultShell
+	}
+	if !allowedShells[shell] {
+		return "", "", fmt.Errorf("unsupported shell %q", shell)
+	}
+
+	if cwd == "" {
+		cwd = defaultWorkingDir
+	}
+	if !strings.HasPrefix(cwd, "/") || len(cwd) > maxWorkingDirLen || strings.IndexFunc(cwd, unicode.IsControl) >= 0 {
+		return "", "", fmt.Errorf("cwd must be an absolute path of at most %d characters", maxWorkingDirLen)
+	}
+	return shell, cwd, nil
+}
+
+// shellCommand builds the exec command that starts shell in cwd, using interpreter to run the
+// launcher. A non-empty commandLogPath instruments bash to record executed commands there.
+func shellCommand(interpreter, shell, cwd, commandLogPath string) []string {
+	rc := ""
+	if commandLogPath != "" {
+		rc = shellCommandLogRC
+	}
+	return []string{interpreter, "-c", shellLauncherScript, "playground-shell", cwd, shell, commandLogPath, rc}
+}
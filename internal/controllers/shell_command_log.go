@@ -0,0 +1,162 @@
+// internal/controllers/shell_command_log.go
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+// Command logging modes (COMMAND_LOG_MODE)
+const (
+	// Reconstruct commands from the keystrokes sent to the terminal (see commandLine)
+	commandLogModeKeystroke = "keystroke"
+	// Have bash record each command it executes to a file in the pod, which is tailed
+	commandLogModeShell = "shell"
+)
+
+// shellCommandLogDir is where instrumented shells in the DinD container record their commands
+const shellCommandLogDir = "/tmp/.playground-commands"
+
+// shellCommandLogRC is the rc file of an instrumented bash. It sources the user's ~/.bashrc and
+// adds a PROMPT_COMMAND hook that appends the last history entry, NUL-terminated, to
+// $PLAYGROUND_COMMAND_LOG whenever a new one was added. This logs what bash actually ran,
+// including edited, recalled and completed lines. Commands bash keeps out of its history
+// (HISTCONTROL=ignorespace, HISTIGNORE, or history disabled) are not logged, and a user can
+// remove the hook, so this is accurate but not tamper-proof.
+const shellCommandLogRC = `[ -f ~/.bashrc ] && . ~/.bashrc
+__playground_last_command=$(HISTTIMEFORMAT= builtin history 1)
+__playground_log_command() {
+	local status=$? entry
+	entry=$(HISTTIMEFORMAT= builtin history 1)
+	if [ -n "$entry" ] && [ "$entry" != "$__playground_last_command" ]; then
+		__playground_last_command=$entry
+		entry=${entry#"${entry%%[![:space:]]*}"}
+		entry=${entry#*[[:space:]]}
+		entry=${entry#"${entry%%[![:space:]]*}"}
+		printf '%s\0' "$entry" >> "$PLAYGROUND_COMMAND_LOG"
+	fi
+	return $status
+}
+PROMPT_COMMAND="__playground_log_command${PROMPT_COMMAND:+;$PROMPT_COMMAND}"`
+
+// shellCommandTailScript follows a command log until its stdin is closed, then removes the log
+// and rc file. Tying its lifetime to stdin keeps it from outliving the session in the pod.
+const shellCommandTailScript = `tail -n +1 -F "$1" 2>/dev/null &
+cat >/dev/null
+kill $! 2>/dev/null
+rm -f "$1" "$1.rc"`
+
+// shellCommandLogPath returns the command log of a terminal session inside the pod
+func shellCommandLogPath(sessionID string) string {
+	hash := sha256.Sum256([]byte(sessionID))
+	return shellCommandLogDir + "/" + hex.EncodeToString(hash[:8]) + ".log"
+}
+
+// tailShellCommands logs the commands an instrumented shell records to path in podName until
+// the returned function is called. Commands are parsed from keystrokes until the first record
+// shows that the shell was instrumented, which it is not when the launcher fell back to /bin/sh.
+func (a *AppController) tailShellCommands(ctx context.Context, wsClient *WSClient, namespace, podName, path string) func() {
+	tailCtx, cancel := context.WithCancel(ctx)
+	stdin, stdinWriter := io.Pipe()
+	wsClient.commandsFromShell.Store(false)
+	records := &commandRecordWriter{
+		maxLength: a.loggingController.maxCommandLength,
+		started:   func() { wsClient.commandsFromShell.Store(true) },
+		emit:      func(command string) { wsClient.logCommand(podName, command) },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		command := []string{fallbackInterpreter, "-c", shellCommandTailScript, "playground-command-log", path}
+		if err := a.k8sClient.StreamExec(tailCtx, namespace, podName, "dind", command, stdin, records); err != nil && tailCtx.Err() == nil {
+			log.Printf("Command log of session %s in pod %s stopped: %v", wsClient.sessionID, podName, err)
+		}
+	}()
+
+	return func() {
+		// Closing stdin lets the tail script clean up; cancel if it does not finish in time
+		stdinWriter.Close()
+		select {
+		case <-done:
+		case <-time.After(execStopTimeout):
+		}
+		cancel()
+	}
+}
+
+// commandRecordWriter splits the output of a command log into its NUL-terminated commands,
+// truncated to maxLength characters. The log is writable from the user's shell, so at most
+// maxLength*utf8.UTFMax bytes of a record are buffered and the rest up to the next NUL is dropped.
+type commandRecordWriter struct {
+	maxLength int
+	partial   []byte
+	truncated bool
+	// started is called on the first record, emit for every non-empty one
+	started     func()
+	seenRecords bool
+	emit        func(string)
+}
+
+func (w *commandRecordWriter) Write(p []byte) (int, error) {
+	maxLength := w.maxLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxCommandLength
+	}
+	written := len(p)
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, 0)
+		record := p
+		if end >= 0 {
+			record = p[:end]
+		}
+		if room := maxLength*utf8.UTFMax - len(w.partial); len(record) > room {
+			record = record[:room]
+			w.truncated = true
+		}
+		w.partial = append(w.partial, record...)
+		if end < 0 {
+			break
+		}
+		w.endRecord(maxLength)
+		p = p[end+1:]
+	}
+	return written, nil
+}
+
+func (w *commandRecordWriter) endRecord(maxLength int) {
+	if !w.seenRecords {
+		w.seenRecords = true
+		if w.started != nil {
+			w.started()
+		}
+	}
+	command := string(bytes.TrimSpace(w.partial))
+	if w.truncated {
+		runes := []rune(command)
+		command = string(runes[:min(len(runes), maxLength)]) + truncatedCommandMarker
+	} else {
+		command = truncateCommand(command, maxLength)
+	}
+	if command != "" {
+		w.emit(command)
+	}
+	w.partial, w.truncated = w.partial[:0], false
+}
+
+// truncateCommand cuts a command to maxLength characters, marking it as truncated
+func truncateCommand(command string, maxLength int) string {
+	if maxLength <= 0 {
+		maxLength = defaultMaxCommandLength
+	}
+	if utf8.RuneCountInString(command) <= maxLength {
+		return command
+	}
+	return string([]rune(command)[:maxLength]) + truncatedCommandMarker
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCommandRecordWriterSplitsRecords(t *testing.T) {
+	var commands []string
+	starts := 0
+	w := &commandRecordWriter{maxLength: 100, started: func() { starts++ }, emit: func(command string) { commands = append(commands, command) }}
+
+	// The launcher writes an empty record before bash starts
+	for _, p := range []string{"\x00", "ls -la\x00kubectl get ", "pods\x00", "  \x00", "echo ", "done\x00"} {
+		if n, err := w.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if starts != 1 {
+		t.Errorf("started was called %d times, want once", starts)
+	}
+	want := []string{"ls -la", "kubectl get pods", "echo done"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %q, want %q", commands, want)
+	}
+}
+
+func TestCommandRecordWriterCapsUnterminatedRecord(t *testing.T) {
+	const maxLength = 1000
+	var commands []string
+	w := &commandRecordWriter{maxLength: maxLength, emit: func(command string) { commands = append(commands, command) }}
+
+	// `yes > $PLAYGROUND_COMMAND_LOG`: 64 MiB without a NUL
+	frame := []byte(strings.Repeat("y\n", 32*1024))
+	for range 1024 {
+		w.Write(frame)
+		if len(w.partial) > maxLength*utf8.UTFMax {
+			t.Fatalf("buffered %d bytes of an unterminated record, want at most %d", len(w.partial), maxLength*utf8.UTFMax)
+		}
+	}
+	w.Write([]byte("\x00ls\x00"))
+
+	if len(commands) != 2 {
+		t.Fatalf("got %d commands, want the truncated record and the next one", len(commands))
+	}
+	if !strings.HasSuffix(commands[0], truncatedCommandMarker) {
+		t.Errorf("truncated record does not end with %q", truncatedCommandMarker)
+	}
+	if n := utf8.RuneCountInString(strings.TrimSuffix(commands[0], truncatedCommandMarker)); n != maxLength {
+		t.Errorf("truncated record has %d characters, want %d", n, maxLength)
+	}
+	if commands[1] != "ls" {
+		t.Errorf("next command = %q, want %q", commands[1], "ls")
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestShellLauncherMarksInstrumentedBash(t *testing.T) {
+	tests := []struct {
+		name       string
+		shell      string
+		wantMarker bool
+	}{
+		{name: "bash", shell: "bash", wantMarker: true},
+		{name: "sh", shell: "sh", wantMarker: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// Stands in for the shell the launcher execs; it only needs to exist
+			shell := filepath.Join(dir, "bin", tt.shell)
+			if err := os.MkdirAll(filepath.Dir(shell), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(shell, []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			logPath := filepath.Join(dir, "commands", "session.log")
+
+			command := shellCommand(fallbackInterpreter, shell, dir, logPath)
+			if output, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+				t.Fatalf("launcher failed: %v\n%s", err, output)
+			}
+
+			data, err := os.ReadFile(logPath)
+			if tt.wantMarker {
+				if err != nil || string(data) != "\x00" {
+					t.Errorf("command log = %q, %v; want an empty record", data, err)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("command log of an uninstrumented shell = %q, %v; want none", data, err)
+			}
+		})
+	}
+}
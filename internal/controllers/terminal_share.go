@@ -0,0 +1,295 @@
+// internal/controllers/terminal_share.go
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/tyottodekiru/k8s-playground/pkg/queue"
+)
+
+const (
+	defaultShareTokenTTL = time.Hour
+	maxShareTokenTTL     = 24 * time.Hour
+	// Output chunks queued for a viewer before it is considered too slow and dropped
+	viewerSendBuffer = 256
+	// How often a viewer's token is checked again, so expiry and revocation on other replicas take effect
+	shareTokenRecheckInterval = 30 * time.Second
+)
+
+// terminalViewer is a read-only WebSocket watching the terminal output of an environment
+type terminalViewer struct {
+	token     string
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (v *terminalViewer) close() {
+	v.closeOnce.Do(func() { close(v.done) })
+}
+
+// viewerHub fans the terminal output of each environment out to its viewers
+type viewerHub struct {
+	mutex   sync.Mutex
+	viewers map[string]map[*terminalViewer]struct{}
+}
+
+func newViewerHub() *viewerHub {
+	return &viewerHub{viewers: make(map[string]map[*terminalViewer]struct{})}
+}
+
+func (h *viewerHub) add(environmentID string, v *terminalViewer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.viewers[environmentID] == nil {
+		h.viewers[environmentID] = make(map[*terminalViewer]struct{})
+	}
+	h.viewers[environmentID][v] = struct{}{}
+}
+
+func (h *viewerHub) remove(environmentID string, v *terminalViewer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.viewers[environmentID], v)
+	if len(h.viewers[environmentID]) == 0 {
+		delete(h.viewers, environmentID)
+	}
+}
+
+// closeAll disconnects every viewer
+func (h *viewerHub) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, viewers := range h.viewers {
+		for v := range viewers {
+			v.close()
+		}
+	}
+}
+
+// broadcast copies terminal output to every viewer of the environment. It never blocks the
+// owner's session: a viewer whose buffer is full is disconnected.
+func (h *viewerHub) broadcast(environmentID string, p []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.viewers[environmentID]) == 0 {
+		return
+	}
+	chunk := append([]byte(nil), p...)
+	for v := range h.viewers[environmentID] {
+		select {
+		case v.send <- chunk:
+		default:
+			log.Printf("Viewer of environment %s is not keeping up, disconnecting it", environmentID)
+			v.close()
+		}
+	}
+}
+
+// revoke disconnects the viewers that joined with token
+func (h *viewerHub) revoke(token string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, viewers := range h.viewers {
+		for v := range viewers {
+			if v.token == token {
+				v.close()
+			}
+		}
+	}
+}
+
+// ownedEnvironment loads the environment named in the URL and checks that the caller owns it.
+// It writes the error response itself and returns nil on failure.
+func (a *AppController) ownedEnvironment(c *gin.Context) *queue.QueueItem {
+	ownerID := c.MustGet("owner_id").(string)
+	envID := c.Param("id")
+
+	item, err := a.redisQueue.GetItem(c.Request.Context(), envID)
+	if err != nil {
+		if errors.Is(err, queue.ErrItemNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Environment not found"})
+		} else {
+			log.Printf("Error getting environment %s for owner %s: %v", envID, ownerID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve environment details"})
+		}
+		return nil
+	}
+	if item.Owner != ownerID {
+		log.Printf("Forbidden: Owner %s attempted to access environment %s owned by %s", ownerID, envID, item.Owner)
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not the owner of this environment"})
+		return nil
+	}
+	return item
+}
+
+// createShareToken issues a link that lets others watch the environment's terminal read-only.
+// The optional JSON body {"ttl": "30m"} sets how long the link is valid (default 1h, max 24h).
+func (a *AppController) createShareToken(c *gin.Context) {
+	item := a.ownedEnvironment(c)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		TTL string `json:"ttl"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	ttl := defaultShareTokenTTL
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 || parsed > maxShareTokenTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ttl must be a duration between 1s and %v", maxShareTokenTTL)})
+			return
+		}
+		ttl = parsed
+	}
+
+	token, err := a.redisQueue.CreateShareToken(c.Request.Context(), item.ID, item.Owner, ttl)
+	if err != nil {
+		log.Printf("Error creating share token for environment %s: %v", item.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	log.Printf("Share link for environment %s created by %s, expires at %v", item.ID, item.Owner, token.ExpiresAt)
+	c.JSON(http.StatusCreated, gin.H{"token": token.Token, "url": "/share/" + token.Token, "expires_at": token.ExpiresAt})
+}
+
+// listShareTokens returns the environment's share links that are still valid
+func (a *AppController) listShareTokens(c *gin.Context) {
+	item := a.ownedEnvironment(c)
+	if item == nil {
+		return
+	}
+	tokens, err := a.redisQueue.ListShareTokens(c.Request.Context(), item.ID)
+	if err != nil {
+		log.Printf("Error listing share tokens for environment %s: %v", item.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list share links"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// revokeShareToken invalidates a share link and disconnects its viewers
+func (a *AppController) revokeShareToken(c *gin.Context) {
+	item := a.ownedEnvironment(c)
+	if item == nil {
+		return
+	}
+	token := c.Param("token")
+	shareToken, err := a.redisQueue.GetShareToken(c.Request.Context(), token)
+	if err != nil || shareToken.EnvironmentID != item.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	if err := a.redisQueue.RevokeShareToken(c.Request.Context(), item.ID, token); err != nil {
+		log.Printf("Error revoking share token for environment %s: %v", item.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	a.viewers.revoke(token)
+	log.Printf("Share link for environment %s revoked by %s", item.ID, item.Owner)
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// sharePage serves the read-only terminal page of a share link
+func (a *AppController) sharePage(c *gin.Context) {
+	c.HTML(http.StatusOK, "share.html", gin.H{"title": "k8s Playground - Shared Terminal", "token": c.Param("token")})
+}
+
+// connectViewer opens a read-only WebSocket on the terminal output of a shared environment.
+// Anything the viewer sends is discarded.
+func (a *AppController) connectViewer(c *gin.Context) {
+	token := c.Param("token")
+	shareToken, err := a.redisQueue.GetShareToken(c.Request.Context(), token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Share link is invalid or has expired"})
+		return
+	}
+	item, err := a.redisQueue.GetItem(c.Request.Context(), shareToken.EnvironmentID)
+	if err != nil || item.Status != queue.StatusAvailable {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Environment not available"})
+		return
+	}
+
+	conn, err := a.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade viewer WebSocket for env %s: %v", item.ID, err)
+		return
+	}
+	defer conn.Close()
+
+	viewer := &terminalViewer{token: token, send: make(chan []byte, viewerSendBuffer), done: make(chan struct{})}
+	a.viewers.add(item.ID, viewer)
+	defer a.viewers.remove(item.ID, viewer)
+	log.Printf("Viewer joined environment %s with a share link of %s", item.ID, shareToken.Owner)
+
+	displayName := item.DisplayName
+	if displayName == "" {
+		displayName = item.ID[:8]
+	}
+	a.sendRawMessage(conn, fmt.Sprintf("\x1b[32mWatching '%s' (read-only). Output appears as the owner works.\x1b[0m\r\n", displayName))
+
+	conn.SetReadLimit(a.wsSettings.maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(a.wsSettings.pongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(a.wsSettings.pongWait)); return nil })
+	go func() {
+		// Input is never forwarded; reading only processes pongs and notices the viewer leaving
+		defer viewer.close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(a.wsSettings.pingPeriod)
+	defer pingTicker.Stop()
+	recheckTicker := time.NewTicker(shareTokenRecheckInterval)
+	defer recheckTicker.Stop()
+
+	closeCode, closeReason := closeCodeShareRevoked, "Share link was revoked"
+	defer func() { a.sendCloseFrame(conn, closeCode, closeReason) }()
+	for {
+		select {
+		case chunk := <-viewer.send:
+			conn.SetWriteDeadline(time.Now().Add(a.wsSettings.writeWait))
+			if err := conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			conn.SetWriteDeadline(time.Now().Add(a.wsSettings.writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-recheckTicker.C:
+			if _, err := a.redisQueue.GetShareToken(context.Background(), token); err != nil {
+				closeReason = "Share link expired or was revoked"
+				return
+			}
+		case <-viewer.done:
+			if a.terminalSessions.isDraining() {
+				closeCode, closeReason = websocket.CloseServiceRestart, serverRestartReason
+				return
+			}
+			closeCode, closeReason = websocket.CloseNormalClosure, "Viewer disconnected"
+			if _, err := a.redisQueue.GetShareToken(context.Background(), token); err != nil {
+				closeCode, closeReason = closeCodeShareRevoked, "Share link was revoked"
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// internal/controllers/websocket_settings.go
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Defaults of the WebSocket tuning, used when WS_* variables are not set
+const (
+	defaultWSWriteWait      = 10 * time.Second
+	defaultWSPongWait       = 60 * time.Second
+	defaultWSMaxMessageSize = 8192
+	// Terminal output is sent in messages of at most this many bytes
+	defaultWSWriteChunkSize = 32 * 1024
+)
+
+// webSocketSettings tunes terminal and viewer WebSocket connections
+type webSocketSettings struct {
+	// Time allowed to write a message to the peer
+	writeWait time.Duration
+	// Time allowed to read the next pong from the peer
+	pongWait time.Duration
+	// Interval of pings; must be shorter than pongWait so a live peer always answers in time
+	pingPeriod time.Duration
+	// Largest message read from the peer, in bytes
+	maxMessageSize int64
+	// Largest message of terminal output written to the peer, in bytes
+	writeChunkSize int
+	// Pause between the messages of one write, 0 = none. Only needed for browsers that
+	// cannot keep up with bursts of output; every pause caps throughput at writeChunkSize/writeChunkDelay.
+	writeChunkDelay time.Duration
+}
+
+func defaultWebSocketSettings() webSocketSettings {
+	return webSocketSettings{
+		writeWait:      defaultWSWriteWait,
+		pongWait:       defaultWSPongWait,
+		pingPeriod:     defaultPingPeriod(defaultWSPongWait),
+		maxMessageSize: defaultWSMaxMessageSize,
+		writeChunkSize: defaultWSWriteChunkSize,
+	}
+}
+
+// defaultPingPeriod leaves a tenth of pongWait for the pong to arrive
+func defaultPingPeriod(pongWait time.Duration) time.Duration {
+	return (pongWait * 9) / 10
+}
+
+// parseWebSocketSettings reads WS_WRITE_WAIT, WS_PONG_WAIT, WS_PING_PERIOD,
+// WS_MAX_MESSAGE_SIZE, WS_WRITE_CHUNK_SIZE and WS_WRITE_CHUNK_DELAY with getenv. Empty values
+// keep their default; an unset WS_PING_PERIOD follows WS_PONG_WAIT.
+func parseWebSocketSettings(getenv func(key, fallback string) string) (webSocketSettings, error) {
+	settings := defaultWebSocketSettings()
+
+	parseDuration := func(name string, target *time.Duration, allowZero bool) error {
+		value := getenv(name, "")
+		if value == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		if d < 0 || (d == 0 && !allowZero) {
+			return fmt.Errorf("%s must be positive, got %v", name, d)
+		}
+		*target = d
+		return nil
+	}
+	parseSize := func(name string, target *int64) error {
+		value := getenv(name, "")
+		if value == "" {
+			return nil
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("%s must be a positive number of bytes, got %q", name, value)
+		}
+		*target = size
+		return nil
+	}
+
+	if err := parseDuration("WS_WRITE_WAIT", &settings.writeWait, false); err != nil {
+		return webSocketSettings{}, err
+	}
+	if err := parseDuration("WS_PONG_WAIT", &settings.pongWait, false); err != nil {
+		return webSocketSettings{}, err
+	}
+	settings.pingPeriod = defaultPingPeriod(settings.pongWait)
+	if err := parseDuration("WS_PING_PERIOD", &settings.pingPeriod, false); err != nil {
+		return webSocketSettings{}, err
+	}
+	if settings.pingPeriod >= settings.pongWait {
+		return webSocketSettings{}, fmt.Errorf("WS_PING_PERIOD (%v) must be shorter than WS_PONG_WAIT (%v)", settings.pingPeriod, settings.pongWait)
+	}
+	if err := parseSize("WS_MAX_MESSAGE_SIZE", &settings.maxMessageSize); err != nil {
+		return webSocketSettings{}, err
+	}
+	writeChunkSize := int64(settings.writeChunkSize)
+	if err := parseSize("WS_WRITE_CHUNK_SIZE", &writeChunkSize); err != nil {
+		return webSocketSettings{}, err
+	}
+	settings.writeChunkSize = int(writeChunkSize)
+	if err := parseDuration("WS_WRITE_CHUNK_DELAY", &settings.writeChunkDelay, true); err != nil {
+		return webSocketSettings{}, err
+	}
+	return settings, nil
+}
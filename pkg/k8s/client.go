@@ -2,6 +2,7 @@ package k8s
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,8 +11,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/sync/singleflight"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -38,8 +41,24 @@ type TerminalSizeQueue interface {
 
 // Client wraps Kubernetes client functionality
 type Client struct {
-	clientset  *kubernetes.Clientset
+	clientset  kubernetes.Interface
 	restConfig *rest.Config
+	// Security context applied to the DinD container; see SetDinDSecurityContext
+	dindSecurityContext *corev1.SecurityContext
+	// Value of InstanceLabel on created resources and in selectors; see SetInstanceID
+	instanceID string
+	// Node selector and tolerations of DinD pods; see SetDinDScheduling
+	dindScheduling DinDScheduling
+	// Raw kubeconfigs of inner kind clusters by pod UID, see OpenServiceTunnel
+	innerKubeconfigs sync.Map
+	// Kind cluster service discovery results by "namespace/pod", see GetKindClusterServices
+	serviceCache    sync.Map
+	serviceCacheTTL time.Duration
+	serviceFlight   singleflight.Group
+	// Ports probed when the inner cluster cannot be asked for its services; see SetServiceScanPorts
+	scanPorts []int
+	// Privileged ports listed when found listening in the DinD container; see SetWebPorts
+	webPorts map[int]bool
 }
 
 // NewClient creates a new Kubernetes client
@@ -55,13 +74,27 @@ func NewClient() (*Client, error) {
 	}
 
 	return &Client{
-		clientset:  clientset,
-		restConfig: config,
+		clientset:       clientset,
+		restConfig:      config,
+		serviceCacheTTL: DefaultServiceCacheTTL,
+		scanPorts:       DefaultScanPorts,
+		webPorts:        portSet(DefaultWebPorts),
 	}, nil
 }
 
+// NewClientForClientset creates a client on an existing clientset, e.g. a fake one in tests.
+// Without a REST config, exec and port-forwarding are unavailable.
+func NewClientForClientset(clientset kubernetes.Interface) *Client {
+	return &Client{
+		clientset:       clientset,
+		serviceCacheTTL: DefaultServiceCacheTTL,
+		scanPorts:       DefaultScanPorts,
+		webPorts:        portSet(DefaultWebPorts),
+	}
+}
+
 // GetClientset returns the underlying Kubernetes clientset
-func (c *Client) GetClientset() *kubernetes.Clientset {
+func (c *Client) GetClientset() kubernetes.Interface {
 	return c.clientset
 }
 
@@ -105,6 +138,19 @@ func sanitizeName(name string) string {
 	return sanitized
 }
 
+// mergeLabels returns base extended with extra. Keys already present in base are never overridden,
+// so user-supplied metadata cannot interfere with the selector labels.
+func mergeLabels(base, extra map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(extra))
+	for k, v := range extra {
+		merged[k] = v
+	}
+	for k, v := range base {
+		merged[k] = v
+	}
+	return merged
+}
+
 // GetServiceClusterIP gets the ClusterIP of a Service.
 func (c *Client) GetServiceClusterIP(ctx context.Context, name, namespace string) (string, error) {
 	service, err := c.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
@@ -154,64 +200,87 @@ func (c *Client) EnsureNFSDirectory(ctx context.Context, namespace, ownerID stri
 	return dirName, nil
 }
 
-// CreateDinDStatefulSet creates a headless service and a StatefulSet for the playground
-func (c *Client) CreateDinDStatefulSet(ctx context.Context, name, namespace, dindImageName, pvcSize, nfsServerIP, nfsSubPath string) (string, error) {
+// userShareVolume returns the volume mounted at ShareMountPath. With an NFS server it is the
+// owner's subdirectory of the NFS export; with an empty nfsServerIP (NFS disabled) it is an
+// emptyDir that lives as long as the pod.
+func userShareVolume(nfsServerIP, nfsSubPath string) (corev1.Volume, corev1.VolumeMount) {
+	if nfsServerIP == "" {
+		return corev1.Volume{Name: "user-share", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			corev1.VolumeMount{Name: "user-share", MountPath: ShareMountPath}
+	}
+	volume := corev1.Volume{
+		Name: "nfs-user-share",
+		VolumeSource: corev1.VolumeSource{
+			NFS: &corev1.NFSVolumeSource{
+				Server: nfsServerIP,
+				Path:   "/",
+			},
+		},
+	}
+	return volume, corev1.VolumeMount{Name: "nfs-user-share", MountPath: ShareMountPath, SubPath: nfsSubPath}
+}
+
+// CreateDinDStatefulSet creates a headless service and a StatefulSet for the playground.
+// An empty storageClass leaves the docker-graph-storage PVC on the cluster's default storage class.
+func (c *Client) CreateDinDStatefulSet(ctx context.Context, name, namespace, dindImageName, pvcSize, storageClass, nfsServerIP, nfsSubPath string, extraLabels map[string]string, resources DinDResources, entrypoint EntrypointPreset) (string, error) {
+	resourceRequirements, err := resources.requirements()
+	if err != nil {
+		return "", fmt.Errorf("invalid resources for statefulset %s: %w", name, err)
+	}
+	shareVolume, shareMount := userShareVolume(nfsServerIP, nfsSubPath)
+
 	headlessSvc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
-			Labels:    map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name},
+			Labels:    c.withInstance(map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name}),
 		},
 		Spec: corev1.ServiceSpec{
 			ClusterIP: "None",
-			Selector:  map[string]string{"app": "k8s-playground-sts", "owner-id": name},
+			Selector:  c.withInstance(map[string]string{"app": "k8s-playground-sts", "owner-id": name}),
 		},
 	}
-	_, err := c.clientset.CoreV1().Services(namespace).Create(ctx, headlessSvc, metav1.CreateOptions{})
+	_, err = c.clientset.CoreV1().Services(namespace).Create(ctx, headlessSvc, metav1.CreateOptions{})
 	if err != nil && !apierrors.IsAlreadyExists(err) {
 		return "", fmt.Errorf("failed to create headless service: %w", err)
 	}
 
-	privileged := true
 	replicas := int32(1)
 
 	sts := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
-			Labels:    map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name},
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      c.withInstance(mergeLabels(map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name}, extraLabels)),
+			Annotations: extraLabels,
 		},
 		Spec: appsv1.StatefulSetSpec{
 			Replicas:    &replicas,
 			ServiceName: name,
 			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{"app": "k8s-playground-sts", "owner-id": name},
+				MatchLabels: c.withInstance(map[string]string{"app": "k8s-playground-sts", "owner-id": name}),
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{"app": "k8s-playground-sts", "component": "dind-environment", "owner-id": name},
+					Labels:      c.withInstance(mergeLabels(map[string]string{"app": "k8s-playground-sts", "component": "dind-environment", "owner-id": name}, extraLabels)),
+					Annotations: extraLabels,
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
 							Name:            "dind",
 							Image:           dindImageName,
-							SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+							Command:         entrypoint.Command,
+							Args:            entrypoint.Args,
+							SecurityContext: c.dindContainerSecurityContext(),
 							Env:             []corev1.EnvVar{{Name: "DOCKER_TLS_CERTDIR", Value: ""}},
 							Ports:           []corev1.ContainerPort{{ContainerPort: 2375, Protocol: corev1.ProtocolTCP}},
 							VolumeMounts: []corev1.VolumeMount{
 								{Name: "docker-graph-storage", MountPath: "/var/lib/docker"},
 								{Name: "tmp", MountPath: "/tmp"},
-								{
-									Name:      "nfs-user-share",
-									MountPath: "/root/share",
-									SubPath:   nfsSubPath,
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi"), corev1.ResourceCPU: resource.MustParse("100m")},
-								Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi"), corev1.ResourceCPU: resource.MustParse("1000m")},
+								shareMount,
 							},
+							Resources: resourceRequirements,
 							ReadinessProbe: &corev1.Probe{
 								ProbeHandler:        corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"docker", "ps"}}},
 								InitialDelaySeconds: 15, TimeoutSeconds: 5, PeriodSeconds: 10, FailureThreshold: 3,
@@ -224,15 +293,7 @@ func (c *Client) CreateDinDStatefulSet(ctx context.Context, name, namespace, din
 					},
 					Volumes: []corev1.Volume{
 						{Name: "tmp", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
-						{
-							Name: "nfs-user-share",
-							VolumeSource: corev1.VolumeSource{
-								NFS: &corev1.NFSVolumeSource{
-									Server: nfsServerIP,
-									Path:   "/",
-								},
-							},
-						},
+						shareVolume,
 					},
 					RestartPolicy: corev1.RestartPolicyAlways,
 					DNSPolicy:     corev1.DNSClusterFirst,
@@ -240,7 +301,7 @@ func (c *Client) CreateDinDStatefulSet(ctx context.Context, name, namespace, din
 			},
 			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
 				{
-					ObjectMeta: metav1.ObjectMeta{Name: "docker-graph-storage"},
+					ObjectMeta: metav1.ObjectMeta{Name: "docker-graph-storage", Labels: c.withInstance(map[string]string{})},
 					Spec: corev1.PersistentVolumeClaimSpec{
 						AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
 						Resources: corev1.VolumeResourceRequirements{
@@ -252,6 +313,11 @@ func (c *Client) CreateDinDStatefulSet(ctx context.Context, name, namespace, din
 		},
 	}
 
+	c.applyDinDScheduling(&sts.Spec.Template.Spec)
+	if storageClass != "" {
+		sts.Spec.VolumeClaimTemplates[0].Spec.StorageClassName = &storageClass
+	}
+
 	_, err = c.clientset.AppsV1().StatefulSets(namespace).Create(ctx, sts, metav1.CreateOptions{})
 	if err != nil {
 		_ = c.clientset.CoreV1().Services(namespace).Delete(ctx, name, metav1.DeleteOptions{})
@@ -263,68 +329,60 @@ func (c *Client) CreateDinDStatefulSet(ctx context.Context, name, namespace, din
 }
 
 // CreateDinDDeployment: Creates a Service and a Deployment with ephemeral storage
-func (c *Client) CreateDinDDeployment(ctx context.Context, name, namespace, dindImageName, nfsServerIP, nfsSubPath string) (string, error) {
+func (c *Client) CreateDinDDeployment(ctx context.Context, name, namespace, dindImageName, nfsServerIP, nfsSubPath string, extraLabels map[string]string, resources DinDResources, entrypoint EntrypointPreset) (string, error) {
+	resourceRequirements, err := resources.requirements()
+	if err != nil {
+		return "", fmt.Errorf("invalid resources for deployment %s: %w", name, err)
+	}
+	shareVolume, shareMount := userShareVolume(nfsServerIP, nfsSubPath)
+
 	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
-			Labels:    map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name},
+			Labels:    c.withInstance(map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name}),
 		},
 		Spec: corev1.ServiceSpec{
-			Selector: map[string]string{"app": "k8s-playground-dep", "owner-id": name},
+			Selector: c.withInstance(map[string]string{"app": "k8s-playground-dep", "owner-id": name}),
 			Ports:    []corev1.ServicePort{{Name: "docker", Port: 2375, TargetPort: intstr.FromInt(2375)}},
 		},
 	}
-	_, err := c.clientset.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+	_, err = c.clientset.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
 	if err != nil && !apierrors.IsAlreadyExists(err) {
 		return "", fmt.Errorf("failed to create service for deployment: %w", err)
 	}
 
-	privileged := true
 	replicas := int32(1)
 
 	dep := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name}},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: c.withInstance(mergeLabels(map[string]string{"app": "k8s-playground", "component": "dind-environment", "owner-id": name}, extraLabels)), Annotations: extraLabels},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: &replicas,
-			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "k8s-playground-dep", "owner-id": name}},
+			Selector: &metav1.LabelSelector{MatchLabels: c.withInstance(map[string]string{"app": "k8s-playground-dep", "owner-id": name})},
 			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "k8s-playground-dep", "component": "dind-environment", "owner-id": name}},
+				ObjectMeta: metav1.ObjectMeta{Labels: c.withInstance(mergeLabels(map[string]string{"app": "k8s-playground-dep", "component": "dind-environment", "owner-id": name}, extraLabels)), Annotations: extraLabels},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{{
 						Name:            "dind",
 						Image:           dindImageName,
-						SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+						Command:         entrypoint.Command,
+						Args:            entrypoint.Args,
+						SecurityContext: c.dindContainerSecurityContext(),
 						Env:             []corev1.EnvVar{{Name: "DOCKER_TLS_CERTDIR", Value: ""}},
 						Ports:           []corev1.ContainerPort{{ContainerPort: 2375, Protocol: corev1.ProtocolTCP}},
 						VolumeMounts: []corev1.VolumeMount{
 							{Name: "docker-graph-storage", MountPath: "/var/lib/docker"},
 							{Name: "tmp", MountPath: "/tmp"},
-							{
-								Name:      "nfs-user-share",
-								MountPath: "/root/share",
-								SubPath:   nfsSubPath,
-							},
-						},
-						Resources: corev1.ResourceRequirements{
-							Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi"), corev1.ResourceCPU: resource.MustParse("100m")},
-							Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi"), corev1.ResourceCPU: resource.MustParse("1000m")},
+							shareMount,
 						},
+						Resources:      resourceRequirements,
 						ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"docker", "ps"}}}, InitialDelaySeconds: 15, TimeoutSeconds: 5, PeriodSeconds: 10, FailureThreshold: 3},
 						LivenessProbe:  &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"docker", "ps"}}}, InitialDelaySeconds: 30, TimeoutSeconds: 5, PeriodSeconds: 20, FailureThreshold: 3},
 					}},
 					Volumes: []corev1.Volume{
 						{Name: "tmp", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
 						{Name: "docker-graph-storage", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
-						{
-							Name: "nfs-user-share",
-							VolumeSource: corev1.VolumeSource{
-								NFS: &corev1.NFSVolumeSource{
-									Server: nfsServerIP,
-									Path:   "/",
-								},
-							},
-						},
+						shareVolume,
 					},
 					RestartPolicy: corev1.RestartPolicyAlways,
 					DNSPolicy:     corev1.DNSClusterFirst,
@@ -333,6 +391,8 @@ func (c *Client) CreateDinDDeployment(ctx context.Context, name, namespace, dind
 		},
 	}
 
+	c.applyDinDScheduling(&dep.Spec.Template.Spec)
+
 	_, err = c.clientset.AppsV1().Deployments(namespace).Create(ctx, dep, metav1.CreateOptions{})
 	if err != nil {
 		_ = c.clientset.CoreV1().Services(namespace).Delete(ctx, name, metav1.DeleteOptions{})
@@ -342,7 +402,6 @@ func (c *Client) CreateDinDDeployment(ctx context.Context, name, namespace, dind
 	return name, nil
 }
 
-
 func (c *Client) GetPod(ctx context.Context, name, namespace string) (*corev1.Pod, error) {
 	pod, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
@@ -351,44 +410,50 @@ func (c *Client) GetPod(ctx context.Context, name, namespace string) (*corev1.Po
 	return pod, nil
 }
 
+// DeleteDinDStatefulSet deletes the StatefulSet, its headless Service and its PVC. Every deletion
+// is attempted even if an earlier one fails, so a transient error does not leak the other
+// resources; the errors are returned combined.
 func (c *Client) DeleteDinDStatefulSet(ctx context.Context, name, namespace string) error {
 	deletePolicy := metav1.DeletePropagationForeground
+	var errs []error
 
 	err := c.clientset.AppsV1().StatefulSets(namespace).Delete(ctx, name, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	})
 	if err != nil && !apierrors.IsNotFound(err) {
-		return fmt.Errorf("failed to delete statefulset %s: %w", name, err)
+		errs = append(errs, fmt.Errorf("failed to delete statefulset %s: %w", name, err))
 	}
 
 	err = c.clientset.CoreV1().Services(namespace).Delete(ctx, name, metav1.DeleteOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
-		return fmt.Errorf("failed to delete service %s: %w", name, err)
+		errs = append(errs, fmt.Errorf("failed to delete service %s: %w", name, err))
 	}
 
 	pvcName := fmt.Sprintf("docker-graph-storage-%s-0", name)
 	err = c.clientset.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, pvcName, metav1.DeleteOptions{})
 	if err != nil && !apierrors.IsNotFound(err) {
-		return fmt.Errorf("failed to delete pvc %s: %w", pvcName, err)
+		errs = append(errs, fmt.Errorf("failed to delete pvc %s: %w", pvcName, err))
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
+// DeleteDinDDeployment deletes the Deployment and its Service, attempting both even if one fails
 func (c *Client) DeleteDinDDeployment(ctx context.Context, name, namespace string) error {
 	deletePolicy := metav1.DeletePropagationForeground
+	var errs []error
 	if err := c.clientset.AppsV1().Deployments(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &deletePolicy}); err != nil && !apierrors.IsNotFound(err) {
-		return fmt.Errorf("failed to delete deployment %s: %w", name, err)
+		errs = append(errs, fmt.Errorf("failed to delete deployment %s: %w", name, err))
 	}
 	if err := c.clientset.CoreV1().Services(namespace).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
-		return fmt.Errorf("failed to delete service %s: %w", name, err)
+		errs = append(errs, fmt.Errorf("failed to delete service %s: %w", name, err))
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func (c *Client) GetPodNameForWorkload(ctx context.Context, workloadName, namespace string) (string, error) {
 	podList, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("app=k8s-playground-dep,owner-id=%s", workloadName),
+		LabelSelector: c.instanceSelector(fmt.Sprintf("app=k8s-playground-dep,owner-id=%s", workloadName)),
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to list pods for workload %s: %w", workloadName, err)
@@ -396,6 +461,12 @@ func (c *Client) GetPodNameForWorkload(ctx context.Context, workloadName, namesp
 	if len(podList.Items) == 0 {
 		return "", fmt.Errorf("no pods found for workload %s", workloadName)
 	}
+	// During a rollout the old pod keeps running while it terminates; prefer the pod that stays
+	for _, pod := range podList.Items {
+		if pod.DeletionTimestamp == nil && (pod.Status.Phase == corev1.PodRunning || pod.Status.Phase == corev1.PodPending) {
+			return pod.Name, nil
+		}
+	}
 	for _, pod := range podList.Items {
 		if pod.Status.Phase == corev1.PodRunning || pod.Status.Phase == corev1.PodPending {
 			return pod.Name, nil
@@ -450,6 +521,59 @@ func (c *Client) IsPodRunning(ctx context.Context, name, namespace string) (bool
 	return true, nil
 }
 
+// IsEnvironmentReady checks that a DinD pod can actually be used: the pod is running, its docker
+// daemon answers and the inner cluster has a Ready node. A pod's readiness probe can pass while
+// the daemon or cluster is still starting. The returned reason explains why it is not ready.
+func (c *Client) IsEnvironmentReady(ctx context.Context, podName, namespace string) (bool, string, error) {
+	running, err := c.IsPodRunning(ctx, podName, namespace)
+	if err != nil {
+		return false, "", err
+	}
+	if !running {
+		return false, "pod is not running", nil
+	}
+
+	script := `docker info >/dev/null 2>&1 || echo "docker_not_ready"`
+	stdout, stderr, err := c.execCommand(ctx, podName, namespace, "dind", []string{"/bin/sh", "-c", script})
+	if err != nil {
+		return false, "", fmt.Errorf("failed to check docker daemon in pod %s: %w (stderr: %s)", podName, err, stderr)
+	}
+	if strings.Contains(stdout, "docker_not_ready") {
+		return false, "docker daemon is not responding", nil
+	}
+
+	return c.IsInnerClusterReady(ctx, podName, namespace)
+}
+
+// IsInnerClusterReady checks that the kind cluster inside the DinD pod answers and has at least one Ready node.
+// The returned reason explains why the cluster is not ready.
+func (c *Client) IsInnerClusterReady(ctx context.Context, podName, namespace string) (bool, string, error) {
+	script := `
+		command -v kubectl >/dev/null 2>&1 || { echo "kubectl_not_found"; exit 0; }
+		timeout 5 kubectl get nodes --no-headers --request-timeout=3s 2>/dev/null || echo "cluster_not_ready"
+	`
+	stdout, stderr, err := c.execCommand(ctx, podName, namespace, "dind", []string{"/bin/bash", "-c", script})
+	if err != nil {
+		return false, "", fmt.Errorf("failed to check inner cluster in pod %s: %w (stderr: %s)", podName, err, stderr)
+	}
+
+	output := strings.TrimSpace(stdout)
+	switch {
+	case strings.Contains(output, "kubectl_not_found"):
+		return false, "kubectl is not available in the environment", nil
+	case output == "" || strings.Contains(output, "cluster_not_ready"):
+		return false, "inner cluster API is not responding", nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "Ready" {
+			return true, "", nil
+		}
+	}
+	return false, "inner cluster has no Ready nodes", nil
+}
+
 func (c *Client) ExecInPod(
 	ctx context.Context,
 	namespace, podName, containerName string,
@@ -520,6 +644,83 @@ func (c *Client) ExecInPod(
 	}
 }
 
+// StreamExec runs a command in a container without a TTY, streaming its stdout to stdout until
+// the command exits or ctx is cancelled. Closing stdin (when given) signals the command to stop.
+func (c *Client) StreamExec(ctx context.Context, namespace, podName, containerName string, command []string, stdin io.Reader, stdout io.Writer) error {
+	req := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+			TTY:       false,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(c.restConfig, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("failed to create SPDY executor for pod %s: %w", podName, err)
+	}
+
+	var stderr strings.Builder
+	if err := executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: &stderr,
+	}); err != nil {
+		return fmt.Errorf("exec in pod %s failed: %w (stderr: %s)", podName, err, stderr.String())
+	}
+	return nil
+}
+
+// IsExecutableNotFound reports whether an ExecInPod error means the command could not be started
+// because its executable does not exist in the container, as opposed to the command failing or
+// the stream breaking. The runtime only reports this as text, e.g.
+// "OCI runtime exec failed: exec failed: ...: exec: "/bin/bash": stat /bin/bash: no such file or directory".
+func IsExecutableNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	if strings.Contains(message, "executable file not found") {
+		return true
+	}
+	return strings.Contains(message, "exec failed") && strings.Contains(message, "no such file or directory")
+}
+
+// execCommand runs a non-interactive command in a container and returns its stdout and stderr
+func (c *Client) execCommand(ctx context.Context, podName, namespace, containerName string, command []string) (string, string, error) {
+	req := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   command,
+			Stdin:     false,
+			Stdout:    true,
+			Stderr:    true,
+			TTY:       false,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(c.restConfig, "POST", req.URL())
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create SPDY executor for pod %s: %w", podName, err)
+	}
+
+	var stdout, stderr strings.Builder
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	return stdout.String(), stderr.String(), err
+}
+
 type terminalSizeQueueAdapter struct {
 	queue TerminalSizeQueue
 }
@@ -537,16 +738,28 @@ func (t *terminalSizeQueueAdapter) Next() *remotecommand.TerminalSize {
 
 // ServiceInfo represents information about a service running in a pod
 type ServiceInfo struct {
-	Name        string `json:"name"`
-	Port        int    `json:"port"`
-	Protocol    string `json:"protocol"`
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	// Namespace and type (ClusterIP, NodePort, ...) of a service of the Kind cluster; empty for
+	// ports found listening in the DinD container
+	Namespace string `json:"namespace,omitempty"`
+	Type      string `json:"type,omitempty"`
+	// Port allocated on the nodes for NodePort and LoadBalancer services
+	NodePort int `json:"node_port,omitempty"`
+	// Whether something is known to serve the port: the service has endpoints, or the port was
+	// found listening
+	Verified bool `json:"verified"`
+	// Hosts of the ingresses routing to the service
+	IngressHosts []string `json:"ingress_hosts,omitempty"`
+	// Summary for display
 	Description string `json:"description"`
 }
 
 // GetServicesInPod discovers services running in the Kind cluster inside the DinD pod
 func (c *Client) GetServicesInPod(ctx context.Context, podName, namespace string) ([]ServiceInfo, error) {
 	var services []ServiceInfo
-	
+
 	// First, get services from the Kind cluster
 	kindServices, err := c.GetKindClusterServices(ctx, podName, namespace)
 	if err != nil {
@@ -554,7 +767,7 @@ func (c *Client) GetServicesInPod(ctx context.Context, podName, namespace string
 	} else {
 		services = append(services, kindServices...)
 	}
-	
+
 	// Also check for services running directly in the DinD container
 	dindServices, err := c.getDinDContainerServices(ctx, podName, namespace)
 	if err != nil {
@@ -562,345 +775,140 @@ func (c *Client) GetServicesInPod(ctx context.Context, podName, namespace string
 	} else {
 		services = append(services, dindServices...)
 	}
-	
+
 	return services, nil
 }
 
-// GetKindClusterServices gets services from the Kind cluster running inside DinD (Enhanced)
+// GetKindClusterServices gets services from the Kind cluster running inside DinD. Results are
+// cached per pod for the configured TTL, and concurrent lookups for the same pod share one exec.
 func (c *Client) GetKindClusterServices(ctx context.Context, podName, namespace string) ([]ServiceInfo, error) {
-	// Create a shorter context for this operation
-	execCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
-	
-	// Enhanced service discovery with multiple methods (with timeouts)
-	cmd := []string{"sh", "-c", `
-		if command -v kubectl >/dev/null 2>&1; then
-			# Check if cluster is ready with shorter timeout
-			if timeout 3 kubectl cluster-info --request-timeout=3s >/dev/null 2>&1; then
-				echo "=== KUBECTL_SERVICES ==="
-				# Get all services with detailed information
-				timeout 5 kubectl get services --all-namespaces --no-headers -o custom-columns="NAME:.metadata.name,NAMESPACE:.metadata.namespace,TYPE:.spec.type,CLUSTER-IP:.spec.clusterIP,EXTERNAL-IP:.status.loadBalancer.ingress[0].ip,PORTS:.spec.ports[*].port,TARGET-PORTS:.spec.ports[*].targetPort,PROTOCOLS:.spec.ports[*].protocol" --request-timeout=3s 2>/dev/null | grep -v '^kube-' | grep -v '^kubernetes ' || echo "no_user_services"
-				
-				echo "=== KUBECTL_ENDPOINTS ==="
-				# Get endpoints to find actual running services (most important for verification)
-				timeout 5 kubectl get endpoints --all-namespaces --no-headers -o custom-columns="NAME:.metadata.name,NAMESPACE:.metadata.namespace,ENDPOINTS:.subsets[*].addresses[*].ip,PORTS:.subsets[*].ports[*].port" --request-timeout=3s 2>/dev/null | grep -v '^kube-' | grep -v '^kubernetes ' || echo "no_endpoints"
-			else
-				echo "cluster_not_ready"
-			fi
-		else
-			echo "kubectl_not_found"
-		fi
-	`}
-	
-	req := c.clientset.CoreV1().RESTClient().Post().
-		Resource("pods").
-		Name(podName).
-		Namespace(namespace).
-		SubResource("exec").
-		VersionedParams(&corev1.PodExecOptions{
-			Container: "dind",
-			Command:   cmd,
-			Stdin:     false,
-			Stdout:    true,
-			Stderr:    true,
-			TTY:       false,
-		}, scheme.ParameterCodec)
-
-	executor, err := remotecommand.NewSPDYExecutor(c.restConfig, "POST", req.URL())
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SPDY executor: %w", err)
+	cacheKey := namespace + "/" + podName
+	if cached, ok := c.serviceCache.Load(cacheKey); ok && time.Since(cached.(cachedServices).fetchedAt) < c.serviceCacheTTL {
+		return cached.(cachedServices).services, nil
 	}
 
-	var stdout, stderr strings.Builder
-	err = executor.StreamWithContext(execCtx, remotecommand.StreamOptions{
-		Stdout: &stdout,
-		Stderr: &stderr,
+	result, err, _ := c.serviceFlight.Do(cacheKey, func() (interface{}, error) {
+		// The exec is shared by every waiting caller, so it must not be cut short by the first one leaving
+		services, err := c.discoverKindClusterServices(context.WithoutCancel(ctx), podName, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if c.serviceCacheTTL > 0 {
+			c.serviceCache.Store(cacheKey, cachedServices{services: services, fetchedAt: time.Now()})
+		}
+		return services, nil
 	})
-
 	if err != nil {
-		log.Printf("Failed to execute kubectl in pod %s: %v, stderr: %s", podName, err, stderr.String())
-		// If kubectl execution fails, try common port scanning as fallback
-		return c.scanCommonPorts(ctx, podName, namespace)
-	}
-
-	output := stdout.String()
-	if strings.Contains(output, "kubectl_not_found") || strings.Contains(output, "kubectl_failed") || strings.Contains(output, "cluster_not_ready") {
-		// If kubectl is not available or cluster not ready, try common port scanning
-		return c.scanCommonPorts(ctx, podName, namespace)
+		return nil, err
 	}
+	return result.([]ServiceInfo), nil
+}
 
-	// Parse enhanced service discovery output
-	services := c.parseEnhancedServiceOutput(output)
-	
-	// If no services found through Kubernetes API, try common port scanning as fallback
-	if len(services) == 0 {
-		log.Printf("No services found via kubectl in pod %s, trying port scanning fallback", podName)
-		return c.scanCommonPorts(ctx, podName, namespace)
-	}
+// InvalidateServiceCache drops the cached service discovery result of a pod so that the next
+// lookup execs into it again
+func (c *Client) InvalidateServiceCache(podName, namespace string) {
+	c.serviceCache.Delete(namespace + "/" + podName)
+}
 
-	log.Printf("Found %d services via kubectl in pod %s", len(services), podName)
-	return services, nil
+// SetServiceCacheTTL sets how long service discovery results are reused. 0 disables caching;
+// concurrent lookups are still coalesced.
+func (c *Client) SetServiceCacheTTL(ttl time.Duration) {
+	c.serviceCacheTTL = ttl
 }
 
-// parseEnhancedServiceOutput parses the enhanced kubectl output for comprehensive service discovery
-func (c *Client) parseEnhancedServiceOutput(output string) []ServiceInfo {
-	var services []ServiceInfo
-	serviceMap := make(map[string]*ServiceInfo) // Use map to deduplicate services
+// DefaultServiceCacheTTL is how long service discovery results are reused unless configured otherwise
+const DefaultServiceCacheTTL = 10 * time.Second
 
-	// Parse services section
-	if servicesStart := strings.Index(output, "=== KUBECTL_SERVICES ==="); servicesStart != -1 {
-		servicesEnd := strings.Index(output[servicesStart:], "=== KUBECTL_INGRESSES ===")
-		if servicesEnd == -1 {
-			servicesEnd = len(output) - servicesStart
-		}
-		servicesSection := output[servicesStart:servicesStart+servicesEnd]
-		
-		if !strings.Contains(servicesSection, "no_user_services") {
-			lines := strings.Split(strings.TrimSpace(servicesSection), "\n")
-			for _, line := range lines[1:] { // Skip header line
-				if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "===") {
-					continue
-				}
-				parts := strings.Fields(line)
-				if len(parts) >= 6 {
-					serviceName := parts[0]
-					serviceNamespace := parts[1]
-					serviceType := parts[2]
-					
-					// Parse ports (comma-separated)
-					portsStr := parts[5]
-					if portsStr != "<none>" && portsStr != "" {
-						ports := strings.Split(portsStr, ",")
-						for _, portStr := range ports {
-							if port, err := strconv.Atoi(strings.TrimSpace(portStr)); err == nil {
-								key := fmt.Sprintf("%s-%s-%d", serviceName, serviceNamespace, port)
-								serviceMap[key] = &ServiceInfo{
-									Name:        serviceName,
-									Description: fmt.Sprintf("%s service in %s namespace (Type: %s)", serviceName, serviceNamespace, serviceType),
-									Port:        port,
-									Protocol:    "http", // Default to http, will be refined later
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Parse ingresses section to identify HTTP services (but don't assume port 80 automatically)
-	if ingressesStart := strings.Index(output, "=== KUBECTL_INGRESSES ==="); ingressesStart != -1 {
-		ingressesEnd := strings.Index(output[ingressesStart:], "=== KUBECTL_ENDPOINTS ===")
-		if ingressesEnd == -1 {
-			ingressesEnd = len(output) - ingressesStart
-		}
-		ingressesSection := output[ingressesStart:ingressesStart+ingressesEnd]
-		
-		if !strings.Contains(ingressesSection, "no_ingresses") {
-			lines := strings.Split(strings.TrimSpace(ingressesSection), "\n")
-			for _, line := range lines[1:] { // Skip header line
-				if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "===") {
-					continue
-				}
-				parts := strings.Fields(line)
-				if len(parts) >= 5 {
-					ingressName := parts[0]
-					hostsStr := parts[2]
-					backendService := parts[4]
-					
-					// Only add ingress if we can find the backend service in our service map
-					found := false
-					for key, service := range serviceMap {
-						if strings.Contains(key, backendService) || strings.Contains(service.Name, backendService) {
-							service.Description += fmt.Sprintf(" | Ingress: %s", hostsStr)
-							found = true
-							break
-						}
-					}
-					
-					// Don't create phantom services for ingresses without confirmed backends
-					if !found {
-						log.Printf("Ingress %s references backend %s but no corresponding service found", ingressName, backendService)
-					}
-				}
-			}
-		}
-	}
+type cachedServices struct {
+	services  []ServiceInfo
+	fetchedAt time.Time
+}
 
-	// Parse endpoints section to find actually running services
-	if endpointsStart := strings.Index(output, "=== KUBECTL_ENDPOINTS ==="); endpointsStart != -1 {
-		endpointsEnd := strings.Index(output[endpointsStart:], "=== KUBECTL_DEPLOYMENTS ===")
-		if endpointsEnd == -1 {
-			endpointsEnd = len(output) - endpointsStart
-		}
-		endpointsSection := output[endpointsStart:endpointsStart+endpointsEnd]
-		
-		if !strings.Contains(endpointsSection, "no_endpoints") {
-			lines := strings.Split(strings.TrimSpace(endpointsSection), "\n")
-			for _, line := range lines[1:] { // Skip header line
-				if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "===") {
-					continue
-				}
-				parts := strings.Fields(line)
-				if len(parts) >= 4 {
-					endpointName := parts[0]
-					endpointNamespace := parts[1]
-					portsStr := parts[3]
-					
-					// Parse ports from endpoints
-					if portsStr != "<none>" && portsStr != "" {
-						ports := strings.Split(portsStr, ",")
-						for _, portStr := range ports {
-							if port, err := strconv.Atoi(strings.TrimSpace(portStr)); err == nil {
-								key := fmt.Sprintf("%s-%s-%d", endpointName, endpointNamespace, port)
-								if existing, exists := serviceMap[key]; exists {
-									// Mark as verified (has endpoints)
-									existing.Description += " ✓"
-								} else {
-									// Add new service discovered through endpoints
-									serviceMap[key] = &ServiceInfo{
-										Name:        endpointName + "-endpoint",
-										Description: fmt.Sprintf("Endpoint: %s in %s namespace ✓", endpointName, endpointNamespace),
-										Port:        port,
-										Protocol:    "http",
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
+// portProbeCommand returns a shell command that succeeds when something accepts TCP
+// connections on host:port within timeout. port may be a shell variable such as "$port".
+func portProbeCommand(host, port string, timeout time.Duration) string {
+	return fmt.Sprintf(`timeout %s bash -c "</dev/tcp/%s/%s"`, strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64), host, port)
+}
 
-	// Parse deployments section to find potential services (but validate they have endpoints)
-	if deploymentsStart := strings.Index(output, "=== KUBECTL_DEPLOYMENTS ==="); deploymentsStart != -1 {
-		deploymentsSection := output[deploymentsStart:]
-		
-		if !strings.Contains(deploymentsSection, "no_deployments") {
-			lines := strings.Split(strings.TrimSpace(deploymentsSection), "\n")
-			for _, line := range lines[1:] { // Skip header line
-				if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "===") {
-					continue
-				}
-				parts := strings.Fields(line)
-				if len(parts) >= 6 {
-					deploymentName := parts[0]
-					deploymentNamespace := parts[1]
-					readyReplicas := parts[2]
-					availableReplicas := parts[3]
-					containersStr := parts[4]
-					portsStr := parts[5]
-					
-					// Only consider deployments with ready replicas and available replicas
-					if readyReplicas != "0" && readyReplicas != "<none>" && 
-					   availableReplicas != "0" && availableReplicas != "<none>" &&
-					   readyReplicas == availableReplicas {
-						// Parse container ports
-						if portsStr != "<none>" && portsStr != "" {
-							ports := strings.Split(portsStr, ",")
-							for _, portStr := range ports {
-								if port, err := strconv.Atoi(strings.TrimSpace(portStr)); err == nil {
-									key := fmt.Sprintf("%s-%s-%d", deploymentName, deploymentNamespace, port)
-									// Only add if not already present and if it's a common web port
-									if _, exists := serviceMap[key]; !exists && isWebPort(port) {
-										serviceMap[key] = &ServiceInfo{
-											Name:        deploymentName + "-app",
-											Description: fmt.Sprintf("App: %s (%s containers, %s ready) - Unverified", deploymentName, containersStr, readyReplicas),
-											Port:        port,
-											Protocol:    "http",
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-			}
-		}
-	}
+// How many ports scanCommonPorts probes at once
+const portScanParallelism = 32
 
-	// Convert map to slice
-	for _, service := range serviceMap {
-		services = append(services, *service)
+// scanCommonPorts scans the configured ports to detect running services. All ports are probed
+// by a single exec, portScanParallelism at a time. ctx bounds the exec.
+func (c *Client) scanCommonPorts(ctx context.Context, podName, namespace string) ([]ServiceInfo, error) {
+	stdout, stderr, err := c.execCommand(ctx, podName, namespace, "dind", []string{"sh", "-c", portScanScript(c.scanPorts)})
+	if err != nil {
+		log.Printf("Failed to scan ports in pod %s: %v, stderr: %s", podName, err, stderr)
+		return []ServiceInfo{}, nil
 	}
 
-	return services
+	services := parseOpenPorts(stdout, c.scanPorts)
+	log.Printf("Found %d of %d scanned ports open in pod %s", len(services), len(c.scanPorts), podName)
+	return services, nil
 }
 
-// isWebPort checks if a port is commonly used for web services
-func isWebPort(port int) bool {
-	webPorts := map[int]bool{
-		80:   true, // HTTP
-		443:  true, // HTTPS
-		3000: true, // Development servers
-		8000: true, // HTTP alternative
-		8080: true, // HTTP proxy/alternative
-		8443: true, // HTTPS alternative
-		9000: true, // Application servers
-		5000: true, // Development servers
-		4000: true, // Development servers
-		3001: true, // Development servers
-		8001: true, // HTTP alternative
-		8888: true, // Jupyter/development
-	}
-	return webPorts[port]
+// portScanScript returns a shell script that prints "port_<port>_open" for each of ports that
+// accepts connections on localhost, probing portScanParallelism ports at a time
+func portScanScript(ports []int) string {
+	return fmt.Sprintf(`
+		n=0
+		for range in %s; do
+			port=${range%%-*}
+			last=${range#*-}
+			while [ "$port" -le "$last" ]; do
+				# Try to connect to localhost:$port to see if something is listening
+				(%s >/dev/null 2>&1 && echo "port_${port}_open") &
+				n=$((n + 1))
+				if [ $((n %% %d)) -eq 0 ]; then wait; fi
+				port=$((port + 1))
+			done
+		done
+		wait
+	`, compactPortList(ports), portProbeCommand("localhost", "$port", time.Second), portScanParallelism)
 }
 
-// scanCommonPorts scans common ports to detect running services
-func (c *Client) scanCommonPorts(ctx context.Context, podName, namespace string) ([]ServiceInfo, error) {
-	commonPorts := []int{80, 443, 3000, 8000, 8080, 8443, 3001, 4000, 5000, 8001, 8888, 9000, 30000, 30001, 30002, 30003, 30080, 31000}
-	
-	var services []ServiceInfo
-	
-	// Check each common port
-	for _, port := range commonPorts {
-		cmd := []string{"sh", "-c", fmt.Sprintf(`
-			# Try to connect to localhost:%d to see if something is listening
-			timeout 1 bash -c "</dev/tcp/localhost/%d" >/dev/null 2>&1 && echo "port_%d_open" || echo "port_%d_closed"
-		`, port, port, port, port)}
-		
-		req := c.clientset.CoreV1().RESTClient().Post().
-			Resource("pods").
-			Name(podName).
-			Namespace(namespace).
-			SubResource("exec").
-			VersionedParams(&corev1.PodExecOptions{
-				Container: "dind",
-				Command:   cmd,
-				Stdin:     false,
-				Stdout:    true,
-				Stderr:    true,
-				TTY:       false,
-			}, scheme.ParameterCodec)
-
-		executor, err := remotecommand.NewSPDYExecutor(c.restConfig, "POST", req.URL())
-		if err != nil {
-			continue // Skip this port if execution fails
+// compactPortList formats ports for the scan script, with runs of consecutive ports as ranges
+// ("80 443 30000-32767") so that a configured range does not turn into thousands of arguments
+func compactPortList(ports []int) string {
+	var entries []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
 		}
-
-		var stdout strings.Builder
-		err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
-			Stdout: &stdout,
-		})
-
-		if err != nil {
-			continue // Skip this port if execution fails
+		if j == i {
+			entries = append(entries, strconv.Itoa(ports[i]))
+		} else {
+			entries = append(entries, fmt.Sprintf("%d-%d", ports[i], ports[j]))
 		}
+		i = j + 1
+	}
+	return strings.Join(entries, " ")
+}
 
-		output := stdout.String()
-		if strings.Contains(output, fmt.Sprintf("port_%d_open", port)) {
-			service := ServiceInfo{
+// parseOpenPorts turns the "port_<port>_open" lines printed by the scan script into services,
+// in the order of scanned. Lines for ports that were not scanned are ignored.
+func parseOpenPorts(output string, scanned []int) []ServiceInfo {
+	open := make(map[int]bool)
+	for _, line := range strings.Fields(output) {
+		var port int
+		if _, err := fmt.Sscanf(line, "port_%d_open", &port); err == nil {
+			open[port] = true
+		}
+	}
+	var services []ServiceInfo
+	for _, port := range scanned {
+		if open[port] {
+			services = append(services, ServiceInfo{
 				Name:        fmt.Sprintf("service-%d", port),
 				Port:        port,
 				Protocol:    "tcp",
+				Verified:    true,
 				Description: getServiceDescription(port),
-			}
-			services = append(services, service)
+			})
 		}
 	}
-	
-	return services, nil
+	return services
 }
 
 // getDinDContainerServices gets services running directly in the DinD container
@@ -908,7 +916,7 @@ func (c *Client) getDinDContainerServices(ctx context.Context, podName, namespac
 	// Create a shorter context for this operation to avoid blocking
 	execCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	
+
 	// Execute netstat command to find listening ports in DinD container
 	req := c.clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
@@ -947,32 +955,32 @@ func (c *Client) getDinDContainerServices(ctx context.Context, podName, namespac
 		return []ServiceInfo{}, nil
 	}
 
-	services := parseNetstatOutput(output)
+	services := parseNetstatOutput(output, c.webPorts)
 	log.Printf("Found %d services via netstat in pod %s", len(services), podName)
 	return services, nil
 }
 
-
-// parseNetstatOutput parses netstat/ss output and returns service information
-func parseNetstatOutput(output string) []ServiceInfo {
+// parseNetstatOutput parses netstat/ss output and returns service information. Ports below 1024
+// are only included if they are in webPorts.
+func parseNetstatOutput(output string, webPorts map[int]bool) []ServiceInfo {
 	var services []ServiceInfo
 	lines := strings.Split(output, "\n")
-	
+
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" || !strings.Contains(line, "LISTEN") {
 			continue
 		}
-		
+
 		// Parse different formats of netstat/ss output
 		fields := strings.Fields(line)
 		if len(fields) < 4 {
 			continue
 		}
-		
+
 		var address string
 		var protocol string
-		
+
 		// Detect if this is netstat or ss output
 		if strings.HasPrefix(fields[0], "tcp") || strings.HasPrefix(fields[0], "udp") {
 			// netstat format: tcp 0 0 0.0.0.0:80 0.0.0.0:* LISTEN
@@ -988,42 +996,43 @@ func parseNetstatOutput(output string) []ServiceInfo {
 				address = fields[0]
 			}
 		}
-		
+
 		if address == "" {
 			continue
 		}
-		
+
 		// Extract port from address (format could be 0.0.0.0:80, *:80, :::80, etc.)
 		portStr := ""
 		if strings.Contains(address, ":") {
 			parts := strings.Split(address, ":")
 			portStr = parts[len(parts)-1]
 		}
-		
+
 		if portStr == "" || portStr == "*" {
 			continue
 		}
-		
+
 		port, err := strconv.Atoi(portStr)
 		if err != nil {
 			continue
 		}
-		
+
 		// Skip system ports and common internal services
-		if port < 1024 && port != 80 && port != 443 && port != 8080 && port != 3000 && port != 8000 {
+		if port < 1024 && !webPorts[port] {
 			continue
 		}
-		
+
 		// Generate a description based on common port usage
 		description := getServiceDescription(port)
-		
+
 		service := ServiceInfo{
 			Name:        fmt.Sprintf("service-%d", port),
 			Port:        port,
 			Protocol:    protocol,
+			Verified:    true,
 			Description: description,
 		}
-		
+
 		// Check if this port is already in the list
 		exists := false
 		for _, existing := range services {
@@ -1032,48 +1041,44 @@ func parseNetstatOutput(output string) []ServiceInfo {
 				break
 			}
 		}
-		
+
 		if !exists {
 			services = append(services, service)
 		}
 	}
-	
+
 	return services
 }
 
 // getServiceDescription returns a description for common port numbers
 func getServiceDescription(port int) string {
 	descriptions := map[int]string{
-		80:   "HTTP Web Server",
-		443:  "HTTPS Web Server",
-		3000: "Development Server",
-		8000: "HTTP Alternative",
-		8080: "HTTP Proxy/Alternative",
-		8443: "HTTPS Alternative",
-		9000: "Application Server",
-		3306: "MySQL Database",
-		5432: "PostgreSQL Database",
-		6379: "Redis Cache",
+		80:    "HTTP Web Server",
+		443:   "HTTPS Web Server",
+		3000:  "Development Server",
+		8000:  "HTTP Alternative",
+		8080:  "HTTP Proxy/Alternative",
+		8443:  "HTTPS Alternative",
+		9000:  "Application Server",
+		3306:  "MySQL Database",
+		5432:  "PostgreSQL Database",
+		6379:  "Redis Cache",
 		27017: "MongoDB Database",
-		5000: "Application Server",
-		4000: "Application Server",
-		8888: "Jupyter/Application Server",
-		9090: "Prometheus/Monitoring",
-		3001: "Development Server",
-		8001: "HTTP Alternative",
-		8002: "HTTP Alternative",
-		8003: "HTTP Alternative",
-		8004: "HTTP Alternative",
-		8005: "HTTP Alternative",
-	}
-	
+		5000:  "Application Server",
+		4000:  "Application Server",
+		8888:  "Jupyter/Application Server",
+		9090:  "Prometheus/Monitoring",
+		3001:  "Development Server",
+		8001:  "HTTP Alternative",
+		8002:  "HTTP Alternative",
+		8003:  "HTTP Alternative",
+		8004:  "HTTP Alternative",
+		8005:  "HTTP Alternative",
+	}
+
 	if desc, exists := descriptions[port]; exists {
 		return desc
 	}
-	
+
 	return fmt.Sprintf("Service on port %d", port)
 }
-
-
-
-
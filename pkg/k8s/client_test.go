@@ -0,0 +1,161 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// failDeletes makes the fake clientset fail every delete of the given resource
+func failDeletes(clientset *fake.Clientset, resource string) {
+	clientset.PrependReactor("delete", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("injected failure")
+	})
+}
+
+func TestDeleteDinDStatefulSetContinuesAfterServiceFailure(t *testing.T) {
+	const name, namespace = "k8s-playground-abcd1234", "playground"
+	meta := metav1.ObjectMeta{Name: name, Namespace: namespace}
+	pvcMeta := metav1.ObjectMeta{Name: "docker-graph-storage-" + name + "-0", Namespace: namespace}
+	clientset := fake.NewSimpleClientset(
+		&appsv1.StatefulSet{ObjectMeta: meta},
+		&corev1.Service{ObjectMeta: meta},
+		&corev1.PersistentVolumeClaim{ObjectMeta: pvcMeta},
+	)
+	failDeletes(clientset, "services")
+	c := &Client{clientset: clientset}
+
+	err := c.DeleteDinDStatefulSet(context.Background(), name, namespace)
+	if err == nil || !strings.Contains(err.Error(), "failed to delete service") {
+		t.Fatalf("DeleteDinDStatefulSet error = %v, want the service failure", err)
+	}
+
+	ctx := context.Background()
+	if _, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("statefulset still exists (err = %v)", err)
+	}
+	if _, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcMeta.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("pvc was not deleted after the service failure (err = %v)", err)
+	}
+}
+
+func TestDeleteDinDDeploymentContinuesAfterDeploymentFailure(t *testing.T) {
+	const name, namespace = "k8s-playground-abcd1234", "playground"
+	meta := metav1.ObjectMeta{Name: name, Namespace: namespace}
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: meta},
+		&corev1.Service{ObjectMeta: meta},
+	)
+	failDeletes(clientset, "deployments")
+	c := &Client{clientset: clientset}
+
+	err := c.DeleteDinDDeployment(context.Background(), name, namespace)
+	if err == nil || !strings.Contains(err.Error(), "failed to delete deployment") {
+		t.Fatalf("DeleteDinDDeployment error = %v, want the deployment failure", err)
+	}
+	if _, err := clientset.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("service was not deleted after the deployment failure (err = %v)", err)
+	}
+}
+
+func TestDeleteDinDStatefulSetIgnoresMissingResources(t *testing.T) {
+	c := &Client{clientset: fake.NewSimpleClientset()}
+	if err := c.DeleteDinDStatefulSet(context.Background(), "k8s-playground-gone0000", "playground"); err != nil {
+		t.Errorf("DeleteDinDStatefulSet of a missing workload = %v, want nil", err)
+	}
+}
+
+func TestCompactPortList(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []int
+		want  string
+	}{
+		{name: "none", ports: nil, want: ""},
+		{name: "single ports", ports: []int{80, 443, 8080}, want: "80 443 8080"},
+		{name: "NodePort range", ports: mustParsePortList(t, "30000-32767"), want: "30000-32767"},
+		{name: "ports and ranges", ports: []int{80, 3000, 3001, 3002, 8080, 30000, 30001}, want: "80 3000-3002 8080 30000-30001"},
+		{name: "order is kept", ports: []int{8080, 80, 81}, want: "8080 80-81"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compactPortList(tt.ports); got != tt.want {
+				t.Errorf("compactPortList(%v) = %q, want %q", tt.ports, got, tt.want)
+			}
+		})
+	}
+}
+
+func mustParsePortList(t *testing.T, raw string) []int {
+	t.Helper()
+	ports, err := ParsePortList(raw)
+	if err != nil {
+		t.Fatalf("ParsePortList(%q): %v", raw, err)
+	}
+	return ports
+}
+
+func TestParseOpenPorts(t *testing.T) {
+	output := "port_8080_open\nport_80_open\nport_9999_open\ngarbage\nport_x_open\nport_80_open\n"
+	got := parseOpenPorts(output, []int{80, 443, 8080})
+	want := []ServiceInfo{
+		{Name: "service-80", Port: 80, Protocol: "tcp", Verified: true, Description: getServiceDescription(80)},
+		{Name: "service-8080", Port: 8080, Protocol: "tcp", Verified: true, Description: getServiceDescription(8080)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseOpenPorts =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := parseOpenPorts("", []int{80}); len(got) != 0 {
+		t.Errorf("parseOpenPorts of empty output = %+v, want none", got)
+	}
+}
+
+func TestPortScanScriptFindsListeningPorts(t *testing.T) {
+	for _, tool := range []string{"sh", "bash", "timeout"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available: %v", tool, err)
+		}
+	}
+	listen := func() (net.Listener, int) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		return listener, listener.Addr().(*net.TCPAddr).Port
+	}
+	first, firstPort := listen()
+	defer first.Close()
+	second, secondPort := listen()
+	defer second.Close()
+	closed, closedPort := listen()
+	closed.Close()
+
+	// The listening ports are scanned as part of ranges
+	ports := []int{closedPort, firstPort - 1, firstPort, firstPort + 1, secondPort, secondPort + 1}
+	output, err := exec.Command("sh", "-c", portScanScript(ports)).Output()
+	if err != nil {
+		t.Fatalf("scan script: %v", err)
+	}
+	open := make(map[int]bool)
+	for _, service := range parseOpenPorts(string(output), ports) {
+		open[service.Port] = true
+	}
+	if !open[firstPort] || !open[secondPort] {
+		t.Errorf("open ports = %v, want %d and %d", open, firstPort, secondPort)
+	}
+	if open[closedPort] {
+		t.Errorf("closed port %d reported open", closedPort)
+	}
+}
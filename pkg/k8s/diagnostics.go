@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// maxDiagnosticEvents is the number of recent warning events included in a pod diagnosis
+const maxDiagnosticEvents = 3
+
+// DiagnosePodNotReady summarizes why a pod has not become ready: its phase, the waiting or
+// terminated reasons of its containers and its most recent warning events. It is meant for
+// error messages shown to users, so failures to look things up are folded into the text.
+func (c *Client) DiagnosePodNotReady(ctx context.Context, podName, namespace string) string {
+	var parts []string
+
+	pod, err := c.GetPod(ctx, podName, namespace)
+	if err != nil {
+		parts = append(parts, fmt.Sprintf("pod unavailable: %v", err))
+	} else {
+		parts = append(parts, fmt.Sprintf("phase=%s", pod.Status.Phase))
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodScheduled && cond.Status != corev1.ConditionTrue && cond.Message != "" {
+				parts = append(parts, fmt.Sprintf("unschedulable: %s", cond.Message))
+			}
+		}
+		statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			if cs.State.Waiting != nil && cs.State.Waiting.Reason != "" {
+				parts = append(parts, fmt.Sprintf("container %s waiting: %s %s", cs.Name, cs.State.Waiting.Reason, cs.State.Waiting.Message))
+			} else if cs.State.Terminated != nil {
+				parts = append(parts, fmt.Sprintf("container %s terminated: %s (exit code %d)", cs.Name, cs.State.Terminated.Reason, cs.State.Terminated.ExitCode))
+			}
+		}
+	}
+
+	events, err := c.GetPodEvents(ctx, podName, namespace)
+	if err != nil {
+		parts = append(parts, fmt.Sprintf("events unavailable: %v", err))
+	} else {
+		shown := 0
+		for _, ev := range events {
+			if ev.Type != corev1.EventTypeWarning {
+				continue
+			}
+			parts = append(parts, fmt.Sprintf("event %s: %s", ev.Reason, strings.TrimSpace(ev.Message)))
+			shown++
+			if shown == maxDiagnosticEvents {
+				break
+			}
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// GetPodEvents returns the events recorded for a pod, newest first
+func (c *Client) GetPodEvents(ctx context.Context, podName, namespace string) ([]corev1.Event, error) {
+	events, err := c.clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.AndSelectors(
+			fields.OneTermEqualSelector("involvedObject.kind", "Pod"),
+			fields.OneTermEqualSelector("involvedObject.name", podName),
+		).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events for pod %s in namespace %s: %w", podName, namespace, err)
+	}
+
+	items := events.Items
+	sort.Slice(items, func(i, j int) bool {
+		return eventTime(items[i]).Time.After(eventTime(items[j]).Time)
+	})
+	return items, nil
+}
+
+// eventTime returns the most meaningful timestamp of an event
+func eventTime(ev corev1.Event) metav1.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp
+	}
+	if !ev.EventTime.IsZero() {
+		return metav1.Time{Time: ev.EventTime.Time}
+	}
+	return ev.CreationTimestamp
+}
+
+// GetContainerLogs returns the last tailLines lines of a container's log, capped at limitBytes
+func (c *Client) GetContainerLogs(ctx context.Context, podName, namespace, containerName string, tailLines, limitBytes int64) (string, error) {
+	raw, err := c.clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Container:  containerName,
+		TailLines:  &tailLines,
+		LimitBytes: &limitBytes,
+	}).DoRaw(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get logs of container %s in pod %s: %w", containerName, podName, err)
+	}
+	return string(raw), nil
+}
+
+// StreamPodLogs follows a container's stdout/stderr, starting with the last tailLines lines.
+// The stream ends when ctx is cancelled or the container stops; the caller must close it.
+func (c *Client) StreamPodLogs(ctx context.Context, podName, namespace, containerName string, tailLines int64) (io.ReadCloser, error) {
+	stream, err := c.clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Container: containerName,
+		TailLines: &tailLines,
+		Follow:    true,
+	}).Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream logs of container %s in pod %s: %w", containerName, podName, err)
+	}
+	return stream, nil
+}
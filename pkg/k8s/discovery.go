@@ -0,0 +1,252 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Bounds service discovery in the inner cluster, including the port-forward to its API server
+	// and the fallback port scan
+	serviceDiscoveryTimeout = 15 * time.Second
+	// Bounds each request to the inner API server during service discovery
+	innerAPIRequestTimeout = 5 * time.Second
+)
+
+// DefaultScanPorts are the ports probed in the DinD container unless configured otherwise
+var DefaultScanPorts = []int{80, 443, 3000, 8000, 8080, 8443, 3001, 4000, 5000, 8001, 8888, 9000, 30000, 30001, 30002, 30003, 30080, 31000}
+
+// DefaultWebPorts are the ports commonly used for web services
+var DefaultWebPorts = []int{80, 443, 3000, 3001, 4000, 5000, 8000, 8001, 8080, 8443, 8888, 9000}
+
+// SetServiceScanPorts sets the ports probed in the DinD container when the services of the inner
+// cluster cannot be listed; see ParsePortList
+func (c *Client) SetServiceScanPorts(ports []int) {
+	c.scanPorts = ports
+}
+
+// SetWebPorts sets the ports below 1024 that are listed when found listening in the DinD
+// container; other privileged ports are assumed to be system services
+func (c *Client) SetWebPorts(ports []int) {
+	c.webPorts = portSet(ports)
+}
+
+// ParsePortList parses a comma-separated list of ports and port ranges such as
+// "80,443,30000-32767". Duplicates are dropped; the order is kept.
+func ParsePortList(raw string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(entry, "-")
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if isRange {
+			if to, err = parsePort(last); err != nil {
+				return nil, err
+			}
+			if to < from {
+				return nil, fmt.Errorf("invalid port range %q", entry)
+			}
+		}
+		for port := from; port <= to; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports in %q", raw)
+	}
+	return ports, nil
+}
+
+func parsePort(raw string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", raw)
+	}
+	return port, nil
+}
+
+func portSet(ports []int) map[int]bool {
+	set := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		set[port] = true
+	}
+	return set
+}
+
+// discoverKindClusterServices lists the services of the Kind cluster through its API server,
+// reached over a port-forward with the cluster's own kubeconfig. Falls back to scanning common
+// ports when the inner cluster cannot be reached or has no services. serviceDiscoveryTimeout
+// bounds both, so a slow fallback scan cannot outlast it.
+func (c *Client) discoverKindClusterServices(ctx context.Context, podName, namespace string) ([]ServiceInfo, error) {
+	discoveryCtx, cancel := context.WithTimeout(ctx, serviceDiscoveryTimeout)
+	defer cancel()
+
+	innerConfig, apiTunnel, err := c.openInnerCluster(discoveryCtx, podName, namespace)
+	if err != nil {
+		log.Printf("Failed to reach the inner cluster of pod %s, trying port scanning fallback: %v", podName, err)
+		return c.scanCommonPorts(discoveryCtx, podName, namespace)
+	}
+	defer apiTunnel.Close()
+	innerConfig.Timeout = innerAPIRequestTimeout
+	innerClientset, err := kubernetes.NewForConfig(innerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inner cluster client: %w", err)
+	}
+
+	services, err := listInnerClusterServices(discoveryCtx, innerClientset)
+	if err != nil {
+		log.Printf("Failed to list services of the inner cluster of pod %s, trying port scanning fallback: %v", podName, err)
+		return c.scanCommonPorts(discoveryCtx, podName, namespace)
+	}
+	if len(services) == 0 {
+		log.Printf("No services found in the inner cluster of pod %s, trying port scanning fallback", podName)
+		return c.scanCommonPorts(discoveryCtx, podName, namespace)
+	}
+
+	log.Printf("Found %d services in the inner cluster of pod %s", len(services), podName)
+	return services, nil
+}
+
+// listInnerClusterServices returns one ServiceInfo per port of the user-facing services of a
+// cluster, sorted by namespace, name and port. NodePorts are included, so the proxy can be
+// addressed by either port. The kubernetes API service and services named
+// kube-* (e.g. kube-dns) are left out, as are ExternalName services, which have nothing to
+// forward to. Ingress hosts are added on a best-effort basis.
+func listInnerClusterServices(ctx context.Context, clientset kubernetes.Interface) ([]ServiceInfo, error) {
+	serviceList, err := clientset.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	endpointsList, err := clientset.CoreV1().Endpoints(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list endpoints: %w", err)
+	}
+	// Names of the ports with ready addresses, by "namespace/service"
+	readyPorts := make(map[string]map[string]bool)
+	for _, endpoints := range endpointsList.Items {
+		key := endpoints.Namespace + "/" + endpoints.Name
+		for _, subset := range endpoints.Subsets {
+			if len(subset.Addresses) == 0 {
+				continue
+			}
+			if readyPorts[key] == nil {
+				readyPorts[key] = make(map[string]bool)
+			}
+			for _, port := range subset.Ports {
+				readyPorts[key][port.Name] = true
+			}
+		}
+	}
+	ingressHosts, err := listIngressHosts(ctx, clientset)
+	if err != nil {
+		log.Printf("Failed to list ingresses, services are listed without their hosts: %v", err)
+	}
+
+	var services []ServiceInfo
+	for _, service := range serviceList.Items {
+		if isSystemService(service) || service.Spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+		key := service.Namespace + "/" + service.Name
+		hosts := ingressHosts[key]
+		for _, port := range service.Spec.Ports {
+			info := ServiceInfo{
+				Name:         service.Name,
+				Port:         int(port.Port),
+				Protocol:     servicePortProtocol(port),
+				Namespace:    service.Namespace,
+				Type:         string(service.Spec.Type),
+				NodePort:     int(port.NodePort),
+				Verified:     readyPorts[key][port.Name],
+				IngressHosts: hosts,
+				Description:  fmt.Sprintf("%s service in %s namespace (Type: %s)", service.Name, service.Namespace, service.Spec.Type),
+			}
+			if info.NodePort != 0 {
+				info.Description += fmt.Sprintf(" | NodePort: %d", info.NodePort)
+			}
+			if len(hosts) > 0 {
+				info.Description += fmt.Sprintf(" | Ingress: %s", strings.Join(hosts, ","))
+			}
+			if info.Verified {
+				info.Description += " ✓"
+			}
+			services = append(services, info)
+		}
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		if services[i].Name != services[j].Name {
+			return services[i].Name < services[j].Name
+		}
+		return services[i].Port < services[j].Port
+	})
+	return services, nil
+}
+
+// listIngressHosts returns the hosts of the ingress rules routing to each service, by
+// "namespace/service". Rules without a host are not included.
+func listIngressHosts(ctx context.Context, clientset kubernetes.Interface) (map[string][]string, error) {
+	ingresses, err := clientset.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ingresses: %w", err)
+	}
+	hosts := make(map[string][]string)
+	for _, ingress := range ingresses.Items {
+		for _, rule := range ingress.Spec.Rules {
+			if rule.Host == "" || rule.HTTP == nil {
+				continue
+			}
+			for _, path := range rule.HTTP.Paths {
+				if path.Backend.Service == nil {
+					continue
+				}
+				key := ingress.Namespace + "/" + path.Backend.Service.Name
+				if !slices.Contains(hosts[key], rule.Host) {
+					hosts[key] = append(hosts[key], rule.Host)
+				}
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// isSystemService reports whether a service belongs to the cluster itself rather than the user
+func isSystemService(service corev1.Service) bool {
+	return (service.Namespace == metav1.NamespaceDefault && service.Name == "kubernetes") || strings.HasPrefix(service.Name, "kube-")
+}
+
+// servicePortProtocol returns the application protocol of a service port if declared, "http"
+// for other TCP ports and the lower-cased transport protocol otherwise
+func servicePortProtocol(port corev1.ServicePort) string {
+	if port.AppProtocol != nil && *port.AppProtocol != "" {
+		return strings.ToLower(*port.AppProtocol)
+	}
+	if port.Protocol != "" && port.Protocol != corev1.ProtocolTCP {
+		return strings.ToLower(string(port.Protocol))
+	}
+	return "http"
+}
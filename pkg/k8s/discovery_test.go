@@ -0,0 +1,196 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testService(namespace, name string, serviceType corev1.ServiceType, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec:       corev1.ServiceSpec{Type: serviceType, Ports: ports},
+	}
+}
+
+func TestListInnerClusterServices(t *testing.T) {
+	grpc := "grpc"
+	clientset := fake.NewSimpleClientset(
+		// Left out: the API server, kube-* services and ExternalName services
+		testService("default", "kubernetes", corev1.ServiceTypeClusterIP, corev1.ServicePort{Name: "https", Port: 443}),
+		testService("kube-system", "kube-dns", corev1.ServiceTypeClusterIP, corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP}),
+		testService("default", "external", corev1.ServiceTypeExternalName, corev1.ServicePort{Port: 80}),
+
+		testService("default", "web", corev1.ServiceTypeClusterIP,
+			corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			corev1.ServicePort{Name: "metrics", Port: 9090, Protocol: corev1.ProtocolTCP},
+		),
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{IP: "10.244.1.5"}},
+				Ports:     []corev1.EndpointPort{{Name: "http", Port: 8080}},
+			}},
+		},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{
+				Host: "web.example.test",
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{Backend: networkingv1.IngressBackend{
+						Service: &networkingv1.IngressServiceBackend{Name: "web"},
+					}}},
+				}},
+			}}},
+		},
+
+		// Endpoints without ready addresses don't verify the service
+		testService("apps", "api", corev1.ServiceTypeClusterIP, corev1.ServicePort{Name: "grpc", Port: 50051, AppProtocol: &grpc}),
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "apps"},
+			Subsets: []corev1.EndpointSubset{{
+				NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.244.2.7"}},
+				Ports:             []corev1.EndpointPort{{Name: "grpc", Port: 50051}},
+			}},
+		},
+		testService("apps", "dns-cache", corev1.ServiceTypeClusterIP, corev1.ServicePort{Name: "dns", Port: 5353, Protocol: corev1.ProtocolUDP}),
+		testService("apps", "dashboard", corev1.ServiceTypeNodePort, corev1.ServicePort{Name: "http", Port: 8080, NodePort: 30080}),
+	)
+
+	got, err := listInnerClusterServices(context.Background(), clientset)
+	if err != nil {
+		t.Fatalf("listInnerClusterServices failed: %v", err)
+	}
+
+	want := []ServiceInfo{
+		{
+			Name:        "api",
+			Port:        50051,
+			Protocol:    "grpc",
+			Namespace:   "apps",
+			Type:        "ClusterIP",
+			Description: "api service in apps namespace (Type: ClusterIP)",
+		},
+		{
+			Name:        "dashboard",
+			Port:        8080,
+			Protocol:    "http",
+			Namespace:   "apps",
+			Type:        "NodePort",
+			NodePort:    30080,
+			Description: "dashboard service in apps namespace (Type: NodePort) | NodePort: 30080",
+		},
+		{
+			Name:        "dns-cache",
+			Port:        5353,
+			Protocol:    "udp",
+			Namespace:   "apps",
+			Type:        "ClusterIP",
+			Description: "dns-cache service in apps namespace (Type: ClusterIP)",
+		},
+		{
+			Name:         "web",
+			Port:         80,
+			Protocol:     "http",
+			Namespace:    "default",
+			Type:         "ClusterIP",
+			Verified:     true,
+			IngressHosts: []string{"web.example.test"},
+			Description:  "web service in default namespace (Type: ClusterIP) | Ingress: web.example.test ✓",
+		},
+		{
+			Name:         "web",
+			Port:         9090,
+			Protocol:     "http",
+			Namespace:    "default",
+			Type:         "ClusterIP",
+			IngressHosts: []string{"web.example.test"},
+			Description:  "web service in default namespace (Type: ClusterIP) | Ingress: web.example.test",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listInnerClusterServices =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// The dashboard offers the NodePort for services that have one
+	encoded, err := json.Marshal(got[1])
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"node_port":30080`) {
+		t.Errorf("NodePort service encodes as %s, want node_port 30080", encoded)
+	}
+	encoded, err = json.Marshal(got[0])
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if strings.Contains(string(encoded), "node_port") {
+		t.Errorf("ClusterIP service encodes as %s, want no node_port", encoded)
+	}
+}
+
+func TestListInnerClusterServicesEmpty(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testService("default", "kubernetes", corev1.ServiceTypeClusterIP, corev1.ServicePort{Name: "https", Port: 443}),
+	)
+	got, err := listInnerClusterServices(context.Background(), clientset)
+	if err != nil {
+		t.Fatalf("listInnerClusterServices failed: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("listInnerClusterServices = %+v, want no services", got)
+	}
+}
+
+func TestParsePortList(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []int
+		wantErr bool
+	}{
+		{name: "single port", raw: "8080", want: []int{8080}},
+		{name: "list keeps order", raw: "8080, 80,443", want: []int{8080, 80, 443}},
+		{name: "range", raw: "30000-30003", want: []int{30000, 30001, 30002, 30003}},
+		{name: "range of one", raw: "80-80", want: []int{80}},
+		{name: "ports and ranges", raw: "80,30000-30001,443", want: []int{80, 30000, 30001, 443}},
+		{name: "duplicates dropped", raw: "80,443,80", want: []int{80, 443}},
+		{name: "overlapping ranges", raw: "8000-8002,8001-8003", want: []int{8000, 8001, 8002, 8003}},
+		{name: "empty entries skipped", raw: ",80,,443,", want: []int{80, 443}},
+		{name: "full range", raw: "65535", want: []int{65535}},
+		{name: "reversed range", raw: "32767-30000", wantErr: true},
+		{name: "zero", raw: "0", wantErr: true},
+		{name: "above 65535", raw: "65536", wantErr: true},
+		{name: "range above 65535", raw: "65530-65536", wantErr: true},
+		{name: "negative", raw: "-80", wantErr: true},
+		{name: "not a number", raw: "http", wantErr: true},
+		{name: "open range", raw: "30000-", wantErr: true},
+		{name: "empty", raw: "", wantErr: true},
+		{name: "only separators", raw: " , ,", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePortList(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePortList(%q) = %v, want an error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePortList(%q): %v", tt.raw, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParsePortList(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
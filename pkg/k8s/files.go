@@ -0,0 +1,190 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// ShareMountPath is where the per-user NFS share is mounted in the DinD container
+const ShareMountPath = "/root/share"
+
+var (
+	// ErrFileNotFound is returned when a path does not exist in the share
+	ErrFileNotFound = errors.New("file not found")
+	// ErrOutsideShare is returned when a path resolves (e.g. through a symlink) outside the share
+	ErrOutsideShare = errors.New("path is outside the share")
+)
+
+// Exit codes of the file scripts, mapped to the errors above
+const (
+	fileExitNotFound     = 3
+	fileExitOutsideShare = 4
+)
+
+// fileGuardScript resolves "$1" (or its closest existing ancestor when it does not have to
+// exist yet) and refuses paths that leave the share through symlinks
+const fileGuardScript = `target="$1"
+[ -e "$target" ] || [ -n "$ALLOW_MISSING" ] || exit 3
+check="$target"
+while [ ! -e "$check" ]; do check=$(dirname -- "$check"); done
+real=$(realpath -- "$check" 2>/dev/null) || exit 3
+case "$real" in
+	` + ShareMountPath + `|` + ShareMountPath + `/*) ;;
+	*) exit 4 ;;
+esac
+`
+
+// FileInfo describes an entry of the share
+type FileInfo struct {
+	Name       string    `json:"name"`
+	IsDir      bool      `json:"is_dir"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// StatSharedFile returns information about a path in the share of the pod
+func (c *Client) StatSharedFile(ctx context.Context, podName, namespace, path string) (*FileInfo, error) {
+	script := fileGuardScript + `stat -c '%F|%s|%Y|%n' -- "$target"`
+	stdout, stderr, err := c.execStream(ctx, podName, namespace, "dind", []string{"sh", "-c", script, "sh", path}, nil)
+	if err != nil {
+		return nil, fileError(path, err, stderr)
+	}
+	info, ok := parseStatLine(strings.TrimRight(stdout, "\n"))
+	if !ok {
+		return nil, fmt.Errorf("unexpected stat output for %s: %q", path, stdout)
+	}
+	return info, nil
+}
+
+// ListSharedFiles lists the entries of a directory in the share of the pod
+func (c *Client) ListSharedFiles(ctx context.Context, podName, namespace, dir string) ([]FileInfo, error) {
+	script := fileGuardScript + `find "$target" -mindepth 1 -maxdepth 1 -exec stat -c '%F|%s|%Y|%n' {} +`
+	stdout, stderr, err := c.execStream(ctx, podName, namespace, "dind", []string{"sh", "-c", script, "sh", dir}, nil)
+	if err != nil {
+		return nil, fileError(dir, err, stderr)
+	}
+	files := []FileInfo{}
+	for _, line := range strings.Split(stdout, "\n") {
+		if info, ok := parseStatLine(line); ok {
+			files = append(files, *info)
+		}
+	}
+	return files, nil
+}
+
+// ReadSharedFile streams a file of the share to w
+func (c *Client) ReadSharedFile(ctx context.Context, podName, namespace, path string, w io.Writer) error {
+	script := fileGuardScript + `exec cat -- "$target"`
+	stderr, err := c.execStreamTo(ctx, podName, namespace, "dind", []string{"sh", "-c", script, "sh", path}, nil, w)
+	if err != nil {
+		return fileError(path, err, stderr)
+	}
+	return nil
+}
+
+// WriteSharedFile stores size bytes read from r at path in the share, creating parent
+// directories. The data is written to a temporary file that only replaces path once all
+// bytes have arrived, so an interrupted upload leaves any previous file untouched.
+func (c *Client) WriteSharedFile(ctx context.Context, podName, namespace, path string, size int64, r io.Reader) error {
+	script := `ALLOW_MISSING=1
+` + fileGuardScript + `mkdir -p -- "$(dirname -- "$target")" || exit 1
+tmp="$target.upload.$$"
+cat > "$tmp" || { rm -f -- "$tmp"; exit 1; }
+if [ "$(wc -c < "$tmp")" -ne "$2" ]; then
+	rm -f -- "$tmp"
+	echo "incomplete upload" >&2
+	exit 1
+fi
+mv -f -- "$tmp" "$target"`
+	_, stderr, err := c.execStream(ctx, podName, namespace, "dind", []string{"sh", "-c", script, "sh", path, strconv.FormatInt(size, 10)}, r)
+	if err != nil {
+		return fileError(path, err, stderr)
+	}
+	return nil
+}
+
+// parseStatLine parses a line of `stat -c '%F|%s|%Y|%n'` output
+func parseStatLine(line string) (*FileInfo, bool) {
+	parts := strings.SplitN(line, "|", 4)
+	if len(parts) != 4 {
+		return nil, false
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	modified, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	name := parts[3]
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return &FileInfo{
+		Name:       name,
+		IsDir:      parts[0] == "directory",
+		Size:       size,
+		ModifiedAt: time.Unix(modified, 0).UTC(),
+	}, true
+}
+
+// fileError maps the exit codes of the file scripts to ErrFileNotFound and ErrOutsideShare
+func fileError(path string, err error, stderr string) error {
+	var exitErr interface{ ExitStatus() int }
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitStatus() {
+		case fileExitNotFound:
+			return fmt.Errorf("%w: %s", ErrFileNotFound, path)
+		case fileExitOutsideShare:
+			return fmt.Errorf("%w: %s", ErrOutsideShare, path)
+		}
+	}
+	return fmt.Errorf("file operation on %s failed: %w (stderr: %s)", path, err, strings.TrimSpace(stderr))
+}
+
+// execStream runs a command in a container with optional stdin and returns its output
+func (c *Client) execStream(ctx context.Context, podName, namespace, containerName string, command []string, stdin io.Reader) (string, string, error) {
+	var stdout strings.Builder
+	stderr, err := c.execStreamTo(ctx, podName, namespace, containerName, command, stdin, &stdout)
+	return stdout.String(), stderr, err
+}
+
+// execStreamTo runs a command in a container, streaming stdin to it and its stdout to w
+func (c *Client) execStreamTo(ctx context.Context, podName, namespace, containerName string, command []string, stdin io.Reader, w io.Writer) (string, error) {
+	req := c.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+			TTY:       false,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(c.restConfig, "POST", req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to create SPDY executor for pod %s: %w", podName, err)
+	}
+
+	var stderr strings.Builder
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: w,
+		Stderr: &stderr,
+	})
+	return stderr.String(), err
+}
@@ -0,0 +1,114 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DinDImage describes the DinD image used for one Kubernetes version.
+// In DIND_IMAGE_VERSIONS_JSON an entry is either a plain tag ("k8s-1.33.0") or an object
+// {"repository": "...", "tag": "...", "digest": "sha256:..."}; repository defaults to
+// DIND_IMAGE_BASE_REPOSITORY.
+type DinDImage struct {
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// UnmarshalJSON accepts both the plain tag string and the object form
+func (i *DinDImage) UnmarshalJSON(data []byte) error {
+	var tag string
+	if err := json.Unmarshal(data, &tag); err == nil {
+		*i = DinDImage{Tag: tag}
+		return nil
+	}
+
+	type plain DinDImage
+	var img plain
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&img); err != nil {
+		return fmt.Errorf("image entry must be a tag string or {repository, tag, digest}: %w", err)
+	}
+	*i = DinDImage(img)
+	return nil
+}
+
+// Validate checks that the entry can be turned into an image reference
+func (i DinDImage) Validate() error {
+	if i.Tag == "" && i.Digest == "" {
+		return fmt.Errorf("either tag or digest is required")
+	}
+	if i.Digest != "" && !strings.HasPrefix(i.Digest, "sha256:") {
+		return fmt.Errorf("digest %q must start with sha256:", i.Digest)
+	}
+	return nil
+}
+
+// Reference builds the full image reference, e.g. repo:tag, repo@sha256:... or repo:tag@sha256:...
+func (i DinDImage) Reference(defaultRepository string) string {
+	ref := i.Repository
+	if ref == "" {
+		ref = defaultRepository
+	}
+	if i.Tag != "" {
+		ref += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		ref += "@" + i.Digest
+	}
+	return ref
+}
+
+// String returns the tag and/or digest, without the repository
+func (i DinDImage) String() string {
+	return strings.TrimLeft(i.Reference(""), ":@")
+}
+
+// ParseDinDImageVersions parses DIND_IMAGE_VERSIONS_JSON into a version -> image map
+func ParseDinDImageVersions(raw string) (map[string]DinDImage, error) {
+	versions := make(map[string]DinDImage)
+	if err := json.Unmarshal([]byte(raw), &versions); err != nil {
+		return nil, err
+	}
+	for version, img := range versions {
+		if err := img.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid image for version %s: %w", version, err)
+		}
+	}
+	return versions, nil
+}
+
+// EntrypointPreset is a named command/args override for the DinD container. Presets are
+// defined by the operator (DIND_ENTRYPOINT_PRESETS_JSON); users can only pick one by name.
+type EntrypointPreset struct {
+	Command []string `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ParseEntrypointPresets parses DIND_ENTRYPOINT_PRESETS_JSON, e.g.
+// {"overlay2": {"args": ["--storage-driver=overlay2"]}}
+func ParseEntrypointPresets(raw string) (map[string]EntrypointPreset, error) {
+	presets := make(map[string]EntrypointPreset)
+	if raw == "" {
+		return presets, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&presets); err != nil {
+		return nil, err
+	}
+	for name, preset := range presets {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid preset name %q: %s", name, strings.Join(errs, "; "))
+		}
+		if len(preset.Command) == 0 && len(preset.Args) == 0 {
+			return nil, fmt.Errorf("preset %q must set command or args", name)
+		}
+	}
+	return presets, nil
+}
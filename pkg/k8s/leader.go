@@ -0,0 +1,132 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Defaults of the leader election timing, the same as those of the Kubernetes controller manager
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// Namespace of the pod, as mounted with its service account token
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// ErrLeadershipLost is returned by RunLeaderElected when the lease could not be renewed. The
+// process should exit so it restarts as a standby with a clean state.
+var ErrLeadershipLost = errors.New("leader election lost")
+
+// LeaderElectionConfig configures RunLeaderElected. Empty fields get defaults.
+type LeaderElectionConfig struct {
+	// Name of the Lease object shared by the replicas of one controller
+	LeaseName string
+	// Namespace of the Lease; defaults to the namespace of the pod
+	LeaseNamespace string
+	// Identity of this replica; defaults to the hostname, i.e. the pod name
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// RunLeaderElected waits until this replica holds the Lease and then calls run with a context
+// that is cancelled when leadership is lost. Standbys take over once the Lease of a leader that
+// stopped renewing it expires. Returns nil when ctx is done and ErrLeadershipLost when the
+// Lease was lost while ctx was still active; in both cases only after run has returned.
+func (c *Client) RunLeaderElected(ctx context.Context, config LeaderElectionConfig, run func(ctx context.Context)) error {
+	if config.LeaseName == "" {
+		return errors.New("lease name is required")
+	}
+	if config.LeaseNamespace == "" {
+		config.LeaseNamespace = podNamespace()
+	}
+	if config.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to determine the leader election identity: %w", err)
+		}
+		config.Identity = hostname
+	}
+	if config.LeaseDuration == 0 {
+		config.LeaseDuration = DefaultLeaseDuration
+	}
+	if config.RenewDeadline == 0 {
+		config.RenewDeadline = DefaultRenewDeadline
+	}
+	if config.RetryPeriod == 0 {
+		config.RetryPeriod = DefaultRetryPeriod
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: config.LeaseName, Namespace: config.LeaseNamespace},
+		Client:     c.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+	}
+	started := make(chan struct{})
+	done := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		Name:          config.LeaseName,
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		// The Lease is not released on shutdown: a standby must not start before run has returned
+		ReleaseOnCancel: false,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				close(started)
+				defer close(done)
+				log.Printf("%s is now the leader of lease %s/%s", config.Identity, config.LeaseNamespace, config.LeaseName)
+				run(leaderCtx)
+			},
+			OnStoppedLeading: func() {
+				log.Printf("%s stopped leading lease %s/%s", config.Identity, config.LeaseNamespace, config.LeaseName)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != config.Identity {
+					log.Printf("Standing by, %s is the leader of lease %s/%s", identity, config.LeaseNamespace, config.LeaseName)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election: %w", err)
+	}
+
+	log.Printf("Waiting for leadership of lease %s/%s as %s", config.LeaseNamespace, config.LeaseName, config.Identity)
+	elector.Run(ctx)
+	// Run returns as soon as leadership ends, without waiting for run
+	select {
+	case <-started:
+		<-done
+	default:
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return ErrLeadershipLost
+}
+
+// podNamespace returns the namespace of the pod this process runs in, or "default" outside a cluster
+func podNamespace() string {
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "default"
+	}
+	if namespace := strings.TrimSpace(string(data)); namespace != "" {
+		return namespace
+	}
+	return "default"
+}
@@ -0,0 +1,378 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	// How long to wait for a port-forward to start listening
+	portForwardReadyTimeout = 10 * time.Second
+	// How long the inner cluster's kubeconfig is reused before it is read from the pod again
+	innerKubeconfigCacheTTL = 5 * time.Minute
+	// How long a probe waits for a refused or reset connection after dialing
+	probeRefusalGrace = 50 * time.Millisecond
+)
+
+// ErrNoReadyEndpoints is returned when a service of the inner cluster has no pod to forward to
+var ErrNoReadyEndpoints = errors.New("service has no ready endpoints")
+
+// PortTunnel forwards a local port on 127.0.0.1 to a port of a pod through the API server
+type PortTunnel struct {
+	LocalPort int
+	stopChan  chan struct{}
+	closeOnce sync.Once
+}
+
+// Close stops the port-forward
+func (t *PortTunnel) Close() {
+	t.closeOnce.Do(func() { close(t.stopChan) })
+}
+
+// contextDialer is spdy's dialer with the upgrade request bound to a context, so that a
+// cancelled request does not wait for an unresponsive API server
+type contextDialer struct {
+	ctx      context.Context
+	upgrader spdy.Upgrader
+	client   *http.Client
+	url      *url.URL
+}
+
+func (d *contextDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, d.url.String(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating request: %w", err)
+	}
+	return spdy.Negotiate(d.upgrader, d.client, req, protocols...)
+}
+
+// openPortTunnel starts a port-forward to podName:port using the given cluster credentials.
+// ctx bounds setting up the port-forward, not its lifetime.
+func openPortTunnel(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, podName, namespace string, port int) (*PortTunnel, error) {
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(podName).
+		SubResource("portforward")
+
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SPDY round tripper: %w", err)
+	}
+	dialer := &contextDialer{ctx: ctx, upgrader: upgrader, client: &http.Client{Transport: transport}, url: req.URL()}
+
+	tunnel := &PortTunnel{stopChan: make(chan struct{})}
+	readyChan := make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{fmt.Sprintf("0:%d", port)}, tunnel.stopChan, readyChan, io.Discard, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port-forward to %s:%d: %w", podName, port, err)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+	case err := <-errChan:
+		return nil, fmt.Errorf("port-forward to %s:%d failed: %w", podName, port, err)
+	case <-time.After(portForwardReadyTimeout):
+		tunnel.Close()
+		return nil, fmt.Errorf("port-forward to %s:%d was not ready within %v", podName, port, portForwardReadyTimeout)
+	case <-ctx.Done():
+		tunnel.Close()
+		return nil, fmt.Errorf("port-forward to %s:%d: %w", podName, port, ctx.Err())
+	}
+
+	ports, err := forwarder.GetPorts()
+	if err != nil || len(ports) == 0 {
+		tunnel.Close()
+		return nil, fmt.Errorf("failed to get local port of port-forward to %s:%d: %v", podName, port, err)
+	}
+	tunnel.LocalPort = int(ports[0].Local)
+	return tunnel, nil
+}
+
+// ServiceTunnel forwards a local port to a service of the kind cluster inside a DinD pod.
+// It chains two port-forwards: one to the inner API server through the outer cluster, and one
+// to a pod backing the service through the inner API server.
+type ServiceTunnel struct {
+	LocalPort int
+	tunnels   []*PortTunnel
+}
+
+// Close stops all port-forwards of the tunnel, innermost first
+func (t *ServiceTunnel) Close() {
+	for i := len(t.tunnels) - 1; i >= 0; i-- {
+		t.tunnels[i].Close()
+	}
+}
+
+// Probe checks that something accepts connections behind the tunnel. A successful dial counts
+// as healthy; the probe only fails when the connection is refused or reset, which it checks for
+// during a short grace period (at most probeRefusalGrace) rather than waiting for data.
+func (t *ServiceTunnel) Probe(timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(t.LocalPort)), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	grace := min(timeout, probeRefusalGrace)
+	if err := conn.SetReadDeadline(time.Now().Add(grace)); err != nil {
+		return err
+	}
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return fmt.Errorf("connection rejected by remote: %w", err)
+	}
+	return nil
+}
+
+type innerKubeconfig struct {
+	raw       []byte
+	fetchedAt time.Time
+}
+
+// OpenServiceTunnel opens a tunnel to port servicePort of the named service in the DinD pod's
+// kind cluster. Ports that are not served by a service of the inner cluster (e.g. processes
+// listening in the DinD container itself) are forwarded to the DinD pod directly.
+func (c *Client) OpenServiceTunnel(ctx context.Context, podName, namespace, serviceName string, servicePort int) (*ServiceTunnel, error) {
+	innerConfig, apiTunnel, err := c.openInnerCluster(ctx, podName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	innerClientset, err := kubernetes.NewForConfig(innerConfig)
+	if err != nil {
+		apiTunnel.Close()
+		return nil, fmt.Errorf("failed to create inner cluster client: %w", err)
+	}
+
+	backendPod, backendNamespace, backendPort, err := resolveServiceBackend(ctx, innerClientset, serviceName, servicePort)
+	if apierrors.IsNotFound(err) {
+		apiTunnel.Close()
+		direct, directErr := openPortTunnel(ctx, c.restConfig, c.clientset, podName, namespace, servicePort)
+		if directErr != nil {
+			return nil, directErr
+		}
+		return &ServiceTunnel{LocalPort: direct.LocalPort, tunnels: []*PortTunnel{direct}}, nil
+	}
+	if err != nil {
+		apiTunnel.Close()
+		return nil, err
+	}
+
+	backendTunnel, err := openPortTunnel(ctx, innerConfig, innerClientset, backendPod, backendNamespace, backendPort)
+	if err != nil {
+		apiTunnel.Close()
+		return nil, err
+	}
+	return &ServiceTunnel{LocalPort: backendTunnel.LocalPort, tunnels: []*PortTunnel{apiTunnel, backendTunnel}}, nil
+}
+
+// openInnerCluster forwards a local port to the kind API server of a DinD pod and returns
+// a REST config for the inner cluster that goes through it
+func (c *Client) openInnerCluster(ctx context.Context, podName, namespace string) (*rest.Config, *PortTunnel, error) {
+	raw, podUID, err := c.innerKubeconfigRaw(ctx, podName, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(raw)
+	if err != nil {
+		c.innerKubeconfigs.Delete(podUID)
+		return nil, nil, fmt.Errorf("invalid inner cluster kubeconfig in pod %s: %w", podName, err)
+	}
+	server, err := url.Parse(config.Host)
+	if err != nil {
+		c.innerKubeconfigs.Delete(podUID)
+		return nil, nil, fmt.Errorf("invalid inner API server address %q: %w", config.Host, err)
+	}
+	apiPort, err := strconv.Atoi(server.Port())
+	if err != nil {
+		c.innerKubeconfigs.Delete(podUID)
+		return nil, nil, fmt.Errorf("inner API server address %q has no port", config.Host)
+	}
+
+	apiTunnel, err := openPortTunnel(ctx, c.restConfig, c.clientset, podName, namespace, apiPort)
+	if err != nil {
+		c.innerKubeconfigs.Delete(podUID)
+		return nil, nil, err
+	}
+
+	// Keep verifying the API server certificate against the name it was issued for
+	if config.TLSClientConfig.ServerName == "" {
+		config.TLSClientConfig.ServerName = server.Hostname()
+	}
+	config.Host = fmt.Sprintf("https://127.0.0.1:%d", apiTunnel.LocalPort)
+	return config, apiTunnel, nil
+}
+
+// innerKubeconfigRaw returns the kubeconfig of the kind cluster in a DinD pod and the pod's UID,
+// which the kubeconfig is cached under. It is read from the pod at most once per
+// innerKubeconfigCacheTTL; a recreated pod has a new UID and is read again. Entries of pods that
+// are being deleted are dropped, and expired entries are swept whenever a new one is stored.
+func (c *Client) innerKubeconfigRaw(ctx context.Context, podName, namespace string) ([]byte, types.UID, error) {
+	pod, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get pod %s: %w", podName, err)
+	}
+	if pod.DeletionTimestamp != nil {
+		c.innerKubeconfigs.Delete(pod.UID)
+		return nil, "", fmt.Errorf("pod %s is being deleted", podName)
+	}
+	if cached, ok := c.innerKubeconfigs.Load(pod.UID); ok && time.Since(cached.(innerKubeconfig).fetchedAt) < innerKubeconfigCacheTTL {
+		return cached.(innerKubeconfig).raw, pod.UID, nil
+	}
+	stdout, stderr, err := c.execCommand(ctx, podName, namespace, "dind", []string{"kubectl", "config", "view", "--raw", "--minify"})
+	if err != nil {
+		c.innerKubeconfigs.Delete(pod.UID)
+		return nil, "", fmt.Errorf("failed to read inner cluster kubeconfig from pod %s: %w (stderr: %s)", podName, err, stderr)
+	}
+	raw := []byte(stdout)
+	c.innerKubeconfigs.Range(func(key, value interface{}) bool {
+		if time.Since(value.(innerKubeconfig).fetchedAt) >= innerKubeconfigCacheTTL {
+			c.innerKubeconfigs.Delete(key)
+		}
+		return true
+	})
+	c.innerKubeconfigs.Store(pod.UID, innerKubeconfig{raw: raw, fetchedAt: time.Now()})
+	return raw, pod.UID, nil
+}
+
+// InnerClusterKubeconfig returns a kubeconfig for the kind cluster in a DinD pod that reaches its
+// API server at https://127.0.0.1:localPort, e.g. through a port-forward to the pod. The
+// certificate is still verified against the name it was issued for. Cluster, user and context
+// are renamed to name so the kubeconfig can be merged with others. A localPort of 0 keeps the
+// inner API server's port, which is returned alongside the kubeconfig.
+func (c *Client) InnerClusterKubeconfig(ctx context.Context, podName, namespace, name string, localPort int) ([]byte, int, error) {
+	raw, podUID, err := c.innerKubeconfigRaw(ctx, podName, namespace)
+	if err != nil {
+		return nil, 0, err
+	}
+	out, apiPort, err := rewriteInnerKubeconfig(raw, podName, name, localPort)
+	if err != nil {
+		c.innerKubeconfigs.Delete(podUID)
+		return nil, 0, err
+	}
+	return out, apiPort, nil
+}
+
+// rewriteInnerKubeconfig does the rewriting for InnerClusterKubeconfig
+func rewriteInnerKubeconfig(raw []byte, podName, name string, localPort int) ([]byte, int, error) {
+	config, err := clientcmd.Load(raw)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid inner cluster kubeconfig in pod %s: %w", podName, err)
+	}
+	kubeContext, ok := config.Contexts[config.CurrentContext]
+	if !ok {
+		return nil, 0, fmt.Errorf("inner cluster kubeconfig in pod %s has no current context", podName)
+	}
+	cluster, ok := config.Clusters[kubeContext.Cluster]
+	if !ok {
+		return nil, 0, fmt.Errorf("inner cluster kubeconfig in pod %s has no cluster %q", podName, kubeContext.Cluster)
+	}
+	authInfo, ok := config.AuthInfos[kubeContext.AuthInfo]
+	if !ok {
+		return nil, 0, fmt.Errorf("inner cluster kubeconfig in pod %s has no user %q", podName, kubeContext.AuthInfo)
+	}
+
+	server, err := url.Parse(cluster.Server)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid inner API server address %q: %w", cluster.Server, err)
+	}
+	apiPort, err := strconv.Atoi(server.Port())
+	if err != nil {
+		return nil, 0, fmt.Errorf("inner API server address %q has no port", cluster.Server)
+	}
+	if localPort == 0 {
+		localPort = apiPort
+	}
+	if cluster.TLSServerName == "" {
+		cluster.TLSServerName = server.Hostname()
+	}
+	cluster.Server = fmt.Sprintf("https://127.0.0.1:%d", localPort)
+
+	kubeContext.Cluster, kubeContext.AuthInfo = name, name
+	config.Clusters = map[string]*clientcmdapi.Cluster{name: cluster}
+	config.AuthInfos = map[string]*clientcmdapi.AuthInfo{name: authInfo}
+	config.Contexts = map[string]*clientcmdapi.Context{name: kubeContext}
+	config.CurrentContext = name
+
+	out, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to serialize kubeconfig: %w", err)
+	}
+	return out, apiPort, nil
+}
+
+// resolveServiceBackend finds a ready pod behind a service and the container port that
+// servicePort maps to. Services in "default" are preferred when several namespaces have one
+// with the same name. Returns a NotFound error when no such service exists.
+func resolveServiceBackend(ctx context.Context, clientset kubernetes.Interface, serviceName string, servicePort int) (string, string, int, error) {
+	services, err := clientset.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", serviceName).String(),
+	})
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to look up service %s: %w", serviceName, err)
+	}
+
+	var service *corev1.Service
+	var port *corev1.ServicePort
+	for i := range services.Items {
+		for j := range services.Items[i].Spec.Ports {
+			if int(services.Items[i].Spec.Ports[j].Port) != servicePort {
+				continue
+			}
+			if service == nil || services.Items[i].Namespace == metav1.NamespaceDefault {
+				service, port = &services.Items[i], &services.Items[i].Spec.Ports[j]
+			}
+		}
+	}
+	if service == nil {
+		return "", "", 0, apierrors.NewNotFound(corev1.Resource("services"), serviceName)
+	}
+
+	endpoints, err := clientset.CoreV1().Endpoints(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", "", 0, fmt.Errorf("%w: %s/%s", ErrNoReadyEndpoints, service.Namespace, service.Name)
+		}
+		return "", "", 0, fmt.Errorf("failed to get endpoints of service %s/%s: %w", service.Namespace, service.Name, err)
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != port.Name {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+					return address.TargetRef.Name, address.TargetRef.Namespace, int(endpointPort.Port), nil
+				}
+			}
+		}
+	}
+	return "", "", 0, fmt.Errorf("%w: %s/%s", ErrNoReadyEndpoints, service.Namespace, service.Name)
+}
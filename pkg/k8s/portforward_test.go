@@ -0,0 +1,158 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+const testInnerKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kind-kind
+  cluster:
+    server: https://kind-control-plane:6443
+contexts:
+- name: kind-kind
+  context:
+    cluster: kind-kind
+    user: kind-kind
+current-context: kind-kind
+users:
+- name: kind-kind
+  user:
+    token: secret
+`
+
+func TestServiceTunnelProbe(t *testing.T) {
+	const timeout = 2 * time.Second
+	tests := []struct {
+		name    string
+		serve   func(conn *net.TCPConn)
+		closed  bool
+		wantErr bool
+	}{
+		{name: "silent server", serve: func(conn *net.TCPConn) {}},
+		{name: "server sends data", serve: func(conn *net.TCPConn) { conn.Write([]byte("SSH-2.0\r\n")) }},
+		{name: "connection reset", serve: func(conn *net.TCPConn) {
+			conn.SetLinger(0)
+			conn.Close()
+		}, wantErr: true},
+		{name: "nothing listening", closed: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer listener.Close()
+			tunnel := &ServiceTunnel{LocalPort: listener.Addr().(*net.TCPAddr).Port}
+			if tt.closed {
+				listener.Close()
+			} else {
+				go func() {
+					conn, err := listener.AcceptTCP()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+					tt.serve(conn)
+					time.Sleep(timeout)
+				}()
+			}
+
+			start := time.Now()
+			err = tunnel.Probe(timeout)
+			if elapsed := time.Since(start); elapsed >= timeout {
+				t.Errorf("Probe took %v, want it to return before the %v timeout", elapsed, timeout)
+			}
+			if tt.wantErr && err == nil {
+				t.Error("Probe succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Probe: %v", err)
+			}
+		})
+	}
+}
+
+func TestInnerKubeconfigCacheIsKeyedByPodUID(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "dind-0", Namespace: "playground", UID: "uid-1"}}
+	clientset := fake.NewSimpleClientset(pod)
+	client := NewClientForClientset(clientset)
+	ctx := context.Background()
+
+	client.innerKubeconfigs.Store(pod.UID, innerKubeconfig{raw: []byte(testInnerKubeconfig), fetchedAt: time.Now()})
+	out, apiPort, err := client.InnerClusterKubeconfig(ctx, "dind-0", "playground", "env", 0)
+	if err != nil {
+		t.Fatalf("InnerClusterKubeconfig: %v", err)
+	}
+	if apiPort != 6443 || !strings.Contains(string(out), "https://127.0.0.1:6443") {
+		t.Errorf("InnerClusterKubeconfig = %d, %s; want the cached kubeconfig pointing at 127.0.0.1:6443", apiPort, out)
+	}
+
+	// A kubeconfig that cannot be used is dropped rather than served until it expires
+	client.innerKubeconfigs.Store(pod.UID, innerKubeconfig{raw: []byte("current-context: missing"), fetchedAt: time.Now()})
+	if _, _, err := client.InnerClusterKubeconfig(ctx, "dind-0", "playground", "env", 0); err == nil {
+		t.Error("InnerClusterKubeconfig succeeded with an invalid kubeconfig")
+	}
+	if _, ok := client.innerKubeconfigs.Load(pod.UID); ok {
+		t.Error("invalid kubeconfig is still cached")
+	}
+
+	// A pod being deleted drops its entry
+	client.innerKubeconfigs.Store(pod.UID, innerKubeconfig{raw: []byte(testInnerKubeconfig), fetchedAt: time.Now()})
+	now := metav1.Now()
+	pod.DeletionTimestamp = &now
+	if _, err := clientset.CoreV1().Pods("playground").Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, _, err := client.InnerClusterKubeconfig(ctx, "dind-0", "playground", "env", 0); err == nil {
+		t.Error("InnerClusterKubeconfig succeeded for a pod being deleted")
+	}
+	if _, ok := client.innerKubeconfigs.Load(pod.UID); ok {
+		t.Error("kubeconfig of a pod being deleted is still cached")
+	}
+}
+
+func TestOpenPortTunnelStopsDialingWhenContextIsDone(t *testing.T) {
+	// An API server that never answers the upgrade request
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := &rest.Config{Host: server.URL}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("NewForConfig: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = openPortTunnel(ctx, config, clientset, "dind-0", "playground", 6443)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("openPortTunnel = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed >= portForwardReadyTimeout {
+		t.Errorf("openPortTunnel took %v, want it to give up with the context", elapsed)
+	}
+}
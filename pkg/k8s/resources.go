@@ -0,0 +1,130 @@
+package k8s
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// DinDResources are the requests and limits of the DinD container, as Kubernetes quantity strings
+type DinDResources struct {
+	CPURequest    string `json:"cpu_request"`
+	MemoryRequest string `json:"memory_request"`
+	CPULimit      string `json:"cpu_limit"`
+	MemoryLimit   string `json:"memory_limit"`
+}
+
+// DefaultDinDResources matches the flat sizing used before resources became configurable
+func DefaultDinDResources() DinDResources {
+	return DinDResources{CPURequest: "100m", MemoryRequest: "512Mi", CPULimit: "1000m", MemoryLimit: "2Gi"}
+}
+
+// ResourceSizing describes how the DinD container is sized for an inner cluster.
+// Base covers a single-node cluster; every additional node adds the per-node allowance
+// to the limits. Max values (optional) cap the computed limits.
+type ResourceSizing struct {
+	Base          DinDResources
+	PerNodeCPU    string
+	PerNodeMemory string
+	MaxCPU        string
+	MaxMemory     string
+}
+
+// Compute returns the DinD container resources for an inner cluster with nodeCount nodes
+func (s ResourceSizing) Compute(nodeCount int) (DinDResources, error) {
+	if nodeCount < 1 {
+		return DinDResources{}, fmt.Errorf("node count must be at least 1, got %d", nodeCount)
+	}
+
+	cpuLimit, err := scaleQuantity(s.Base.CPULimit, s.PerNodeCPU, nodeCount-1)
+	if err != nil {
+		return DinDResources{}, fmt.Errorf("cpu: %w", err)
+	}
+	memoryLimit, err := scaleQuantity(s.Base.MemoryLimit, s.PerNodeMemory, nodeCount-1)
+	if err != nil {
+		return DinDResources{}, fmt.Errorf("memory: %w", err)
+	}
+	if err := checkMax(cpuLimit, s.MaxCPU); err != nil {
+		return DinDResources{}, fmt.Errorf("cpu limit for %d node(s): %w", nodeCount, err)
+	}
+	if err := checkMax(memoryLimit, s.MaxMemory); err != nil {
+		return DinDResources{}, fmt.Errorf("memory limit for %d node(s): %w", nodeCount, err)
+	}
+
+	computed := DinDResources{
+		CPURequest:    s.Base.CPURequest,
+		MemoryRequest: s.Base.MemoryRequest,
+		CPULimit:      cpuLimit.String(),
+		MemoryLimit:   memoryLimit.String(),
+	}
+	if _, err := computed.requirements(); err != nil {
+		return DinDResources{}, err
+	}
+	return computed, nil
+}
+
+func scaleQuantity(base, perNode string, extraNodes int) (resource.Quantity, error) {
+	total, err := resource.ParseQuantity(base)
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("invalid base quantity %q: %w", base, err)
+	}
+	if extraNodes > 0 && perNode != "" {
+		step, err := resource.ParseQuantity(perNode)
+		if err != nil {
+			return resource.Quantity{}, fmt.Errorf("invalid per-node quantity %q: %w", perNode, err)
+		}
+		for i := 0; i < extraNodes; i++ {
+			total.Add(step)
+		}
+	}
+	return total, nil
+}
+
+func checkMax(value resource.Quantity, max string) error {
+	if max == "" {
+		return nil
+	}
+	maxQuantity, err := resource.ParseQuantity(max)
+	if err != nil {
+		return fmt.Errorf("invalid max quantity %q: %w", max, err)
+	}
+	if value.Cmp(maxQuantity) > 0 {
+		return fmt.Errorf("%s exceeds the maximum of %s", value.String(), maxQuantity.String())
+	}
+	return nil
+}
+
+// requirements converts the quantities into a container ResourceRequirements
+func (r DinDResources) requirements() (corev1.ResourceRequirements, error) {
+	parse := func(name, value string) (resource.Quantity, error) {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		return q, nil
+	}
+	cpuRequest, err := parse("cpu request", r.CPURequest)
+	if err != nil {
+		return corev1.ResourceRequirements{}, err
+	}
+	memoryRequest, err := parse("memory request", r.MemoryRequest)
+	if err != nil {
+		return corev1.ResourceRequirements{}, err
+	}
+	cpuLimit, err := parse("cpu limit", r.CPULimit)
+	if err != nil {
+		return corev1.ResourceRequirements{}, err
+	}
+	memoryLimit, err := parse("memory limit", r.MemoryLimit)
+	if err != nil {
+		return corev1.ResourceRequirements{}, err
+	}
+	if cpuRequest.Cmp(cpuLimit) > 0 || memoryRequest.Cmp(memoryLimit) > 0 {
+		return corev1.ResourceRequirements{}, fmt.Errorf("requests (%s, %s) must not exceed limits (%s, %s)", r.CPURequest, r.MemoryRequest, r.CPULimit, r.MemoryLimit)
+	}
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceMemory: memoryRequest, corev1.ResourceCPU: cpuRequest},
+		Limits:   corev1.ResourceList{corev1.ResourceMemory: memoryLimit, corev1.ResourceCPU: cpuLimit},
+	}, nil
+}
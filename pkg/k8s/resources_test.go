@@ -0,0 +1,41 @@
+package k8s
+
+import "testing"
+
+func TestResourceSizingCompute(t *testing.T) {
+	sizing := ResourceSizing{
+		Base:          DefaultDinDResources(),
+		PerNodeCPU:    "500m",
+		PerNodeMemory: "1Gi",
+		MaxCPU:        "2",
+		MaxMemory:     "4Gi",
+	}
+	tests := []struct {
+		name      string
+		nodeCount int
+		want      DinDResources
+		wantErr   bool
+	}{
+		{name: "single node", nodeCount: 1, want: DinDResources{CPURequest: "100m", MemoryRequest: "512Mi", CPULimit: "1", MemoryLimit: "2Gi"}},
+		{name: "control plane and two workers", nodeCount: 3, want: DinDResources{CPURequest: "100m", MemoryRequest: "512Mi", CPULimit: "2", MemoryLimit: "4Gi"}},
+		{name: "over the maximum", nodeCount: 4, wantErr: true},
+		{name: "no nodes", nodeCount: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sizing.Compute(tt.nodeCount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Compute(%d) = %+v, want an error", tt.nodeCount, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Compute(%d): %v", tt.nodeCount, err)
+			}
+			if got != tt.want {
+				t.Errorf("Compute(%d) = %+v, want %+v", tt.nodeCount, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RestartDinDPod replaces the pod of an environment's workload while keeping the workload itself,
+// its PVC and NFS mount. The StatefulSet pod is deleted and recreated by the StatefulSet controller;
+// a Deployment is rolled like `kubectl rollout restart`.
+func (c *Client) RestartDinDPod(ctx context.Context, workloadName, workloadType, namespace string, requestedAt time.Time) error {
+	if workloadType == "deployment" {
+		patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`, requestedAt.UTC().Format(time.RFC3339))
+		_, err := c.clientset.AppsV1().Deployments(namespace).Patch(ctx, workloadName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to restart deployment %s: %w", workloadName, err)
+		}
+		return nil
+	}
+
+	podName := fmt.Sprintf("%s-0", workloadName)
+	err := c.clientset.CoreV1().Pods(namespace).Delete(ctx, podName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod %s: %w", podName, err)
+	}
+	return nil
+}
+
+// RestartedPodReady returns the workload's pod once a pod created at or after since is running
+// and not being deleted. The returned name is empty while the replacement is not ready yet.
+func (c *Client) RestartedPodReady(ctx context.Context, workloadName, workloadType, namespace string, since time.Time) (string, error) {
+	// Pod timestamps have second precision
+	since = since.Truncate(time.Second)
+
+	var candidates []corev1.Pod
+	if workloadType == "deployment" {
+		podList, err := c.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: c.instanceSelector(fmt.Sprintf("app=k8s-playground-dep,owner-id=%s", workloadName)),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to list pods for workload %s: %w", workloadName, err)
+		}
+		candidates = podList.Items
+	} else {
+		pod, err := c.clientset.CoreV1().Pods(namespace).Get(ctx, fmt.Sprintf("%s-0", workloadName), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get pod of workload %s: %w", workloadName, err)
+		}
+		candidates = []corev1.Pod{*pod}
+	}
+
+	for _, pod := range candidates {
+		if pod.DeletionTimestamp != nil || pod.CreationTimestamp.Time.Before(since) {
+			continue
+		}
+		running, err := c.IsPodRunning(ctx, pod.Name, namespace)
+		if err != nil {
+			return "", err
+		}
+		if running {
+			return pod.Name, nil
+		}
+	}
+	return "", nil
+}
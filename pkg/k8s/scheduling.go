@@ -0,0 +1,90 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DinDScheduling constrains which nodes DinD pods are scheduled onto, e.g. to keep the
+// privileged playground pods on dedicated nodes. The zero value adds no constraints.
+type DinDScheduling struct {
+	NodeSelector map[string]string
+	Tolerations  []corev1.Toleration
+}
+
+// ParseNodeSelector parses a node selector (DIND_NODE_SELECTOR) given as a JSON object of
+// label keys to values. An empty string yields no selector.
+func ParseNodeSelector(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var selector map[string]string
+	if err := json.Unmarshal([]byte(raw), &selector); err != nil {
+		return nil, fmt.Errorf("invalid node selector JSON: %w", err)
+	}
+	for key, value := range selector {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid node selector key %q: %v", key, errs)
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid node selector value %q for %s: %v", value, key, errs)
+		}
+	}
+	return selector, nil
+}
+
+// ParseTolerations parses tolerations (DIND_TOLERATIONS) given as a JSON array in the form of
+// the pod spec's tolerations field. An empty string yields no tolerations.
+func ParseTolerations(raw string) ([]corev1.Toleration, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var tolerations []corev1.Toleration
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&tolerations); err != nil {
+		return nil, fmt.Errorf("invalid tolerations JSON: %w", err)
+	}
+	for i, toleration := range tolerations {
+		switch toleration.Operator {
+		case "", corev1.TolerationOpEqual:
+		case corev1.TolerationOpExists:
+			if toleration.Value != "" {
+				return nil, fmt.Errorf("toleration %d: value must be empty with operator Exists", i)
+			}
+		default:
+			return nil, fmt.Errorf("toleration %d: invalid operator %q", i, toleration.Operator)
+		}
+		switch toleration.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("toleration %d: invalid effect %q", i, toleration.Effect)
+		}
+		if toleration.Key == "" && toleration.Operator != corev1.TolerationOpExists {
+			return nil, fmt.Errorf("toleration %d: an empty key requires operator Exists", i)
+		}
+	}
+	return tolerations, nil
+}
+
+// SetDinDScheduling sets the node selector and tolerations of newly created StatefulSets and Deployments
+func (c *Client) SetDinDScheduling(scheduling DinDScheduling) {
+	c.dindScheduling = scheduling
+}
+
+// applyDinDScheduling copies the configured scheduling constraints into a pod spec
+func (c *Client) applyDinDScheduling(spec *corev1.PodSpec) {
+	if len(c.dindScheduling.NodeSelector) > 0 {
+		spec.NodeSelector = make(map[string]string, len(c.dindScheduling.NodeSelector))
+		for key, value := range c.dindScheduling.NodeSelector {
+			spec.NodeSelector[key] = value
+		}
+	}
+	for _, toleration := range c.dindScheduling.Tolerations {
+		spec.Tolerations = append(spec.Tolerations, *toleration.DeepCopy())
+	}
+}
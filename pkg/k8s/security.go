@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var capabilityPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// DefaultDinDSecurityContext is applied to the DinD container when no template is configured.
+// Docker-in-Docker needs a privileged container.
+func DefaultDinDSecurityContext() *corev1.SecurityContext {
+	privileged := true
+	return &corev1.SecurityContext{Privileged: &privileged}
+}
+
+// ParseSecurityContext parses a container security context template (the JSON form of
+// corev1.SecurityContext, e.g. DIND_SECURITY_CONTEXT_JSON) and validates it.
+// An empty string yields the default. Privileged defaults to true when the template omits it.
+func ParseSecurityContext(raw string) (*corev1.SecurityContext, error) {
+	if raw == "" {
+		return DefaultDinDSecurityContext(), nil
+	}
+
+	sc := &corev1.SecurityContext{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(sc); err != nil {
+		return nil, fmt.Errorf("invalid security context JSON: %w", err)
+	}
+	if sc.Privileged == nil {
+		privileged := true
+		sc.Privileged = &privileged
+	}
+
+	if *sc.Privileged && sc.AllowPrivilegeEscalation != nil && !*sc.AllowPrivilegeEscalation {
+		return nil, fmt.Errorf("allowPrivilegeEscalation cannot be false when privileged is true")
+	}
+	if sc.Capabilities != nil {
+		for _, capability := range append(append([]corev1.Capability{}, sc.Capabilities.Add...), sc.Capabilities.Drop...) {
+			if capability != "ALL" && !capabilityPattern.MatchString(string(capability)) {
+				return nil, fmt.Errorf("invalid capability %q", capability)
+			}
+		}
+	}
+	if sc.SeccompProfile != nil {
+		switch sc.SeccompProfile.Type {
+		case corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined:
+			if sc.SeccompProfile.LocalhostProfile != nil {
+				return nil, fmt.Errorf("seccompProfile.localhostProfile is only allowed with type Localhost")
+			}
+		case corev1.SeccompProfileTypeLocalhost:
+			if sc.SeccompProfile.LocalhostProfile == nil || *sc.SeccompProfile.LocalhostProfile == "" {
+				return nil, fmt.Errorf("seccompProfile.localhostProfile is required with type Localhost")
+			}
+		default:
+			return nil, fmt.Errorf("invalid seccompProfile.type %q", sc.SeccompProfile.Type)
+		}
+	}
+	if sc.RunAsNonRoot != nil && *sc.RunAsNonRoot {
+		return nil, fmt.Errorf("runAsNonRoot is not supported for the DinD container")
+	}
+	if sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem {
+		log.Printf("Warning: readOnlyRootFilesystem is set on the DinD container; the Docker daemon may fail to start")
+	}
+	return sc, nil
+}
+
+// SetDinDSecurityContext sets the security context template applied to the DinD container
+// of newly created StatefulSets and Deployments.
+func (c *Client) SetDinDSecurityContext(sc *corev1.SecurityContext) {
+	c.dindSecurityContext = sc
+}
+
+// dindContainerSecurityContext returns a copy of the configured template for use in a pod spec
+func (c *Client) dindContainerSecurityContext() *corev1.SecurityContext {
+	if c.dindSecurityContext == nil {
+		return DefaultDinDSecurityContext()
+	}
+	return c.dindSecurityContext.DeepCopy()
+}
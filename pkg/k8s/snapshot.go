@@ -0,0 +1,96 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Snapshots are stored on the per-user NFS share so that any later environment of the
+// same owner can restore them. Layout of /root/share/.snapshots/<snapshot-id>/:
+//
+//	manifest.json  - source environment, creation time and the list of saved images
+//	images.tar     - `docker save` of every tagged image in the DinD daemon
+//	home.tar.gz    - contents of /root (excluding the share itself), e.g. kubeconfig and user files
+//
+// Restoring loads the images back into the DinD daemon, pushes them into the Kind
+// cluster when one is running, and unpacks the home directory.
+const (
+	snapshotBaseDir = "/root/share/.snapshots"
+	snapshotTimeout = 10 * time.Minute
+)
+
+var snapshotIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidateSnapshotID checks that a snapshot ID is safe to use as a directory name
+func ValidateSnapshotID(snapshotID string) error {
+	if !snapshotIDPattern.MatchString(snapshotID) {
+		return fmt.Errorf("invalid snapshot id: %q", snapshotID)
+	}
+	return nil
+}
+
+// CreateSnapshot saves the DinD container's images and home directory to the NFS share
+func (c *Client) CreateSnapshot(ctx context.Context, podName, namespace, snapshotID, sourceEnvironmentID string) error {
+	if err := ValidateSnapshotID(snapshotID); err != nil {
+		return err
+	}
+	execCtx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	script := fmt.Sprintf(`set -e
+DIR=%s/%s
+mkdir -p "$DIR"
+IMAGES=$(docker images --filter dangling=false --format '{{.Repository}}:{{.Tag}}' | grep -v '<none>' || true)
+if [ -n "$IMAGES" ]; then
+	docker save -o "$DIR/images.tar" $IMAGES
+fi
+tar --exclude=./share -czf "$DIR/home.tar.gz" -C /root .
+printf '{"snapshot_id":"%%s","source_environment_id":"%%s","created_at":"%%s","images":"%%s"}\n' \
+	%s %s "$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ)" "$(echo $IMAGES)" > "$DIR/manifest.json"
+`, snapshotBaseDir, snapshotID, snapshotID, sourceEnvironmentID)
+
+	log.Printf("Creating snapshot %s from pod %s", snapshotID, podName)
+	_, stderr, err := c.execCommand(execCtx, podName, namespace, "dind", []string{"bash", "-c", script})
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot %s in pod %s: %w (stderr: %s)", snapshotID, podName, err, stderr)
+	}
+	return nil
+}
+
+// RestoreSnapshot loads a previously created snapshot into the DinD container
+func (c *Client) RestoreSnapshot(ctx context.Context, podName, namespace, snapshotID string) error {
+	if err := ValidateSnapshotID(snapshotID); err != nil {
+		return err
+	}
+	execCtx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	script := fmt.Sprintf(`set -e
+DIR=%s/%s
+if [ ! -f "$DIR/manifest.json" ]; then
+	echo "snapshot not found" >&2
+	exit 2
+fi
+if [ -f "$DIR/images.tar" ]; then
+	LOADED=$(docker load -i "$DIR/images.tar")
+	if command -v kind >/dev/null 2>&1 && [ -n "$(kind get clusters 2>/dev/null)" ]; then
+		for IMAGE in $(echo "$LOADED" | sed -n 's/^Loaded image: //p'); do
+			kind load docker-image "$IMAGE" >/dev/null 2>&1 || echo "warning: failed to load $IMAGE into kind" >&2
+		done
+	fi
+fi
+if [ -f "$DIR/home.tar.gz" ]; then
+	tar -xzf "$DIR/home.tar.gz" -C /root
+fi
+`, snapshotBaseDir, snapshotID)
+
+	log.Printf("Restoring snapshot %s into pod %s", snapshotID, podName)
+	_, stderr, err := c.execCommand(execCtx, podName, namespace, "dind", []string{"bash", "-c", script})
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot %s into pod %s: %w (stderr: %s)", snapshotID, podName, err, stderr)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// How long applying all manifests of a template may take
+const templateApplyTimeout = 5 * time.Minute
+
+// EnvironmentTemplate is a named set of manifests applied to the inner cluster of a new
+// environment. Templates are defined by the operator (ENVIRONMENT_TEMPLATES_JSON); users can only
+// pick one by name. Each manifest is either an http(s) URL or inline YAML/JSON, applied in order.
+type EnvironmentTemplate struct {
+	Description string   `json:"description,omitempty"`
+	Manifests   []string `json:"manifests"`
+}
+
+// ParseEnvironmentTemplates parses ENVIRONMENT_TEMPLATES_JSON, e.g.
+// {"ingress-lab": {"description": "NGINX ingress", "manifests": ["https://example.com/ingress.yaml"]}}
+func ParseEnvironmentTemplates(raw string) (map[string]EnvironmentTemplate, error) {
+	templates := make(map[string]EnvironmentTemplate)
+	if raw == "" {
+		return templates, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&templates); err != nil {
+		return nil, err
+	}
+	for name, template := range templates {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid template name %q: %s", name, strings.Join(errs, "; "))
+		}
+		if len(template.Manifests) == 0 {
+			return nil, fmt.Errorf("template %q has no manifests", name)
+		}
+		for i, manifest := range template.Manifests {
+			if strings.TrimSpace(manifest) == "" {
+				return nil, fmt.Errorf("manifest %d of template %q is empty", i, name)
+			}
+			if isManifestURL(manifest) {
+				if u, err := url.Parse(manifest); err != nil || u.Host == "" {
+					return nil, fmt.Errorf("manifest %d of template %q is not a valid URL", i, name)
+				}
+			}
+		}
+	}
+	return templates, nil
+}
+
+func isManifestURL(manifest string) bool {
+	return strings.HasPrefix(manifest, "https://") || strings.HasPrefix(manifest, "http://")
+}
+
+// ApplyTemplate applies the template's manifests to the inner cluster of a DinD pod with kubectl.
+// Every manifest is attempted; the returned error describes those that failed.
+func (c *Client) ApplyTemplate(ctx context.Context, podName, namespace string, template EnvironmentTemplate) error {
+	applyCtx, cancel := context.WithTimeout(ctx, templateApplyTimeout)
+	defer cancel()
+
+	var errs []error
+	for i, manifest := range template.Manifests {
+		var output strings.Builder
+		var err error
+		if isManifestURL(manifest) {
+			err = c.StreamExec(applyCtx, namespace, podName, "dind", []string{"kubectl", "apply", "-f", manifest}, nil, &output)
+		} else {
+			err = c.StreamExec(applyCtx, namespace, podName, "dind", []string{"kubectl", "apply", "-f", "-"}, strings.NewReader(manifest), &output)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("manifest %d: %w", i, err))
+			continue
+		}
+		log.Printf("Applied manifest %d in pod %s: %s", i, podName, strings.TrimSpace(output.String()))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,109 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// dindWorkloadSelector matches the StatefulSets and Deployments created for environments
+const dindWorkloadSelector = "app=k8s-playground,component=dind-environment"
+
+// InstanceLabel is set to INSTANCE_ID on every resource an app instance creates, so several
+// instances can share a namespace without touching each other's environments
+const InstanceLabel = "playground-instance"
+
+// ValidateInstanceID checks that an instance ID (INSTANCE_ID) can be used as a label value
+func ValidateInstanceID(id string) error {
+	if errs := validation.IsValidLabelValue(id); len(errs) > 0 {
+		return fmt.Errorf("invalid instance ID %q: %s", id, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// SetInstanceID sets the instance ID labelled onto new resources and required by the client's
+// label selectors. Without one, the client only sees resources that carry no instance label.
+func (c *Client) SetInstanceID(id string) {
+	c.instanceID = id
+}
+
+// withInstance adds the instance label to a label map
+func (c *Client) withInstance(labels map[string]string) map[string]string {
+	if c.instanceID != "" {
+		labels[InstanceLabel] = c.instanceID
+	}
+	return labels
+}
+
+// instanceSelector restricts a label selector to the resources of this instance
+func (c *Client) instanceSelector(selector string) string {
+	if c.instanceID == "" {
+		return selector + ",!" + InstanceLabel
+	}
+	return selector + "," + InstanceLabel + "=" + c.instanceID
+}
+
+// DinDWorkload is a StatefulSet or Deployment created for an environment
+type DinDWorkload struct {
+	Name      string
+	Namespace string
+	Type      string // "statefulset" or "deployment", as in QueueItem.WorkloadType
+	CreatedAt time.Time
+}
+
+// ListDinDWorkloads lists the environment workloads in namespace, or in all namespaces
+// when namespace is empty
+func (c *Client) ListDinDWorkloads(ctx context.Context, namespace string) ([]DinDWorkload, error) {
+	opts := metav1.ListOptions{LabelSelector: c.instanceSelector(dindWorkloadSelector)}
+
+	statefulSets, err := c.clientset.AppsV1().StatefulSets(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DinD statefulsets: %w", err)
+	}
+	deployments, err := c.clientset.AppsV1().Deployments(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DinD deployments: %w", err)
+	}
+
+	workloads := make([]DinDWorkload, 0, len(statefulSets.Items)+len(deployments.Items))
+	for _, sts := range statefulSets.Items {
+		workloads = append(workloads, DinDWorkload{
+			Name:      sts.Name,
+			Namespace: sts.Namespace,
+			Type:      "statefulset",
+			CreatedAt: sts.CreationTimestamp.Time,
+		})
+	}
+	for _, dep := range deployments.Items {
+		workloads = append(workloads, DinDWorkload{
+			Name:      dep.Name,
+			Namespace: dep.Namespace,
+			Type:      "deployment",
+			CreatedAt: dep.CreationTimestamp.Time,
+		})
+	}
+	return workloads, nil
+}
+
+// DinDWorkloadExists reports whether the workload of an environment exists, including while it is
+// being deleted
+func (c *Client) DinDWorkloadExists(ctx context.Context, workloadName, workloadType, namespace string) (bool, error) {
+	var err error
+	if workloadType == "deployment" {
+		_, err = c.clientset.AppsV1().Deployments(namespace).Get(ctx, workloadName, metav1.GetOptions{})
+	} else {
+		_, err = c.clientset.AppsV1().StatefulSets(namespace).Get(ctx, workloadName, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get workload %s: %w", workloadName, err)
+	}
+	return true, nil
+}
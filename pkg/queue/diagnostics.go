@@ -0,0 +1,138 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	diagnosticsKeyPrefix = "diagnostics:"
+	// diagnosticsIndexKey is a sorted set of environment IDs scored by capture time
+	diagnosticsIndexKey = "diagnostics_index"
+)
+
+// DiagnosticEvent is a Kubernetes event recorded in a diagnostics bundle
+type DiagnosticEvent struct {
+	Type     string    `json:"type"`
+	Reason   string    `json:"reason"`
+	Message  string    `json:"message"`
+	Count    int32     `json:"count,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// DiagnosticsBundle is a post-mortem of an environment that failed to provision,
+// kept after the workload itself has been removed
+type DiagnosticsBundle struct {
+	EnvironmentID string            `json:"environment_id"`
+	Owner         string            `json:"owner"`
+	K8sVersion    string            `json:"k8s_version"`
+	Image         string            `json:"image,omitempty"`
+	Namespace     string            `json:"namespace"`
+	WorkloadName  string            `json:"workload_name,omitempty"`
+	PodName       string            `json:"pod_name,omitempty"`
+	PodPhase      string            `json:"pod_phase,omitempty"`
+	Reason        string            `json:"reason"`
+	Events        []DiagnosticEvent `json:"events,omitempty"`
+	ContainerLogs map[string]string `json:"container_logs,omitempty"`
+	// CaptureErrors lists the artifacts that could not be collected
+	CaptureErrors []string  `json:"capture_errors,omitempty"`
+	CapturedAt    time.Time `json:"captured_at"`
+}
+
+// DiagnosticsSummary is the listing form of a DiagnosticsBundle
+type DiagnosticsSummary struct {
+	EnvironmentID string    `json:"environment_id"`
+	Owner         string    `json:"owner"`
+	K8sVersion    string    `json:"k8s_version"`
+	Reason        string    `json:"reason"`
+	CapturedAt    time.Time `json:"captured_at"`
+}
+
+// SaveDiagnostics stores a bundle for retention, replacing any earlier bundle of the same environment
+func (r *RedisQueue) SaveDiagnostics(ctx context.Context, bundle *DiagnosticsBundle, retention time.Duration) error {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to marshal diagnostics bundle: %w", err)
+	}
+
+	pipe := r.Client.TxPipeline()
+	pipe.Set(ctx, diagnosticsKeyPrefix+bundle.EnvironmentID, data, retention)
+	pipe.ZAdd(ctx, diagnosticsIndexKey, &redis.Z{Score: float64(bundle.CapturedAt.Unix()), Member: bundle.EnvironmentID})
+	pipe.ZRemRangeByScore(ctx, diagnosticsIndexKey, "-inf", strconv.FormatInt(time.Now().Add(-retention).Unix(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to save diagnostics for %s: %w", bundle.EnvironmentID, err)
+	}
+	return nil
+}
+
+// ErrDiagnosticsNotFound is returned by GetDiagnostics when no bundle is retained for the environment
+var ErrDiagnosticsNotFound = errors.New("diagnostics not found")
+
+// GetDiagnostics returns the bundle captured for an environment
+func (r *RedisQueue) GetDiagnostics(ctx context.Context, environmentID string) (*DiagnosticsBundle, error) {
+	data, err := r.Client.Get(ctx, diagnosticsKeyPrefix+environmentID).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("%w: %s", ErrDiagnosticsNotFound, environmentID)
+		}
+		return nil, fmt.Errorf("failed to get diagnostics for %s: %w", environmentID, err)
+	}
+
+	var bundle DiagnosticsBundle
+	if err := json.Unmarshal([]byte(data), &bundle); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal diagnostics for %s: %w", environmentID, err)
+	}
+	return &bundle, nil
+}
+
+// ListDiagnostics returns summaries of the retained bundles, newest first.
+// Index entries whose bundle has expired are dropped along the way.
+func (r *RedisQueue) ListDiagnostics(ctx context.Context) ([]DiagnosticsSummary, error) {
+	ids, err := r.Client.ZRevRange(ctx, diagnosticsIndexKey, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list diagnostics: %w", err)
+	}
+	if len(ids) == 0 {
+		return []DiagnosticsSummary{}, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = diagnosticsKeyPrefix + id
+	}
+	values, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load diagnostics: %w", err)
+	}
+
+	summaries := make([]DiagnosticsSummary, 0, len(ids))
+	var expired []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			expired = append(expired, ids[i])
+			continue
+		}
+		var bundle DiagnosticsBundle
+		if err := json.Unmarshal([]byte(data), &bundle); err != nil {
+			continue // Skip invalid bundles
+		}
+		summaries = append(summaries, DiagnosticsSummary{
+			EnvironmentID: bundle.EnvironmentID,
+			Owner:         bundle.Owner,
+			K8sVersion:    bundle.K8sVersion,
+			Reason:        bundle.Reason,
+			CapturedAt:    bundle.CapturedAt,
+		})
+	}
+	if len(expired) > 0 {
+		r.Client.ZRem(ctx, diagnosticsIndexKey, expired...)
+	}
+	return summaries, nil
+}
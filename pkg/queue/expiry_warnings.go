@@ -0,0 +1,32 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ExpiryWarningChannel is the pub/sub channel on which imminent expiry of an item is announced
+const ExpiryWarningChannel = "k8s_playground_expiry_warnings"
+
+// ExpiryWarning is published on ExpiryWarningChannel when an item is about to be collected
+type ExpiryWarning struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PublishExpiryWarning announces that an item will expire at its ExpiresAt
+func (r *RedisQueue) PublishExpiryWarning(ctx context.Context, item *QueueItem) error {
+	data, err := json.Marshal(ExpiryWarning{ID: item.ID, ExpiresAt: item.ExpiresAt})
+	if err != nil {
+		return fmt.Errorf("failed to marshal expiry warning: %w", err)
+	}
+	return r.Client.Publish(ctx, ExpiryWarningChannel, data).Err()
+}
+
+// SubscribeExpiryWarnings delivers expiry warnings until ctx is cancelled. Like status events,
+// warnings published while the subscription is reconnecting are missed.
+func (r *RedisQueue) SubscribeExpiryWarnings(ctx context.Context) <-chan ExpiryWarning {
+	return subscribeEvents[ExpiryWarning](ctx, r, ExpiryWarningChannel)
+}
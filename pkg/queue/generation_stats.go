@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	generationDurationsKey   = "generation_durations"
+	generationParallelismKey = "generation_parallelism"
+	// generationDurationSamples is how many recent generations the average is taken over
+	generationDurationSamples = 20
+)
+
+// GenerationStats summarizes recent generations, for estimating how long pending items wait
+type GenerationStats struct {
+	// Average time from claiming an item to it becoming available
+	AverageDuration time.Duration
+	// Number of generations the average is based on, 0 if none was recorded yet
+	Samples int
+	// How many items the generator provisions at once, 0 if unknown
+	Parallelism int
+}
+
+// RecordGenerationDuration records how long a successful generation took, keeping only the most
+// recent ones
+func (r *RedisQueue) RecordGenerationDuration(ctx context.Context, d time.Duration) error {
+	pipe := r.Client.TxPipeline()
+	pipe.LPush(ctx, generationDurationsKey, d.Milliseconds())
+	pipe.LTrim(ctx, generationDurationsKey, 0, generationDurationSamples-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record generation duration: %w", err)
+	}
+	return nil
+}
+
+// SetGenerationParallelism records how many items the generator provisions at once
+func (r *RedisQueue) SetGenerationParallelism(ctx context.Context, parallelism int) error {
+	if err := r.Client.Set(ctx, generationParallelismKey, parallelism, 0).Err(); err != nil {
+		return fmt.Errorf("failed to record generation parallelism: %w", err)
+	}
+	return nil
+}
+
+// GetGenerationStats returns the average of the recently recorded generation durations and the
+// generator's parallelism
+func (r *RedisQueue) GetGenerationStats(ctx context.Context) (GenerationStats, error) {
+	var stats GenerationStats
+	durations, err := r.Client.LRange(ctx, generationDurationsKey, 0, -1).Result()
+	if err != nil {
+		return stats, fmt.Errorf("failed to get generation durations: %w", err)
+	}
+	var total int64
+	for _, raw := range durations {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			continue
+		}
+		total += ms
+		stats.Samples++
+	}
+	if stats.Samples > 0 {
+		stats.AverageDuration = time.Duration(total/int64(stats.Samples)) * time.Millisecond
+	}
+
+	parallelism, err := r.Client.Get(ctx, generationParallelismKey).Int()
+	if err != nil && err != redis.Nil {
+		return stats, fmt.Errorf("failed to get generation parallelism: %w", err)
+	}
+	stats.Parallelism = parallelism
+	return stats, nil
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	historyKeyPrefix = "history:"
+	// MaxHistoryEvents bounds the history kept per environment; older events are dropped
+	MaxHistoryEvents = 50
+	// historyRetention expires the history of items that were removed without DeleteItem
+	historyRetention = 30 * 24 * time.Hour
+)
+
+// Types of HistoryEvent
+const (
+	HistoryEventStatus    = "status"
+	HistoryEventConnected = "connected"
+)
+
+// HistoryEvent is an entry of an environment's lifecycle timeline
+type HistoryEvent struct {
+	Time   time.Time   `json:"time"`
+	Type   string      `json:"type"`
+	Status QueueStatus `json:"status,omitempty"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+// appendHistoryScript appends an event to the history list and trims it. Status events are
+// skipped when the latest status event already has the same status, since UpdateItem is also
+// used for writes that do not change the status.
+var appendHistoryScript = redis.NewScript(`
+local event = cjson.decode(ARGV[1])
+if event.type == "status" then
+	local events = redis.call("LRANGE", KEYS[1], 0, -1)
+	for i = #events, 1, -1 do
+		local previous = cjson.decode(events[i])
+		if previous.type == "status" then
+			if previous.status == event.status then
+				return 0
+			end
+			break
+		end
+	end
+end
+redis.call("RPUSH", KEYS[1], ARGV[1])
+redis.call("LTRIM", KEYS[1], -tonumber(ARGV[2]), -1)
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// RecordHistory appends an event to an environment's history
+func (r *RedisQueue) RecordHistory(ctx context.Context, environmentID string, event HistoryEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal history event: %w", err)
+	}
+	err = appendHistoryScript.Run(ctx, r.Client, []string{historyKeyPrefix + environmentID},
+		string(data), MaxHistoryEvents, historyRetention.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to record history of %s: %w", environmentID, err)
+	}
+	return nil
+}
+
+// recordStatusHistory adds the item's current status to its history. Like the status
+// announcement it is best-effort: the item itself has already been written.
+func (r *RedisQueue) recordStatusHistory(ctx context.Context, item *QueueItem) {
+	event := HistoryEvent{Time: item.StatusUpdatedAt, Type: HistoryEventStatus, Status: item.Status}
+	if item.Status == StatusError {
+		event.Detail = item.ErrorMessage
+	}
+	_ = r.RecordHistory(ctx, item.ID, event)
+}
+
+// GetHistory returns an environment's history, oldest event first
+func (r *RedisQueue) GetHistory(ctx context.Context, environmentID string) ([]HistoryEvent, error) {
+	entries, err := r.Client.LRange(ctx, historyKeyPrefix+environmentID, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history of %s: %w", environmentID, err)
+	}
+	events := make([]HistoryEvent, 0, len(entries))
+	for _, entry := range entries {
+		var event HistoryEvent
+		if err := json.Unmarshal([]byte(entry), &event); err != nil {
+			continue // Skip invalid entries
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const rateLimitKeyPrefix = "rate_limit:"
+
+// tokenBucketScript atomically refills the bucket for the elapsed time and takes one token.
+// Returns {allowed (0/1), milliseconds until the next token is available}.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1]) or capacity
+local ts = tonumber(data[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate) + 1000)
+return {allowed, wait}
+`)
+
+// TakeToken takes one token from the named bucket, which holds up to capacity tokens and
+// refills completely over window. When the bucket is empty it returns false and how long
+// until a token becomes available.
+func (r *RedisQueue) TakeToken(ctx context.Context, bucket string, capacity int, window time.Duration) (bool, time.Duration, error) {
+	if capacity <= 0 || window <= 0 {
+		return true, 0, nil
+	}
+	ratePerMs := float64(capacity) / float64(window.Milliseconds())
+	result, err := tokenBucketScript.Run(ctx, r.Client, []string{rateLimitKeyPrefix + bucket},
+		capacity, ratePerMs, time.Now().UnixMilli()).Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take token from bucket %s: %w", bucket, err)
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket result for %s: %v", bucket, result)
+	}
+	allowed, _ := result[0].(int64)
+	waitMs, _ := result[1].(int64)
+	return allowed == 1, time.Duration(waitMs) * time.Millisecond, nil
+}
@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTakeTokenLimitsBurst(t *testing.T) {
+	const capacity, burst = 5, 20
+	const window = time.Second
+	q, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	// A script creating in a loop: all requests arrive at once
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed, denied := 0, 0
+	for range burst {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, wait, err := q.TakeToken(ctx, "create:alice", capacity, window)
+			if err != nil {
+				t.Errorf("TakeToken: %v", err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if ok {
+				allowed++
+				return
+			}
+			denied++
+			if wait <= 0 || wait > window/capacity {
+				t.Errorf("denied with retry after %v, want within (0, %v]", wait, window/capacity)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != capacity || denied != burst-capacity {
+		t.Fatalf("burst of %d: %d allowed, %d denied; want %d allowed", burst, allowed, denied, capacity)
+	}
+
+	// Other owners have their own bucket
+	if ok, _, err := q.TakeToken(ctx, "create:bob", capacity, window); err != nil || !ok {
+		t.Errorf("TakeToken for another owner = %v, %v; want allowed", ok, err)
+	}
+
+	// One token is back after window/capacity, but not a second one
+	time.Sleep(window/capacity + 50*time.Millisecond)
+	if ok, _, err := q.TakeToken(ctx, "create:alice", capacity, window); err != nil || !ok {
+		t.Errorf("TakeToken after refill = %v, %v; want allowed", ok, err)
+	}
+	if ok, _, err := q.TakeToken(ctx, "create:alice", capacity, window); err != nil || ok {
+		t.Errorf("second TakeToken after refill = %v, %v; want denied", ok, err)
+	}
+}
+
+func TestTakeTokenUnlimited(t *testing.T) {
+	q, mr := newTestQueue(t)
+	ctx := context.Background()
+	for range 100 {
+		if ok, _, err := q.TakeToken(ctx, "create:alice", 0, time.Minute); err != nil || !ok {
+			t.Fatalf("TakeToken without a limit = %v, %v; want allowed", ok, err)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("keys = %v, want no bucket without a limit", keys)
+	}
+}
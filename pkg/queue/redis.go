@@ -3,7 +3,9 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -12,18 +14,42 @@ import (
 
 const (
 	QueueKey = "k8s_playground_queue"
+
+	heartbeatKeyPrefix = "environment_heartbeat:"
+	activityKeyPrefix  = "environment_activity:"
+	tombstoneKeyPrefix = "queue_tombstone:"
+
+	// HeartbeatTTL is how long a session heartbeat keeps an environment marked as in use
+	HeartbeatTTL = 90 * time.Second
+	// activityRetention bounds how long the last-activity timestamp is kept
+	activityRetention = 7 * 24 * time.Hour
+	// DefaultTerminatedItemTTL is how long a terminated item stays in the queue when nothing else
+	// removes it, unless TERMINATED_ITEM_TTL is set
+	DefaultTerminatedItemTTL = 24 * time.Hour
 )
 
 type RedisQueue struct {
 	Client *redis.Client
+
+	terminatedItemTTL time.Duration
 }
 
+// NewRedisQueue connects to Redis. TERMINATED_ITEM_TTL is read here rather than by one controller,
+// since every process reading the queue leaves expired terminated items out.
 func NewRedisQueue(redisURL string) (*RedisQueue, error) {
 	opts, err := redis.ParseURL(redisURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
 	}
 
+	terminatedItemTTL := DefaultTerminatedItemTTL
+	if raw := os.Getenv("TERMINATED_ITEM_TTL"); raw != "" {
+		terminatedItemTTL, err = time.ParseDuration(raw)
+		if err != nil || terminatedItemTTL < 0 {
+			return nil, fmt.Errorf("invalid TERMINATED_ITEM_TTL: %s", raw)
+		}
+	}
+
 	client := redis.NewClient(opts)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -33,27 +59,37 @@ func NewRedisQueue(redisURL string) (*RedisQueue, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	return &RedisQueue{Client: client}, nil
+	return &RedisQueue{Client: client, terminatedItemTTL: terminatedItemTTL}, nil
 }
 
 func (r *RedisQueue) AddItem(ctx context.Context, item *QueueItem) error {
 	if item.ID == "" {
 		item.ID = uuid.New().String()
 	}
+	if item.CreatedAt.IsZero() {
+		item.CreatedAt = time.Now()
+	}
 
 	data, err := json.Marshal(item)
 	if err != nil {
 		return fmt.Errorf("failed to marshal queue item: %w", err)
 	}
 
-	return r.Client.HSet(ctx, QueueKey, item.ID, data).Err()
+	if err := r.Client.HSet(ctx, QueueKey, item.ID, data).Err(); err != nil {
+		return err
+	}
+	r.recordStatusHistory(ctx, item)
+	return nil
 }
 
+// ErrItemNotFound is returned (wrapped) by GetItem when no item has the ID
+var ErrItemNotFound = errors.New("item not found")
+
 func (r *RedisQueue) GetItem(ctx context.Context, id string) (*QueueItem, error) {
 	data, err := r.Client.HGet(ctx, QueueKey, id).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, fmt.Errorf("item not found")
+			return nil, fmt.Errorf("%w: %s", ErrItemNotFound, id)
 		}
 		return nil, fmt.Errorf("failed to get queue item: %w", err)
 	}
@@ -62,19 +98,188 @@ func (r *RedisQueue) GetItem(ctx context.Context, id string) (*QueueItem, error)
 	if err := json.Unmarshal([]byte(data), &item); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal queue item: %w", err)
 	}
+	item.backfillCreatedAt()
 
 	return &item, nil
 }
 
+// ErrConflict is returned (wrapped) by UpdateItemIfUnchanged and TransitionItem when the item
+// was modified since it was read
+var ErrConflict = errors.New("item was modified concurrently")
+
+// How often TransitionItem re-reads an item that keeps being modified before giving up
+const maxTransitionAttempts = 3
+
+// compareAndSetItemScript stores an item only if the stored copy still has the expected version,
+// writing the tombstone of a terminated item in the same step.
+// Returns 1 when stored, 0 on a version mismatch and -1 when the item no longer exists.
+var compareAndSetItemScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if not current then
+	return -1
+end
+local version = cjson.decode(current)['version'] or 0
+if version ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+if tonumber(ARGV[4]) > 0 then
+	redis.call('SET', KEYS[2], ARGV[5], 'PX', ARGV[4])
+end
+return 1
+`)
+
+// UpdateItem stores the item, overwriting whatever was stored (last writer wins). Moving an item
+// to StatusTerminated or StatusDryRunTerminated also writes an expiring tombstone key; once it
+// expires the item is no longer returned by GetAllItems and PurgeExpiredTerminated deletes it.
 func (r *RedisQueue) UpdateItem(ctx context.Context, item *QueueItem) error {
 	item.StatusUpdatedAt = time.Now()
+	item.Version++
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queue item: %w", err)
+	}
+
+	if !item.IsTerminated() || r.terminatedItemTTL <= 0 {
+		if err := r.Client.HSet(ctx, QueueKey, item.ID, data).Err(); err != nil {
+			return err
+		}
+		r.recordStatusHistory(ctx, item)
+		r.publishStatus(ctx, item)
+		return nil
+	}
+
+	pipe := r.Client.TxPipeline()
+	pipe.HSet(ctx, QueueKey, item.ID, data)
+	pipe.Set(ctx, tombstoneKeyPrefix+item.ID, item.StatusUpdatedAt.Unix(), r.terminatedItemTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	r.recordStatusHistory(ctx, item)
+	r.publishStatus(ctx, item)
+	return nil
+}
+
+// UpdateItemIfUnchanged stores the item only if the stored copy was not modified since item was
+// read, so a status change based on a stale read cannot overwrite a concurrent one. Returns an
+// error wrapping ErrConflict when it was modified and ErrItemNotFound when it was deleted; item
+// is left as it was in both cases.
+func (r *RedisQueue) UpdateItemIfUnchanged(ctx context.Context, item *QueueItem) error {
+	readVersion, readUpdatedAt := item.Version, item.StatusUpdatedAt
+	item.StatusUpdatedAt = time.Now()
+	item.Version = readVersion + 1
+	restore := func() {
+		item.Version, item.StatusUpdatedAt = readVersion, readUpdatedAt
+	}
 
 	data, err := json.Marshal(item)
 	if err != nil {
+		restore()
 		return fmt.Errorf("failed to marshal queue item: %w", err)
 	}
+	var tombstoneTTL int64
+	if item.IsTerminated() && r.terminatedItemTTL > 0 {
+		tombstoneTTL = r.terminatedItemTTL.Milliseconds()
+	}
+
+	result, err := compareAndSetItemScript.Run(ctx, r.Client, []string{QueueKey, tombstoneKeyPrefix + item.ID},
+		item.ID, readVersion, string(data), tombstoneTTL, item.StatusUpdatedAt.Unix()).Int()
+	if err != nil {
+		restore()
+		return fmt.Errorf("failed to update queue item: %w", err)
+	}
+	switch result {
+	case 0:
+		restore()
+		return fmt.Errorf("%w: %s", ErrConflict, item.ID)
+	case -1:
+		restore()
+		return fmt.Errorf("%w: %s", ErrItemNotFound, item.ID)
+	}
+	r.recordStatusHistory(ctx, item)
+	r.publishStatus(ctx, item)
+	return nil
+}
+
+// TransitionItem applies change to item and stores it with UpdateItemIfUnchanged. When the item
+// was modified meanwhile but still has the status it was read with, change is applied to the
+// re-read item and the update retried; if its status changed, an error wrapping ErrConflict is
+// returned. item is only updated once the change was stored, so change should set every field
+// the caller wants to keep from its own copy.
+func (r *RedisQueue) TransitionItem(ctx context.Context, item *QueueItem, change func(*QueueItem)) error {
+	candidate := *item
+	for attempt := 1; ; attempt++ {
+		change(&candidate)
+		err := r.UpdateItemIfUnchanged(ctx, &candidate)
+		if err == nil {
+			*item = candidate
+			return nil
+		}
+		if !errors.Is(err, ErrConflict) || attempt == maxTransitionAttempts {
+			return err
+		}
+
+		current, err := r.GetItem(ctx, item.ID)
+		if err != nil {
+			return err
+		}
+		if current.Status != item.Status {
+			return fmt.Errorf("%w: item %s is now %s", ErrConflict, item.ID, current.Status)
+		}
+		candidate = *current
+	}
+}
+
+// claimItemScript moves an item from one status to another if it still has the first one,
+// editing the item's JSON in place. Items have no list fields, which cjson could not tell apart
+// from objects when re-encoding. Returns the updated JSON, or nil if the item is gone or has
+// another status.
+var claimItemScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if not current then
+	return false
+end
+local item = cjson.decode(current)
+if item['status'] ~= ARGV[2] then
+	return false
+end
+item['status'] = ARGV[3]
+item['status_updated_at'] = ARGV[4]
+item['version'] = (item['version'] or 0) + 1
+local data = cjson.encode(item)
+redis.call('HSET', KEYS[1], ARGV[1], data)
+return data
+`)
 
-	return r.Client.HSet(ctx, QueueKey, item.ID, data).Err()
+// ClaimPendingItem atomically moves the item from StatusPending to StatusGenerating, so only one
+// generator worker or replica can pick it up. Returns the claimed item and true, or false if the
+// item is no longer pending (or no longer exists).
+func (r *RedisQueue) ClaimPendingItem(ctx context.Context, id string) (*QueueItem, bool, error) {
+	now := time.Now()
+	data, err := claimItemScript.Run(ctx, r.Client, []string{QueueKey},
+		id, string(StatusPending), string(StatusGenerating), now.Format(time.RFC3339Nano)).Text()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim queue item %s: %w", id, err)
+	}
+
+	var item QueueItem
+	if err := json.Unmarshal([]byte(data), &item); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal claimed queue item: %w", err)
+	}
+	item.backfillCreatedAt()
+	r.recordStatusHistory(ctx, &item)
+	r.publishStatus(ctx, &item)
+	return &item, true, nil
+}
+
+// SetTerminatedItemTTL sets how long terminated items are kept before they expire from the
+// queue on their own, as a safety net for when the collector is not running. 0 disables expiry.
+func (r *RedisQueue) SetTerminatedItemTTL(ttl time.Duration) {
+	r.terminatedItemTTL = ttl
 }
 
 func (r *RedisQueue) GetAllItems(ctx context.Context) ([]*QueueItem, error) {
@@ -84,17 +289,93 @@ func (r *RedisQueue) GetAllItems(ctx context.Context) ([]*QueueItem, error) {
 	}
 
 	items := make([]*QueueItem, 0, len(data))
+	var terminated []*QueueItem
 	for _, itemData := range data {
 		var item QueueItem
 		if err := json.Unmarshal([]byte(itemData), &item); err != nil {
 			continue // Skip invalid items
 		}
+		item.backfillCreatedAt()
+		if item.IsTerminated() && r.terminatedItemTTL > 0 {
+			terminated = append(terminated, &item)
+			continue
+		}
 		items = append(items, &item)
 	}
 
+	if len(terminated) > 0 {
+		kept, _ := r.splitExpiredTerminated(ctx, terminated)
+		items = append(items, kept...)
+	}
+
 	return items, nil
 }
 
+// PurgeExpiredTerminated deletes terminated items whose tombstone has expired, along with their
+// status history, and returns how many were deleted. GetAllItems already leaves them out.
+func (r *RedisQueue) PurgeExpiredTerminated(ctx context.Context) (int, error) {
+	if r.terminatedItemTTL <= 0 {
+		return 0, nil
+	}
+	data, err := r.Client.HGetAll(ctx, QueueKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get all queue items: %w", err)
+	}
+	var terminated []*QueueItem
+	for _, itemData := range data {
+		var item QueueItem
+		if err := json.Unmarshal([]byte(itemData), &item); err != nil {
+			continue
+		}
+		if item.IsTerminated() {
+			terminated = append(terminated, &item)
+		}
+	}
+	if len(terminated) == 0 {
+		return 0, nil
+	}
+
+	_, expired := r.splitExpiredTerminated(ctx, terminated)
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(expired))
+	pipe := r.Client.Pipeline()
+	for i, item := range expired {
+		ids[i] = item.ID
+		pipe.Del(ctx, historyKeyPrefix+item.ID)
+	}
+	pipe.HDel(ctx, QueueKey, ids...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to purge expired terminated items: %w", err)
+	}
+	return len(expired), nil
+}
+
+// splitExpiredTerminated separates terminated items whose tombstone has expired from the rest.
+// Items terminated before tombstones existed have none; they expire once StatusUpdatedAt is
+// older than the TTL. If the tombstones cannot be checked, none are considered expired.
+func (r *RedisQueue) splitExpiredTerminated(ctx context.Context, terminated []*QueueItem) (kept, expired []*QueueItem) {
+	pipe := r.Client.Pipeline()
+	exists := make([]*redis.IntCmd, len(terminated))
+	for i, item := range terminated {
+		exists[i] = pipe.Exists(ctx, tombstoneKeyPrefix+item.ID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return terminated, nil
+	}
+
+	kept = make([]*QueueItem, 0, len(terminated))
+	for i, item := range terminated {
+		if exists[i].Val() == 0 && time.Since(item.StatusUpdatedAt) > r.terminatedItemTTL {
+			expired = append(expired, item)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept, expired
+}
+
 func (r *RedisQueue) GetItemsByStatus(ctx context.Context, status QueueStatus) ([]*QueueItem, error) {
 	allItems, err := r.GetAllItems(ctx)
 	if err != nil {
@@ -127,8 +408,72 @@ func (r *RedisQueue) GetItemsByOwner(ctx context.Context, owner string) ([]*Queu
 	return filteredItems, nil
 }
 
+// GetItemsByStatusAndOwner returns the owner's items in the given status
+func (r *RedisQueue) GetItemsByStatusAndOwner(ctx context.Context, status QueueStatus, owner string) ([]*QueueItem, error) {
+	return r.GetItemsByStatusesAndOwner(ctx, []QueueStatus{status}, owner)
+}
+
+// GetItemsByStatusesAndOwner returns the owner's items whose status is any of statuses,
+// in a single pass over the queue. An empty owner matches every owner, and no statuses
+// match every status.
+func (r *RedisQueue) GetItemsByStatusesAndOwner(ctx context.Context, statuses []QueueStatus, owner string) ([]*QueueItem, error) {
+	allItems, err := r.GetAllItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[QueueStatus]bool, len(statuses))
+	for _, status := range statuses {
+		wanted[status] = true
+	}
+
+	var filteredItems []*QueueItem
+	for _, item := range allItems {
+		if (len(wanted) == 0 || wanted[item.Status]) && (owner == "" || item.Owner == owner) {
+			filteredItems = append(filteredItems, item)
+		}
+	}
+
+	return filteredItems, nil
+}
+
 func (r *RedisQueue) DeleteItem(ctx context.Context, id string) error {
-	return r.Client.HDel(ctx, QueueKey, id).Err()
+	pipe := r.Client.TxPipeline()
+	pipe.HDel(ctx, QueueKey, id)
+	pipe.Del(ctx, tombstoneKeyPrefix+id)
+	pipe.Del(ctx, historyKeyPrefix+id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RecordActivity refreshes the environment's heartbeat and last-activity timestamp.
+// The heartbeat key expires after HeartbeatTTL so dead sessions drop out on their own.
+func (r *RedisQueue) RecordActivity(ctx context.Context, environmentID string) error {
+	now := time.Now()
+	pipe := r.Client.Pipeline()
+	pipe.Set(ctx, heartbeatKeyPrefix+environmentID, now.Unix(), HeartbeatTTL)
+	pipe.Set(ctx, activityKeyPrefix+environmentID, now.Unix(), activityRetention)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to record activity for %s: %w", environmentID, err)
+	}
+	return nil
+}
+
+// GetActivity returns the last recorded activity time (zero if none) and whether a live heartbeat exists.
+func (r *RedisQueue) GetActivity(ctx context.Context, environmentID string) (time.Time, bool, error) {
+	pipe := r.Client.Pipeline()
+	heartbeatCmd := pipe.Exists(ctx, heartbeatKeyPrefix+environmentID)
+	activityCmd := pipe.Get(ctx, activityKeyPrefix+environmentID)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return time.Time{}, false, fmt.Errorf("failed to get activity for %s: %w", environmentID, err)
+	}
+
+	var lastActivity time.Time
+	if unix, err := activityCmd.Int64(); err == nil {
+		lastActivity = time.Unix(unix, 0)
+	}
+	return lastActivity, heartbeatCmd.Val() > 0, nil
 }
 
 func (r *RedisQueue) Close() error {
@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestQueue(t *testing.T) (*RedisQueue, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	q, err := NewRedisQueue("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q, mr
+}
+
+func TestNewRedisQueueReadsTerminatedItemTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        string
+		wantPurged bool
+	}{
+		{name: "default", ttl: "", wantPurged: false},
+		{name: "shorter", ttl: "1m", wantPurged: true},
+		{name: "disabled", ttl: "0", wantPurged: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TERMINATED_ITEM_TTL", tt.ttl)
+			q, _ := newTestQueue(t)
+			ctx := context.Background()
+			// Terminated an hour ago, without a tombstone
+			item := &QueueItem{ID: "terminated", Status: StatusTerminated, StatusUpdatedAt: time.Now().Add(-time.Hour)}
+			if err := q.AddItem(ctx, item); err != nil {
+				t.Fatalf("AddItem: %v", err)
+			}
+
+			items, err := q.GetAllItems(ctx)
+			if err != nil {
+				t.Fatalf("GetAllItems: %v", err)
+			}
+			if purged := len(items) == 0; purged != tt.wantPurged {
+				t.Errorf("purged = %v, want %v", purged, tt.wantPurged)
+			}
+		})
+	}
+}
+
+func TestNewRedisQueueRejectsInvalidTerminatedItemTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	for _, ttl := range []string{"soon", "-1h"} {
+		t.Setenv("TERMINATED_ITEM_TTL", ttl)
+		if _, err := NewRedisQueue("redis://" + mr.Addr()); err == nil {
+			t.Errorf("NewRedisQueue accepted TERMINATED_ITEM_TTL=%q", ttl)
+		}
+	}
+}
+
+func TestTerminatedItemsArePurgedOnceTombstoneExpires(t *testing.T) {
+	for _, status := range []QueueStatus{StatusTerminated, StatusDryRunTerminated, StatusShutdown} {
+		t.Run(string(status), func(t *testing.T) {
+			q, mr := newTestQueue(t)
+			q.SetTerminatedItemTTL(10 * time.Millisecond)
+			ctx := context.Background()
+			item := &QueueItem{ID: "item", Status: StatusShutdown}
+			if err := q.AddItem(ctx, item); err != nil {
+				t.Fatalf("AddItem: %v", err)
+			}
+			item.Status = status
+			if err := q.UpdateItem(ctx, item); err != nil {
+				t.Fatalf("UpdateItem: %v", err)
+			}
+			wantPurged := status != StatusShutdown
+			if hasTombstone := mr.Exists(tombstoneKeyPrefix + item.ID); hasTombstone != wantPurged {
+				t.Errorf("tombstone written = %v, want %v", hasTombstone, wantPurged)
+			}
+
+			mr.FastForward(time.Second)
+			time.Sleep(20 * time.Millisecond)
+			items, err := q.GetAllItems(ctx)
+			if err != nil {
+				t.Fatalf("GetAllItems: %v", err)
+			}
+			if hidden := len(items) == 0; hidden != wantPurged {
+				t.Errorf("left out of GetAllItems = %v, want %v", hidden, wantPurged)
+			}
+			// Reading leaves the queue alone; purging is the collector's job
+			if !mr.Exists(QueueKey) {
+				t.Fatal("GetAllItems deleted the item")
+			}
+
+			purged, err := q.PurgeExpiredTerminated(ctx)
+			if err != nil {
+				t.Fatalf("PurgeExpiredTerminated: %v", err)
+			}
+			wantCount := 0
+			if wantPurged {
+				wantCount = 1
+			}
+			if purged != wantCount {
+				t.Errorf("PurgeExpiredTerminated = %d, want %d", purged, wantCount)
+			}
+			if stored := mr.Exists(QueueKey); stored == wantPurged {
+				t.Errorf("item stored after purge = %v, want %v", stored, !wantPurged)
+			}
+		})
+	}
+}
+
+func TestGetItemsByStatusesAndOwner(t *testing.T) {
+	q, _ := newTestQueue(t)
+	ctx := context.Background()
+	for _, item := range []*QueueItem{
+		{ID: "alice-pending", Owner: "alice", Status: StatusPending},
+		{ID: "alice-available", Owner: "alice", Status: StatusAvailable},
+		{ID: "alice-shutdown", Owner: "alice", Status: StatusShutdown},
+		{ID: "bob-available", Owner: "bob", Status: StatusAvailable},
+	} {
+		if err := q.AddItem(ctx, item); err != nil {
+			t.Fatalf("AddItem: %v", err)
+		}
+	}
+	tests := []struct {
+		name     string
+		statuses []QueueStatus
+		owner    string
+		want     []string
+	}{
+		{name: "statuses of an owner", statuses: []QueueStatus{StatusPending, StatusAvailable}, owner: "alice", want: []string{"alice-available", "alice-pending"}},
+		{name: "status of every owner", statuses: []QueueStatus{StatusAvailable}, want: []string{"alice-available", "bob-available"}},
+		{name: "every status of an owner", owner: "bob", want: []string{"bob-available"}},
+		{name: "everything", want: []string{"alice-available", "alice-pending", "alice-shutdown", "bob-available"}},
+		{name: "no match", statuses: []QueueStatus{StatusError}, owner: "alice", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := q.GetItemsByStatusesAndOwner(ctx, tt.statuses, tt.owner)
+			if err != nil {
+				t.Fatalf("GetItemsByStatusesAndOwner: %v", err)
+			}
+			var got []string
+			for _, item := range items {
+				got = append(got, item.ID)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("GetItemsByStatusesAndOwner(%v, %q) = %v, want %v", tt.statuses, tt.owner, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// sessionKeyKey holds the cookie signing key generated by the first app-controller started
+// without SESSION_KEY
+const sessionKeyKey = "app_session_key"
+
+// LoadOrStoreSessionKey returns the session key stored in Redis, storing candidate first if none
+// is. Replicas starting at the same time agree on a single key since only the first SETNX wins.
+// Returns whether candidate was stored.
+func (r *RedisQueue) LoadOrStoreSessionKey(ctx context.Context, candidate string) (string, bool, error) {
+	stored, err := r.Client.SetNX(ctx, sessionKeyKey, candidate, 0).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to store session key: %w", err)
+	}
+	if stored {
+		return candidate, true, nil
+	}
+	key, err := r.Client.Get(ctx, sessionKeyKey).Result()
+	if err == redis.Nil {
+		return "", false, fmt.Errorf("session key disappeared from Redis")
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load session key: %w", err)
+	}
+	return key, false, nil
+}
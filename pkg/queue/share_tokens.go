@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	shareTokenKeyPrefix = "share_token:"
+	// shareTokenIndexPrefix + environment ID is a sorted set of that environment's tokens scored by expiry
+	shareTokenIndexPrefix = "share_tokens:"
+)
+
+// ShareToken grants read-only access to the terminal output of an environment until it expires or is revoked
+type ShareToken struct {
+	Token         string    `json:"token"`
+	EnvironmentID string    `json:"environment_id"`
+	Owner         string    `json:"owner"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// CreateShareToken issues a new random share token for an environment, valid for ttl
+func (r *RedisQueue) CreateShareToken(ctx context.Context, environmentID, owner string, ttl time.Duration) (*ShareToken, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate share token: %w", err)
+	}
+	now := time.Now()
+	token := &ShareToken{
+		Token:         hex.EncodeToString(raw),
+		EnvironmentID: environmentID,
+		Owner:         owner,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal share token: %w", err)
+	}
+
+	indexKey := shareTokenIndexPrefix + environmentID
+	pipe := r.Client.TxPipeline()
+	pipe.Set(ctx, shareTokenKeyPrefix+token.Token, data, ttl)
+	pipe.ZAdd(ctx, indexKey, &redis.Z{Score: float64(token.ExpiresAt.Unix()), Member: token.Token})
+	pipe.ZRemRangeByScore(ctx, indexKey, "-inf", strconv.FormatInt(now.Unix(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to save share token for %s: %w", environmentID, err)
+	}
+
+	// Let the index expire with its longest-lived token
+	if latest, err := r.Client.ZRevRangeWithScores(ctx, indexKey, 0, 0).Result(); err == nil && len(latest) > 0 {
+		r.Client.ExpireAt(ctx, indexKey, time.Unix(int64(latest[0].Score), 0))
+	}
+	return token, nil
+}
+
+// GetShareToken returns a token that has neither expired nor been revoked
+func (r *RedisQueue) GetShareToken(ctx context.Context, token string) (*ShareToken, error) {
+	data, err := r.Client.Get(ctx, shareTokenKeyPrefix+token).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, fmt.Errorf("share token not found")
+		}
+		return nil, fmt.Errorf("failed to get share token: %w", err)
+	}
+	var shareToken ShareToken
+	if err := json.Unmarshal([]byte(data), &shareToken); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal share token: %w", err)
+	}
+	return &shareToken, nil
+}
+
+// ListShareTokens returns the valid tokens of an environment, soonest to expire first
+func (r *RedisQueue) ListShareTokens(ctx context.Context, environmentID string) ([]*ShareToken, error) {
+	tokens, err := r.Client.ZRangeByScore(ctx, shareTokenIndexPrefix+environmentID, &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list share tokens for %s: %w", environmentID, err)
+	}
+
+	result := make([]*ShareToken, 0, len(tokens))
+	for _, token := range tokens {
+		shareToken, err := r.GetShareToken(ctx, token)
+		if err != nil {
+			continue // Expired or revoked in the meantime
+		}
+		result = append(result, shareToken)
+	}
+	return result, nil
+}
+
+// RevokeShareToken invalidates a token of an environment
+func (r *RedisQueue) RevokeShareToken(ctx context.Context, environmentID, token string) error {
+	pipe := r.Client.TxPipeline()
+	pipe.Del(ctx, shareTokenKeyPrefix+token)
+	pipe.ZRem(ctx, shareTokenIndexPrefix+environmentID, token)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to revoke share token for %s: %w", environmentID, err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// StatusChannel is the pub/sub channel on which every item update is announced
+const StatusChannel = "k8s_playground_status"
+
+// StatusEvent is published on StatusChannel whenever an item is written by UpdateItem
+type StatusEvent struct {
+	ID     string      `json:"id"`
+	Status QueueStatus `json:"status"`
+}
+
+// publishStatus announces an item's current status. Subscribers treat events as hints and
+// re-read the item when they need more, so a lost publish is not an error.
+func (r *RedisQueue) publishStatus(ctx context.Context, item *QueueItem) {
+	data, err := json.Marshal(StatusEvent{ID: item.ID, Status: item.Status})
+	if err != nil {
+		return
+	}
+	r.Client.Publish(ctx, StatusChannel, data)
+}
+
+// SubscribeStatus delivers the status events of all items until ctx is cancelled. The
+// subscription reconnects on its own if the connection to Redis is lost; events published
+// in the meantime are missed.
+func (r *RedisQueue) SubscribeStatus(ctx context.Context) <-chan StatusEvent {
+	return subscribeEvents[StatusEvent](ctx, r, StatusChannel)
+}
+
+// subscribeEvents delivers the JSON events published on channel until ctx is cancelled,
+// skipping messages that do not decode
+func subscribeEvents[T any](ctx context.Context, r *RedisQueue, channel string) <-chan T {
+	pubsub := r.Client.Subscribe(ctx, channel)
+	events := make(chan T, 64)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event T
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events
+}
@@ -1,6 +1,9 @@
 package queue
 
-import "time"
+import (
+	"sort"
+	"time"
+)
 
 type QueueStatus string
 
@@ -9,8 +12,13 @@ const (
 	StatusGenerating QueueStatus = "generating"
 	StatusError      QueueStatus = "error"
 	StatusAvailable  QueueStatus = "available"
+	// StatusRestarting: the pod is being replaced at the owner's request; the generator sets the item
+	// back to available once the new pod is running
+	StatusRestarting QueueStatus = "restarting"
 	StatusShutdown   QueueStatus = "shutdown"
 	StatusTerminated QueueStatus = "terminated"
+	// StatusDryRunTerminated: a killer running with DRY_RUN handled the shutdown without deleting the workload
+	StatusDryRunTerminated QueueStatus = "dry_run_terminated"
 )
 
 type QueueItem struct {
@@ -21,18 +29,110 @@ type QueueItem struct {
 	StatusUpdatedAt time.Time   `json:"status_updated_at"`
 	PodID           string      `json:"pod_id,omitempty"` // This will hold the StatefulSet or Deployment name
 	ExpiresAt       time.Time   `json:"expires_at"`
+	CreatedAt       time.Time   `json:"created_at"` // When the item was added to the queue, see backfillCreatedAt
 	ID              string      `json:"id"`
 	DisplayName     string      `json:"display_name,omitempty"`
 	// ★ ワークロードのタイプ ("statefulset" or "deployment") を追加
 	WorkloadType string `json:"workload_type,omitempty"`
+	// Cost allocation metadata (team, project, cost-center, ...) applied as labels/annotations on the workload
+	CostAllocation map[string]string `json:"cost_allocation,omitempty"`
+	// Snapshot to restore into the new environment before it becomes available
+	FromSnapshot string `json:"from_snapshot,omitempty"`
+	// Number of times the item has been retried after entering the error state
+	RetryCount int `json:"retry_count,omitempty"`
+	// Errored workloads are kept for post-mortem until this time (see ERROR_QUARANTINE_PERIOD in the collector)
+	QuarantineUntil *time.Time `json:"quarantine_until,omitempty"`
+	// Resources allocated to the DinD container, computed by the generator
+	Resources *ResourceAllocation `json:"resources,omitempty"`
+	// Named DinD command/args preset (see DIND_ENTRYPOINT_PRESETS_JSON)
+	EntrypointPreset string `json:"entrypoint_preset,omitempty"`
+	// Named set of manifests applied once the inner cluster is ready (see ENVIRONMENT_TEMPLATES_JSON)
+	Template string `json:"template,omitempty"`
+	// Namespace the workload runs in; empty means the controllers' default NAMESPACE
+	Namespace string `json:"namespace,omitempty"`
+	// When the current restart was requested; pods created before it belong to the old incarnation
+	RestartRequestedAt *time.Time `json:"restart_requested_at,omitempty"`
+	// When the owner was warned that the environment is about to expire (see EXPIRY_WARNING_WINDOW in the collector)
+	WarnedAt *time.Time `json:"warned_at,omitempty"`
+	// Incremented by every update; UpdateItemIfUnchanged only writes over the version it read
+	Version int64 `json:"version,omitempty"`
+}
+
+// ResourceAllocation records the requests and limits given to an environment's DinD container
+type ResourceAllocation struct {
+	CPURequest    string `json:"cpu_request"`
+	MemoryRequest string `json:"memory_request"`
+	CPULimit      string `json:"cpu_limit"`
+	MemoryLimit   string `json:"memory_limit"`
+}
+
+// legacyItemLifetime is the lifetime assumed for items stored before CreatedAt was recorded, the
+// app-controller's default environment lifetime at the time
+const legacyItemLifetime = 24 * time.Hour
+
+// backfillCreatedAt derives CreatedAt for items stored before it was recorded: ExpiresAt minus
+// the default lifetime, but never later than the last status change (an extended lifetime
+// would otherwise move it forward). The derived value is persisted by the item's next update.
+func (q *QueueItem) backfillCreatedAt() {
+	if !q.CreatedAt.IsZero() {
+		return
+	}
+	q.CreatedAt = q.ExpiresAt.Add(-legacyItemLifetime)
+	if !q.StatusUpdatedAt.IsZero() && q.StatusUpdatedAt.Before(q.CreatedAt) {
+		q.CreatedAt = q.StatusUpdatedAt
+	}
 }
 
 func (q *QueueItem) IsExpired() bool {
 	return time.Now().After(q.ExpiresAt)
 }
 
+// IsActive reports whether the item currently occupies a slot in the owner's quota
+func (q *QueueItem) IsActive() bool {
+	return q.Status == StatusGenerating || q.Status == StatusAvailable || q.Status == StatusRestarting
+}
+
+// MaxRetries bounds how many times an errored or stuck environment is sent back to the generator
+const MaxRetries = 3
+
+// NamespaceOr returns the item's namespace, or defaultNamespace for items created before namespaces were per item
+func (q *QueueItem) NamespaceOr(defaultNamespace string) string {
+	if q.Namespace != "" {
+		return q.Namespace
+	}
+	return defaultNamespace
+}
+
+// WorkloadName returns the name of the DinD workload the generator creates for the item. PodID
+// is only recorded once provisioning finishes, so this is the name to use before then.
+func (q *QueueItem) WorkloadName() string {
+	return "k8s-playground-" + q.ID[:min(8, len(q.ID))]
+}
+
+// IsTerminated reports whether the item's shutdown was handled, including by a killer running with
+// DRY_RUN. Terminated items are kept for a while, then deleted.
+func (q *QueueItem) IsTerminated() bool {
+	return q.Status == StatusTerminated || q.Status == StatusDryRunTerminated
+}
+
+// SortByCreation sorts items in the order pending items are served: oldest first, and by ID
+// among items created at the same time
+func SortByCreation(items []*QueueItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+}
+
+// IsQuarantined reports whether the item's workload must be kept for inspection
+func (q *QueueItem) IsQuarantined() bool {
+	return q.QuarantineUntil != nil && time.Now().Before(*q.QuarantineUntil)
+}
+
 func (q *QueueItem) ShouldBeCollected() bool {
-	terminalStates := []QueueStatus{StatusShutdown, StatusTerminated, StatusError}
+	terminalStates := []QueueStatus{StatusShutdown, StatusTerminated, StatusDryRunTerminated, StatusError}
 	for _, state := range terminalStates {
 		if q.Status == state {
 			return false // Already in a terminal state or being processed for shutdown
@@ -1,9 +1,11 @@
 // web/static/app.js
 
 let environments = [];
+let queuePositions = {}; // Position in line of pending environments, keyed by ID
 let activeSessions = new Map();
 let currentEnvId = null;
 let availableK8sVersions = []; // ★ 利用可能なK8sバージョンを保持する配列
+let k8sVersionDetails = {}; // Image and default/deprecated flags of each version, keyed by version
 let currentStatusFilter = 'all'; // ★ フィルタの現在の状態を保持する変数を追加
 
 // K8s version loading optimization
@@ -79,7 +81,7 @@ async function loadK8sVersionsWithRetry(maxRetries = 3, retryDelay = 1000) {
     
     for (let attempt = 1; attempt <= maxRetries; attempt++) {
         try {
-            const response = await fetch('/api/k8s-versions', {
+            const response = await fetch('/api/k8s-versions/detailed', {
                 headers: {
                     'Cache-Control': 'no-cache'
                 }
@@ -90,7 +92,10 @@ async function loadK8sVersionsWithRetry(maxRetries = 3, retryDelay = 1000) {
             }
             
             const data = await response.json();
-            const versions = data.versions || [];
+            const details = {};
+            (data.versions || []).forEach(info => { details[info.version] = info; });
+            k8sVersionDetails = details;
+            const versions = Object.keys(details);
             
             // 自然順ソート (例: "1.28", "1.9" -> "1.9", "1.28")
             versions.sort((a, b) => {
@@ -154,6 +159,16 @@ async function debugRefreshK8sVersions() {
     await loadAvailableK8sVersions(true);
 }
 
+// Labels a version in the dropdowns with its flags; the newest one is marked (Latest)
+function k8sVersionLabel(version, index) {
+    const details = k8sVersionDetails[version] || {};
+    const labels = [];
+    if (index === 0) labels.push('Latest');
+    if (details.default) labels.push('Default');
+    if (details.deprecated) labels.push('Deprecated');
+    return labels.length > 0 ? ` (${labels.join(', ')})` : '';
+}
+
 // ★ K8sバージョンドロップダウンを動的に生成する関数
 function populateK8sVersionDropdowns(versions) {
     console.log('populateK8sVersionDropdowns called with versions:', versions);
@@ -185,7 +200,7 @@ function populateK8sVersionDropdowns(versions) {
             versions.forEach((version, index) => {
                 const option = document.createElement('option');
                 option.value = version;
-                option.textContent = `v${version}${index === 0 ? ' (Latest)' : ''}`; // 最新バージョンにラベル付け
+                option.textContent = `v${version}${k8sVersionLabel(version, index)}`;
                 selectElement.appendChild(option);
             });
             selectElement.disabled = false;
@@ -194,6 +209,11 @@ function populateK8sVersionDropdowns(versions) {
             if (currentValue && versions.includes(currentValue)) {
                 selectElement.value = currentValue;
                 console.log('Restored previous selection:', currentValue);
+            } else {
+                const defaultVersion = versions.find(version => k8sVersionDetails[version]?.default);
+                if (defaultVersion) {
+                    selectElement.value = defaultVersion;
+                }
             }
         }
     }
@@ -222,6 +242,7 @@ async function loadEnvironments() {
         });
         
         environments = data.environments || [];
+        queuePositions = data.queue || {};
         environments.sort((a, b) => (a.display_name || a.id || "").localeCompare(b.display_name || b.id || ""));
         
         // 認証が成功している場合のみKubernetesバージョンを読み込む
@@ -348,7 +369,7 @@ function renderSidebarContent() {
 
     // ★ フィルタリング処理
     const filteredEnvs = environments.filter(env => {
-        if (env.status === 'terminated') {
+        if (env.status === 'terminated' || env.status === 'dry_run_terminated') {
             return false; // Terminated状態のものは常に非表示
         }
         if (currentStatusFilter === 'all') {
@@ -398,10 +419,12 @@ function renderSidebarContent() {
                     buttonHtml = `<button class="btn btn-primary btn-sm" onclick="connectEnvironment('${env.id}')">Terminal</button>`;
                 }
                 buttonHtml += ` <button class="btn btn-info btn-sm" onclick="showBrowserTab('${env.id}')" title="Open split view with browser">Browser</button>`;
+                buttonHtml += ` <button class="btn btn-warning btn-sm" onclick="restartEnvironment('${env.id}')" title="Replace the pod, keeping its volumes">Restart</button>`;
                 buttonHtml += ` <button class="btn btn-danger btn-sm" onclick="destroyEnvironment('${env.id}')">Destroy</button>`;
                 break;
             case 'pending':
             case 'generating':
+            case 'restarting':
                 itemClass += ' env-item-pending'; 
                 break;
             case 'error':
@@ -411,6 +434,7 @@ function renderSidebarContent() {
                 break;
             case 'shutdown':
             case 'terminated':
+            case 'dry_run_terminated':
                 itemClass += ' env-item-terminated';
                 break;
             default:
@@ -430,8 +454,11 @@ function renderSidebarContent() {
                     <div class="env-details">
                         ID: ${env.id.substring(0, 8)}<br>
                         Kubernetes: ${env.k8s_version || 'N/A'}<br>
-                        Created: ${env.status_updated_at ? formatDate(env.status_updated_at) : 'N/A'}<br>
+                        ${env.template ? `Template: ${env.template}<br>` : ''}
+                        ${env.status === 'pending' && queuePositions[env.id] ? `Queue: ${formatQueuePosition(queuePositions[env.id])}<br>` : ''}
+                        Created: ${env.created_at ? formatDate(env.created_at) : 'N/A'}<br>
                         Expires: ${env.expires_at ? formatDate(env.expires_at) : 'N/A'}
+                        ${env.resources ? `<br>Resources: CPU ${env.resources.cpu_request}/${env.resources.cpu_limit}, Memory ${env.resources.memory_request}/${env.resources.memory_limit}` : ''}
                         ${env.error_message ? `<span class="env-error-msg">${env.error_message}</span>` : ''}
                     </div>
                 </div>
@@ -518,7 +545,11 @@ async function createEnvironment() {
             loadEnvironments();
         } else {
             const error = await response.json();
-            alert('Failed to create environment: ' + (error.error || 'Unknown error'));
+            let message = error.error || 'Unknown error';
+            if (error.available_versions) {
+                message += '. Available versions: ' + error.available_versions.join(', ');
+            }
+            alert('Failed to create environment: ' + message);
         }
     } catch (error) {
         console.error('Failed to create environment:', error);
@@ -557,6 +588,24 @@ async function destroyEnvironment(id) {
     }
 }
 
+async function restartEnvironment(id) {
+    if (!confirm('Restart this environment? Running processes will be stopped; files in the persistent volumes are kept.')) {
+        return;
+    }
+
+    try {
+        const response = await fetch(`/api/environments/${id}/restart`, { method: 'POST' });
+        if (!response.ok) {
+            const error = await response.json();
+            alert('Failed to restart environment: ' + (error.error || 'Unknown error'));
+        }
+    } catch (error) {
+        console.error('Failed to restart environment:', error);
+        alert('Failed to restart environment: ' + error.message);
+    }
+    loadEnvironments();
+}
+
 async function showTerminalForEnv(id) {
     // Reset browser state when switching to terminal only
     isBrowserVisible = false;
@@ -722,6 +771,10 @@ function showTerminalPanelDOM(envId, termInstance) {
 
 function connectWebSocket(environmentId, sessionData) {
     return new Promise((resolve, reject) => {
+        if (sessionData.heartbeatTimer) {
+            clearInterval(sessionData.heartbeatTimer);
+            sessionData.heartbeatTimer = null;
+        }
         if (sessionData.socket && sessionData.socket.readyState !== WebSocket.CLOSED) {
             sessionData.socket.onopen = null;
             sessionData.socket.onmessage = null;
@@ -764,6 +817,12 @@ function connectWebSocket(environmentId, sessionData) {
                     }
                 });
             }
+            // Heartbeat keeps the environment marked as in use while the terminal is open, even without typing
+            sessionData.heartbeatTimer = setInterval(() => {
+                if (newSocket.readyState === WebSocket.OPEN) {
+                    newSocket.send(JSON.stringify({ heartbeat: true }));
+                }
+            }, 30000);
             setTimeout(() => { 
                 sendTerminalSize(environmentId);
                 if (sessionData.term && !sessionData.term.isDisposed) sessionData.term.focus();
@@ -777,7 +836,17 @@ function connectWebSocket(environmentId, sessionData) {
                 if (event.data instanceof ArrayBuffer) {
                     sessionData.term.write(new Uint8Array(event.data));
                 } else {
-                    sessionData.term.write(event.data);
+                    // Server notices (warning/error/status) arrive as JSON TerminalMessages
+                    let text = event.data;
+                    try {
+                        const msg = JSON.parse(event.data);
+                        if (msg && typeof msg.operation === 'string' && typeof msg.data === 'string') {
+                            text = msg.data;
+                        }
+                    } catch (e) {
+                        // Not JSON; write as-is
+                    }
+                    sessionData.term.write(text);
                 }
             }
         };
@@ -795,6 +864,10 @@ function connectWebSocket(environmentId, sessionData) {
 
         newSocket.onclose = function(event) {
             console.log(`WebSocket closed for ${environmentId}. Code: ${event.code}, Reason: '${event.reason}', WasClean: ${event.wasClean}`);
+            if (sessionData.heartbeatTimer) {
+                clearInterval(sessionData.heartbeatTimer);
+                sessionData.heartbeatTimer = null;
+            }
             const currentSessionOnClose = activeSessions.get(environmentId); 
 
             if (currentSessionOnClose && currentSessionOnClose.socket === newSocket) { 
@@ -808,7 +881,13 @@ function connectWebSocket(environmentId, sessionData) {
             const displayName = env ? (env.display_name || env.id.substring(0,8)) : environmentId.substring(0,8);
 
             if (sessionData.term && !sessionData.term.isDisposed) {
-                 sessionData.term.write(event.code !== 1000 ? `\r\n\x1b[31m[Connection lost for '${displayName}' - Code: ${event.code}, Reason: ${event.reason || 'N/A'}]\x1b[0m\r\n` : `\r\n\x1b[33m[Connection closed for '${displayName}']\x1b[0m\r\n`);
+                 // The server sends a reason with 1000 (shell exited), 1011 (server error), 1012 (server restarting) and 4001/4002/4004 (pod gone, session limit, terminated by an admin)
+                 if (event.reason) {
+                     const color = event.code === 1000 ? '33' : '31';
+                     sessionData.term.write(`\r\n\x1b[${color}m[Session for '${displayName}' ended: ${event.reason}]\x1b[0m\r\n`);
+                 } else {
+                     sessionData.term.write(event.code !== 1000 ? `\r\n\x1b[31m[Connection lost for '${displayName}' - Code: ${event.code}]\x1b[0m\r\n` : `\r\n\x1b[33m[Connection closed for '${displayName}']\x1b[0m\r\n`);
+                 }
             }
             renderSidebarContent(); 
         };
@@ -851,6 +930,10 @@ function disconnectCurrentTerminal() {
 function disconnectTerminal(envId, isUIRefreshNeeded = true) {
     const session = activeSessions.get(envId);
     if (session) {
+        if (session.heartbeatTimer) {
+            clearInterval(session.heartbeatTimer);
+            session.heartbeatTimer = null;
+        }
         if (session.socket) {
             session.socket.onopen = null; 
             session.socket.onmessage = null;
@@ -889,6 +972,15 @@ function disconnectTerminal(envId, isUIRefreshNeeded = true) {
     }
 }
 
+function formatQueuePosition(queue) {
+    let text = `#${queue.position} in line`;
+    if (queue.eta_seconds) {
+        const minutes = Math.ceil(queue.eta_seconds / 60);
+        text += `, ready in about ${minutes} min`;
+    }
+    return text;
+}
+
 function formatDate(dateString) {
     const date = new Date(dateString);
     if (isNaN(date.getTime())) return 'Invalid date';
@@ -1198,7 +1290,9 @@ function createBrowserPopup(popup, envId, services) {
                 services.forEach(service => {
                     const option = document.createElement('option');
                     option.value = service.name + ':' + service.port;
-                    option.textContent = service.name + ' (' + service.description + ') - Port ' + service.port;
+                    const serviceName = service.namespace ? service.namespace + '/' + service.name : service.name;
+                    option.textContent = (service.verified ? '✓ ' : '') + serviceName + (service.type ? ' [' + service.type + ']' : '') + ' - Port ' + service.port;
+                    option.title = service.description;
                     select.appendChild(option);
                 });
             } else {
@@ -1584,9 +1678,10 @@ function populateServicesList(services) {
         servicesHTML += services.map(service => `
             <div class="service-item">
                 <div class="service-info">
-                    <div class="service-name">${service.name}</div>
+                    <div class="service-name">${service.namespace ? service.namespace + '/' : ''}${service.name}${service.verified ? ' ✓' : ''}</div>
                     <div class="service-description">${service.description}</div>
-                    <div class="service-port">Port: ${service.port} (${service.protocol})</div>
+                    <div class="service-port">Port: ${service.port} (${service.protocol})${service.type ? ' · ' + service.type : ''}${service.node_port ? ' · NodePort ' + service.node_port : ''}</div>
+                    ${service.ingress_hosts && service.ingress_hosts.length > 0 ? `<div class="service-port">Ingress: ${service.ingress_hosts.join(', ')}</div>` : ''}
                 </div>
                 <button class="btn btn-sm btn-primary" 
                         onclick="navigateToService('${currentEnvId}', ${service.port})">